@@ -0,0 +1,72 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Marshaler     string
+		StatsInterval time.Duration
+		ExpectedError string
+	}{
+		{
+			Name:      "json",
+			Marshaler: "json",
+		},
+		{
+			Name:      "protobuf",
+			Marshaler: "protobuf",
+		},
+		{
+			Name:      "json_v4",
+			Marshaler: "json_v4",
+		},
+		{
+			Name:      "cbor",
+			Marshaler: "cbor",
+		},
+		{
+			Name:          "stats interval disabled",
+			Marshaler:     "json",
+			StatsInterval: -1,
+			ExpectedError: "stats_interval must be greater than zero",
+		},
+		{
+			Name:          "unknown marshaler",
+			Marshaler:     "foo",
+			ExpectedError: "get source marshaler error: unknown marshaler: foo",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Integration.Marshaler = tst.Marshaler
+			conf.Roaming.API.Bind = "127.0.0.1:0"
+			conf.Roaming.StatsInterval = time.Second
+			if tst.StatsInterval != 0 {
+				conf.Roaming.StatsInterval = tst.StatsInterval
+			}
+			conf.Roaming.PassiveRoaming.NetID = "000000"
+			conf.Roaming.PassiveRoaming.RFRegion = "EU868"
+
+			err := Setup(conf)
+			if tst.ExpectedError != "" {
+				assert.EqualError(err, tst.ExpectedError)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NoError(ln.Close())
+		})
+	}
+}
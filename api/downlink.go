@@ -0,0 +1,254 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gofrs/uuid"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+// relayedDownlink holds the identity of a downlink that was relayed from a
+// route target server to the local gateway, so that its ack can be routed
+// back to the originating server.
+type relayedDownlink struct {
+	route      string
+	gatewayID  lorawan.EUI64
+	downlinkID []byte
+	token      uint32
+}
+
+// forwardedGateway holds the local gateway ID and the local broker of a
+// forwarded gateway.
+type forwardedGateway struct {
+	gatewayID lorawan.EUI64
+	server    string
+}
+
+var (
+	// forwardedGateways maps the route name and the forwarded gateway ID to
+	// the local gateway.
+	forwardedGatewaysMux sync.RWMutex
+	forwardedGateways    = make(map[string]forwardedGateway)
+
+	// relayedDownlinks holds the relayed downlinks by local downlink ID.
+	relayedDownlinks = cache.New(time.Minute, time.Minute)
+)
+
+func forwardedGatewayKey(route string, forwardedID lorawan.EUI64) string {
+	return route + "/" + forwardedID.String()
+}
+
+// setForwardedGateway stores the local gateway for the gateway ID under
+// which it has been forwarded to the given route.
+func setForwardedGateway(route string, forwardedID lorawan.EUI64, gw forwardedGateway) {
+	forwardedGatewaysMux.Lock()
+	defer forwardedGatewaysMux.Unlock()
+	forwardedGateways[forwardedGatewayKey(route, forwardedID)] = gw
+}
+
+// getForwardedGateway returns the local gateway for the gateway ID under
+// which it has been forwarded to the given route.
+func getForwardedGateway(route string, forwardedID lorawan.EUI64) (forwardedGateway, bool) {
+	forwardedGatewaysMux.RLock()
+	defer forwardedGatewaysMux.RUnlock()
+	gw, ok := forwardedGateways[forwardedGatewayKey(route, forwardedID)]
+	return gw, ok
+}
+
+// routeCommandTopic returns the downlink command topic of the route on the
+// target server.
+func routeCommandTopic(r Route) string {
+	if r.GatewayID != (lorawan.EUI64{}) {
+		return fmt.Sprintf("gateway/%s/command/down", r.GatewayID)
+	}
+	return "gateway/+/command/down"
+}
+
+// subscribeRoute subscribes to the downlink command topic of the route on
+// the target server.
+func subscribeRoute(r Route) error {
+	if r.Mode == RouteModePassiveRoaming {
+		// downlinks are received through the passive-roaming endpoint
+		return nil
+	}
+
+	name := r.Name
+	return pool.subscribe(r.Server, routeCommandTopic(r), func(c mqtt.Client, msg mqtt.Message) {
+		if err := handleDownlink(name, msg); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"route": name,
+				"topic": msg.Topic(),
+			}).Error("api: relay downlink error")
+		}
+	})
+}
+
+// unsubscribeRoute unsubscribes from the downlink command topic of the route.
+func unsubscribeRoute(r Route) error {
+	if r.Mode == RouteModePassiveRoaming {
+		return nil
+	}
+	return pool.unsubscribe(r.Server, routeCommandTopic(r))
+}
+
+// handleDownlink relays the downlink received from the route target server
+// to the local gateway.
+func handleDownlink(routeName string, msg mqtt.Message) error {
+	route, ok := GetRoute(routeName)
+	if !ok {
+		return errors.New("route does not exist")
+	}
+
+	topicParts := strings.Split(msg.Topic(), "/")
+	if len(topicParts) < 2 {
+		return fmt.Errorf("invalid topic: %s", msg.Topic())
+	}
+
+	var forwardedID lorawan.EUI64
+	if err := forwardedID.UnmarshalText([]byte(topicParts[1])); err != nil {
+		return errors.Wrap(err, "unmarshal gateway ID error")
+	}
+
+	fwd, ok := getForwardedGateway(route.Name, forwardedID)
+	if !ok {
+		return fmt.Errorf("unknown gateway %s", forwardedID)
+	}
+
+	m, err := route.getMarshaler()
+	if err != nil {
+		return errors.Wrap(err, "get route marshaler error")
+	}
+
+	var pl gw.DownlinkFrame
+	if err := m.Unmarshal(msg.Payload(), &pl); err != nil {
+		return errors.Wrap(err, "unmarshal downlink frame error")
+	}
+
+	return relayDownlink(route, forwardedID, fwd, &pl)
+}
+
+// relayDownlink relays the given downlink to the local gateway. The gateway
+// ID is rewritten to the local gateway ID and a new downlink ID and token are
+// assigned, such that the ack can be matched to the relayed downlink.
+func relayDownlink(route Route, forwardedID lorawan.EUI64, fwd forwardedGateway, pl *gw.DownlinkFrame) error {
+	gatewayID := fwd.gatewayID
+
+	downID, err := uuid.NewV4()
+	if err != nil {
+		return errors.Wrap(err, "new uuid error")
+	}
+
+	relayedDownlinks.SetDefault(downID.String(), relayedDownlink{
+		route:      route.Name,
+		gatewayID:  forwardedID,
+		downlinkID: pl.DownlinkId,
+		token:      pl.Token,
+	})
+
+	pl.GatewayId = gatewayID[:]
+	pl.DownlinkId = downID[:]
+	pl.Token = uint32(binary.BigEndian.Uint16(downID[:2]))
+	if pl.TxInfo != nil {
+		pl.TxInfo.GatewayId = gatewayID[:]
+	}
+	for _, item := range pl.Items {
+		if item.TxInfo != nil {
+			item.TxInfo.GatewayId = gatewayID[:]
+		}
+	}
+
+	b, err := sourceMarshaler.Marshal(pl)
+	if err != nil {
+		return errors.Wrap(err, "marshal downlink frame error")
+	}
+
+	client, err := getLocalClient(fwd.server)
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("gateway/%s/command/down", gatewayID)
+	token := client.Publish(topic, 0, false, b)
+	if !token.WaitTimeout(pool.maxTokenWait) {
+		return errors.New("token wait timeout error")
+	}
+	if err := token.Error(); err != nil {
+		return errors.Wrap(err, "publish downlink frame error")
+	}
+
+	log.WithFields(log.Fields{
+		"route":       route.Name,
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+		"topic":       topic,
+	}).Info("api: relayed downlink to local gateway")
+
+	return nil
+}
+
+// onAck handles the downlink acks published on the local broker. Acks of
+// relayed downlinks are forwarded to the route target server from which the
+// downlink originated, using the original gateway ID, downlink ID and token.
+func onAck(client mqtt.Client, msg mqtt.Message) {
+	var pl gw.DownlinkTXAck
+	if err := sourceMarshaler.Unmarshal(msg.Payload(), &pl); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("Failed to decode message")
+		return
+	}
+
+	var downID uuid.UUID
+	copy(downID[:], pl.DownlinkId)
+
+	v, ok := relayedDownlinks.Get(downID.String())
+	if !ok {
+		// the downlink was not relayed by the api
+		return
+	}
+	relayedDownlinks.Delete(downID.String())
+	rd := v.(relayedDownlink)
+
+	route, ok := GetRoute(rd.route)
+	if !ok {
+		log.WithField("route", rd.route).Warn("api: route of relayed downlink does not exist")
+		return
+	}
+
+	if route.Mode == RouteModePassiveRoaming {
+		// the backend interfaces do not define a downlink ack
+		return
+	}
+
+	pl.GatewayId = rd.gatewayID[:]
+	pl.DownlinkId = rd.downlinkID
+	pl.Token = rd.token
+
+	m, err := route.getMarshaler()
+	if err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("Failed to get route marshaler")
+		return
+	}
+
+	b, err := m.Marshal(&pl)
+	if err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("Failed to encode message")
+		return
+	}
+
+	if err := pool.publish(route.Server, publishMessage{
+		route:   route.Name,
+		topic:   fmt.Sprintf("gateway/%s/event/ack", rd.gatewayID),
+		payload: b,
+	}); err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("Failed to forward message to NS broker")
+	}
+}
@@ -0,0 +1,206 @@
+package api
+
+import (
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// sourceMarshaler holds the marshaler of the gateway events published on
+// the local broker.
+var (
+	sourceMarshalerName = "protobuf"
+	sourceMarshaler     marshaler.Marshaler
+)
+
+// newEventMessage returns a new message for the given topic type. It returns
+// nil when the topic type is not supported.
+func newEventMessage(topicType string) proto.Message {
+	switch topicType {
+	case "up":
+		return &gw.UplinkFrame{}
+	case "stats":
+		return &gw.GatewayStats{}
+	case "conn":
+		return &gw.ConnState{}
+	default:
+		return nil
+	}
+}
+
+// setGatewayID replaces the gateway ID of the given message.
+func setGatewayID(msg proto.Message, gatewayID lorawan.EUI64) {
+	switch v := msg.(type) {
+	case *gw.UplinkFrame:
+		if v.RxInfo != nil {
+			v.RxInfo.GatewayId = gatewayID[:]
+		}
+	case *gw.GatewayStats:
+		v.GatewayId = gatewayID[:]
+	case *gw.ConnState:
+		v.GatewayId = gatewayID[:]
+	}
+}
+
+// onMessage handles incoming MQTT messages from a broker. It decodes the message
+// payload using the source marshaler and determines the routes to which the message
+// must be forwarded. For each route, the gateway ID is replaced by the gateway alias
+// of the route and the message is encoded using the route marshaler before it is
+// published to the route target server.
+func onMessage(server string, msg mqtt.Message) {
+	// Get topic gateway ID and type
+	topicParts := strings.Split(msg.Topic(), "/")
+	topicType := topicParts[len(topicParts)-1]
+
+	if len(topicParts) < 2 {
+		log.WithField("topic", msg.Topic()).Warn("Unknown topic")
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(topicParts[1])); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("Failed to decode gateway ID")
+		return
+	}
+
+	pl := newEventMessage(topicType)
+	if pl == nil {
+		log.WithFields(log.Fields{
+			"package": "mqtt",
+			"topic":   msg.Topic(),
+		}).Warn("Unknown topic type")
+		return
+	}
+
+	// An empty (retained) connection state means the gateway has been removed
+	if v, ok := pl.(*gw.ConnState); ok && len(msg.Payload()) == 0 {
+		v.State = gw.ConnState_OFFLINE
+	} else if err := sourceMarshaler.Unmarshal(msg.Payload(), pl); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"package":   "mqtt",
+			"topic":     msg.Topic(),
+			"marshaler": sourceMarshalerName,
+		}).Error("Failed to decode message")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"package": "mqtt",
+		"topic":   msg.Topic(),
+	}).Info("Received message on topic: " + msg.Topic())
+
+	// By default, the message is forwarded to all routes of the gateway
+	forwardRoutes := getRoutesForGateway(gatewayID)
+
+	// Handle different topic types
+	switch v := pl.(type) {
+	case *gw.UplinkFrame:
+		log.WithFields(log.Fields{
+			"package": "mqtt",
+			"topic":   msg.Topic(),
+		}).Info("Handling event UP")
+
+		// Forward the message only to the routes matching the uplink policy
+		res := applyUplinkPolicy(gatewayID, v.PhyPayload)
+		policyDecisionCounter(res.mType, res.decision).Inc()
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"m_type":     res.mType,
+			"decision":   res.decision,
+			"routes":     len(res.routes),
+		}).Info("api: uplink policy decision")
+
+		if res.decision != decisionForward {
+			return
+		}
+		forwardRoutes = res.routes
+	case *gw.GatewayStats:
+		log.WithFields(log.Fields{
+			"package": "mqtt",
+			"topic":   msg.Topic(),
+		}).Info("Handling event STATS")
+	case *gw.ConnState:
+		log.WithFields(log.Fields{
+			"package": "mqtt",
+			"topic":   msg.Topic(),
+		}).Info("Handling state CONN")
+	}
+
+	for _, route := range forwardRoutes {
+		if route.Mode == RouteModePassiveRoaming {
+			forwardPassiveRoaming(route, server, gatewayID, pl)
+			continue
+		}
+
+		switch v := pl.(type) {
+		case *gw.GatewayStats:
+			handleStats(route, gatewayID, v)
+		case *gw.ConnState:
+			handleConn(route, gatewayID, v.State)
+		default:
+			forwardMessage(route, server, gatewayID, msg.Topic(), pl)
+		}
+	}
+}
+
+// forwardMessage rewrites the gateway ID of the given message to the gateway
+// alias of the route and enqueues it for publishing to the route target server.
+func forwardMessage(route Route, server string, gatewayID lorawan.EUI64, topic string, pl proto.Message) {
+	newTopic := topic
+	topicParts := strings.Split(topic, "/")
+	forwardedID := gatewayID
+
+	// Replace gateway ID with the gateway alias of the route
+	if route.GatewayID != (lorawan.EUI64{}) {
+		pl = proto.Clone(pl)
+		setGatewayID(pl, route.GatewayID)
+		forwardedID = route.GatewayID
+
+		topicParts[1] = route.GatewayID.String()
+		newTopic = strings.Join(topicParts, "/")
+	}
+
+	// Store the gateway ID mapping so that downlinks can be relayed
+	setForwardedGateway(route.Name, forwardedID, forwardedGateway{
+		gatewayID: gatewayID,
+		server:    server,
+	})
+
+	publishToRoute(route, newTopic, pl, false)
+}
+
+// publishToRoute encodes the given message using the route marshaler and
+// enqueues it for publishing to the route target server.
+func publishToRoute(route Route, topic string, pl proto.Message, retain bool) {
+	m, err := route.getMarshaler()
+	if err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("Failed to get route marshaler")
+		return
+	}
+
+	b, err := m.Marshal(pl)
+	if err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("Failed to encode message")
+		return
+	}
+
+	if err := pool.publish(route.Server, publishMessage{
+		route:   route.Name,
+		topic:   topic,
+		payload: b,
+		retain:  retain,
+	}); err != nil {
+		log.WithFields(log.Fields{
+			"package": "mqtt",
+			"topic":   topic,
+			"route":   route.Name,
+			"error":   err,
+		}).Error("Failed to forward message to NS broker")
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+func TestSetGatewayID(t *testing.T) {
+	gatewayID := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+
+	tests := []struct {
+		Name     string
+		Topic    string
+		Message  proto.Message
+		Expected proto.Message
+	}{
+		{
+			Name:  "uplink",
+			Topic: "up",
+			Message: &gw.UplinkFrame{
+				PhyPayload: []byte{0x01, 0x02, 0x03},
+				RxInfo: &gw.UplinkRXInfo{
+					GatewayId: []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+				},
+			},
+			Expected: &gw.UplinkFrame{
+				PhyPayload: []byte{0x01, 0x02, 0x03},
+				RxInfo: &gw.UplinkRXInfo{
+					GatewayId: gatewayID[:],
+				},
+			},
+		},
+		{
+			Name:  "stats",
+			Topic: "stats",
+			Message: &gw.GatewayStats{
+				GatewayId:         []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+				RxPacketsReceived: 10,
+			},
+			Expected: &gw.GatewayStats{
+				GatewayId:         gatewayID[:],
+				RxPacketsReceived: 10,
+			},
+		},
+		{
+			Name:  "conn",
+			Topic: "conn",
+			Message: &gw.ConnState{
+				GatewayId: []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01},
+				State:     gw.ConnState_ONLINE,
+			},
+			Expected: &gw.ConnState{
+				GatewayId: gatewayID[:],
+				State:     gw.ConnState_ONLINE,
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			pb, err := marshaler.Get("protobuf")
+			assert.NoError(err)
+			js, err := marshaler.Get("json")
+			assert.NoError(err)
+
+			// decode the protobuf source message by topic type
+			b, err := pb.Marshal(tst.Message)
+			assert.NoError(err)
+			pl := newEventMessage(tst.Topic)
+			assert.NoError(pb.Unmarshal(b, pl))
+
+			// re-encode as json after rewriting the gateway ID
+			setGatewayID(pl, gatewayID)
+			b, err = js.Marshal(pl)
+			assert.NoError(err)
+
+			out := newEventMessage(tst.Topic)
+			assert.NoError(js.Unmarshal(b, out))
+			assert.True(proto.Equal(tst.Expected, out))
+		})
+	}
+}
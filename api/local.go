@@ -0,0 +1,244 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// localClient holds the connection to a local broker from which gateway
+// events are forwarded. It either subscribes to the events of all gateways
+// (wildcard) or to the events of the individual session gateways.
+type localClient struct {
+	sync.Mutex
+
+	server   string
+	client   mqtt.Client
+	wildcard bool
+	gateways map[lorawan.EUI64]struct{}
+}
+
+var (
+	localClientsMux sync.Mutex
+	localClients    = make(map[string]*localClient)
+)
+
+// getOrConnectLocal returns the client for the given local broker. When it
+// does not exist yet, it connects to the broker.
+func getOrConnectLocal(server string) (*localClient, error) {
+	if server == "" {
+		return nil, errors.New("mqtt broker address is missing")
+	}
+
+	localClientsMux.Lock()
+	defer localClientsMux.Unlock()
+
+	if c, ok := localClients[server]; ok {
+		return c, nil
+	}
+
+	c := &localClient{
+		server:   server,
+		gateways: make(map[lorawan.EUI64]struct{}),
+	}
+
+	clientOpts := mqtt.NewClientOptions().AddBroker(server)
+	clientOpts.SetAutoReconnect(true)
+	clientOpts.SetCleanSession(true)
+	clientOpts.SetOnConnectHandler(func(client mqtt.Client) {
+		log.WithField("server", server).Info("api: connected to local broker")
+
+		// subscriptions are lost on reconnect because of the clean session
+		go c.restoreSubscriptions()
+	})
+
+	c.client = mqtt.NewClient(clientOpts)
+	token := c.client.Connect()
+	if !token.WaitTimeout(pool.maxTokenWait) {
+		return nil, errors.New("token wait timeout error")
+	}
+	if err := token.Error(); err != nil {
+		return nil, errors.Wrap(err, "connect error")
+	}
+
+	localClients[server] = c
+	return c, nil
+}
+
+// lookupLocal returns the client for the given local broker, without
+// connecting to it.
+func lookupLocal(server string) (*localClient, bool) {
+	localClientsMux.Lock()
+	defer localClientsMux.Unlock()
+	c, ok := localClients[server]
+	return c, ok
+}
+
+// getLocalClient returns the connected client for the given local broker.
+func getLocalClient(server string) (mqtt.Client, error) {
+	c, ok := lookupLocal(server)
+	if !ok || !c.client.IsConnected() {
+		return nil, fmt.Errorf("mqtt client for %s is not connected", server)
+	}
+	return c.client, nil
+}
+
+// closeLocalClients disconnects from all local brokers.
+func closeLocalClients() {
+	localClientsMux.Lock()
+	defer localClientsMux.Unlock()
+
+	for server, c := range localClients {
+		c.client.Disconnect(250)
+		delete(localClients, server)
+	}
+}
+
+// subscribeAll subscribes to the events of all gateways.
+func (c *localClient) subscribeAll() error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.wildcard = true
+	if err := c.subscribe("+"); err != nil {
+		return err
+	}
+
+	// the per gateway subscriptions are covered by the wildcard subscription
+	for gatewayID := range c.gateways {
+		if err := c.unsubscribe(gatewayID.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// subscribeGateway subscribes to the events of the given gateway.
+func (c *localClient) subscribeGateway(gatewayID lorawan.EUI64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.gateways[gatewayID] = struct{}{}
+	if c.wildcard {
+		return nil
+	}
+	return c.subscribe(gatewayID.String())
+}
+
+// unsubscribeGateway unsubscribes from the events of the given gateway. When
+// there are no remaining subscriptions, the client is disconnected.
+func (c *localClient) unsubscribeGateway(gatewayID lorawan.EUI64) error {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.gateways, gatewayID)
+	if c.wildcard {
+		return nil
+	}
+
+	if err := c.unsubscribe(gatewayID.String()); err != nil {
+		return err
+	}
+
+	if len(c.gateways) == 0 {
+		localClientsMux.Lock()
+		delete(localClients, c.server)
+		localClientsMux.Unlock()
+
+		c.client.Disconnect(250)
+		log.WithField("server", c.server).Info("api: disconnected from local broker")
+	}
+
+	return nil
+}
+
+func (c *localClient) restoreSubscriptions() {
+	c.Lock()
+	defer c.Unlock()
+
+	ids := []string{"+"}
+	if !c.wildcard {
+		ids = nil
+		for gatewayID := range c.gateways {
+			ids = append(ids, gatewayID.String())
+		}
+	}
+
+	for _, id := range ids {
+		if err := c.subscribe(id); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"server":     c.server,
+				"gateway_id": id,
+			}).Error("api: subscribe to gateway events error")
+		}
+	}
+}
+
+// topics returns the topics to subscribe to for the given gateway ID (or +)
+// with their handlers.
+func (c *localClient) topics(gatewayID string) map[string]mqtt.MessageHandler {
+	onEvent := func(client mqtt.Client, msg mqtt.Message) {
+		onMessage(c.server, msg)
+	}
+
+	return map[string]mqtt.MessageHandler{
+		fmt.Sprintf("gateway/%s/event/up", gatewayID):    onEvent,
+		fmt.Sprintf("gateway/%s/event/stats", gatewayID): onEvent,
+		fmt.Sprintf("gateway/%s/state/conn", gatewayID):  onEvent,
+		fmt.Sprintf("gateway/%s/event/ack", gatewayID):   onAck,
+	}
+}
+
+func (c *localClient) subscribe(gatewayID string) error {
+	if !c.client.IsConnected() {
+		// the subscriptions are made on connect
+		return nil
+	}
+
+	for topic, handler := range c.topics(gatewayID) {
+		log.WithFields(log.Fields{
+			"server": c.server,
+			"topic":  topic,
+		}).Info("api: subscribing to topic on local broker")
+
+		if err := tokenWait(c.client.Subscribe(topic, 0, handler)); err != nil {
+			return errors.Wrapf(err, "subscribe to topic %s error", topic)
+		}
+	}
+
+	return nil
+}
+
+func (c *localClient) unsubscribe(gatewayID string) error {
+	if !c.client.IsConnected() {
+		return nil
+	}
+
+	for topic := range c.topics(gatewayID) {
+		log.WithFields(log.Fields{
+			"server": c.server,
+			"topic":  topic,
+		}).Info("api: unsubscribing from topic on local broker")
+
+		if err := tokenWait(c.client.Unsubscribe(topic)); err != nil {
+			return errors.Wrapf(err, "unsubscribe from topic %s error", topic)
+		}
+	}
+
+	return nil
+}
+
+// tokenWait waits for the given token to complete using the configured max.
+// token wait duration.
+func tokenWait(token mqtt.Token) error {
+	if !token.WaitTimeout(pool.maxTokenWait) {
+		return errors.New("token wait timeout error")
+	}
+	return token.Error()
+}
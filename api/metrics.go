@@ -0,0 +1,44 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	fc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roaming_forwarded_count",
+		Help: "The number of messages forwarded to a target broker (per server).",
+	}, []string{"server"})
+
+	dc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roaming_dropped_count",
+		Help: "The number of messages dropped because the publish queue or the max. in-flight requests limit was full (per server).",
+	}, []string{"server"})
+
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roaming_failed_count",
+		Help: "The number of messages that failed to be forwarded to a target broker (per server).",
+	}, []string{"server"})
+
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "roaming_policy_decision_count",
+		Help: "The number of uplink policy decisions (per frame type and decision).",
+	}, []string{"m_type", "decision"})
+)
+
+func forwardedCounter(s string) prometheus.Counter {
+	return fc.With(prometheus.Labels{"server": s})
+}
+
+func forwardDroppedCounter(s string) prometheus.Counter {
+	return dc.With(prometheus.Labels{"server": s})
+}
+
+func forwardFailedCounter(s string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"server": s})
+}
+
+func policyDecisionCounter(mType, decision string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"m_type": mType, "decision": decision})
+}
@@ -0,0 +1,482 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/brocaar/lorawan/band"
+)
+
+// passiveRoaming holds the passive-roaming (LoRaWAN Backend Interfaces)
+// configuration. Only the stateless mode is implemented: each uplink is
+// forwarded as XmitDataReq, the PRStartReq / PRStopReq session flow is not
+// supported.
+var passiveRoaming struct {
+	netID          lorawan.NetID
+	rfRegion       string
+	band           band.Band
+	requestTimeout time.Duration
+
+	// inFlight bounds the number of concurrent XmitDataReq requests.
+	inFlight chan struct{}
+}
+
+// backendClient holds the cached backend-interfaces client of a route,
+// together with the route it was created for.
+type backendClient struct {
+	route  Route
+	client backend.Client
+}
+
+var (
+	backendClientsMux sync.Mutex
+	backendClients    = make(map[string]backendClient)
+)
+
+// setupPassiveRoaming configures the passive-roaming forwarding mode.
+func setupPassiveRoaming(conf config.Config) error {
+	c := conf.Roaming.PassiveRoaming
+
+	if c.NetID != "" {
+		if err := passiveRoaming.netID.UnmarshalText([]byte(c.NetID)); err != nil {
+			return errors.Wrap(err, "unmarshal NetID error")
+		}
+	}
+
+	b, err := band.GetConfig(band.Name(c.RFRegion), false, lorawan.DwellTimeNoLimit)
+	if err != nil {
+		return errors.Wrap(err, "get band config error")
+	}
+
+	passiveRoaming.rfRegion = c.RFRegion
+	passiveRoaming.band = b
+	passiveRoaming.requestTimeout = c.RequestTimeout
+
+	maxInFlight := c.MaxInFlightRequests
+	if maxInFlight <= 0 {
+		maxInFlight = 1
+	}
+	passiveRoaming.inFlight = make(chan struct{}, maxInFlight)
+
+	return nil
+}
+
+// getBackendClient returns the backend-interfaces client for the given
+// route. The client is cached per route and re-created when the route
+// changes.
+func getBackendClient(r Route) (backend.Client, error) {
+	backendClientsMux.Lock()
+	defer backendClientsMux.Unlock()
+
+	if c, ok := backendClients[r.Name]; ok && c.route.NetID == r.NetID && c.route.Server == r.Server && c.route.Authorization == r.Authorization {
+		return c.client, nil
+	}
+
+	client, err := backend.NewClient(backend.ClientConfig{
+		SenderID:      passiveRoaming.netID.String(),
+		ReceiverID:    r.NetID.String(),
+		Server:        r.Server,
+		Authorization: r.Authorization,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	backendClients[r.Name] = backendClient{
+		route:  r,
+		client: client,
+	}
+
+	return client, nil
+}
+
+// forwardPassiveRoaming forwards the given uplink to the route as
+// XmitDataReq. Other messages are not supported by the backend interfaces and
+// are ignored.
+func forwardPassiveRoaming(route Route, server string, gatewayID lorawan.EUI64, pl proto.Message) {
+	up, ok := pl.(*gw.UplinkFrame)
+	if !ok {
+		return
+	}
+
+	forwardedID := gatewayID
+	if route.GatewayID != (lorawan.EUI64{}) {
+		forwardedID = route.GatewayID
+	}
+
+	req, err := newXmitDataReq(forwardedID, up)
+	if err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("api: create xmit data request error")
+		forwardFailedCounter(route.Server).Inc()
+		return
+	}
+
+	// Store the gateway ID mapping so that downlinks can be relayed
+	setForwardedGateway(route.Name, forwardedID, forwardedGateway{
+		gatewayID: gatewayID,
+		server:    server,
+	})
+
+	// This is called from the MQTT message handler, which must not block.
+	select {
+	case passiveRoaming.inFlight <- struct{}{}:
+	default:
+		log.WithFields(log.Fields{
+			"route":  route.Name,
+			"server": route.Server,
+		}).Warning("api: max in-flight xmit data requests reached, dropping uplink")
+		forwardDroppedCounter(route.Server).Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-passiveRoaming.inFlight }()
+
+		client, err := getBackendClient(route)
+		if err != nil {
+			log.WithError(err).WithField("route", route.Name).Error("api: new backend client error")
+			forwardFailedCounter(route.Server).Inc()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), passiveRoaming.requestTimeout)
+		defer cancel()
+
+		if _, err := client.XmitDataReq(ctx, req); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"route":  route.Name,
+				"server": route.Server,
+			}).Error("api: xmit data request error")
+			forwardFailedCounter(route.Server).Inc()
+			return
+		}
+
+		forwardedCounter(route.Server).Inc()
+	}()
+}
+
+// newXmitDataReq returns the XmitDataReq for the given uplink. The
+// ULToken holds the uplink context of the gateway, which is needed for
+// scheduling the downlink.
+func newXmitDataReq(forwardedID lorawan.EUI64, up *gw.UplinkFrame) (backend.XmitDataReqPayload, error) {
+	var req backend.XmitDataReqPayload
+
+	txInfo := up.GetTxInfo()
+	rxInfo := up.GetRxInfo()
+	if txInfo == nil || rxInfo == nil {
+		return req, errors.New("tx_info and rx_info must be set")
+	}
+
+	ulToken, err := proto.Marshal(&gw.UplinkRXInfo{
+		Context: rxInfo.Context,
+		Board:   rxInfo.Board,
+		Antenna: rxInfo.Antenna,
+	})
+	if err != nil {
+		return req, errors.Wrap(err, "marshal ul token error")
+	}
+
+	dr, err := getDataRateIndex(txInfo)
+	if err != nil {
+		return req, errors.Wrap(err, "get data-rate index error")
+	}
+
+	recvTime := time.Now().UTC()
+	if rxInfo.Time != nil {
+		if t, err := ptypes.Timestamp(rxInfo.Time); err == nil {
+			recvTime = t
+		}
+	}
+
+	ulFreq := float64(txInfo.Frequency) / 1000000
+	rssi := int(rxInfo.Rssi)
+	snr := rxInfo.LoraSnr
+	gwCnt := 1
+
+	req.PHYPayload = backend.HEXBytes(up.PhyPayload)
+	req.ULMetaData = &backend.ULMetaData{
+		DataRate: &dr,
+		ULFreq:   &ulFreq,
+		RecvTime: backend.ISO8601Time(recvTime),
+		RFRegion: passiveRoaming.rfRegion,
+		GWCnt:    &gwCnt,
+		GWInfo: []backend.GWInfoElement{
+			{
+				ID:        backend.HEXBytes(forwardedID[:]),
+				RFRegion:  passiveRoaming.rfRegion,
+				RSSI:      &rssi,
+				SNR:       &snr,
+				ULToken:   backend.HEXBytes(ulToken),
+				DLAllowed: true,
+			},
+		},
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(up.PhyPayload); err == nil {
+		if pl, ok := phy.MACPayload.(*lorawan.MACPayload); ok {
+			req.ULMetaData.DevAddr = &pl.FHDR.DevAddr
+		}
+	}
+
+	return req, nil
+}
+
+// getDataRateIndex returns the data-rate index of the given uplink TX info.
+func getDataRateIndex(txInfo *gw.UplinkTXInfo) (int, error) {
+	var dr band.DataRate
+
+	switch txInfo.Modulation {
+	case common.Modulation_LORA:
+		modInfo := txInfo.GetLoraModulationInfo()
+		if modInfo == nil {
+			return 0, errors.New("lora_modulation_info must be set")
+		}
+		dr.Modulation = band.LoRaModulation
+		dr.SpreadFactor = int(modInfo.SpreadingFactor)
+		dr.Bandwidth = int(modInfo.Bandwidth)
+	case common.Modulation_FSK:
+		modInfo := txInfo.GetFskModulationInfo()
+		if modInfo == nil {
+			return 0, errors.New("fsk_modulation_info must be set")
+		}
+		dr.Modulation = band.FSKModulation
+		dr.BitRate = int(modInfo.Datarate)
+	default:
+		return 0, fmt.Errorf("unsupported modulation: %s", txInfo.Modulation)
+	}
+
+	return passiveRoaming.band.GetDataRateIndex(true, dr)
+}
+
+// newDownlinkFrame returns the downlink frame for the given XmitDataReq
+// DLMetaData. It returns the gateway ID under which the uplink was forwarded
+// and the local gateway to which the downlink must be sent.
+func newDownlinkFrame(route Route, phyPayload []byte, dl *backend.DLMetaData) (gw.DownlinkFrame, lorawan.EUI64, forwardedGateway, error) {
+	var df gw.DownlinkFrame
+	var forwardedID lorawan.EUI64
+	var fwd forwardedGateway
+	var rxInfo gw.UplinkRXInfo
+
+	found := false
+	for _, gwInfo := range dl.GWInfo {
+		if len(gwInfo.ID) != len(forwardedID) {
+			continue
+		}
+		copy(forwardedID[:], gwInfo.ID)
+
+		var ok bool
+		if fwd, ok = getForwardedGateway(route.Name, forwardedID); !ok {
+			continue
+		}
+
+		if err := proto.Unmarshal(gwInfo.ULToken, &rxInfo); err != nil {
+			return df, forwardedID, fwd, errors.Wrap(err, "unmarshal ul token error")
+		}
+
+		found = true
+		break
+	}
+	if !found {
+		return df, forwardedID, fwd, errors.New("no known gateway in gw_info")
+	}
+
+	rxDelay := 1
+	if dl.RXDelay1 != nil && *dl.RXDelay1 > 0 {
+		rxDelay = *dl.RXDelay1
+	}
+
+	type rxWindow struct {
+		freq  *float64
+		dr    *int
+		delay int
+	}
+	var windows []rxWindow
+
+	if dl.ClassMode != nil && *dl.ClassMode == "C" {
+		windows = append(windows, rxWindow{freq: dl.DLFreq2, dr: dl.DataRate2})
+	} else {
+		windows = append(windows,
+			rxWindow{freq: dl.DLFreq1, dr: dl.DataRate1, delay: rxDelay},
+			rxWindow{freq: dl.DLFreq2, dr: dl.DataRate2, delay: rxDelay + 1},
+		)
+	}
+
+	for _, w := range windows {
+		if w.freq == nil || w.dr == nil {
+			continue
+		}
+
+		txInfo, err := newDownlinkTXInfo(*w.freq, *w.dr, w.delay, &rxInfo)
+		if err != nil {
+			return df, forwardedID, fwd, err
+		}
+
+		df.Items = append(df.Items, &gw.DownlinkFrameItem{
+			PhyPayload: phyPayload,
+			TxInfo:     txInfo,
+		})
+	}
+
+	if len(df.Items) == 0 {
+		return df, forwardedID, fwd, errors.New("dl_meta_data contains no rx window")
+	}
+
+	return df, forwardedID, fwd, nil
+}
+
+// newDownlinkTXInfo returns the TX info for the given frequency (MHz) and
+// data-rate. When delay is 0, the downlink is sent immediately.
+func newDownlinkTXInfo(freq float64, dr int, delay int, rxInfo *gw.UplinkRXInfo) (*gw.DownlinkTXInfo, error) {
+	dataRate, err := passiveRoaming.band.GetDataRate(dr)
+	if err != nil {
+		return nil, errors.Wrap(err, "get data-rate error")
+	}
+
+	txInfo := gw.DownlinkTXInfo{
+		Frequency: uint32(math.Round(freq * 1000000)),
+		Board:     rxInfo.Board,
+		Antenna:   rxInfo.Antenna,
+		Context:   rxInfo.Context,
+	}
+	txInfo.Power = int32(passiveRoaming.band.GetDownlinkTXPower(txInfo.Frequency))
+
+	switch dataRate.Modulation {
+	case band.LoRaModulation:
+		txInfo.Modulation = common.Modulation_LORA
+		txInfo.ModulationInfo = &gw.DownlinkTXInfo_LoraModulationInfo{
+			LoraModulationInfo: &gw.LoRaModulationInfo{
+				SpreadingFactor:       uint32(dataRate.SpreadFactor),
+				Bandwidth:             uint32(dataRate.Bandwidth),
+				CodeRate:              "4/5",
+				PolarizationInversion: true,
+			},
+		}
+	case band.FSKModulation:
+		txInfo.Modulation = common.Modulation_FSK
+		txInfo.ModulationInfo = &gw.DownlinkTXInfo_FskModulationInfo{
+			FskModulationInfo: &gw.FSKModulationInfo{
+				Datarate:           uint32(dataRate.BitRate),
+				FrequencyDeviation: uint32(dataRate.BitRate / 2),
+			},
+		}
+	default:
+		return nil, fmt.Errorf("unsupported modulation: %s", dataRate.Modulation)
+	}
+
+	if delay == 0 {
+		txInfo.Timing = gw.DownlinkTiming_IMMEDIATELY
+		txInfo.TimingInfo = &gw.DownlinkTXInfo_ImmediatelyTimingInfo{
+			ImmediatelyTimingInfo: &gw.ImmediatelyTimingInfo{},
+		}
+	} else {
+		txInfo.Timing = gw.DownlinkTiming_DELAY
+		txInfo.TimingInfo = &gw.DownlinkTXInfo_DelayTimingInfo{
+			DelayTimingInfo: &gw.DelayTimingInfo{
+				Delay: ptypes.DurationProto(time.Duration(delay) * time.Second),
+			},
+		}
+	}
+
+	return &txInfo, nil
+}
+
+// getPassiveRoamingRoute returns the passive-roaming route for the given
+// SenderID (NetID).
+func getPassiveRoamingRoute(senderID string) (Route, bool) {
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(senderID)); err != nil {
+		return Route{}, false
+	}
+
+	for _, r := range GetRoutes() {
+		if r.Mode == RouteModePassiveRoaming && r.NetID == netID {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// handlePassiveRoaming handles the XmitDataReq requests sent by the
+// passive-roaming partners. Downlinks are relayed to the local gateway.
+func handlePassiveRoaming(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req backend.XmitDataReqPayload
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeXmitDataAns(w, req.BasePayload, backend.MalformedRequest, err)
+		return
+	}
+
+	if req.MessageType != backend.XmitDataReq {
+		writeXmitDataAns(w, req.BasePayload, backend.MalformedRequest, fmt.Errorf("unexpected message type: %s", req.MessageType))
+		return
+	}
+
+	route, ok := getPassiveRoamingRoute(req.SenderID)
+	if !ok {
+		writeXmitDataAns(w, req.BasePayload, backend.UnknownSender, errors.New("no passive-roaming route for sender"))
+		return
+	}
+
+	if req.DLMetaData == nil || len(req.PHYPayload) == 0 {
+		writeXmitDataAns(w, req.BasePayload, backend.MalformedRequest, errors.New("dl_meta_data and phy_payload must be set"))
+		return
+	}
+
+	df, forwardedID, fwd, err := newDownlinkFrame(route, req.PHYPayload, req.DLMetaData)
+	if err != nil {
+		writeXmitDataAns(w, req.BasePayload, backend.MalformedRequest, err)
+		return
+	}
+
+	if err := relayDownlink(route, forwardedID, fwd, &df); err != nil {
+		log.WithError(err).WithField("route", route.Name).Error("api: relay downlink error")
+		writeXmitDataAns(w, req.BasePayload, backend.XmitFailed, err)
+		return
+	}
+
+	writeXmitDataAns(w, req.BasePayload, backend.Success, nil)
+}
+
+// writeXmitDataAns writes the XmitDataAns for the given request.
+func writeXmitDataAns(w http.ResponseWriter, req backend.BasePayload, code backend.ResultCode, err error) {
+	ans := backend.XmitDataAnsPayload{
+		BasePayloadResult: backend.BasePayloadResult{
+			BasePayload: backend.BasePayload{
+				ProtocolVersion: backend.ProtocolVersion1_0,
+				SenderID:        passiveRoaming.netID.String(),
+				ReceiverID:      req.SenderID,
+				TransactionID:   req.TransactionID,
+				MessageType:     backend.XmitDataAns,
+				ReceiverToken:   req.SenderToken,
+			},
+			Result: backend.Result{
+				ResultCode: code,
+			},
+		},
+	}
+	if err != nil {
+		ans.Result.Description = err.Error()
+	}
+
+	writeJSON(w, http.StatusOK, ans)
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+)
+
+func TestPassiveRoaming(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Roaming.PassiveRoaming.NetID = "000001"
+	conf.Roaming.PassiveRoaming.RFRegion = "EU868"
+	conf.Roaming.PassiveRoaming.RequestTimeout = time.Second
+	assert.NoError(setupPassiveRoaming(conf))
+
+	gatewayID := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	forwardedID := lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+	route := Route{
+		Name:   "partner",
+		Mode:   RouteModePassiveRoaming,
+		NetID:  lorawan.NetID{0x00, 0x00, 0x02},
+		Server: "http://partner.example.com",
+	}
+
+	routes = nil
+	forwardedGateways = make(map[string]forwardedGateway)
+	defer func() {
+		routes = nil
+		forwardedGateways = make(map[string]forwardedGateway)
+	}()
+	assert.NoError(SetRoute(route))
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	nowPB, _ := ptypes.TimestampProto(now)
+
+	devAddr := lorawan.DevAddr{0x04, 0x00, 0x00, 0x01}
+
+	up := gw.UplinkFrame{
+		PhyPayload: dataUp(t, devAddr),
+		TxInfo: &gw.UplinkTXInfo{
+			Frequency:  868100000,
+			Modulation: common.Modulation_LORA,
+			ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+				LoraModulationInfo: &gw.LoRaModulationInfo{
+					Bandwidth:       125,
+					SpreadingFactor: 7,
+				},
+			},
+		},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: gatewayID[:],
+			Time:      nowPB,
+			Rssi:      -60,
+			LoraSnr:   5.5,
+			Board:     1,
+			Antenna:   2,
+			Context:   []byte{0x01, 0x02, 0x03, 0x04},
+		},
+	}
+
+	t.Run("XmitDataReq", func(t *testing.T) {
+		assert := require.New(t)
+
+		req, err := newXmitDataReq(forwardedID, &up)
+		assert.NoError(err)
+
+		assert.Equal(backend.HEXBytes(up.PhyPayload), req.PHYPayload)
+		assert.Equal(5, *req.ULMetaData.DataRate)
+		assert.Equal(868.1, *req.ULMetaData.ULFreq)
+		assert.Equal(devAddr, *req.ULMetaData.DevAddr)
+		assert.Equal("EU868", req.ULMetaData.RFRegion)
+		assert.Equal(now, time.Time(req.ULMetaData.RecvTime))
+		assert.Len(req.ULMetaData.GWInfo, 1)
+
+		gwInfo := req.ULMetaData.GWInfo[0]
+		assert.Equal(backend.HEXBytes(forwardedID[:]), gwInfo.ID)
+		assert.Equal(-60, *gwInfo.RSSI)
+		assert.Equal(5.5, *gwInfo.SNR)
+		assert.True(gwInfo.DLAllowed)
+
+		var rxInfo gw.UplinkRXInfo
+		assert.NoError(proto.Unmarshal(gwInfo.ULToken, &rxInfo))
+		assert.Equal(up.RxInfo.Context, rxInfo.Context)
+	})
+
+	t.Run("DownlinkFrame", func(t *testing.T) {
+		assert := require.New(t)
+
+		req, err := newXmitDataReq(forwardedID, &up)
+		assert.NoError(err)
+
+		dlFreq1 := 868.1
+		dlFreq2 := 869.525
+		dr1 := 5
+		dr2 := 0
+		rxDelay1 := 1
+
+		dl := backend.DLMetaData{
+			DLFreq1:   &dlFreq1,
+			DLFreq2:   &dlFreq2,
+			DataRate1: &dr1,
+			DataRate2: &dr2,
+			RXDelay1:  &rxDelay1,
+			GWInfo:    req.ULMetaData.GWInfo,
+		}
+
+		_, _, _, err = newDownlinkFrame(route, []byte{0x01}, &dl)
+		assert.EqualError(err, "no known gateway in gw_info")
+
+		setForwardedGateway(route.Name, forwardedID, forwardedGateway{
+			gatewayID: gatewayID,
+			server:    "tcp://127.0.0.1:1883",
+		})
+
+		df, fwdID, fwd, err := newDownlinkFrame(route, []byte{0x01}, &dl)
+		assert.NoError(err)
+		assert.Equal(forwardedID, fwdID)
+		assert.Equal(gatewayID, fwd.gatewayID)
+		assert.Len(df.Items, 2)
+
+		rx1 := df.Items[0].TxInfo
+		assert.EqualValues(868100000, rx1.Frequency)
+		assert.EqualValues(14, rx1.Power)
+		assert.EqualValues(1, rx1.Board)
+		assert.EqualValues(2, rx1.Antenna)
+		assert.Equal(up.RxInfo.Context, rx1.Context)
+		assert.Equal(gw.DownlinkTiming_DELAY, rx1.Timing)
+		assert.EqualValues(7, rx1.GetLoraModulationInfo().SpreadingFactor)
+		assert.Equal(time.Second, rx1.GetDelayTimingInfo().Delay.AsDuration())
+
+		rx2 := df.Items[1].TxInfo
+		assert.EqualValues(869525000, rx2.Frequency)
+		assert.EqualValues(12, rx2.GetLoraModulationInfo().SpreadingFactor)
+		assert.Equal(2*time.Second, rx2.GetDelayTimingInfo().Delay.AsDuration())
+	})
+
+	t.Run("Passive-roaming route", func(t *testing.T) {
+		assert := require.New(t)
+
+		r, ok := getPassiveRoamingRoute("000002")
+		assert.True(ok)
+		assert.Equal(route.Name, r.Name)
+
+		_, ok = getPassiveRoamingRoute("000003")
+		assert.False(ok)
+	})
+
+	t.Run("Backend client cache", func(t *testing.T) {
+		assert := require.New(t)
+		defer func() { backendClients = make(map[string]backendClient) }()
+
+		c1, err := getBackendClient(route)
+		assert.NoError(err)
+		c2, err := getBackendClient(route)
+		assert.NoError(err)
+		assert.True(c1 == c2)
+
+		// the client is re-created when the route changes
+		changed := route
+		changed.Server = "http://other.example.com"
+		c3, err := getBackendClient(changed)
+		assert.NoError(err)
+		assert.False(c1 == c3)
+	})
+
+	t.Run("Max in-flight requests", func(t *testing.T) {
+		assert := require.New(t)
+
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Write([]byte(`{"Result": {"ResultCode": "Success"}}`))
+		}))
+		defer server.Close()
+		defer func() { backendClients = make(map[string]backendClient) }()
+
+		r := route
+		r.Server = server.URL
+
+		// the in-flight slot (max 1) is taken, the uplink is dropped
+		passiveRoaming.inFlight <- struct{}{}
+		forwardPassiveRoaming(r, "tcp://127.0.0.1:1883", gatewayID, &up)
+		assert.Len(passiveRoaming.inFlight, 1)
+		<-passiveRoaming.inFlight
+
+		forwardPassiveRoaming(r, "tcp://127.0.0.1:1883", gatewayID, &up)
+		assert.Eventually(func() bool {
+			return atomic.LoadInt32(&requests) == 1 && len(passiveRoaming.inFlight) == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Policy decisions.
+const (
+	decisionForward = "forward"
+	decisionNoRoute = "no_route"
+	decisionInvalid = "invalid"
+)
+
+// JoinEUIRange defines an (inclusive) range of JoinEUIs.
+type JoinEUIRange struct {
+	From lorawan.EUI64 `json:"from"`
+	To   lorawan.EUI64 `json:"to"`
+}
+
+// Validate validates the JoinEUI range.
+func (r JoinEUIRange) Validate() error {
+	if bytes.Compare(r.From[:], r.To[:]) > 0 {
+		return errors.New("from must not be greater than to")
+	}
+	return nil
+}
+
+// Match returns true when the given JoinEUI is within the range.
+func (r JoinEUIRange) Match(joinEUI lorawan.EUI64) bool {
+	return bytes.Compare(joinEUI[:], r.From[:]) >= 0 && bytes.Compare(joinEUI[:], r.To[:]) <= 0
+}
+
+// policyResult holds the routing decision for an uplink PHYPayload.
+type policyResult struct {
+	mType    string
+	decision string
+	routes   []Route
+}
+
+// applyUplinkPolicy decodes the given PHYPayload and returns the routes of
+// the given gateway to which the uplink must be forwarded, based on the rules
+// of its MType:
+//
+//   - join-request: by JoinEUI range
+//   - rejoin-request type 0 and 2: by NetID
+//   - rejoin-request type 1: by JoinEUI range
+//   - data uplink: by NetID of the DevAddr
+//   - proprietary: to the routes accepting proprietary frames
+//
+// Other MTypes and payloads that can not be decoded are not forwarded.
+func applyUplinkPolicy(gatewayID lorawan.EUI64, b []byte) policyResult {
+	var res policyResult
+
+	var mhdr lorawan.MHDR
+	if len(b) == 0 || mhdr.UnmarshalBinary(b[0:1]) != nil {
+		res.mType = "unknown"
+		res.decision = decisionInvalid
+		return res
+	}
+	res.mType = strings.ToLower(mhdr.MType.String())
+
+	var filter func(Route) bool
+
+	if mhdr.MType == lorawan.Proprietary {
+		// The payload of proprietary frames is not defined by the LoRaWAN
+		// specification, so it is not decoded.
+		filter = func(r Route) bool {
+			return r.Proprietary
+		}
+	} else {
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(b); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"m_type":     mhdr.MType,
+			}).Warning("api: decode phypayload error")
+			res.decision = decisionInvalid
+			return res
+		}
+
+		switch pl := phy.MACPayload.(type) {
+		case *lorawan.JoinRequestPayload:
+			filter = func(r Route) bool {
+				return r.MatchJoinEUI(pl.JoinEUI)
+			}
+		case *lorawan.RejoinRequestType02Payload:
+			filter = func(r Route) bool {
+				return r.NetID == pl.NetID
+			}
+		case *lorawan.RejoinRequestType1Payload:
+			filter = func(r Route) bool {
+				return r.MatchJoinEUI(pl.JoinEUI)
+			}
+		case *lorawan.MACPayload:
+			if mhdr.MType != lorawan.UnconfirmedDataUp && mhdr.MType != lorawan.ConfirmedDataUp {
+				res.decision = decisionInvalid
+				return res
+			}
+			filter = func(r Route) bool {
+				return r.MatchDevAddr(pl.FHDR.DevAddr)
+			}
+		default:
+			res.decision = decisionInvalid
+			return res
+		}
+	}
+
+	for _, r := range getRoutesForGateway(gatewayID) {
+		if filter(r) {
+			res.routes = append(res.routes, r)
+		}
+	}
+
+	if len(res.routes) == 0 {
+		res.decision = decisionNoRoute
+	} else {
+		res.decision = decisionForward
+	}
+
+	return res
+}
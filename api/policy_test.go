@@ -0,0 +1,141 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestApplyUplinkPolicy(t *testing.T) {
+	gatewayID := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	netID := lorawan.NetID{0x00, 0x00, 0x02}
+
+	devAddr := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	devAddr.SetAddrPrefix(netID)
+
+	routes = nil
+	defer func() { routes = nil }()
+
+	require.NoError(t, SetRoute(Route{
+		Name:   "netid",
+		NetID:  netID,
+		Server: "tcp://netid:1883",
+	}))
+	require.NoError(t, SetRoute(Route{
+		Name:   "join",
+		NetID:  lorawan.NetID{0x00, 0x00, 0x03},
+		Server: "tcp://join:1883",
+		JoinEUIRanges: []JoinEUIRange{
+			{
+				From: lorawan.EUI64{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00},
+				To:   lorawan.EUI64{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff},
+			},
+		},
+		Proprietary: true,
+	}))
+
+	marshal := func(phy lorawan.PHYPayload) []byte {
+		b, err := phy.MarshalBinary()
+		require.NoError(t, err)
+		return b
+	}
+
+	joinRequest := func(joinEUI lorawan.EUI64) []byte {
+		return marshal(lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{MType: lorawan.JoinRequest, Major: lorawan.LoRaWANR1},
+			MACPayload: &lorawan.JoinRequestPayload{
+				JoinEUI: joinEUI,
+			},
+		})
+	}
+
+	tests := []struct {
+		Name             string
+		PHYPayload       []byte
+		ExpectedMType    string
+		ExpectedDecision string
+		ExpectedRoutes   []string
+	}{
+		{
+			Name:             "empty payload",
+			ExpectedMType:    "unknown",
+			ExpectedDecision: decisionInvalid,
+		},
+		{
+			Name:             "short payload",
+			PHYPayload:       []byte{0x40, 0x01, 0x02},
+			ExpectedMType:    "unconfirmeddataup",
+			ExpectedDecision: decisionInvalid,
+		},
+		{
+			Name:             "data up",
+			PHYPayload:       dataUp(t, devAddr),
+			ExpectedMType:    "unconfirmeddataup",
+			ExpectedDecision: decisionForward,
+			ExpectedRoutes:   []string{"netid"},
+		},
+		{
+			Name:             "data up without route",
+			PHYPayload:       dataUp(t, lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}),
+			ExpectedMType:    "unconfirmeddataup",
+			ExpectedDecision: decisionNoRoute,
+		},
+		{
+			Name:             "join-request in range",
+			PHYPayload:       joinRequest(lorawan.EUI64{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x10}),
+			ExpectedMType:    "joinrequest",
+			ExpectedDecision: decisionForward,
+			ExpectedRoutes:   []string{"join"},
+		},
+		{
+			Name:             "join-request out of range",
+			PHYPayload:       joinRequest(lorawan.EUI64{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00}),
+			ExpectedMType:    "joinrequest",
+			ExpectedDecision: decisionNoRoute,
+		},
+		{
+			Name: "rejoin-request type 0",
+			PHYPayload: marshal(lorawan.PHYPayload{
+				MHDR: lorawan.MHDR{MType: lorawan.RejoinRequest, Major: lorawan.LoRaWANR1},
+				MACPayload: &lorawan.RejoinRequestType02Payload{
+					RejoinType: lorawan.RejoinRequestType0,
+					NetID:      netID,
+				},
+			}),
+			ExpectedMType:    "rejoinrequest",
+			ExpectedDecision: decisionForward,
+			ExpectedRoutes:   []string{"netid"},
+		},
+		{
+			Name:             "proprietary",
+			PHYPayload:       []byte{0xe0, 0x01},
+			ExpectedMType:    "proprietary",
+			ExpectedDecision: decisionForward,
+			ExpectedRoutes:   []string{"join"},
+		},
+		{
+			Name:             "downlink mtype",
+			PHYPayload:       []byte{0x60, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04},
+			ExpectedMType:    "unconfirmeddatadown",
+			ExpectedDecision: decisionInvalid,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			res := applyUplinkPolicy(gatewayID, tst.PHYPayload)
+			assert.Equal(tst.ExpectedMType, res.mType)
+			assert.Equal(tst.ExpectedDecision, res.decision)
+
+			var names []string
+			for _, r := range res.routes {
+				names = append(names, r.Name)
+			}
+			assert.Equal(tst.ExpectedRoutes, names)
+		})
+	}
+}
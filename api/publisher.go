@@ -0,0 +1,251 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// publishMessage holds a message that must be published to the target broker.
+type publishMessage struct {
+	route   string
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// publisher holds a long-lived connection to a target broker. Messages are
+// published in order from a bounded queue. Subscriptions are restored on
+// reconnect.
+type publisher struct {
+	server string
+	client mqtt.Client
+	queue  chan publishMessage
+	stop   chan struct{}
+	done   chan struct{}
+
+	subscriptionsMux sync.Mutex
+	subscriptions    map[string]mqtt.MessageHandler
+}
+
+// publisherPool holds one publisher per target broker.
+type publisherPool struct {
+	sync.Mutex
+
+	queueSize    int
+	queueTimeout time.Duration
+	maxTokenWait time.Duration
+	publishers   map[string]*publisher
+}
+
+var pool = &publisherPool{
+	queueSize:    100,
+	queueTimeout: time.Second,
+	maxTokenWait: 5 * time.Second,
+	publishers:   make(map[string]*publisher),
+}
+
+// publish enqueues the given message for publishing to the given server. When
+// the queue is full, it blocks up to the configured queue timeout after which
+// the message is dropped.
+func (p *publisherPool) publish(server string, msg publishMessage) error {
+	pub, err := p.get(server)
+	if err != nil {
+		forwardFailedCounter(server).Inc()
+		return errors.Wrap(err, "get publisher error")
+	}
+
+	select {
+	case pub.queue <- msg:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case pub.queue <- msg:
+		return nil
+	case <-timer.C:
+		forwardDroppedCounter(server).Inc()
+		return errors.New("publish queue is full")
+	}
+}
+
+// get returns the publisher for the given server. When it does not exist
+// yet, a new one will be created.
+func (p *publisherPool) get(server string) (*publisher, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if pub, ok := p.publishers[server]; ok {
+		return pub, nil
+	}
+
+	clientID, err := newClientID()
+	if err != nil {
+		return nil, errors.Wrap(err, "new client id error")
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(server).SetClientID(clientID)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetCleanSession(true)
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.WithError(err).WithField("server", server).Error("api: target broker connection lost")
+	})
+
+	pub := &publisher{
+		server:        server,
+		queue:         make(chan publishMessage, p.queueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]mqtt.MessageHandler),
+	}
+
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.WithFields(log.Fields{
+			"server":    server,
+			"client_id": clientID,
+		}).Info("api: connected to target broker")
+		go pub.restoreSubscriptions()
+	})
+	pub.client = mqtt.NewClient(opts)
+
+	// With SetConnectRetry the token only completes once connected, the
+	// queue will buffer messages in the meantime.
+	pub.client.Connect()
+	go pub.publishLoop(p.maxTokenWait)
+
+	p.publishers[server] = pub
+	return pub, nil
+}
+
+// subscribe subscribes to the given topic on the given server.
+func (p *publisherPool) subscribe(server, topic string, handler mqtt.MessageHandler) error {
+	pub, err := p.get(server)
+	if err != nil {
+		return errors.Wrap(err, "get publisher error")
+	}
+
+	pub.subscriptionsMux.Lock()
+	pub.subscriptions[topic] = handler
+	pub.subscriptionsMux.Unlock()
+
+	// When not connected, the subscription is made on connect.
+	if !pub.client.IsConnected() {
+		return nil
+	}
+
+	return pub.subscribe(topic, handler)
+}
+
+// unsubscribe unsubscribes from the given topic on the given server.
+func (p *publisherPool) unsubscribe(server, topic string) error {
+	pub, err := p.get(server)
+	if err != nil {
+		return errors.Wrap(err, "get publisher error")
+	}
+
+	pub.subscriptionsMux.Lock()
+	delete(pub.subscriptions, topic)
+	pub.subscriptionsMux.Unlock()
+
+	if !pub.client.IsConnected() {
+		return nil
+	}
+
+	token := pub.client.Unsubscribe(topic)
+	if !token.WaitTimeout(p.maxTokenWait) {
+		return errors.New("token wait timeout error")
+	}
+	return token.Error()
+}
+
+// close disconnects all publishers.
+func (p *publisherPool) close() {
+	p.Lock()
+	defer p.Unlock()
+
+	for server, pub := range p.publishers {
+		close(pub.stop)
+		<-pub.done
+		pub.client.Disconnect(250)
+		delete(p.publishers, server)
+	}
+}
+
+func (pub *publisher) subscribe(topic string, handler mqtt.MessageHandler) error {
+	log.WithFields(log.Fields{
+		"server": pub.server,
+		"topic":  topic,
+	}).Info("api: subscribing to topic on target broker")
+
+	token := pub.client.Subscribe(topic, 0, handler)
+	if !token.WaitTimeout(pool.maxTokenWait) {
+		return errors.New("token wait timeout error")
+	}
+	return token.Error()
+}
+
+func (pub *publisher) restoreSubscriptions() {
+	pub.subscriptionsMux.Lock()
+	defer pub.subscriptionsMux.Unlock()
+
+	for topic, handler := range pub.subscriptions {
+		if err := pub.subscribe(topic, handler); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"server": pub.server,
+				"topic":  topic,
+			}).Error("api: subscribe to topic on target broker error")
+		}
+	}
+}
+
+func (pub *publisher) publishLoop(maxTokenWait time.Duration) {
+	defer close(pub.done)
+
+	for {
+		var msg publishMessage
+		select {
+		case msg = <-pub.queue:
+		case <-pub.stop:
+			return
+		}
+
+		token := pub.client.Publish(msg.topic, 0, msg.retain, msg.payload)
+		if !token.WaitTimeout(maxTokenWait) || token.Error() != nil {
+			forwardFailedCounter(pub.server).Inc()
+			log.WithFields(log.Fields{
+				"server": pub.server,
+				"route":  msg.route,
+				"topic":  msg.topic,
+				"error":  token.Error(),
+			}).Error("api: publish message to target broker error")
+			continue
+		}
+
+		forwardedCounter(pub.server).Inc()
+		log.WithFields(log.Fields{
+			"server": pub.server,
+			"route":  msg.route,
+			"topic":  msg.topic,
+		}).Info("api: forwarded message to target broker")
+	}
+}
+
+// newClientID returns a random MQTT client ID, which is within the 23
+// characters limit of MQTT 3.1.
+func newClientID() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "roaming-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// Route modes.
+const (
+	RouteModeMQTT           = "mqtt"
+	RouteModePassiveRoaming = "passive_roaming"
+)
+
+// Route defines a roaming route. Uplinks of which the DevAddr matches the
+// NetID of the route are forwarded to the route target server, using the
+// GatewayID of the route as gateway alias. When the GatewayID is not set, the
+// gateway ID is forwarded as-is. Messages are encoded using the Marshaler of
+// the route, or the marshaler of the source events when not set. When the
+// SourceGatewayID is set, only the events of this gateway are forwarded.
+// Join-requests are forwarded when their JoinEUI is within one of the
+// JoinEUIRanges and proprietary frames when Proprietary is set.
+//
+// In the passive-roaming Mode, the uplinks are forwarded as LoRaWAN Backend
+// Interfaces XmitDataReq to the HTTP endpoint (Server) of the NetID, using
+// the optional Authorization header value. Only stateless passive roaming
+// is supported (no PRStartReq / PRStopReq).
+//
+// The stats are aggregated per gateway alias, with the location and meta-data
+// removed when RedactLocation and RedactMetaData are set. The connection
+// state is published as retained message under the gateway alias.
+type Route struct {
+	Name            string         `json:"name"`
+	Mode            string         `json:"mode,omitempty"`
+	NetID           lorawan.NetID  `json:"net_id"`
+	Server          string         `json:"server"`
+	Authorization   string         `json:"authorization,omitempty"`
+	GatewayID       lorawan.EUI64  `json:"gateway_id"`
+	SourceGatewayID lorawan.EUI64  `json:"source_gateway_id"`
+	JoinEUIRanges   []JoinEUIRange `json:"join_eui_ranges,omitempty"`
+	Proprietary     bool           `json:"proprietary,omitempty"`
+	DisableStats    bool           `json:"disable_stats,omitempty"`
+	RedactLocation  bool           `json:"redact_location,omitempty"`
+	RedactMetaData  bool           `json:"redact_meta_data,omitempty"`
+	DisableConn     bool           `json:"disable_conn,omitempty"`
+	Marshaler       string         `json:"marshaler,omitempty"`
+}
+
+// Validate validates the route.
+func (r Route) Validate() error {
+	if r.Name == "" {
+		return errors.New("name must be set")
+	}
+	if r.Server == "" {
+		return errors.New("server must be set")
+	}
+	switch r.Mode {
+	case "", RouteModeMQTT, RouteModePassiveRoaming:
+	default:
+		return fmt.Errorf("invalid mode: %s", r.Mode)
+	}
+	if _, err := r.getMarshaler(); err != nil {
+		return err
+	}
+	for _, jr := range r.JoinEUIRanges {
+		if err := jr.Validate(); err != nil {
+			return errors.Wrap(err, "invalid join_eui_ranges")
+		}
+	}
+	return nil
+}
+
+// getMarshaler returns the marshaler of the route.
+func (r Route) getMarshaler() (marshaler.Marshaler, error) {
+	if r.Marshaler == "" {
+		return sourceMarshaler, nil
+	}
+	return marshaler.Get(r.Marshaler)
+}
+
+// MatchGateway returns true when the events of the given gateway must be
+// forwarded by the route.
+func (r Route) MatchGateway(gatewayID lorawan.EUI64) bool {
+	return r.SourceGatewayID == (lorawan.EUI64{}) || r.SourceGatewayID == gatewayID
+}
+
+// MatchJoinEUI returns true when the given JoinEUI is within one of the
+// JoinEUI ranges of the route.
+func (r Route) MatchJoinEUI(joinEUI lorawan.EUI64) bool {
+	for _, jr := range r.JoinEUIRanges {
+		if jr.Match(joinEUI) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchDevAddr returns true when the given DevAddr belongs to the NetID of
+// the route.
+func (r Route) MatchDevAddr(devAddr lorawan.DevAddr) bool {
+	return devAddr.IsNetID(r.NetID)
+}
+
+var (
+	routesMux sync.RWMutex
+	routes    []Route
+)
+
+// setupRoutes loads the routes from the configuration.
+func setupRoutes(conf config.Config) error {
+	for _, rc := range conf.Roaming.Routes {
+		r := Route{
+			Name:           rc.Name,
+			Mode:           rc.Mode,
+			Server:         rc.Server,
+			Authorization:  rc.Authorization,
+			Proprietary:    rc.Proprietary,
+			DisableStats:   rc.DisableStats,
+			RedactLocation: rc.RedactLocation,
+			RedactMetaData: rc.RedactMetaData,
+			DisableConn:    rc.DisableConn,
+			Marshaler:      rc.Marshaler,
+		}
+
+		if err := r.NetID.UnmarshalText([]byte(rc.NetID)); err != nil {
+			return errors.Wrap(err, "unmarshal NetID error")
+		}
+
+		if rc.GatewayID != "" {
+			if err := r.GatewayID.UnmarshalText([]byte(rc.GatewayID)); err != nil {
+				return errors.Wrap(err, "unmarshal gateway ID error")
+			}
+		}
+
+		for _, jc := range rc.JoinEUIRanges {
+			var jr JoinEUIRange
+			if err := jr.From.UnmarshalText([]byte(jc.From)); err != nil {
+				return errors.Wrap(err, "unmarshal JoinEUI range from error")
+			}
+			if err := jr.To.UnmarshalText([]byte(jc.To)); err != nil {
+				return errors.Wrap(err, "unmarshal JoinEUI range to error")
+			}
+			r.JoinEUIRanges = append(r.JoinEUIRanges, jr)
+		}
+
+		if err := SetRoute(r); err != nil {
+			return errors.Wrapf(err, "set route %s error", rc.Name)
+		}
+	}
+
+	return nil
+}
+
+// SetRoute adds the given route to the routing table. An existing route with
+// the same name will be replaced.
+func SetRoute(r Route) error {
+	if err := r.Validate(); err != nil {
+		return errors.Wrap(err, "validate route error")
+	}
+
+	routesMux.Lock()
+	defer routesMux.Unlock()
+
+	log.WithFields(log.Fields{
+		"name":       r.Name,
+		"net_id":     r.NetID,
+		"server":     r.Server,
+		"gateway_id": r.GatewayID,
+		"marshaler":  r.Marshaler,
+	}).Info("api: route configured")
+
+	for i := range routes {
+		if routes[i].Name == r.Name {
+			routes[i] = r
+			return nil
+		}
+	}
+
+	routes = append(routes, r)
+	return nil
+}
+
+// DeleteRoute removes the route with the given name from the routing table.
+// It returns false when the route does not exist.
+func DeleteRoute(name string) bool {
+	routesMux.Lock()
+	defer routesMux.Unlock()
+
+	for i := range routes {
+		if routes[i].Name == name {
+			routes = append(routes[:i], routes[i+1:]...)
+			log.WithField("name", name).Info("api: route deleted")
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetRoute returns the route with the given name.
+func GetRoute(name string) (Route, bool) {
+	routesMux.RLock()
+	defer routesMux.RUnlock()
+
+	for _, r := range routes {
+		if r.Name == name {
+			return r, true
+		}
+	}
+
+	return Route{}, false
+}
+
+// GetRoutes returns a copy of the routing table.
+func GetRoutes() []Route {
+	routesMux.RLock()
+	defer routesMux.RUnlock()
+
+	out := make([]Route, len(routes))
+	copy(out, routes)
+	return out
+}
+
+// getRoutesForGateway returns the routes matching the given gateway.
+func getRoutesForGateway(gatewayID lorawan.EUI64) []Route {
+	var out []Route
+	for _, r := range GetRoutes() {
+		if r.MatchGateway(gatewayID) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
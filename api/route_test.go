@@ -0,0 +1,95 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestRoutes(t *testing.T) {
+	assert := require.New(t)
+
+	netID1 := lorawan.NetID{0x00, 0x00, 0x01}
+	netID2 := lorawan.NetID{0x60, 0x00, 0x02}
+
+	devAddr1 := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	devAddr1.SetAddrPrefix(netID1)
+
+	devAddr2 := lorawan.DevAddr{0x01, 0x02, 0x03, 0x04}
+	devAddr2.SetAddrPrefix(netID2)
+
+	gatewayID1 := lorawan.EUI64{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	gatewayID2 := lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+
+	routes = nil
+	defer func() { routes = nil }()
+
+	assert.Error(SetRoute(Route{Server: "tcp://127.0.0.1:1883"}))
+	assert.Error(SetRoute(Route{Name: "a"}))
+
+	assert.NoError(SetRoute(Route{Name: "a", NetID: netID1, Server: "tcp://a:1883"}))
+	assert.NoError(SetRoute(Route{Name: "b", NetID: netID2, Server: "tcp://b:1883"}))
+	assert.NoError(SetRoute(Route{Name: "c", NetID: netID1, Server: "tcp://c:1883"}))
+
+	t.Run("Match type 0 NetID", func(t *testing.T) {
+		assert := require.New(t)
+		r := applyUplinkPolicy(gatewayID1, dataUp(t, devAddr1)).routes
+		assert.Len(r, 2)
+		assert.Equal("a", r[0].Name)
+		assert.Equal("c", r[1].Name)
+	})
+
+	t.Run("Match type 3 NetID", func(t *testing.T) {
+		assert := require.New(t)
+		r := applyUplinkPolicy(gatewayID1, dataUp(t, devAddr2)).routes
+		assert.Len(r, 1)
+		assert.Equal("b", r[0].Name)
+	})
+
+	t.Run("Replace route", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(SetRoute(Route{Name: "c", NetID: netID2, Server: "tcp://c:1883"}))
+		assert.Len(GetRoutes(), 3)
+		assert.Len(applyUplinkPolicy(gatewayID1, dataUp(t, devAddr1)).routes, 1)
+		assert.Len(applyUplinkPolicy(gatewayID1, dataUp(t, devAddr2)).routes, 2)
+	})
+
+	t.Run("Delete route", func(t *testing.T) {
+		assert := require.New(t)
+		assert.True(DeleteRoute("a"))
+		assert.False(DeleteRoute("a"))
+		assert.Len(applyUplinkPolicy(gatewayID1, dataUp(t, devAddr1)).routes, 0)
+	})
+
+	t.Run("Match source gateway", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(SetRoute(Route{Name: "d", NetID: netID1, Server: "tcp://d:1883", SourceGatewayID: gatewayID2}))
+		assert.Len(getRoutesForGateway(gatewayID1), 2)
+		assert.Len(getRoutesForGateway(gatewayID2), 3)
+		assert.Len(applyUplinkPolicy(gatewayID1, dataUp(t, devAddr1)).routes, 0)
+
+		r := applyUplinkPolicy(gatewayID2, dataUp(t, devAddr1)).routes
+		assert.Len(r, 1)
+		assert.Equal("d", r[0].Name)
+	})
+}
+
+// dataUp returns an unconfirmed data-up PHYPayload for the given DevAddr.
+func dataUp(t *testing.T, devAddr lorawan.DevAddr) []byte {
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.UnconfirmedDataUp,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.MACPayload{
+			FHDR: lorawan.FHDR{
+				DevAddr: devAddr,
+			},
+		},
+	}
+	b, err := phy.MarshalBinary()
+	require.NoError(t, err)
+	return b
+}
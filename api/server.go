@@ -0,0 +1,300 @@
+package api
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// apiPrefix defines the path prefix of the (versioned) management API.
+const apiPrefix = "/api/v1"
+
+var (
+	server      *http.Server
+	ln          net.Listener
+	bearerToken string
+	tlsCert     string
+	tlsKey      string
+)
+
+// setupServer configures the management API server.
+func setupServer(conf config.Config) error {
+	var err error
+
+	bearerToken = conf.Roaming.API.BearerToken
+	tlsCert = conf.Roaming.API.TLSCert
+	tlsKey = conf.Roaming.API.TLSKey
+
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("tls_cert and tls_key must both be set")
+	}
+
+	// without the TLS certificate, the server would fall back to plain HTTP
+	// and the client certificates would never be verified.
+	if conf.Roaming.API.CACert != "" && tlsCert == "" {
+		return errors.New("ca_cert requires tls_cert and tls_key to be set")
+	}
+
+	if bearerToken == "" && conf.Roaming.API.CACert == "" && !isLoopbackBind(conf.Roaming.API.Bind) {
+		return errors.New("bearer_token or ca_cert must be set when binding to a non-loopback address")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/sessions", handleSessions)
+	mux.HandleFunc(apiPrefix+"/sessions/", handleSession)
+	mux.HandleFunc(apiPrefix+"/routes", handleRoutes)
+	mux.HandleFunc(apiPrefix+"/routes/", handleRoute)
+	mux.HandleFunc(apiPrefix+"/passive-roaming", handlePassiveRoaming)
+
+	// using net.Listen makes it easier to test as we can bind to ":0" and
+	// then read back the Addr to find the assigned (random) port.
+	ln, err = net.Listen("tcp", conf.Roaming.API.Bind)
+	if err != nil {
+		return errors.Wrap(err, "create listener error")
+	}
+
+	server = &http.Server{
+		Handler: authenticate(mux),
+	}
+
+	// if the CA cert is configured, setup client certificate verification.
+	if conf.Roaming.API.CACert != "" {
+		rawCACert, err := ioutil.ReadFile(conf.Roaming.API.CACert)
+		if err != nil {
+			return errors.Wrap(err, "read ca cert error")
+		}
+
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(rawCACert)
+
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  caCertPool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	return nil
+}
+
+// isLoopbackBind returns true when the given bind address only accepts
+// connections from the local host.
+func isLoopbackBind(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startServer starts serving the management API.
+func startServer() {
+	go func() {
+		log.WithFields(log.Fields{
+			"bind":     ln.Addr(),
+			"tls_cert": tlsCert,
+			"tls_key":  tlsKey,
+		}).Info("api: starting management api server")
+
+		var err error
+		if tlsCert != "" && tlsKey != "" {
+			err = server.ServeTLS(ln, tlsCert, tlsKey)
+		} else {
+			err = server.Serve(ln)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("api: management api server error")
+		}
+	}()
+}
+
+// stopServer stops the management API server.
+func stopServer() {
+	if server != nil {
+		server.Close()
+	}
+}
+
+// authenticate wraps the given handler with bearer-token authentication, when
+// a bearer token has been configured.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(bearerToken)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSessions handles the session collection requests:
+// GET returns all sessions and POST creates a new session.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, GetSessions())
+	case http.MethodPost:
+		var b Body
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		s, err := CreateSession(b)
+		if err != nil {
+			if err == ErrSessionAlreadyExists {
+				writeError(w, http.StatusConflict, err)
+			} else {
+				writeError(w, http.StatusBadRequest, err)
+			}
+			return
+		}
+		writeJSON(w, http.StatusCreated, s)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleSession handles the single session requests, by source gateway ID:
+// GET returns the session and DELETE deletes the session.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/sessions/")
+
+	switch r.Method {
+	case http.MethodGet:
+		s, err := GetSession(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case http.MethodDelete:
+		if err := DeleteSession(id); err != nil {
+			if err == ErrSessionDoesNotExist {
+				writeError(w, http.StatusNotFound, err)
+			} else {
+				writeError(w, http.StatusInternalServerError, err)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleRoutes handles the routing table requests:
+// GET returns the routing table and POST adds or replaces the given route.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, GetRoutes())
+	case http.MethodPost:
+		var route Route
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := setAndSubscribeRoute(route); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		setAPIRoute(route.Name, true)
+		persist()
+		writeJSON(w, http.StatusOK, route)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleRoute handles the single route requests:
+// GET returns the route and DELETE removes the route.
+func handleRoute(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, apiPrefix+"/routes/")
+
+	route, ok := GetRoute(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("route does not exist"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, route)
+	case http.MethodDelete:
+		DeleteRoute(route.Name)
+		setAPIRoute(route.Name, false)
+		persist()
+		setRouteOffline(route)
+		if err := unsubscribeRoute(route); err != nil {
+			log.WithError(err).WithField("route", route.Name).Error("api: unsubscribe route error")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// setAndSubscribeRoute sets the given route and subscribes to its downlink
+// command topic. The subscription of the replaced route is removed.
+func setAndSubscribeRoute(route Route) error {
+	old, exists := GetRoute(route.Name)
+
+	if err := SetRoute(route); err != nil {
+		return err
+	}
+
+	if exists {
+		if err := unsubscribeRoute(old); err != nil {
+			log.WithError(err).WithField("route", old.Name).Error("api: unsubscribe route error")
+		}
+	}
+
+	return subscribeRoute(route)
+}
+
+// writeJSON writes the given value as JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	b = append(b, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeError writes the given error as JSON response.
+func writeError(w http.ResponseWriter, status int, err error) {
+	b, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+	b = append(b, '\n')
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,192 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+func TestServer(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.Config
+	conf.Roaming.API.Bind = "127.0.0.1:0"
+	conf.Roaming.API.BearerToken = "secret"
+	assert.NoError(setupServer(conf))
+	defer ln.Close()
+
+	sessions["0102030405060708"] = Session{ID: "0102030405060708"}
+	defer func() { sessions = make(map[string]Session) }()
+
+	tests := []struct {
+		Name           string
+		Method         string
+		Path           string
+		Token          string
+		Body           string
+		ExpectedStatus int
+		ExpectedBody   string
+	}{
+		{
+			Name:           "missing bearer token",
+			Method:         http.MethodGet,
+			Path:           "/api/v1/sessions",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   `{"error":"invalid or missing bearer token"}` + "\n",
+		},
+		{
+			Name:           "invalid bearer token",
+			Method:         http.MethodGet,
+			Path:           "/api/v1/sessions",
+			Token:          "foo",
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedBody:   `{"error":"invalid or missing bearer token"}` + "\n",
+		},
+		{
+			Name:           "list sessions",
+			Method:         http.MethodGet,
+			Path:           "/api/v1/sessions",
+			Token:          "secret",
+			ExpectedStatus: http.StatusOK,
+			ExpectedBody:   `[{"id":"0102030405060708","gateway_id":"","added_broker":"","broker_ip_h_ns":"","gwid_token":""}]` + "\n",
+		},
+		{
+			Name:           "create session with invalid body",
+			Method:         http.MethodPost,
+			Path:           "/api/v1/sessions",
+			Token:          "secret",
+			Body:           `{"gateway_id": "0102030405060708", "added_broker": "tcp://127.0.0.1:1883"}`,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"validate error: broker_ip_h_ns must be set"}` + "\n",
+		},
+		{
+			Name:           "create session without gateway id",
+			Method:         http.MethodPost,
+			Path:           "/api/v1/sessions",
+			Token:          "secret",
+			Body:           `{"added_broker": "tcp://127.0.0.1:1883"}`,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedBody:   `{"error":"validate error: gateway_id is invalid: lorawan: exactly 8 bytes are expected"}` + "\n",
+		},
+		{
+			Name:           "create duplicate session",
+			Method:         http.MethodPost,
+			Path:           "/api/v1/sessions",
+			Token:          "secret",
+			Body:           `{"gateway_id": "0102030405060708", "added_broker": "tcp://127.0.0.1:1883", "broker_ip_h_ns": "tcp://ns:1883", "gwid_token": "0807060504030201"}`,
+			ExpectedStatus: http.StatusConflict,
+			ExpectedBody:   `{"error":"session already exists"}` + "\n",
+		},
+		{
+			Name:           "get unknown session",
+			Method:         http.MethodGet,
+			Path:           "/api/v1/sessions/foo",
+			Token:          "secret",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"session does not exist"}` + "\n",
+		},
+		{
+			Name:           "delete unknown session",
+			Method:         http.MethodDelete,
+			Path:           "/api/v1/sessions/foo",
+			Token:          "secret",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"session does not exist"}` + "\n",
+		},
+		{
+			Name:           "get unknown route",
+			Method:         http.MethodGet,
+			Path:           "/api/v1/routes/foo",
+			Token:          "secret",
+			ExpectedStatus: http.StatusNotFound,
+			ExpectedBody:   `{"error":"route does not exist"}` + "\n",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			req := httptest.NewRequest(tst.Method, tst.Path, bytes.NewBufferString(tst.Body))
+			if tst.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+tst.Token)
+			}
+			w := httptest.NewRecorder()
+			server.Handler.ServeHTTP(w, req)
+
+			assert.Equal(tst.ExpectedStatus, w.Code)
+			assert.Equal(tst.ExpectedBody, w.Body.String())
+			assert.Equal("application/json", w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestSetupServerSecurity(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Bind          string
+		BearerToken   string
+		TLSCert       string
+		TLSKey        string
+		CACert        string
+		ExpectedError string
+	}{
+		{
+			Name: "loopback without authentication",
+			Bind: "127.0.0.1:0",
+		},
+		{
+			Name: "localhost without authentication",
+			Bind: "localhost:0",
+		},
+		{
+			Name:          "all interfaces without authentication",
+			Bind:          ":0",
+			ExpectedError: "bearer_token or ca_cert must be set when binding to a non-loopback address",
+		},
+		{
+			Name:        "all interfaces with bearer token",
+			Bind:        ":0",
+			BearerToken: "secret",
+		},
+		{
+			Name:          "ca cert without tls cert",
+			Bind:          "127.0.0.1:0",
+			CACert:        "ca.pem",
+			ExpectedError: "ca_cert requires tls_cert and tls_key to be set",
+		},
+		{
+			Name:          "tls cert without tls key",
+			Bind:          "127.0.0.1:0",
+			TLSCert:       "cert.pem",
+			ExpectedError: "tls_cert and tls_key must both be set",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.Config
+			conf.Roaming.API.Bind = tst.Bind
+			conf.Roaming.API.BearerToken = tst.BearerToken
+			conf.Roaming.API.TLSCert = tst.TLSCert
+			conf.Roaming.API.TLSKey = tst.TLSKey
+			conf.Roaming.API.CACert = tst.CACert
+
+			err := setupServer(conf)
+			if tst.ExpectedError != "" {
+				assert.EqualError(err, tst.ExpectedError)
+				return
+			}
+
+			assert.NoError(err)
+			assert.NoError(ln.Close())
+		})
+	}
+}
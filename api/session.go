@@ -0,0 +1,363 @@
+package api
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Body holds the roaming session parameters: the source gateway of which
+// the events are forwarded (GatewayID), the local broker to which this gateway
+// is connected (AddedBroker), the network server broker to which its events
+// are forwarded (BrokerIPHNS), the gateway alias (GWIDToken) and the optional
+// NetID of the session route. When the NetID is not set, the configured
+// session NetID is used.
+type Body struct {
+	GatewayID   string `json:"gateway_id"`
+	AddedBroker string `json:"added_broker"`
+	BrokerIPHNS string `json:"broker_ip_h_ns"`
+	GWIDToken   string `json:"gwid_token"`
+	NetID       string `json:"net_id,omitempty"`
+}
+
+// Validate validates the body.
+func (b Body) Validate() error {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(b.GatewayID)); err != nil {
+		return errors.Wrap(err, "gateway_id is invalid")
+	}
+	if b.AddedBroker == "" {
+		return errors.New("added_broker must be set")
+	}
+	if b.BrokerIPHNS == "" {
+		return errors.New("broker_ip_h_ns must be set")
+	}
+
+	if err := gatewayID.UnmarshalText([]byte(b.GWIDToken)); err != nil {
+		return errors.Wrap(err, "gwid_token is invalid")
+	}
+
+	if b.NetID != "" {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(b.NetID)); err != nil {
+			return errors.Wrap(err, "net_id is invalid")
+		}
+	}
+
+	return nil
+}
+
+// Session defines a roaming session. A session is identified by the EUI of
+// its source gateway, so that each gateway has at most one session.
+type Session struct {
+	ID string `json:"id"`
+	Body
+}
+
+// sessionNetID defines the NetID that is used for the route of a session,
+// when the session does not define a NetID.
+var sessionNetID = lorawan.NetID{0x00, 0x00, 0x01}
+
+// sessionJoinEUIRange defines the JoinEUI range that is used for the route of
+// a session. All join-requests of the session gateway are forwarded.
+var sessionJoinEUIRange = JoinEUIRange{
+	To: lorawan.EUI64{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+}
+
+// gatewayID returns the source gateway ID of the session.
+func (s Session) gatewayID() lorawan.EUI64 {
+	var gatewayID lorawan.EUI64
+	gatewayID.UnmarshalText([]byte(s.GatewayID))
+	return gatewayID
+}
+
+// route returns the route of the session.
+func (s Session) route() Route {
+	r := Route{
+		Name:            "session-" + s.ID,
+		NetID:           sessionNetID,
+		Server:          s.BrokerIPHNS,
+		SourceGatewayID: s.gatewayID(),
+		JoinEUIRanges:   []JoinEUIRange{sessionJoinEUIRange},
+	}
+	r.GatewayID.UnmarshalText([]byte(s.GWIDToken))
+	if s.NetID != "" {
+		r.NetID.UnmarshalText([]byte(s.NetID))
+	}
+	return r
+}
+
+// Session errors.
+var (
+	ErrSessionDoesNotExist  = errors.New("session does not exist")
+	ErrSessionAlreadyExists = errors.New("session already exists")
+)
+
+var (
+	sessionsMux sync.RWMutex
+	sessions    = make(map[string]Session)
+
+	// creatingSessions holds the IDs of the sessions that are being created,
+	// such that concurrent requests for the same gateway are rejected.
+	creatingSessions = make(map[string]struct{})
+
+	// pendingSessions holds the restored sessions that could not be started
+	// yet, e.g. because the local broker was unreachable. These are retried
+	// in the background and remain persisted.
+	pendingSessions      = make(map[string]Session)
+	sessionRetryInterval = 30 * time.Second
+	sessionRetryStop     chan struct{}
+	sessionRetryDone     chan struct{}
+)
+
+// CreateSession creates a new roaming session for the source gateway. It
+// subscribes to the gateway events on the local broker and sets the route to
+// the network server broker.
+func CreateSession(b Body) (Session, error) {
+	if err := b.Validate(); err != nil {
+		return Session{}, errors.Wrap(err, "validate error")
+	}
+
+	s := Session{
+		Body: b,
+	}
+	s.ID = s.gatewayID().String()
+	s.GatewayID = s.ID
+
+	if !reserveSession(s.ID) {
+		return Session{}, ErrSessionAlreadyExists
+	}
+	defer releaseSession(s.ID)
+
+	if err := startSession(s); err != nil {
+		return Session{}, err
+	}
+	persist()
+
+	return s, nil
+}
+
+// reserveSession reserves the given session ID for creation. It returns
+// false when a session with the given ID already exists, is pending or is
+// being created.
+func reserveSession(id string) bool {
+	sessionsMux.Lock()
+	defer sessionsMux.Unlock()
+
+	if _, ok := sessions[id]; ok {
+		return false
+	}
+	if _, ok := pendingSessions[id]; ok {
+		return false
+	}
+	if _, ok := creatingSessions[id]; ok {
+		return false
+	}
+
+	creatingSessions[id] = struct{}{}
+	return true
+}
+
+// releaseSession releases the reservation of the given session ID.
+func releaseSession(id string) {
+	sessionsMux.Lock()
+	defer sessionsMux.Unlock()
+	delete(creatingSessions, id)
+}
+
+// startSession sets the route of the given session, subscribes to the events
+// of its gateway on the local broker and adds it to the sessions.
+func startSession(s Session) error {
+	c, err := getOrConnectLocal(s.AddedBroker)
+	if err != nil {
+		return errors.Wrap(err, "connect to local broker error")
+	}
+
+	if err := setAndSubscribeRoute(s.route()); err != nil {
+		return errors.Wrap(err, "set route error")
+	}
+
+	if err := c.subscribeGateway(s.gatewayID()); err != nil {
+		return errors.Wrap(err, "subscribe gateway error")
+	}
+
+	sessionsMux.Lock()
+	sessions[s.ID] = s
+	sessionsMux.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id":     s.GatewayID,
+		"added_broker":   s.AddedBroker,
+		"broker_ip_h_ns": s.BrokerIPHNS,
+		"gwid_token":     s.GWIDToken,
+	}).Info("api: session started")
+
+	return nil
+}
+
+// addPendingSession adds the given session to the sessions that are retried
+// in the background.
+func addPendingSession(s Session) {
+	sessionsMux.Lock()
+	defer sessionsMux.Unlock()
+	pendingSessions[s.ID] = s
+}
+
+// getPendingSessions returns the sessions that have not been started yet.
+func getPendingSessions() []Session {
+	sessionsMux.RLock()
+	defer sessionsMux.RUnlock()
+
+	out := make([]Session, 0, len(pendingSessions))
+	for id, s := range pendingSessions {
+		// the session is being started by retryPendingSessions
+		if _, ok := sessions[id]; ok {
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// startSessionRetryLoop starts the background retry of the pending sessions.
+func startSessionRetryLoop() {
+	sessionRetryStop = make(chan struct{})
+	sessionRetryDone = make(chan struct{})
+
+	go func() {
+		defer close(sessionRetryDone)
+
+		ticker := time.NewTicker(sessionRetryInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				retryPendingSessions()
+			case <-sessionRetryStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSessionRetryLoop stops the background retry of the pending sessions.
+func stopSessionRetryLoop() {
+	if sessionRetryStop == nil {
+		return
+	}
+
+	close(sessionRetryStop)
+	<-sessionRetryDone
+	sessionRetryStop = nil
+}
+
+// retryPendingSessions tries to start the pending sessions.
+func retryPendingSessions() {
+	for _, s := range getPendingSessions() {
+		if err := startSession(s); err != nil {
+			log.WithError(err).WithField("gateway_id", s.GatewayID).Warning("api: start pending session error, retrying later")
+			continue
+		}
+
+		sessionsMux.Lock()
+		_, pending := pendingSessions[s.ID]
+		delete(pendingSessions, s.ID)
+		sessionsMux.Unlock()
+
+		// the session has been deleted while it was being started
+		if !pending {
+			if err := DeleteSession(s.ID); err != nil && err != ErrSessionDoesNotExist {
+				log.WithError(err).WithField("gateway_id", s.GatewayID).Error("api: delete session error")
+			}
+		}
+	}
+}
+
+// GetSession returns the session for the given gateway ID.
+func GetSession(id string) (Session, error) {
+	id = normalizeSessionID(id)
+
+	sessionsMux.RLock()
+	defer sessionsMux.RUnlock()
+
+	s, ok := sessions[id]
+	if !ok {
+		return Session{}, ErrSessionDoesNotExist
+	}
+	return s, nil
+}
+
+// GetSessions returns all sessions.
+func GetSessions() []Session {
+	sessionsMux.RLock()
+	defer sessionsMux.RUnlock()
+
+	out := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// DeleteSession deletes the session for the given gateway ID, removes its
+// route and unsubscribes from the events of its gateway.
+func DeleteSession(id string) error {
+	id = normalizeSessionID(id)
+
+	sessionsMux.Lock()
+	s, ok := sessions[id]
+	delete(sessions, id)
+	_, pending := pendingSessions[id]
+	delete(pendingSessions, id)
+	sessionsMux.Unlock()
+
+	if !ok {
+		if pending {
+			persist()
+			log.WithField("gateway_id", id).Info("api: pending session deleted")
+			return nil
+		}
+		return ErrSessionDoesNotExist
+	}
+
+	r := s.route()
+	DeleteRoute(r.Name)
+	persist()
+	setRouteOffline(r)
+
+	if err := unsubscribeRoute(r); err != nil {
+		return errors.Wrap(err, "unsubscribe route error")
+	}
+
+	if c, ok := lookupLocal(s.AddedBroker); ok {
+		if err := c.unsubscribeGateway(s.gatewayID()); err != nil {
+			return errors.Wrap(err, "unsubscribe gateway error")
+		}
+	}
+
+	log.WithField("gateway_id", id).Info("api: session deleted")
+
+	return nil
+}
+
+// normalizeSessionID returns the canonical (lower-case hex) form of the given
+// session ID, so that the gateway ID may be given in any case.
+func normalizeSessionID(id string) string {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(id)); err != nil {
+		return id
+	}
+	return gatewayID.String()
+}
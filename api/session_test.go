@@ -0,0 +1,88 @@
+package api
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestReserveSession(t *testing.T) {
+	assert := require.New(t)
+	defer func() {
+		sessions = make(map[string]Session)
+		pendingSessions = make(map[string]Session)
+		creatingSessions = make(map[string]struct{})
+	}()
+
+	// only one of the concurrent reservations succeeds
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var reserved int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveSession("0102030405060708") {
+				mux.Lock()
+				reserved++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(1, reserved)
+
+	releaseSession("0102030405060708")
+	assert.True(reserveSession("0102030405060708"))
+	releaseSession("0102030405060708")
+
+	sessions["0102030405060708"] = Session{ID: "0102030405060708"}
+	assert.False(reserveSession("0102030405060708"))
+
+	pendingSessions["0807060504030201"] = Session{ID: "0807060504030201"}
+	assert.False(reserveSession("0807060504030201"))
+}
+
+func TestSessionRoute(t *testing.T) {
+	tests := []struct {
+		Name          string
+		NetID         string
+		ExpectedNetID lorawan.NetID
+	}{
+		{
+			Name:          "default net id",
+			ExpectedNetID: sessionNetID,
+		},
+		{
+			Name:          "session net id",
+			NetID:         "00000a",
+			ExpectedNetID: lorawan.NetID{0x00, 0x00, 0x0a},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			s := Session{
+				ID: "0102030405060708",
+				Body: Body{
+					GatewayID:   "0102030405060708",
+					AddedBroker: "tcp://127.0.0.1:1883",
+					BrokerIPHNS: "tcp://ns.example.com:1883",
+					GWIDToken:   "0807060504030201",
+					NetID:       tst.NetID,
+				},
+			}
+			assert.NoError(s.Validate())
+
+			r := s.route()
+			assert.Equal(tst.ExpectedNetID, r.NetID)
+			assert.Equal(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, r.GatewayID)
+			assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, r.SourceGatewayID)
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+// aliasKey identifies a gateway (alias) of a route.
+type aliasKey struct {
+	route string
+	alias lorawan.EUI64
+}
+
+var (
+	// aggregatedStats holds the stats per gateway alias, aggregated since the
+	// last flush.
+	statsMux        sync.Mutex
+	aggregatedStats = make(map[aliasKey]*gw.GatewayStats)
+	statsInterval   time.Duration
+	statsStop       chan struct{}
+	statsDone       chan struct{}
+
+	// onlineGateways holds the online local gateways per gateway alias.
+	connMux        sync.Mutex
+	onlineGateways = make(map[aliasKey]map[lorawan.EUI64]struct{})
+)
+
+// getAlias returns the gateway ID under which the given gateway is forwarded
+// to the route.
+func (r Route) getAlias(gatewayID lorawan.EUI64) lorawan.EUI64 {
+	if r.GatewayID != (lorawan.EUI64{}) {
+		return r.GatewayID
+	}
+	return gatewayID
+}
+
+// startStatsLoop starts the periodic flushing of the aggregated stats.
+func startStatsLoop() {
+	statsStop = make(chan struct{})
+	statsDone = make(chan struct{})
+
+	go func() {
+		defer close(statsDone)
+
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				flushStats()
+			case <-statsStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopStatsLoop stops the periodic flushing of the aggregated stats.
+func stopStatsLoop() {
+	if statsStop == nil {
+		return
+	}
+
+	close(statsStop)
+	<-statsDone
+	statsStop = nil
+}
+
+// handleStats redacts the given stats according to the route policy and
+// aggregates these under the gateway alias of the route. Aggregated stats
+// are published by flushStats.
+func handleStats(route Route, gatewayID lorawan.EUI64, stats *gw.GatewayStats) {
+	if route.DisableStats {
+		return
+	}
+
+	stats = proto.Clone(stats).(*gw.GatewayStats)
+	if route.RedactLocation {
+		stats.Location = nil
+	}
+	if route.RedactMetaData {
+		stats.MetaData = nil
+		stats.Ip = ""
+	}
+
+	key := aliasKey{route: route.Name, alias: route.getAlias(gatewayID)}
+
+	statsMux.Lock()
+	defer statsMux.Unlock()
+
+	agg, ok := aggregatedStats[key]
+	if !ok {
+		aggregatedStats[key] = stats
+		return
+	}
+	mergeStats(agg, stats)
+}
+
+// mergeStats adds the counters of src to dst. The location, meta-data and
+// config version of src overwrite these of dst.
+func mergeStats(dst, src *gw.GatewayStats) {
+	dst.RxPacketsReceived += src.RxPacketsReceived
+	dst.RxPacketsReceivedOk += src.RxPacketsReceivedOk
+	dst.TxPacketsReceived += src.TxPacketsReceived
+	dst.TxPacketsEmitted += src.TxPacketsEmitted
+
+	if src.Location != nil {
+		dst.Location = src.Location
+	}
+	if src.ConfigVersion != "" {
+		dst.ConfigVersion = src.ConfigVersion
+	}
+	if src.Ip != "" {
+		dst.Ip = src.Ip
+	}
+	for k, v := range src.MetaData {
+		if dst.MetaData == nil {
+			dst.MetaData = make(map[string]string)
+		}
+		dst.MetaData[k] = v
+	}
+
+	for f, c := range src.RxPacketsPerFrequency {
+		if dst.RxPacketsPerFrequency == nil {
+			dst.RxPacketsPerFrequency = make(map[uint32]uint32)
+		}
+		dst.RxPacketsPerFrequency[f] += c
+	}
+	for f, c := range src.TxPacketsPerFrequency {
+		if dst.TxPacketsPerFrequency == nil {
+			dst.TxPacketsPerFrequency = make(map[uint32]uint32)
+		}
+		dst.TxPacketsPerFrequency[f] += c
+	}
+	for s, c := range src.TxPacketsPerStatus {
+		if dst.TxPacketsPerStatus == nil {
+			dst.TxPacketsPerStatus = make(map[string]uint32)
+		}
+		dst.TxPacketsPerStatus[s] += c
+	}
+
+	dst.RxPacketsPerModulation = mergeModulationCounts(dst.RxPacketsPerModulation, src.RxPacketsPerModulation)
+	dst.TxPacketsPerModulation = mergeModulationCounts(dst.TxPacketsPerModulation, src.TxPacketsPerModulation)
+}
+
+// mergeModulationCounts adds the counts of src to dst.
+func mergeModulationCounts(dst, src []*gw.PerModulationCount) []*gw.PerModulationCount {
+	for _, s := range src {
+		found := false
+		for _, d := range dst {
+			if proto.Equal(d.Modulation, s.Modulation) {
+				d.Count += s.Count
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, proto.Clone(s).(*gw.PerModulationCount))
+		}
+	}
+	return dst
+}
+
+// flushStats publishes the aggregated stats of every gateway alias.
+func flushStats() {
+	statsMux.Lock()
+	stats := aggregatedStats
+	aggregatedStats = make(map[aliasKey]*gw.GatewayStats)
+	statsMux.Unlock()
+
+	for key, pl := range stats {
+		route, ok := GetRoute(key.route)
+		if !ok {
+			continue
+		}
+
+		statsID, err := uuid.NewV4()
+		if err != nil {
+			log.WithError(err).Error("api: new uuid error")
+			continue
+		}
+
+		pl.GatewayId = key.alias[:]
+		pl.StatsId = statsID[:]
+		pl.Time = ptypes.TimestampNow()
+
+		publishToRoute(route, fmt.Sprintf("gateway/%s/event/stats", key.alias), pl, false)
+	}
+}
+
+// handleConn tracks the connection state of the given gateway and publishes
+// the (retained) state of the gateway alias of the route when it changes. The
+// alias is online as long as one of its local gateways is online.
+func handleConn(route Route, gatewayID lorawan.EUI64, state gw.ConnState_State) {
+	if route.DisableConn {
+		return
+	}
+
+	key := aliasKey{route: route.Name, alias: route.getAlias(gatewayID)}
+
+	connMux.Lock()
+	gateways := onlineGateways[key]
+	wasOnline := len(gateways) != 0
+
+	if state == gw.ConnState_ONLINE {
+		if gateways == nil {
+			gateways = make(map[lorawan.EUI64]struct{})
+			onlineGateways[key] = gateways
+		}
+		gateways[gatewayID] = struct{}{}
+	} else {
+		delete(gateways, gatewayID)
+		if len(gateways) == 0 {
+			delete(onlineGateways, key)
+		}
+	}
+
+	isOnline := len(gateways) != 0
+	connMux.Unlock()
+
+	// The OFFLINE state is always published, such that a stale retained
+	// ONLINE state on the target is overwritten.
+	if wasOnline && isOnline {
+		return
+	}
+
+	if isOnline {
+		publishConn(route, key.alias, gw.ConnState_ONLINE)
+	} else {
+		publishConn(route, key.alias, gw.ConnState_OFFLINE)
+	}
+}
+
+// setRouteOffline publishes the OFFLINE state for every online gateway alias
+// of the given route. This is used when the route (or session) is removed.
+func setRouteOffline(route Route) {
+	var aliases []lorawan.EUI64
+
+	connMux.Lock()
+	for key := range onlineGateways {
+		if key.route == route.Name {
+			aliases = append(aliases, key.alias)
+			delete(onlineGateways, key)
+		}
+	}
+	connMux.Unlock()
+
+	statsMux.Lock()
+	for key := range aggregatedStats {
+		if key.route == route.Name {
+			delete(aggregatedStats, key)
+		}
+	}
+	statsMux.Unlock()
+
+	for _, alias := range aliases {
+		publishConn(route, alias, gw.ConnState_OFFLINE)
+	}
+}
+
+// publishConn publishes the (retained) connection state of the given gateway
+// alias to the route.
+func publishConn(route Route, alias lorawan.EUI64, state gw.ConnState_State) {
+	log.WithFields(log.Fields{
+		"route":      route.Name,
+		"gateway_id": alias,
+		"state":      state,
+	}).Info("api: publishing gateway connection state")
+
+	publishToRoute(route, fmt.Sprintf("gateway/%s/state/conn", alias), &gw.ConnState{
+		GatewayId: alias[:],
+		State:     state,
+	}, true)
+}
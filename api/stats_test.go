@@ -0,0 +1,153 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+func TestStatsAndConn(t *testing.T) {
+	assert := require.New(t)
+
+	gatewayID1 := lorawan.EUI64{0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01, 0x01}
+	gatewayID2 := lorawan.EUI64{0x02, 0x02, 0x02, 0x02, 0x02, 0x02, 0x02, 0x02}
+	alias := lorawan.EUI64{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}
+
+	route := Route{
+		Name:           "partner",
+		Server:         "tcp://partner:1883",
+		GatewayID:      alias,
+		RedactLocation: true,
+		RedactMetaData: true,
+		Marshaler:      "protobuf",
+	}
+
+	// Use a publisher without publish loop, such that the enqueued messages
+	// can be inspected.
+	pub := &publisher{
+		server: route.Server,
+		queue:  make(chan publishMessage, 10),
+	}
+	pool.publishers[route.Server] = pub
+
+	routes = nil
+	defer func() {
+		routes = nil
+		delete(pool.publishers, route.Server)
+		aggregatedStats = make(map[aliasKey]*gw.GatewayStats)
+		onlineGateways = make(map[aliasKey]map[lorawan.EUI64]struct{})
+	}()
+	assert.NoError(SetRoute(route))
+
+	m, err := marshaler.Get("protobuf")
+	assert.NoError(err)
+
+	nextMessage := func(t *testing.T) publishMessage {
+		select {
+		case msg := <-pub.queue:
+			return msg
+		default:
+			require.FailNow(t, "expected published message")
+		}
+		return publishMessage{}
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		assert := require.New(t)
+
+		lora := &gw.Modulation{
+			Parameters: &gw.Modulation_Lora{
+				Lora: &gw.LoRaModulationInfo{Bandwidth: 125, SpreadingFactor: 7},
+			},
+		}
+
+		handleStats(route, gatewayID1, &gw.GatewayStats{
+			GatewayId:             gatewayID1[:],
+			Ip:                    "192.168.1.1",
+			Location:              &common.Location{Latitude: 1.123},
+			MetaData:              map[string]string{"foo": "bar"},
+			RxPacketsReceived:     10,
+			RxPacketsReceivedOk:   5,
+			RxPacketsPerFrequency: map[uint32]uint32{868100000: 5},
+			RxPacketsPerModulation: []*gw.PerModulationCount{
+				{Modulation: lora, Count: 5},
+			},
+		})
+		handleStats(route, gatewayID2, &gw.GatewayStats{
+			GatewayId:             gatewayID2[:],
+			RxPacketsReceived:     3,
+			RxPacketsReceivedOk:   2,
+			TxPacketsEmitted:      1,
+			RxPacketsPerFrequency: map[uint32]uint32{868100000: 1, 868300000: 1},
+			RxPacketsPerModulation: []*gw.PerModulationCount{
+				{Modulation: lora, Count: 2},
+			},
+		})
+
+		flushStats()
+
+		msg := nextMessage(t)
+		assert.Equal("gateway/0807060504030201/event/stats", msg.topic)
+		assert.False(msg.retain)
+
+		var stats gw.GatewayStats
+		assert.NoError(m.Unmarshal(msg.payload, &stats))
+		assert.Equal(alias[:], stats.GatewayId)
+		assert.Nil(stats.Location)
+		assert.Nil(stats.MetaData)
+		assert.Equal("", stats.Ip)
+		assert.EqualValues(13, stats.RxPacketsReceived)
+		assert.EqualValues(7, stats.RxPacketsReceivedOk)
+		assert.EqualValues(1, stats.TxPacketsEmitted)
+		assert.Equal(map[uint32]uint32{868100000: 6, 868300000: 1}, stats.RxPacketsPerFrequency)
+		assert.Len(stats.RxPacketsPerModulation, 1)
+		assert.EqualValues(7, stats.RxPacketsPerModulation[0].Count)
+		assert.Len(stats.StatsId, 16)
+
+		// nothing has been aggregated since the last flush
+		flushStats()
+		assert.Len(pub.queue, 0)
+	})
+
+	t.Run("Conn", func(t *testing.T) {
+		assert := require.New(t)
+
+		assertState := func(state gw.ConnState_State) {
+			msg := nextMessage(t)
+			assert.Equal("gateway/0807060504030201/state/conn", msg.topic)
+			assert.True(msg.retain)
+
+			var pl gw.ConnState
+			assert.NoError(m.Unmarshal(msg.payload, &pl))
+			assert.Equal(alias[:], pl.GatewayId)
+			assert.Equal(state, pl.State)
+		}
+
+		handleConn(route, gatewayID1, gw.ConnState_ONLINE)
+		assertState(gw.ConnState_ONLINE)
+
+		// the alias is already online
+		handleConn(route, gatewayID2, gw.ConnState_ONLINE)
+		assert.Len(pub.queue, 0)
+
+		// the alias is still online through the second gateway
+		handleConn(route, gatewayID1, gw.ConnState_OFFLINE)
+		assert.Len(pub.queue, 0)
+
+		handleConn(route, gatewayID2, gw.ConnState_OFFLINE)
+		assertState(gw.ConnState_OFFLINE)
+
+		handleConn(route, gatewayID1, gw.ConnState_ONLINE)
+		assertState(gw.ConnState_ONLINE)
+
+		// the route is removed
+		setRouteOffline(route)
+		assertState(gw.ConnState_OFFLINE)
+		assert.Len(onlineGateways, 0)
+	})
+}
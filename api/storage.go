@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// storageData defines the on-disk structure of the roaming state.
+type storageData struct {
+	Sessions []Session `json:"sessions"`
+	Routes   []Route   `json:"routes"`
+}
+
+var (
+	storageMux  sync.Mutex
+	storagePath string
+
+	// apiRoutes holds the names of the routes that have been set through the
+	// API. Only these routes are persisted, as the session routes are derived
+	// from the sessions and the other routes are loaded from the configuration.
+	apiRoutes = make(map[string]struct{})
+)
+
+// setAPIRoute marks the given route as set (or unset) through the API.
+func setAPIRoute(name string, set bool) {
+	storageMux.Lock()
+	defer storageMux.Unlock()
+
+	if set {
+		apiRoutes[name] = struct{}{}
+	} else {
+		delete(apiRoutes, name)
+	}
+}
+
+// loadStorage reads the roaming state from disk. When storage is disabled or
+// the file does not exist yet, an empty state is returned.
+func loadStorage() (storageData, error) {
+	var data storageData
+
+	if storagePath == "" {
+		return data, nil
+	}
+
+	b, err := ioutil.ReadFile(storagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return data, nil
+		}
+		return data, errors.Wrap(err, "read file error")
+	}
+
+	if err := json.Unmarshal(b, &data); err != nil {
+		return data, errors.Wrap(err, "unmarshal error")
+	}
+
+	return data, nil
+}
+
+// saveStorage writes the roaming state to disk. The file is first written to
+// a temporary file which is then renamed, so that a crash never leaves a
+// partially written file behind.
+func saveStorage() error {
+	if storagePath == "" {
+		return nil
+	}
+
+	storageMux.Lock()
+	defer storageMux.Unlock()
+
+	data := storageData{
+		Sessions: append(GetSessions(), getPendingSessions()...),
+	}
+	for _, r := range GetRoutes() {
+		if _, ok := apiRoutes[r.Name]; ok {
+			data.Routes = append(data.Routes, r)
+		}
+	}
+
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal error")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(storagePath), 0700); err != nil {
+		return errors.Wrap(err, "create directory error")
+	}
+
+	tmpPath := storagePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return errors.Wrap(err, "write file error")
+	}
+
+	if err := os.Rename(tmpPath, storagePath); err != nil {
+		return errors.Wrap(err, "rename file error")
+	}
+
+	return nil
+}
+
+// persist saves the roaming state to disk and logs on error. It is used
+// after modifications through the API, as these have already been applied.
+func persist() {
+	if err := saveStorage(); err != nil {
+		log.WithError(err).WithField("path", storagePath).Error("api: save roaming state error")
+	}
+}
+
+// restoreStorage restores the routes and sessions from disk. Sessions that
+// can not be started (e.g. the local broker is unreachable) are retried in
+// the background.
+func restoreStorage() error {
+	data, err := loadStorage()
+	if err != nil {
+		return errors.Wrap(err, "load storage error")
+	}
+
+	for _, r := range data.Routes {
+		if err := SetRoute(r); err != nil {
+			return errors.Wrapf(err, "restore route %s error", r.Name)
+		}
+		setAPIRoute(r.Name, true)
+	}
+
+	var pending int
+	for _, s := range data.Sessions {
+		if err := startSession(s); err != nil {
+			log.WithError(err).WithField("gateway_id", s.GatewayID).Warning("api: restore session error, retrying in background")
+			addPendingSession(s)
+			pending++
+		}
+	}
+
+	if pending != 0 {
+		startSessionRetryLoop()
+	}
+
+	log.WithFields(log.Fields{
+		"path":     storagePath,
+		"routes":   len(data.Routes),
+		"sessions": len(data.Sessions),
+		"pending":  pending,
+	}).Info("api: roaming state restored")
+
+	return nil
+}
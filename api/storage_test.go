@@ -0,0 +1,116 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestStorage(t *testing.T) {
+	assert := require.New(t)
+
+	storagePath = filepath.Join(t.TempDir(), "roaming", "roaming.json")
+	defer func() {
+		storagePath = ""
+		routes = nil
+		sessions = make(map[string]Session)
+		apiRoutes = make(map[string]struct{})
+	}()
+
+	t.Run("Load non-existing file", func(t *testing.T) {
+		assert := require.New(t)
+		data, err := loadStorage()
+		assert.NoError(err)
+		assert.Equal(storageData{}, data)
+	})
+
+	s := Session{
+		ID: "0102030405060708",
+		Body: Body{
+			GatewayID:   "0102030405060708",
+			AddedBroker: "tcp://127.0.0.1:1883",
+			BrokerIPHNS: "tcp://ns.example.com:1883",
+			GWIDToken:   "0807060504030201",
+		},
+	}
+	sessions[s.ID] = s
+
+	apiRoute := Route{
+		Name:   "api",
+		NetID:  lorawan.NetID{0x00, 0x00, 0x02},
+		Server: "tcp://api.example.com:1883",
+	}
+	configRoute := Route{
+		Name:   "config",
+		NetID:  lorawan.NetID{0x00, 0x00, 0x03},
+		Server: "tcp://config.example.com:1883",
+	}
+	assert.NoError(SetRoute(apiRoute))
+	assert.NoError(SetRoute(configRoute))
+	assert.NoError(SetRoute(s.route()))
+	setAPIRoute(apiRoute.Name, true)
+
+	t.Run("Save and load", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(saveStorage())
+
+		_, err := os.Stat(storagePath + ".tmp")
+		assert.True(os.IsNotExist(err))
+
+		data, err := loadStorage()
+		assert.NoError(err)
+		assert.Equal(storageData{
+			Sessions: []Session{s},
+			Routes:   []Route{apiRoute},
+		}, data)
+	})
+}
+
+func TestRestoreStoragePendingSession(t *testing.T) {
+	assert := require.New(t)
+
+	storagePath = filepath.Join(t.TempDir(), "roaming.json")
+	defer func() {
+		stopSessionRetryLoop()
+		storagePath = ""
+		routes = nil
+		sessions = make(map[string]Session)
+		pendingSessions = make(map[string]Session)
+		apiRoutes = make(map[string]struct{})
+	}()
+
+	// the local broker is unreachable
+	s := Session{
+		ID: "0102030405060708",
+		Body: Body{
+			GatewayID:   "0102030405060708",
+			AddedBroker: "tcp://127.0.0.1:1",
+			BrokerIPHNS: "tcp://ns.example.com:1883",
+			GWIDToken:   "0807060504030201",
+		},
+	}
+	pendingSessions[s.ID] = s
+	assert.NoError(saveStorage())
+	pendingSessions = make(map[string]Session)
+
+	assert.NoError(restoreStorage())
+	assert.Len(GetSessions(), 0)
+	assert.Equal([]Session{s}, getPendingSessions())
+
+	// the session remains persisted
+	assert.NoError(saveStorage())
+	data, err := loadStorage()
+	assert.NoError(err)
+	assert.Equal([]Session{s}, data.Sessions)
+
+	// deleting the pending session removes it from disk
+	assert.NoError(DeleteSession(s.ID))
+	assert.Len(getPendingSessions(), 0)
+	data, err = loadStorage()
+	assert.NoError(err)
+	assert.Len(data.Sessions, 0)
+}
@@ -56,6 +56,47 @@ join_euis=[{{ range $index, $elm := .Filters.JoinEUIs }}
 ]
 
 
+# Hooks configuration.
+#
+# Hooks can be used to modify, drop or duplicate uplink frames, gateway stats
+# and downlink frames in flight, using Starlark scripts
+# (https://github.com/bazelbuild/starlark). A script implements a hook by
+# defining one or multiple of the following functions:
+#
+#   def uplink(frame):     # gw.UplinkFrame
+#   def stats(stats):      # gw.GatewayStats
+#   def downlink(frame):   # gw.DownlinkFrame
+#
+# The function is called with the message as dict, in the same format as used
+# by the JSON marshaler (bytes are base64 encoded). It must return the
+# (modified) dict, a list of dicts to duplicate the message or None to drop
+# the message. The json and base64 modules are available to all scripts.
+#
+# Example:
+# def uplink(frame):
+#   frame["rxInfo"]["board"] = 1
+#   return frame
+#
+# When a script fails or times out, the message is passed unmodified to the
+# next script.
+[hooks]
+
+# Scripts.
+#
+# The scripts are executed in the configured order.
+#
+# Example:
+# scripts=[
+#   "/etc/chirpstack-gateway-bridge/hooks/drop_test_devices.star",
+# ]
+scripts=[{{ range $index, $elm := .Hooks.Scripts }}
+  "{{ $elm }}",{{ end }}
+]
+
+# Max. execution duration of a script function.
+timeout="{{ .Hooks.Timeout }}"
+
+
 # Gateway backend configuration.
 [backend]
 
@@ -221,12 +262,65 @@ type="{{ .Backend.Type }}"
 # This defines how the MQTT payloads are encoded. Valid options are:
 # * protobuf:  Protobuf encoding
 # * json:      JSON encoding (easier for debugging, but less compact than 'protobuf')
+# * json_v4:   JSON encoding with IDs and EUIs as HEX string, timestamps as RFC3339
+#              and the PHYPayload as both base64 and decoded LoRaWAN structure
+# * cbor:      CBOR encoding (compact, for bandwidth-sensitive links)
 marshaler="{{ .Integration.Marshaler }}"
 
+  # Store-and-forward queue.
+  #
+  # When configured, events that can not be published by an integration
+  # (e.g. because the connection with the MQTT broker is lost) are stored
+  # in an on-disk queue and are re-published in order once the integration
+  # is able to publish again. Queued events are retained on restart. Each
+  # integration uses a sub-directory named after the integration.
+  #
+  # Note: while the MQTT integration is reconnecting, QoS 1 and 2 events are
+  # held by the MQTT client and published once reconnected. Only QoS 0 events
+  # fail and are queued.
+  [integration.queue]
+  # Queue path.
+  #
+  # When left blank, the queue is disabled.
+  path="{{ .Integration.Queue.Path }}"
+
+  # Max size.
+  #
+  # The maximum number of queued events (per integration). When the queue
+  # is full, the oldest events are dropped. Set to 0 to disable this limit.
+  max_size={{ .Integration.Queue.MaxSize }}
+
+  # Max age.
+  #
+  # Queued events older than the given duration are dropped. Set to 0 to
+  # disable this limit.
+  max_age="{{ .Integration.Queue.MaxAge }}"
+
+  # Retry interval.
+  #
+  # The interval in which re-publishing the queued events is retried.
+  retry_interval="{{ .Integration.Queue.RetryInterval }}"
+
   # MQTT integration configuration.
-  [integration.mqtt]
+  #
+  # Multiple MQTT integrations can be configured by repeating the
+  # [[integration.mqtt]] block (including its auth sections). Events and
+  # states are published to all integrations and commands are accepted from
+  # any of them. A failing integration does not affect the other integrations.
+{{ range $index, $mqtt := .Integration.MQTT }}
+  [[integration.mqtt]]
+  # Name of the integration (optional).
+  #
+  # This is used for logging. When left blank, mqtt-<index> is used.
+  name="{{ $mqtt.Name }}"
+
+  # Payload marshaler (optional).
+  #
+  # When left blank, the integration marshaler (see above) is used.
+  marshaler="{{ $mqtt.Marshaler }}"
+
   # Event topic template.
-  event_topic_template="{{ .Integration.MQTT.EventTopicTemplate }}"
+  event_topic_template="{{ $mqtt.EventTopicTemplate }}"
 
   # State topic template.
   #
@@ -234,33 +328,190 @@ marshaler="{{ .Integration.Marshaler }}"
   # so that the last message will be stored by the MQTT broker. When set to
   # a blank string, this feature will be disabled. This feature is only
   # supported when using the generic authentication type.
-  state_topic_template="{{ .Integration.MQTT.StateTopicTemplate }}"
+  state_topic_template="{{ $mqtt.StateTopicTemplate }}"
 
   # Command topic template.
-  command_topic_template="{{ .Integration.MQTT.CommandTopicTemplate }}"
+  command_topic_template="{{ $mqtt.CommandTopicTemplate }}"
 
   # State retained.
   #
   # By default this value is set to true and states are published as retained
   # MQTT messages. Setting this to false means that states will not be retained
   # by the MQTT broker.
-  state_retained={{ .Integration.MQTT.StateRetained }}
+  state_retained={{ $mqtt.StateRetained }}
 
   # Keep alive will set the amount of time (in seconds) that the client should
   # wait before sending a PING request to the broker. This will allow the client
   # to know that a connection has not been lost with the server.
   # Valid units are 'ms', 's', 'm', 'h'. Note that these values can be combined, e.g. '24h30m15s'.
-  keep_alive="{{ .Integration.MQTT.KeepAlive }}"
+  keep_alive="{{ $mqtt.KeepAlive }}"
 
   # Maximum interval that will be waited between reconnection attempts when connection is lost.
   # Valid units are 'ms', 's', 'm', 'h'. Note that these values can be combined, e.g. '24h30m15s'.
-  max_reconnect_interval="{{ .Integration.MQTT.MaxReconnectInterval }}"
+  max_reconnect_interval="{{ $mqtt.MaxReconnectInterval }}"
 
   # Terminate on connect error.
   #
   # When set to true, instead of re-trying to connect, the ChirpStack Gateway Bridge
-  # process will be terminated on a connection error.
-  terminate_on_connect_error={{ .Integration.MQTT.TerminateOnConnectError }}
+  # process will be terminated on a connection error. This does not apply to
+  # the per-gateway connections, which always reconnect.
+  terminate_on_connect_error={{ $mqtt.TerminateOnConnectError }}
+
+  # Instance ID.
+  #
+  # This identifies the ChirpStack Gateway Bridge instance in the HA mode and
+  # the bridge state (see below). It must be unique for each instance and
+  # stable across restarts. When left blank, the hostname is used.
+  instance_id="{{ $mqtt.InstanceID }}"
+
+
+  # QoS and retain flag per event type.
+  #
+  # By default, events are published using the qos of the authentication
+  # settings and are not retained. Per event type (up, upset, stats, ack, exec
+  # and raw), this can be overridden. Example:
+  #
+  # [integration.mqtt.events.up]
+  # qos=1
+  #
+  # [integration.mqtt.events.stats]
+  # qos=0
+  # retained=true
+{{ range $event, $opts := $mqtt.Events }}
+  [integration.mqtt.events.{{ $event }}]
+  qos={{ $opts.QOS }}
+  retained={{ $opts.Retained }}
+{{ end }}
+
+  # QoS and retain flag per state type.
+  #
+  # By default, states are published using the qos of the authentication
+  # settings and the state_retained setting. Per state type (conn), this can
+  # be overridden. Example:
+  #
+  # [integration.mqtt.states.conn]
+  # qos=1
+  # retained=true
+{{ range $state, $opts := $mqtt.States }}
+  [integration.mqtt.states.{{ $state }}]
+  qos={{ $opts.QOS }}
+  retained={{ $opts.Retained }}
+{{ end }}
+
+  # QoS per subscription type.
+  #
+  # By default, the command topic is subscribed to using the qos of the
+  # authentication settings. This can be overridden using the command
+  # subscription type. Example:
+  #
+  # [integration.mqtt.subscriptions.command]
+  # qos=1
+{{ range $subscription, $opts := $mqtt.Subscriptions }}
+  [integration.mqtt.subscriptions.{{ $subscription }}]
+  qos={{ $opts.QOS }}
+{{ end }}
+
+
+  # High-availability mode.
+  #
+  # This allows running multiple ChirpStack Gateway Bridge instances in
+  # active-active mode, e.g. behind a load-balancer. The gateway command topics
+  # are subscribed to using a shared subscription. Each instance advertises the
+  # gateways connected to it using a retained "owner" state message. Commands
+  # received by an instance to which the gateway is not connected are
+  # re-published to the instance topic of the instance owning the gateway.
+  #
+  # Note: this requires a MQTT broker supporting shared subscriptions and a
+  # state_topic_template.
+  [integration.mqtt.ha]
+  # Enable high-availability mode.
+  enabled={{ $mqtt.HA.Enabled }}
+
+  # Shared subscription group.
+  #
+  # All instances must use the same group. When left blank, regular
+  # subscriptions are used.
+  shared_subscription_group="{{ $mqtt.HA.SharedSubscriptionGroup }}"
+
+  # Instance topic template.
+  #
+  # Commands are re-published to this topic for the instance owning the
+  # gateway.
+  instance_topic_template="{{ $mqtt.HA.InstanceTopicTemplate }}"
+
+
+  # Per-gateway connections.
+  #
+  # When enabled, a separate MQTT connection is opened for each gateway
+  # connecting to the ChirpStack Gateway Bridge, using the credentials of that
+  # gateway. This is useful when the MQTT broker applies ACLs per gateway.
+  # Each connection uses a (retained) OFFLINE conn state as last will and
+  # testament. The connection is closed when the gateway disconnects.
+  #
+  # The servers, ca_cert, qos and clean_session settings of the generic
+  # authentication (below) are used for each connection.
+  [integration.mqtt.per_gateway]
+  # Enable per-gateway connections.
+  enabled={{ $mqtt.PerGateway.Enabled }}
+
+  # Credential templates.
+  #
+  # Use {{ "{{" }} .GatewayID {{ "}}" }} as placeholder for the gateway ID, e.g. to
+  # use a certificate per gateway:
+  # tls_cert_template="/etc/chirpstack-gateway-bridge/certs/{{ "{{" }} .GatewayID {{ "}}" }}.crt"
+  username_template="{{ $mqtt.PerGateway.UsernameTemplate }}"
+  password_template="{{ $mqtt.PerGateway.PasswordTemplate }}"
+  client_id_template="{{ $mqtt.PerGateway.ClientIDTemplate }}"
+  tls_cert_template="{{ $mqtt.PerGateway.TLSCertTemplate }}"
+  tls_key_template="{{ $mqtt.PerGateway.TLSKeyTemplate }}"
+
+  # Credentials file.
+  #
+  # JSON file with the credentials per gateway ID. The credentials of gateways
+  # in this file take precedence over the templates. Example:
+  # {
+  #   "0102030405060708": {
+  #     "username": "gw1",
+  #     "password": "secret",
+  #     "client_id": "0102030405060708",
+  #     "tls_cert": "/path/to/gw1.crt",
+  #     "tls_key": "/path/to/gw1.key"
+  #   }
+  # }
+  credentials_file="{{ $mqtt.PerGateway.CredentialsFile }}"
+
+
+  # Bridge state.
+  #
+  # When a single MQTT connection is shared by multiple gateways, the
+  # ChirpStack Gateway Bridge can not set a last will and testament per
+  # gateway. When enabled, the bridge publishes a retained ONLINE conn state
+  # and a periodic heartbeat for the instance, with an OFFLINE last will and
+  # testament. It also publishes the (retained) list of connected gateways.
+  #
+  # On startup, the gateways of the list published by the previous run of this
+  # instance that did not reconnect within the grace period are set to
+  # OFFLINE.
+  #
+  # Note: this requires a state_topic_template and a stable instance_id.
+  [integration.mqtt.bridge_state]
+  # Enable bridge state.
+  enabled={{ $mqtt.BridgeState.Enabled }}
+
+  # State topic template.
+  state_topic_template="{{ $mqtt.BridgeState.StateTopicTemplate }}"
+
+  # Heartbeat interval.
+  #
+  # Interval in which the ONLINE conn state (including timestamp) and the list
+  # of connected gateways are published.
+  heartbeat_interval="{{ $mqtt.BridgeState.HeartbeatInterval }}"
+
+  # Grace period.
+  #
+  # Time to wait after startup for gateways to reconnect, before setting the
+  # gateways of the previous run to OFFLINE.
+  grace_period="{{ $mqtt.BridgeState.GracePeriod }}"
 
 
   # MQTT authentication.
@@ -268,7 +519,7 @@ marshaler="{{ .Integration.Marshaler }}"
   # Type defines the MQTT authentication type to use.
   #
   # Set this to the name of one of the sections below.
-  type="{{ .Integration.MQTT.Auth.Type }}"
+  type="{{ $mqtt.Auth.Type }}"
 
     # Generic MQTT authentication.
     [integration.mqtt.auth.generic]
@@ -276,15 +527,15 @@ marshaler="{{ .Integration.Marshaler }}"
     #
     # Configure one or multiple MQTT server to connect to. Each item must be in
     # the following format: scheme://host:port where scheme is tcp, ssl or ws.
-    servers=[{{ range $index, $elm := .Integration.MQTT.Auth.Generic.Servers }}
+    servers=[{{ range $index, $elm := $mqtt.Auth.Generic.Servers }}
       "{{ $elm }}",{{ end }}
     ]
 
     # Connect with the given username (optional)
-    username="{{ .Integration.MQTT.Auth.Generic.Username }}"
+    username="{{ $mqtt.Auth.Generic.Username }}"
 
     # Connect with the given password (optional)
-    password="{{ .Integration.MQTT.Auth.Generic.Password }}"
+    password="{{ $mqtt.Auth.Generic.Password }}"
 
     # Quality of service level
     #
@@ -294,34 +545,34 @@ marshaler="{{ .Integration.Marshaler }}"
     #
     # Note: an increase of this value will decrease the performance.
     # For more information: https://www.hivemq.com/blog/mqtt-essentials-part-6-mqtt-quality-of-service-levels
-    qos={{ .Integration.MQTT.Auth.Generic.QOS }}
+    qos={{ $mqtt.Auth.Generic.QOS }}
 
     # Clean session
     #
     # Set the "clean session" flag in the connect message when this client
     # connects to an MQTT broker. By setting this flag you are indicating
     # that no messages saved by the broker for this client should be delivered.
-    clean_session={{ .Integration.MQTT.Auth.Generic.CleanSession }}
+    clean_session={{ $mqtt.Auth.Generic.CleanSession }}
 
     # Client ID
     #
     # Set the client id to be used by this client when connecting to the MQTT
     # broker. A client id must be no longer than 23 characters. When left blank,
     # a random id will be generated. This requires clean_session=true.
-    client_id="{{ .Integration.MQTT.Auth.Generic.ClientID }}"
+    client_id="{{ $mqtt.Auth.Generic.ClientID }}"
 
     # CA certificate file (optional)
     #
     # Use this when setting up a secure connection (when server uses ssl://...)
     # but the certificate used by the server is not trusted by any CA certificate
     # on the server (e.g. when self generated).
-    ca_cert="{{ .Integration.MQTT.Auth.Generic.CACert }}"
+    ca_cert="{{ $mqtt.Auth.Generic.CACert }}"
 
     # mqtt TLS certificate file (optional)
-    tls_cert="{{ .Integration.MQTT.Auth.Generic.TLSCert }}"
+    tls_cert="{{ $mqtt.Auth.Generic.TLSCert }}"
 
     # mqtt TLS key file (optional)
-    tls_key="{{ .Integration.MQTT.Auth.Generic.TLSKey }}"
+    tls_key="{{ $mqtt.Auth.Generic.TLSKey }}"
 
 
     # Google Cloud Platform Cloud IoT Core authentication.
@@ -331,22 +582,22 @@ marshaler="{{ .Integration.Marshaler }}"
     # Cloud IoT Core.
     [integration.mqtt.auth.gcp_cloud_iot_core]
     # MQTT server.
-    server="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.Server }}"
+    server="{{ $mqtt.Auth.GCPCloudIoTCore.Server }}"
 
     # Google Cloud IoT Core Device id.
-    device_id="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.DeviceID }}"
+    device_id="{{ $mqtt.Auth.GCPCloudIoTCore.DeviceID }}"
 
     # Google Cloud project id.
-    project_id="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.ProjectID }}"
+    project_id="{{ $mqtt.Auth.GCPCloudIoTCore.ProjectID }}"
 
     # Google Cloud region.
-    cloud_region="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.CloudRegion }}"
+    cloud_region="{{ $mqtt.Auth.GCPCloudIoTCore.CloudRegion }}"
 
     # Google Cloud IoT registry id.
-    registry_id="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.RegistryID }}"
+    registry_id="{{ $mqtt.Auth.GCPCloudIoTCore.RegistryID }}"
 
     # JWT token expiration time.
-    jwt_expiration="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.JWTExpiration }}"
+    jwt_expiration="{{ $mqtt.Auth.GCPCloudIoTCore.JWTExpiration }}"
 
     # JWT token key-file.
     #
@@ -356,7 +607,7 @@ marshaler="{{ .Integration.Marshaler }}"
     #
     # Then point the setting below to the private-key.pem and associate the
     # public-key.pem with this device / gateway in Google Cloud IoT Core.
-    jwt_key_file="{{ .Integration.MQTT.Auth.GCPCloudIoTCore.JWTKeyFile }}"
+    jwt_key_file="{{ $mqtt.Auth.GCPCloudIoTCore.JWTKeyFile }}"
 
 
     # Azure IoT Hub
@@ -369,35 +620,606 @@ marshaler="{{ .Integration.Marshaler }}"
     #
     # This connection string can be retrieved from the Azure IoT Hub device
     # details when using the symmetric key authentication type.
-    device_connection_string="{{ .Integration.MQTT.Auth.AzureIoTHub.DeviceConnectionString }}"
+    device_connection_string="{{ $mqtt.Auth.AzureIoTHub.DeviceConnectionString }}"
 
     # Token expiration (symmetric key authentication).
     #
     # ChirpStack Gateway Bridge will generate a SAS token with the given expiration.
     # After the token has expired, it will generate a new one and trigger a
     # re-connect (only for symmetric key authentication).
-    sas_token_expiration="{{ .Integration.MQTT.Auth.AzureIoTHub.SASTokenExpiration }}"
+    sas_token_expiration="{{ $mqtt.Auth.AzureIoTHub.SASTokenExpiration }}"
 
     # Device ID (X.509 authentication).
     #
     # This will be automatically set when a device connection string is given.
     # It must be set for X.509 authentication.
-    device_id="{{ .Integration.MQTT.Auth.AzureIoTHub.DeviceID }}"
+    device_id="{{ $mqtt.Auth.AzureIoTHub.DeviceID }}"
 
     # IoT Hub hostname (X.509 authentication).
     #
     # This will be automatically set when a device connection string is given.
     # It must be set for X.509 authentication.
     # Example: iot-hub-name.azure-devices.net
-    hostname="{{ .Integration.MQTT.Auth.AzureIoTHub.Hostname }}"
+    hostname="{{ $mqtt.Auth.AzureIoTHub.Hostname }}"
 
     # Client certificates (X.509 authentication).
     #
     # Configure the tls_cert (certificate file) and tls_key (private-key file)
     # when the device is configured with X.509 authentication.
-    tls_cert="{{ .Integration.MQTT.Auth.AzureIoTHub.TLSCert }}"
-    tls_key="{{ .Integration.MQTT.Auth.AzureIoTHub.TLSKey }}"
+    tls_cert="{{ $mqtt.Auth.AzureIoTHub.TLSCert }}"
+    tls_key="{{ $mqtt.Auth.AzureIoTHub.TLSKey }}"
+{{ end }}
+
+
+  # HTTP integration configuration.
+  #
+  # The HTTP integration posts the gateway events (up, stats, ack, raw and
+  # exec) and states to the configured URLs, using the configured marshaler.
+  # Multiple HTTP integrations can be configured by repeating the
+  # [[integration.http]] block. Note that when an HTTP integration has been
+  # configured, the MQTT integration must be configured explicitly.
+  #
+  # Example:
+  # [[integration.http]]
+  # event_url_template="http://localhost:8080/gateway/{{ "{{" }} .GatewayID {{ "}}" }}/event/{{ "{{" }} .EventType {{ "}}" }}"
+{{ range $index, $http := .Integration.HTTP }}
+  [[integration.http]]
+  # Name of the integration (optional).
+  #
+  # This is used for logging. When left blank, http-<index> is used.
+  name="{{ $http.Name }}"
+
+  # Payload marshaler (optional).
+  #
+  # When left blank, the integration marshaler (see above) is used.
+  marshaler="{{ $http.Marshaler }}"
+
+  # Event URL template.
+  event_url_template="{{ $http.EventURLTemplate }}"
+
+  # State URL template (optional).
+  #
+  # When left blank, states (e.g. the gateway connection state) are not posted.
+  state_url_template="{{ $http.StateURLTemplate }}"
+
+  # Request timeout.
+  timeout="{{ $http.Timeout }}"
+
+  # Max retries.
+  #
+  # Requests failing because of a network error or a 429 or 5xx response are
+  # retried up to the given number of times, with an exponential backoff
+  # starting at retry_interval, capped at max_retry_interval.
+  max_retries={{ $http.MaxRetries }}
+  retry_interval="{{ $http.RetryInterval }}"
+  max_retry_interval="{{ $http.MaxRetryInterval }}"
+
+  # Headers.
+  #
+  # Additional headers to set on each request (e.g. for authentication).
+  [integration.http.headers]
+{{ range $k, $v := $http.Headers }}  {{ $k }}="{{ $v }}"
+{{ end }}
+
+  # Commands.
+  [integration.http.command]
+  # Command mode.
+  #
+  # Valid options are:
+  # * server:  Commands are posted to the embedded HTTP server at
+  #            /gateway/<gateway_id>/command/<command> where command
+  #            is one of down, config, exec or raw.
+  # * poll:    Commands are retrieved by long-polling the poll_url_template
+  #            URL per gateway. A 200 response must contain the command type
+  #            in the X-Gateway-Command header, a 204 response indicates that
+  #            there was no command.
+  # * blank:   Commands are not accepted by this integration.
+  #
+  # Commands are only accepted for the gateways connected to the bridge and
+  # the gateway ID of the command payload (when set) must match the gateway
+  # ID of the command.
+  mode="{{ $http.Command.Mode }}"
+
+  # Bind (server mode).
+  #
+  # By default, the command server only accepts connections from the local
+  # host. When binding to a non-loopback address, the bearer_token and / or
+  # the ca_cert must be set.
+  bind="{{ $http.Command.Bind }}"
+
+  # TLS certificate and key (server mode, optional).
+  tls_cert="{{ $http.Command.TLSCert }}"
+  tls_key="{{ $http.Command.TLSKey }}"
+
+  # TLS CA certificate (server mode, optional).
+  #
+  # When configured, the command server validates that the client certificate
+  # has been signed by this CA certificate. This requires the tls_cert and
+  # tls_key to be set.
+  ca_cert="{{ $http.Command.CACert }}"
+
+  # Bearer token (server mode, optional).
+  #
+  # When set, the command requests must contain the
+  # "Authorization: Bearer <token>" header.
+  bearer_token="{{ $http.Command.BearerToken }}"
+
+  # Poll URL template (poll mode).
+  poll_url_template="{{ $http.Command.PollURLTemplate }}"
+
+  # Poll timeout (poll mode).
+  #
+  # This must be greater than the long-polling timeout of the server.
+  poll_timeout="{{ $http.Command.PollTimeout }}"
+{{ end }}
+
+
+  # Kafka integration configuration.
+  #
+  # The Kafka integration produces the gateway events and states to the
+  # topics generated from the configured templates, using the gateway ID as
+  # message key (such that the ordering per gateway is retained). The event
+  # or state type is set in the "event" or "state" message header.
+  # Multiple Kafka integrations can be configured by repeating the
+  # [[integration.kafka]] block. Note that when a Kafka integration has been
+  # configured, the MQTT integration must be configured explicitly.
+  #
+  # Example:
+  # [[integration.kafka]]
+  # brokers=["localhost:9092"]
+{{ range $index, $kafka := .Integration.Kafka }}
+  [[integration.kafka]]
+  # Name of the integration (optional).
+  #
+  # This is used for logging. When left blank, kafka-<index> is used.
+  name="{{ $kafka.Name }}"
+
+  # Payload marshaler (optional).
+  #
+  # When left blank, the integration marshaler (see above) is used.
+  marshaler="{{ $kafka.Marshaler }}"
+
+  # Kafka brokers.
+  brokers=[{{ range $index, $elm := $kafka.Brokers }}
+    "{{ $elm }}",{{ end }}
+  ]
+
+  # Event topic template.
+  event_topic_template="{{ $kafka.EventTopicTemplate }}"
+
+  # State topic template (optional).
+  #
+  # As Kafka does not support retained messages, it is recommended to
+  # enable log compaction on this topic. When set to a blank string, states
+  # are not produced.
+  state_topic_template="{{ $kafka.StateTopicTemplate }}"
 
+  # Command topic.
+  #
+  # Commands must be produced to this topic with the gateway ID as message
+  # key and the command type (down, config, exec or raw) in the "command"
+  # message header. Commands for gateways that are not connected to this
+  # instance are ignored, as are commands of which the payload gateway ID
+  # does not match the message key. When set to a blank string, commands are
+  # not consumed.
+  command_topic="{{ $kafka.CommandTopic }}"
+
+  # Consumer group ID.
+  #
+  # As each instance must consume all commands, each instance must use a
+  # unique group ID. When left blank, chirpstack-gateway-bridge-<hostname>
+  # is used.
+  group_id="{{ $kafka.GroupID }}"
+
+  # Batch timeout.
+  #
+  # The maximum time to wait before a (partial) batch of messages is sent.
+  # Messages are produced asynchronously, such that publishing an event does
+  # not wait for the batch to be sent. As a consequence, write errors are
+  # logged (and counted by the integration_kafka_write_error_count metric),
+  # but are not returned to the store-and-forward queue.
+  batch_timeout="{{ $kafka.BatchTimeout }}"
+
+  # Write timeout.
+  write_timeout="{{ $kafka.WriteTimeout }}"
+
+  # TLS.
+  #
+  # Set tls=true to connect using TLS. The ca_cert, tls_cert and tls_key are
+  # optional.
+  tls={{ $kafka.TLS }}
+  ca_cert="{{ $kafka.CACert }}"
+  tls_cert="{{ $kafka.TLSCert }}"
+  tls_key="{{ $kafka.TLSKey }}"
+
+  # SASL/PLAIN authentication (optional).
+  username="{{ $kafka.Username }}"
+  password="{{ $kafka.Password }}"
+{{ end }}
+
+
+  # gRPC integration configuration.
+  #
+  # The gRPC integration opens a bidirectional stream to the configured
+  # server (method /chirpstack.gateway_bridge.GatewayBridgeService/Stream).
+  # Each message of the stream is a google.protobuf.Any message, wrapping:
+  # * bridge to server: gw.UplinkFrame, gw.GatewayStats, gw.DownlinkTXAck,
+  #   gw.ConnState, gw.GatewayCommandExecResponse and
+  #   gw.RawPacketForwarderEvent
+  # * server to bridge: gw.DownlinkFrame, gw.GatewayConfiguration,
+  #   gw.GatewayCommandExecRequest and gw.RawPacketForwarderCommand
+  # Multiple gRPC integrations can be configured by repeating the
+  # [[integration.grpc]] block. Note that when a gRPC integration has been
+  # configured, the MQTT integration must be configured explicitly.
+  #
+  # Example:
+  # [[integration.grpc]]
+  # server="localhost:8000"
+{{ range $index, $grpc := .Integration.GRPC }}
+  [[integration.grpc]]
+  # Name of the integration (optional).
+  #
+  # This is used for logging. When left blank, grpc-<index> is used.
+  name="{{ $grpc.Name }}"
+
+  # Server (hostname:port).
+  server="{{ $grpc.Server }}"
+
+  # Keep alive will set the interval after which the client pings the server
+  # when there is no activity, to detect a broken connection.
+  keep_alive="{{ $grpc.KeepAlive }}"
+
+  # Maximum interval that will be waited between reconnection attempts when
+  # the stream is lost.
+  max_reconnect_interval="{{ $grpc.MaxReconnectInterval }}"
+
+  # Terminate on connect error.
+  #
+  # When set to true, instead of re-trying to connect, the ChirpStack Gateway Bridge
+  # process will be terminated on a connection error.
+  terminate_on_connect_error={{ $grpc.TerminateOnConnectError }}
+
+  # TLS.
+  #
+  # Set tls=true to connect using TLS. The ca_cert is optional, configure
+  # the tls_cert and tls_key for mTLS.
+  tls={{ $grpc.TLS }}
+  ca_cert="{{ $grpc.CACert }}"
+  tls_cert="{{ $grpc.TLSCert }}"
+  tls_key="{{ $grpc.TLSKey }}"
+{{ end }}
+
+
+# Roaming configuration.
+#
+# The roaming forwarder subscribes to the gateway events published on the
+# local MQTT broker and forwards these to the matching roaming routes. The
+# events are decoded using the integration marshaler.
+[roaming]
+
+# Local MQTT broker.
+#
+# When set, the gateway events published on this broker will be forwarded
+# to the configured routes. Example: tcp://127.0.0.1:1883
+server="{{ .Roaming.Server }}"
+
+# Publish queue size.
+#
+# A single connection is kept per target broker. Messages are queued before
+# they are published to the target broker. This defines the max. number of
+# queued messages per target broker.
+publish_queue_size={{ .Roaming.PublishQueueSize }}
+
+# Publish queue timeout.
+#
+# When the publish queue is full, the forwarder will wait for the given
+# duration after which the message will be dropped.
+publish_queue_timeout="{{ .Roaming.PublishQueueTimeout }}"
+
+# Max. time to wait for a publish to be acknowledged by the target broker.
+max_token_wait="{{ .Roaming.MaxTokenWait }}"
+
+# Storage path.
+#
+# When set, the sessions and the routes created through the API are stored
+# in this (JSON) file and restored on startup. When left blank, these are
+# lost on restart.
+# Example: /var/lib/chirpstack-gateway-bridge/roaming.json
+storage_path="{{ .Roaming.StoragePath }}"
+
+# Session NetID.
+#
+# The NetID of the route of a session created through the API, when the
+# session does not set the net_id. Make sure this does not overlap with the
+# NetID of a configured route.
+session_net_id="{{ .Roaming.SessionNetID }}"
+
+# Stats interval.
+#
+# The gateway stats are aggregated per route and gateway (alias) and
+# published to the route using this interval. This must be greater than zero,
+# use disable_stats of the route to disable forwarding the stats.
+stats_interval="{{ .Roaming.StatsInterval }}"
+
+  # Roaming routes.
+  #
+  # Uplinks are forwarded according to their frame type:
+  #   * data uplinks and rejoin-requests (type 0 and 2) to every route of
+  #     which the NetID matches the DevAddr (or NetID) of the uplink
+  #   * join-requests and rejoin-requests (type 1) to every route of which
+  #     a JoinEUI range contains the JoinEUI of the uplink
+  #   * proprietary frames to every route accepting proprietary frames
+  # Stats are aggregated per gateway (alias) and published every
+  # stats_interval. Connection states are published as retained messages under
+  # the gateway (alias), which is ONLINE as long as one of its gateways is
+  # online. OFFLINE is published when the route (or session) is removed.
+  # Downlinks published by the network server of the route are relayed
+  # to the local gateway and the downlink acks are routed back to the network
+  # server. Routes can also be managed through the API.
+  #
+  # Example:
+  # [[roaming.routes]]
+  #
+  #   # Name of the route.
+  #   name="partner-a"
+  #
+  #   # Forwarding mode.
+  #   #
+  #   # Valid options are:
+  #   #   * mqtt: the gateway events are re-published on the MQTT broker of
+  #   #     the network server
+  #   #   * passive_roaming: the uplinks are forwarded as LoRaWAN Backend
+  #   #     Interfaces XmitDataReq to the HTTP endpoint of the network server
+  #   mode="mqtt"
+  #
+  #   # NetID of the network to which uplinks must be forwarded.
+  #   net_id="000001"
+  #
+  #   # MQTT broker (mqtt mode) or HTTP endpoint (passive_roaming mode) of the
+  #   # network server.
+  #   server="tcp://partner-a.example.com:1883"
+  #
+  #   # Authorization header value (passive_roaming mode).
+  #   #
+  #   # Example: "Bearer <token>"
+  #   authorization=""
+  #
+  #   # Gateway ID alias.
+  #   #
+  #   # When set, the gateway ID is replaced by this value before forwarding.
+  #   gateway_id="0102030405060708"
+  #
+  #   # Forward proprietary frames.
+  #   proprietary=false
+  #
+  #   # Disable forwarding the gateway stats.
+  #   disable_stats=false
+  #
+  #   # Remove the gateway location from the forwarded stats.
+  #   redact_location=false
+  #
+  #   # Remove the gateway meta-data and IP from the forwarded stats.
+  #   redact_meta_data=false
+  #
+  #   # Disable forwarding the gateway connection state.
+  #   disable_conn=false
+  #
+  #   # Payload marshaler.
+  #   #
+  #   # The marshaler used to encode the forwarded messages. When left blank,
+  #   # the integration marshaler is used. Valid options are protobuf, json,
+  #   # json_v4 and cbor.
+  #   marshaler="json"
+  #
+  #   # JoinEUI ranges (inclusive) of the join-requests to forward.
+  #   [[roaming.routes.join_eui_ranges]]
+  #   from="0000000000000000"
+  #   to="00000000000000ff"
+{{ range $i, $route := .Roaming.Routes }}
+  [[roaming.routes]]
+  name="{{ $route.Name }}"
+  mode="{{ $route.Mode }}"
+  net_id="{{ $route.NetID }}"
+  server="{{ $route.Server }}"
+  authorization="{{ $route.Authorization }}"
+  gateway_id="{{ $route.GatewayID }}"
+  proprietary={{ $route.Proprietary }}
+  disable_stats={{ $route.DisableStats }}
+  redact_location={{ $route.RedactLocation }}
+  redact_meta_data={{ $route.RedactMetaData }}
+  disable_conn={{ $route.DisableConn }}
+  marshaler="{{ $route.Marshaler }}"
+{{ range $j, $joinEUIRange := $route.JoinEUIRanges }}
+    [[roaming.routes.join_eui_ranges]]
+    from="{{ $joinEUIRange.From }}"
+    to="{{ $joinEUIRange.To }}"
+{{ end }}{{ end }}
+
+  # Passive-roaming settings.
+  #
+  # These apply to the routes using the passive_roaming mode. Downlinks are
+  # received by the management API as XmitDataReq on /api/v1/passive-roaming.
+  #
+  # Note: only stateless passive roaming is supported. Each uplink is
+  # forwarded as XmitDataReq, the PRStartReq / PRStopReq session flow is not
+  # implemented. The partner must accept XmitDataReq requests without a
+  # prior PRStartReq.
+  [roaming.passive_roaming]
+
+  # NetID of this network.
+  #
+  # This is used as SenderID of the XmitDataReq requests.
+  net_id="{{ .Roaming.PassiveRoaming.NetID }}"
+
+  # RF region.
+  #
+  # This is used to translate the data-rates of the uplinks and downlinks.
+  # Valid options are the LoRaWAN band names, e.g. EU868, US915 or AS923.
+  rf_region="{{ .Roaming.PassiveRoaming.RFRegion }}"
+
+  # Request timeout.
+  request_timeout="{{ .Roaming.PassiveRoaming.RequestTimeout }}"
+
+  # Max. in-flight requests.
+  #
+  # This limits the number of concurrent XmitDataReq requests (for all
+  # routes). Uplinks exceeding this limit are dropped.
+  max_in_flight_requests={{ .Roaming.PassiveRoaming.MaxInFlightRequests }}
+
+
+  # Roaming management API.
+  #
+  # The API exposes the roaming sessions and routes under /api/v1.
+  [roaming.api]
+
+  # ip:port to bind the API server to.
+  #
+  # When binding to a non-loopback address (e.g. 0.0.0.0:3000), either the
+  # bearer_token or the ca_cert (mTLS) must be set.
+  bind="{{ .Roaming.API.Bind }}"
+
+  # Bearer token.
+  #
+  # When set, requests must provide this token using the
+  # 'Authorization: Bearer <token>' header.
+  bearer_token="{{ .Roaming.API.BearerToken }}"
+
+  # TLS certificate and key files.
+  #
+  # When set, the API server will use TLS.
+  tls_cert="{{ .Roaming.API.TLSCert }}"
+  tls_key="{{ .Roaming.API.TLSKey }}"
+
+  # TLS CA certificate.
+  #
+  # When configured, the API server will validate that the client
+  # certificate has been signed by this CA certificate (mTLS). This requires
+  # the tls_cert and tls_key to be set.
+  ca_cert="{{ .Roaming.API.CACert }}"
+
+# Forwarder configuration.
+#
+# The forwarder queues the events and commands of each gateway in an ordered
+# queue. These queues are served by a bounded pool of workers, processing
+# the tasks of a gateway one at a time and in order. Downlinks and commands
+# are queued in a separate (priority) lane per gateway, which is processed
+# before the events of the gateway.
+[forwarder]
+
+  # Number of workers.
+  workers={{ .Forwarder.Workers }}
+
+  # Max. number of queued tasks per gateway.
+  #
+  # This must be greater than 0. The same limit applies to the priority lane
+  # of the downlinks and commands.
+  queue_size={{ .Forwarder.QueueSize }}
+
+  # Drop policy.
+  #
+  # This defines what happens when the queue of a gateway is full:
+  #   drop_oldest: drop the oldest queued task
+  #   drop_newest: drop the new task
+  #   block:       block until there is space in the queue (backpressure)
+  #
+  # The drop policy only applies to the events. When the priority lane is
+  # full, the oldest downlink or command is dropped, as receiving commands
+  # must never block.
+  drop_policy="{{ .Forwarder.DropPolicy }}"
+
+  # Drain timeout.
+  #
+  # On shutdown, the forwarder stops accepting new tasks and waits up to this
+  # duration for the queued tasks to be processed. Tasks that remain queued
+  # after this timeout are lost.
+  drain_timeout="{{ .Forwarder.DrainTimeout }}"
+
+
+  # Uplink de-duplication.
+  #
+  # When multiple gateways are connected to this bridge, the same uplink
+  # frame might be received by more than one gateway. When enabled, the
+  # copies of an uplink (identified by the hash of the PHYPayload) received
+  # within the de-duplication window are published as a single event.
+  [forwarder.deduplication]
+
+  # Enable de-duplication.
+  #
+  # When disabled, each gateway publishes its own up event.
+  enabled={{ .Forwarder.Deduplication.Enabled }}
+
+  # De-duplication window.
+  #
+  # The window starts when the first copy of an uplink has been received.
+  window="{{ .Forwarder.Deduplication.Window }}"
+
+  # De-duplication mode.
+  #
+  # Valid options are:
+  #   best_snr: publish the up event of the gateway with the best SNR
+  #   combine:  publish an upset event (UplinkFrameSet) containing the
+  #             RX meta-data of all gateways
+  #
+  # In both cases, the event is published for the gateway with the best SNR.
+  #
+  # Note: in combine mode, no up events are published. ChirpStack Network
+  # Server v3 does not subscribe to the upset event, so its uplinks are lost
+  # in this mode. Only use combine mode when the consumer handles the upset
+  # event.
+  mode="{{ .Forwarder.Deduplication.Mode }}"
+
+
+  # Downlink TX schedule.
+  #
+  # When enabled, the TX slots of the downlinks sent to each gateway are
+  # booked, based on the timing, context and time on air of the downlink.
+  # Downlink items that would collide with a booked slot are skipped, such
+  # that the gateway falls through to the next item. If all items collide,
+  # the downlink is not sent and a COLLISION_PACKET ack is published.
+  #
+  # Note that downlinks using the IMMEDIATELY timing are not checked.
+  [forwarder.tx_schedule]
+
+  # Enable the TX schedule.
+  enabled={{ .Forwarder.TXSchedule.Enabled }}
+
+
+  # Downlink duty-cycle and dwell-time.
+  #
+  # When enabled, the time on air of the downlinks sent to each gateway is
+  # accounted per sub-band. Downlink items that would exceed the duty-cycle
+  # limit of the sub-band within the window, or the dwell-time limit, are
+  # skipped, such that the gateway falls through to the next item. If all
+  # items are refused, the downlink is not sent and an ack is published with
+  # status COLLISION_PACKET, such that the network server may retry the
+  # downlink later (the v3 API does not define a duty-cycle status). The
+  # reason (duty_cycle or dwell_time) is logged.
+  [forwarder.duty_cycle]
+
+  # Enable duty-cycle enforcement.
+  enabled={{ .Forwarder.DutyCycle.Enabled }}
+
+  # Region.
+  #
+  # This defines the sub-bands and their duty-cycle limits. Valid options are
+  # the LoRaWAN band names, e.g. EU868, US915 or AS923. Currently, only EU868
+  # defines duty-cycle limits (ETSI EN 300 220). Other regions are only
+  # accepted when dwell_time_400ms is enabled, in which case only the
+  # dwell-time limit is enforced.
+  region="{{ .Forwarder.DutyCycle.Region }}"
+
+  # Duty-cycle window.
+  #
+  # The time on air is accounted within this sliding window.
+  window="{{ .Forwarder.DutyCycle.Window }}"
+
+  # Enforce the 400ms dwell-time limit.
+  #
+  # When set, downlink items with a time on air of more than 400ms are
+  # refused. This is required by some AS923 countries. This can only be
+  # enabled for the regions with a dwell-time limit (AS923, AS923-2, AS923-3,
+  # AS923-4 and AU915).
+  dwell_time_400ms={{ .Forwarder.DutyCycle.DwellTime400ms }}
 
 # Metrics configuration.
 [metrics]
@@ -18,6 +18,69 @@ import (
 var cfgFile string // config file
 var version string
 
+// integrationMQTTDefaults holds the default values of each [[integration.mqtt]]
+// block. These are applied per block by setIntegrationDefaults, as viper
+// defaults do not apply to the elements of an array of tables.
+var integrationMQTTDefaults = map[string]interface{}{
+	"auth.type": "generic",
+
+	"event_topic_template":   "gateway/{{ .GatewayID }}/event/{{ .EventType }}",
+	"state_topic_template":   "gateway/{{ .GatewayID }}/state/{{ .StateType }}",
+	"command_topic_template": "gateway/{{ .GatewayID }}/command/#",
+	"state_retained":         true,
+	"keep_alive":             30 * time.Second,
+	"max_reconnect_interval": time.Minute,
+	"max_token_wait":         5 * time.Second,
+
+	"ha.shared_subscription_group": "chirpstack-gateway-bridge",
+	"ha.instance_topic_template":   "bridge/{{ .InstanceID }}/gateway/{{ .GatewayID }}/command/{{ .CommandType }}",
+
+	"per_gateway.client_id_template": "{{ .GatewayID }}",
+
+	"bridge_state.state_topic_template": "bridge/{{ .InstanceID }}/state/{{ .StateType }}",
+	"bridge_state.heartbeat_interval":   30 * time.Second,
+	"bridge_state.grace_period":         time.Minute,
+
+	"auth.generic.servers":       []string{"tcp://127.0.0.1:1883"},
+	"auth.generic.clean_session": true,
+
+	"auth.gcp_cloud_iot_core.server":         "ssl://mqtt.googleapis.com:8883",
+	"auth.gcp_cloud_iot_core.jwt_expiration": time.Hour * 24,
+
+	"auth.azure_iot_hub.sas_token_expiration": 24 * time.Hour,
+}
+
+// integrationHTTPDefaults holds the default values of each [[integration.http]]
+// block.
+var integrationHTTPDefaults = map[string]interface{}{
+	"timeout":            5 * time.Second,
+	"max_retries":        3,
+	"retry_interval":     time.Second,
+	"max_retry_interval": 30 * time.Second,
+
+	"command.mode":         "server",
+	"command.bind":         "127.0.0.1:3002",
+	"command.poll_timeout": time.Minute,
+}
+
+// integrationKafkaDefaults holds the default values of each
+// [[integration.kafka]] block.
+var integrationKafkaDefaults = map[string]interface{}{
+	"brokers":              []string{"localhost:9092"},
+	"event_topic_template": "gateway.event.{{ .EventType }}",
+	"state_topic_template": "gateway.state.{{ .StateType }}",
+	"command_topic":        "gateway.command",
+	"batch_timeout":        10 * time.Millisecond,
+	"write_timeout":        5 * time.Second,
+}
+
+// integrationGRPCDefaults holds the default values of each [[integration.grpc]]
+// block.
+var integrationGRPCDefaults = map[string]interface{}{
+	"keep_alive":             30 * time.Second,
+	"max_reconnect_interval": time.Minute,
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "chirpstack-gateway-bridge",
 	Short: "abstracts the packet_forwarder protocol into Protobuf or JSON over MQTT",
@@ -55,23 +118,31 @@ func init() {
 	viper.SetDefault("backend.basic_station.frequency_max", 870000000)
 
 	viper.SetDefault("integration.marshaler", "protobuf")
-	viper.SetDefault("integration.mqtt.auth.type", "generic")
+	viper.SetDefault("integration.queue.max_size", 10000)
+	viper.SetDefault("integration.queue.max_age", 24*time.Hour)
+	viper.SetDefault("integration.queue.retry_interval", 5*time.Second)
 
-	viper.SetDefault("integration.mqtt.event_topic_template", "gateway/{{ .GatewayID }}/event/{{ .EventType }}")
-	viper.SetDefault("integration.mqtt.state_topic_template", "gateway/{{ .GatewayID }}/state/{{ .StateType }}")
-	viper.SetDefault("integration.mqtt.command_topic_template", "gateway/{{ .GatewayID }}/command/#")
-	viper.SetDefault("integration.mqtt.state_retained", true)
-	viper.SetDefault("integration.mqtt.keep_alive", 30*time.Second)
-	viper.SetDefault("integration.mqtt.max_reconnect_interval", time.Minute)
-	viper.SetDefault("integration.mqtt.max_token_wait", 5*time.Second)
+	viper.SetDefault("hooks.timeout", 100*time.Millisecond)
 
-	viper.SetDefault("integration.mqtt.auth.generic.servers", []string{"tcp://127.0.0.1:1883"})
-	viper.SetDefault("integration.mqtt.auth.generic.clean_session", true)
+	viper.SetDefault("forwarder.workers", 10)
+	viper.SetDefault("forwarder.queue_size", 100)
+	viper.SetDefault("forwarder.drop_policy", "drop_oldest")
+	viper.SetDefault("forwarder.drain_timeout", 5*time.Second)
+	viper.SetDefault("forwarder.deduplication.window", 200*time.Millisecond)
+	viper.SetDefault("forwarder.deduplication.mode", "best_snr")
+	viper.SetDefault("forwarder.duty_cycle.region", "EU868")
+	viper.SetDefault("forwarder.duty_cycle.window", time.Hour)
 
-	viper.SetDefault("integration.mqtt.auth.gcp_cloud_iot_core.server", "ssl://mqtt.googleapis.com:8883")
-	viper.SetDefault("integration.mqtt.auth.gcp_cloud_iot_core.jwt_expiration", time.Hour*24)
-
-	viper.SetDefault("integration.mqtt.auth.azure_iot_hub.sas_token_expiration", 24*time.Hour)
+	viper.SetDefault("roaming.publish_queue_size", 100)
+	viper.SetDefault("roaming.publish_queue_timeout", time.Second)
+	viper.SetDefault("roaming.max_token_wait", 5*time.Second)
+	viper.SetDefault("roaming.stats_interval", 30*time.Second)
+	viper.SetDefault("roaming.session_net_id", "000001")
+	viper.SetDefault("roaming.api.bind", "127.0.0.1:3000")
+	viper.SetDefault("roaming.passive_roaming.net_id", "000000")
+	viper.SetDefault("roaming.passive_roaming.rf_region", "EU868")
+	viper.SetDefault("roaming.passive_roaming.request_timeout", 5*time.Second)
+	viper.SetDefault("roaming.passive_roaming.max_in_flight_requests", 100)
 
 	viper.SetDefault("meta_data.dynamic.split_delimiter", "=")
 	viper.SetDefault("meta_data.dynamic.execution_interval", time.Minute)
@@ -130,6 +201,12 @@ func initConfig() {
 	}
 
 	viperBindEnvs(config.C)
+	setIntegrationDefaults("http", integrationHTTPDefaults, reflect.TypeOf(config.IntegrationHTTP{}), false)
+	setIntegrationDefaults("kafka", integrationKafkaDefaults, reflect.TypeOf(config.IntegrationKafka{}), false)
+	setIntegrationDefaults("grpc", integrationGRPCDefaults, reflect.TypeOf(config.IntegrationGRPC{}), false)
+	// For backwards compatibility, the MQTT integration is configured by
+	// default when no other integration has been configured.
+	setIntegrationDefaults("mqtt", integrationMQTTDefaults, reflect.TypeOf(config.IntegrationMQTT{}), !viper.IsSet("integration.http") && !viper.IsSet("integration.kafka") && !viper.IsSet("integration.grpc"))
 
 	if err := viper.Unmarshal(&config.C); err != nil {
 		log.WithError(err).Fatal("unmarshal config error")
@@ -142,9 +219,101 @@ func initConfig() {
 	}
 
 	// migrate server to servers
-	if config.C.Integration.MQTT.Auth.Generic.Server != "" {
-		config.C.Integration.MQTT.Auth.Generic.Servers = []string{config.C.Integration.MQTT.Auth.Generic.Server}
+	for i := range config.C.Integration.MQTT {
+		if config.C.Integration.MQTT[i].Auth.Generic.Server != "" {
+			config.C.Integration.MQTT[i].Auth.Generic.Servers = []string{config.C.Integration.MQTT[i].Auth.Generic.Server}
+		}
+	}
+}
+
+// setIntegrationDefaults normalizes the configuration of the given
+// integration type to a list of blocks and applies the default values to each
+// block. A single [integration.<type>] section is handled as a list with one
+// block and the INTEGRATION__<TYPE>__* env. variables are applied to the first
+// block. When the integration has not been configured and implicit is set,
+// a single block with the default values is configured.
+func setIntegrationDefaults(typ string, defaults map[string]interface{}, ift reflect.Type, implicit bool) {
+	key := "integration." + typ
+	var blocks []map[string]interface{}
+
+	switch v := viper.Get(key).(type) {
+	case nil:
+		if !implicit {
+			return
+		}
+		blocks = append(blocks, make(map[string]interface{}))
+	case map[string]interface{}:
+		blocks = append(blocks, v)
+	case []map[string]interface{}:
+		blocks = v
+	case []interface{}:
+		for _, b := range v {
+			m, ok := b.(map[string]interface{})
+			if !ok {
+				log.WithField("type", reflect.TypeOf(b)).Fatalf("invalid %s configuration", key)
+			}
+			blocks = append(blocks, m)
+		}
+	default:
+		log.WithField("type", reflect.TypeOf(v)).Fatalf("invalid %s configuration", key)
+	}
+
+	if len(blocks) != 0 {
+		setIntegrationEnvs(blocks[0], ift, []string{"integration", typ})
+	}
+
+	for _, b := range blocks {
+		for k, v := range defaults {
+			setMapValue(b, strings.Split(k, "."), v, false)
+		}
+	}
+
+	viper.Set(key, blocks)
+}
+
+// setIntegrationEnvs sets the values of the env. variables matching the
+// fields of the given type in the given block.
+func setIntegrationEnvs(block map[string]interface{}, ift reflect.Type, prefix []string, parts ...string) {
+	for i := 0; i < ift.NumField(); i++ {
+		t := ift.Field(i)
+		tv, ok := t.Tag.Lookup("mapstructure")
+		if !ok {
+			tv = strings.ToLower(t.Name)
+		}
+		if tv == "-" {
+			continue
+		}
+
+		if t.Type.Kind() == reflect.Struct {
+			setIntegrationEnvs(block, t.Type, prefix, append(parts, tv)...)
+			continue
+		}
+
+		key := append(append([]string{}, parts...), tv)
+		env := strings.ToUpper(strings.Join(append(append([]string{}, prefix...), key...), "__"))
+		if v, ok := os.LookupEnv(env); ok {
+			setMapValue(block, key, v, true)
+		}
+	}
+}
+
+// setMapValue sets the value of the given (nested) key. Existing values are
+// only replaced when overwrite is set.
+func setMapValue(m map[string]interface{}, key []string, value interface{}, overwrite bool) {
+	for _, k := range key[:len(key)-1] {
+		sub, ok := m[k].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[k] = sub
+		}
+		m = sub
+	}
+
+	k := key[len(key)-1]
+	if _, ok := m[k]; ok && !overwrite {
+		return
 	}
+	m[k] = value
 }
 
 func viperBindEnvs(iface interface{}, parts ...string) {
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"github.com/brocaar/chirpstack-gateway-bridge/api"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,11 +9,13 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/brocaar/chirpstack-gateway-bridge/api"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/commands"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/filters"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/forwarder"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/hooks"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metrics"
@@ -27,15 +28,17 @@ func run(cmd *cobra.Command, args []string) error {
 		setSyslog,
 		printStartMessage,
 		setupFilters,
+		setupHooks,
 		setupBackend,
 		setupIntegration,
 		setupForwarder,
 		setupMetrics,
 		setupMetaData,
 		setupCommands,
+		setupAPI,
 		startIntegration,
+		startAPI,
 		startBackend,
-		api.Launch(),
 	}
 
 	for _, t := range tasks {
@@ -49,7 +52,11 @@ func run(cmd *cobra.Command, args []string) error {
 	log.WithField("signal", <-sigChan).Info("signal received")
 	log.Warning("shutting down server")
 
+	if err := forwarder.Stop(); err != nil {
+		log.WithError(err).Error("stop forwarder error")
+	}
 	integration.GetIntegration().Stop()
+	api.Stop()
 
 	return nil
 }
@@ -109,6 +116,13 @@ func setupFilters() error {
 	return nil
 }
 
+func setupHooks() error {
+	if err := hooks.Setup(config.C); err != nil {
+		return errors.Wrap(err, "setup hooks error")
+	}
+	return nil
+}
+
 func setupCommands() error {
 	if err := commands.Setup(config.C); err != nil {
 		return errors.Wrap(err, "setup commands error")
@@ -116,6 +130,13 @@ func setupCommands() error {
 	return nil
 }
 
+func setupAPI() error {
+	if err := api.Setup(config.C); err != nil {
+		return errors.Wrap(err, "setup api error")
+	}
+	return nil
+}
+
 func startIntegration() error {
 	if err := integration.GetIntegration().Start(); err != nil {
 		return errors.Wrap(err, "start integration error")
@@ -123,6 +144,13 @@ func startIntegration() error {
 	return nil
 }
 
+func startAPI() error {
+	if err := api.Start(); err != nil {
+		return errors.Wrap(err, "start api error")
+	}
+	return nil
+}
+
 func startBackend() error {
 	if err := backend.GetBackend().Start(); err != nil {
 		return errors.Wrap(err, "start backend error")
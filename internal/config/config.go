@@ -16,6 +16,11 @@ type Config struct {
 		JoinEUIs [][2]string `mapstructure:"join_euis"`
 	} `mapstructure:"filters"`
 
+	Hooks struct {
+		Scripts []string      `mapstructure:"scripts"`
+		Timeout time.Duration `mapstructure:"timeout"`
+	} `mapstructure:"hooks"`
+
 	Backend struct {
 		Type string `mapstructure:"type"`
 
@@ -56,55 +61,69 @@ type Config struct {
 	Integration struct {
 		Marshaler string `mapstructure:"marshaler"`
 
-		MQTT struct {
-			EventTopicTemplate      string        `mapstructure:"event_topic_template"`
-			CommandTopicTemplate    string        `mapstructure:"command_topic_template"`
-			StateTopicTemplate      string        `mapstructure:"state_topic_template"`
-			StateRetained           bool          `mapstructure:"state_retained"`
-			KeepAlive               time.Duration `mapstructure:"keep_alive"`
-			MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
-			TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
-			MaxTokenWait            time.Duration `mapstructure:"max_token_wait"`
-
-			Auth struct {
-				Type string `mapstructure:"type"`
-
-				Generic struct {
-					Server       string   `mapstructure:"server"`
-					Servers      []string `mapstructure:"servers"`
-					Username     string   `mapstructure:"username"`
-					Password     string   `mapstrucure:"password"`
-					CACert       string   `mapstructure:"ca_cert"`
-					TLSCert      string   `mapstructure:"tls_cert"`
-					TLSKey       string   `mapstructure:"tls_key"`
-					QOS          uint8    `mapstructure:"qos"`
-					CleanSession bool     `mapstructure:"clean_session"`
-					ClientID     string   `mapstructure:"client_id"`
-				} `mapstructure:"generic"`
-
-				GCPCloudIoTCore struct {
-					Server        string        `mapstructure:"server"`
-					DeviceID      string        `mapstructure:"device_id"`
-					ProjectID     string        `mapstructure:"project_id"`
-					CloudRegion   string        `mapstructure:"cloud_region"`
-					RegistryID    string        `mapstructure:"registry_id"`
-					JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
-					JWTKeyFile    string        `mapstructure:"jwt_key_file"`
-				} `mapstructure:"gcp_cloud_iot_core"`
-
-				AzureIoTHub struct {
-					DeviceConnectionString string        `mapstructure:"device_connection_string"`
-					DeviceID               string        `mapstructure:"device_id"`
-					Hostname               string        `mapstructure:"hostname"`
-					DeviceKey              string        `mapstructure:"-"`
-					SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
-					TLSCert                string        `mapstructure:"tls_cert"`
-					TLSKey                 string        `mapstructure:"tls_key"`
-				} `mapstructure:"azure_iot_hub"`
-			} `mapstructure:"auth"`
-		} `mapstructure:"mqtt"`
+		MQTT  []IntegrationMQTT  `mapstructure:"mqtt"`
+		HTTP  []IntegrationHTTP  `mapstructure:"http"`
+		Kafka []IntegrationKafka `mapstructure:"kafka"`
+		GRPC  []IntegrationGRPC  `mapstructure:"grpc"`
+
+		Queue struct {
+			Path          string        `mapstructure:"path"`
+			MaxSize       int           `mapstructure:"max_size"`
+			MaxAge        time.Duration `mapstructure:"max_age"`
+			RetryInterval time.Duration `mapstructure:"retry_interval"`
+		} `mapstructure:"queue"`
 	} `mapstructure:"integration"`
 
+	Forwarder struct {
+		Workers      int           `mapstructure:"workers"`
+		QueueSize    int           `mapstructure:"queue_size"`
+		DropPolicy   string        `mapstructure:"drop_policy"`
+		DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+		Deduplication struct {
+			Enabled bool          `mapstructure:"enabled"`
+			Window  time.Duration `mapstructure:"window"`
+			Mode    string        `mapstructure:"mode"`
+		} `mapstructure:"deduplication"`
+
+		TXSchedule struct {
+			Enabled bool `mapstructure:"enabled"`
+		} `mapstructure:"tx_schedule"`
+
+		DutyCycle struct {
+			Enabled        bool          `mapstructure:"enabled"`
+			Region         string        `mapstructure:"region"`
+			Window         time.Duration `mapstructure:"window"`
+			DwellTime400ms bool          `mapstructure:"dwell_time_400ms"`
+		} `mapstructure:"duty_cycle"`
+	} `mapstructure:"forwarder"`
+
+	Roaming struct {
+		Server              string         `mapstructure:"server"`
+		PublishQueueSize    int            `mapstructure:"publish_queue_size"`
+		PublishQueueTimeout time.Duration  `mapstructure:"publish_queue_timeout"`
+		MaxTokenWait        time.Duration  `mapstructure:"max_token_wait"`
+		StoragePath         string         `mapstructure:"storage_path"`
+		SessionNetID        string         `mapstructure:"session_net_id"`
+		StatsInterval       time.Duration  `mapstructure:"stats_interval"`
+		Routes              []RoamingRoute `mapstructure:"routes"`
+
+		PassiveRoaming struct {
+			NetID               string        `mapstructure:"net_id"`
+			RFRegion            string        `mapstructure:"rf_region"`
+			RequestTimeout      time.Duration `mapstructure:"request_timeout"`
+			MaxInFlightRequests int           `mapstructure:"max_in_flight_requests"`
+		} `mapstructure:"passive_roaming"`
+
+		API struct {
+			Bind        string `mapstructure:"bind"`
+			BearerToken string `mapstructure:"bearer_token"`
+			TLSCert     string `mapstructure:"tls_cert"`
+			TLSKey      string `mapstructure:"tls_key"`
+			CACert      string `mapstructure:"ca_cert"`
+		} `mapstructure:"api"`
+	} `mapstructure:"roaming"`
+
 	Metrics struct {
 		Prometheus struct {
 			EndpointEnabled bool   `mapstructure:"endpoint_enabled"`
@@ -154,5 +173,181 @@ type BasicStationConcentratorFSK struct {
 	Frequency uint32 `mapstructure:"frequency"`
 }
 
+// IntegrationMQTT holds the configuration of a MQTT integration.
+type IntegrationMQTT struct {
+	Name      string `mapstructure:"name"`
+	Marshaler string `mapstructure:"marshaler"`
+
+	EventTopicTemplate      string        `mapstructure:"event_topic_template"`
+	CommandTopicTemplate    string        `mapstructure:"command_topic_template"`
+	StateTopicTemplate      string        `mapstructure:"state_topic_template"`
+	StateRetained           bool          `mapstructure:"state_retained"`
+	KeepAlive               time.Duration `mapstructure:"keep_alive"`
+	MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
+	TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
+	MaxTokenWait            time.Duration `mapstructure:"max_token_wait"`
+	InstanceID              string        `mapstructure:"instance_id"`
+
+	Events        map[string]IntegrationMQTTPublish   `mapstructure:"events"`
+	States        map[string]IntegrationMQTTPublish   `mapstructure:"states"`
+	Subscriptions map[string]IntegrationMQTTSubscribe `mapstructure:"subscriptions"`
+
+	HA struct {
+		Enabled                 bool   `mapstructure:"enabled"`
+		SharedSubscriptionGroup string `mapstructure:"shared_subscription_group"`
+		InstanceTopicTemplate   string `mapstructure:"instance_topic_template"`
+	} `mapstructure:"ha"`
+
+	PerGateway struct {
+		Enabled          bool   `mapstructure:"enabled"`
+		UsernameTemplate string `mapstructure:"username_template"`
+		PasswordTemplate string `mapstructure:"password_template"`
+		ClientIDTemplate string `mapstructure:"client_id_template"`
+		TLSCertTemplate  string `mapstructure:"tls_cert_template"`
+		TLSKeyTemplate   string `mapstructure:"tls_key_template"`
+		CredentialsFile  string `mapstructure:"credentials_file"`
+	} `mapstructure:"per_gateway"`
+
+	BridgeState struct {
+		Enabled            bool          `mapstructure:"enabled"`
+		StateTopicTemplate string        `mapstructure:"state_topic_template"`
+		HeartbeatInterval  time.Duration `mapstructure:"heartbeat_interval"`
+		GracePeriod        time.Duration `mapstructure:"grace_period"`
+	} `mapstructure:"bridge_state"`
+
+	Auth struct {
+		Type string `mapstructure:"type"`
+
+		Generic struct {
+			Server       string   `mapstructure:"server"`
+			Servers      []string `mapstructure:"servers"`
+			Username     string   `mapstructure:"username"`
+			Password     string   `mapstrucure:"password"`
+			CACert       string   `mapstructure:"ca_cert"`
+			TLSCert      string   `mapstructure:"tls_cert"`
+			TLSKey       string   `mapstructure:"tls_key"`
+			QOS          uint8    `mapstructure:"qos"`
+			CleanSession bool     `mapstructure:"clean_session"`
+			ClientID     string   `mapstructure:"client_id"`
+		} `mapstructure:"generic"`
+
+		GCPCloudIoTCore struct {
+			Server        string        `mapstructure:"server"`
+			DeviceID      string        `mapstructure:"device_id"`
+			ProjectID     string        `mapstructure:"project_id"`
+			CloudRegion   string        `mapstructure:"cloud_region"`
+			RegistryID    string        `mapstructure:"registry_id"`
+			JWTExpiration time.Duration `mapstructure:"jwt_expiration"`
+			JWTKeyFile    string        `mapstructure:"jwt_key_file"`
+		} `mapstructure:"gcp_cloud_iot_core"`
+
+		AzureIoTHub struct {
+			DeviceConnectionString string        `mapstructure:"device_connection_string"`
+			DeviceID               string        `mapstructure:"device_id"`
+			Hostname               string        `mapstructure:"hostname"`
+			DeviceKey              string        `mapstructure:"-"`
+			SASTokenExpiration     time.Duration `mapstructure:"sas_token_expiration"`
+			TLSCert                string        `mapstructure:"tls_cert"`
+			TLSKey                 string        `mapstructure:"tls_key"`
+		} `mapstructure:"azure_iot_hub"`
+	} `mapstructure:"auth"`
+}
+
+// IntegrationMQTTPublish holds the QoS and retain flag of a MQTT event or
+// state type.
+type IntegrationMQTTPublish struct {
+	QOS      uint8 `mapstructure:"qos"`
+	Retained bool  `mapstructure:"retained"`
+}
+
+// IntegrationMQTTSubscribe holds the QoS of a MQTT subscription type.
+type IntegrationMQTTSubscribe struct {
+	QOS uint8 `mapstructure:"qos"`
+}
+
+// IntegrationHTTP holds the configuration of a HTTP integration.
+type IntegrationHTTP struct {
+	Name      string `mapstructure:"name"`
+	Marshaler string `mapstructure:"marshaler"`
+
+	EventURLTemplate string            `mapstructure:"event_url_template"`
+	StateURLTemplate string            `mapstructure:"state_url_template"`
+	Headers          map[string]string `mapstructure:"headers"`
+	Timeout          time.Duration     `mapstructure:"timeout"`
+	MaxRetries       int               `mapstructure:"max_retries"`
+	RetryInterval    time.Duration     `mapstructure:"retry_interval"`
+	MaxRetryInterval time.Duration     `mapstructure:"max_retry_interval"`
+
+	Command struct {
+		Mode            string        `mapstructure:"mode"`
+		Bind            string        `mapstructure:"bind"`
+		TLSCert         string        `mapstructure:"tls_cert"`
+		TLSKey          string        `mapstructure:"tls_key"`
+		CACert          string        `mapstructure:"ca_cert"`
+		BearerToken     string        `mapstructure:"bearer_token"`
+		PollURLTemplate string        `mapstructure:"poll_url_template"`
+		PollTimeout     time.Duration `mapstructure:"poll_timeout"`
+	} `mapstructure:"command"`
+}
+
+// IntegrationKafka holds the configuration of a Kafka integration.
+type IntegrationKafka struct {
+	Name      string `mapstructure:"name"`
+	Marshaler string `mapstructure:"marshaler"`
+
+	Brokers            []string      `mapstructure:"brokers"`
+	EventTopicTemplate string        `mapstructure:"event_topic_template"`
+	StateTopicTemplate string        `mapstructure:"state_topic_template"`
+	CommandTopic       string        `mapstructure:"command_topic"`
+	GroupID            string        `mapstructure:"group_id"`
+	BatchTimeout       time.Duration `mapstructure:"batch_timeout"`
+	WriteTimeout       time.Duration `mapstructure:"write_timeout"`
+
+	TLS      bool   `mapstructure:"tls"`
+	CACert   string `mapstructure:"ca_cert"`
+	TLSCert  string `mapstructure:"tls_cert"`
+	TLSKey   string `mapstructure:"tls_key"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// IntegrationGRPC holds the configuration of a gRPC integration.
+type IntegrationGRPC struct {
+	Name string `mapstructure:"name"`
+
+	Server                  string        `mapstructure:"server"`
+	KeepAlive               time.Duration `mapstructure:"keep_alive"`
+	MaxReconnectInterval    time.Duration `mapstructure:"max_reconnect_interval"`
+	TerminateOnConnectError bool          `mapstructure:"terminate_on_connect_error"`
+
+	TLS     bool   `mapstructure:"tls"`
+	CACert  string `mapstructure:"ca_cert"`
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+}
+
+// RoamingRoute holds the configuration for a roaming route.
+type RoamingRoute struct {
+	Name           string                `mapstructure:"name"`
+	Mode           string                `mapstructure:"mode"`
+	NetID          string                `mapstructure:"net_id"`
+	Server         string                `mapstructure:"server"`
+	Authorization  string                `mapstructure:"authorization"`
+	GatewayID      string                `mapstructure:"gateway_id"`
+	JoinEUIRanges  []RoamingJoinEUIRange `mapstructure:"join_eui_ranges"`
+	Proprietary    bool                  `mapstructure:"proprietary"`
+	DisableStats   bool                  `mapstructure:"disable_stats"`
+	RedactLocation bool                  `mapstructure:"redact_location"`
+	RedactMetaData bool                  `mapstructure:"redact_meta_data"`
+	DisableConn    bool                  `mapstructure:"disable_conn"`
+	Marshaler      string                `mapstructure:"marshaler"`
+}
+
+// RoamingJoinEUIRange holds an (inclusive) JoinEUI range of a roaming route.
+type RoamingJoinEUIRange struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
 // C holds the global configuration.
 var C Config
@@ -0,0 +1,115 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/lorawan"
+)
+
+// De-duplication modes.
+const (
+	DeduplicationModeCombine = "combine"
+	DeduplicationModeBestSNR = "best_snr"
+)
+
+// deduplicationHandler handles the de-duplicated uplink event.
+type deduplicationHandler func(gatewayID lorawan.EUI64, event string, uplinkID uuid.UUID, v proto.Message)
+
+// deduplicator collects the copies of the same uplink frame, received by
+// multiple gateways, within the de-duplication window. After the window
+// has passed, a single event is emitted.
+type deduplicator struct {
+	mux     sync.Mutex
+	window  time.Duration
+	mode    string
+	handler deduplicationHandler
+	frames  map[[sha256.Size]byte][]gw.UplinkFrame
+}
+
+// newDeduplicator creates a new deduplicator.
+func newDeduplicator(window time.Duration, mode string, handler deduplicationHandler) (*deduplicator, error) {
+	switch mode {
+	case DeduplicationModeCombine, DeduplicationModeBestSNR:
+	default:
+		return nil, errors.Errorf("unknown deduplication mode: %s", mode)
+	}
+
+	if window <= 0 {
+		return nil, errors.New("window must be greater than zero")
+	}
+
+	return &deduplicator{
+		window:  window,
+		mode:    mode,
+		handler: handler,
+		frames:  make(map[[sha256.Size]byte][]gw.UplinkFrame),
+	}, nil
+}
+
+// add adds the given uplink frame. The first copy of a frame starts the
+// de-duplication window.
+func (d *deduplicator) add(pl gw.UplinkFrame) {
+	key := sha256.Sum256(pl.PhyPayload)
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	frames, ok := d.frames[key]
+	d.frames[key] = append(frames, pl)
+
+	if ok {
+		deduplicationCounter().Inc()
+		return
+	}
+
+	time.AfterFunc(d.window, func() {
+		d.flush(key)
+	})
+}
+
+// flush emits the event for the frames collected under the given key.
+func (d *deduplicator) flush(key [sha256.Size]byte) {
+	d.mux.Lock()
+	frames := d.frames[key]
+	delete(d.frames, key)
+	d.mux.Unlock()
+
+	if len(frames) == 0 {
+		return
+	}
+
+	// the event is published for the gateway with the best SNR
+	best := frames[0]
+	for _, f := range frames[1:] {
+		if f.GetRxInfo().GetLoraSnr() > best.GetRxInfo().GetLoraSnr() {
+			best = f
+		}
+	}
+
+	var gatewayID lorawan.EUI64
+	var uplinkID uuid.UUID
+	copy(gatewayID[:], best.GetRxInfo().GatewayId)
+	copy(uplinkID[:], best.GetRxInfo().UplinkId)
+
+	switch d.mode {
+	case DeduplicationModeBestSNR:
+		d.handler(gatewayID, integration.EventUp, uplinkID, &best)
+	case DeduplicationModeCombine:
+		set := gw.UplinkFrameSet{
+			PhyPayload: best.PhyPayload,
+			TxInfo:     best.TxInfo,
+		}
+		for i := range frames {
+			set.RxInfo = append(set.RxInfo, frames[i].RxInfo)
+		}
+		d.handler(gatewayID, integration.EventUpSet, uplinkID, &set)
+	}
+}
@@ -0,0 +1,146 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
+	"github.com/brocaar/lorawan"
+)
+
+type dedupEvent struct {
+	gatewayID lorawan.EUI64
+	event     string
+	uplinkID  uuid.UUID
+	v         proto.Message
+}
+
+func TestDeduplicator(t *testing.T) {
+	frames := []gw.UplinkFrame{
+		{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo:     &gw.UplinkTXInfo{Frequency: 868100000},
+			RxInfo: &gw.UplinkRXInfo{
+				GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				UplinkId:  []byte{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+				LoraSnr:   1,
+			},
+		},
+		{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo:     &gw.UplinkTXInfo{Frequency: 868100000},
+			RxInfo: &gw.UplinkRXInfo{
+				GatewayId: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+				UplinkId:  []byte{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+				LoraSnr:   5.5,
+			},
+		},
+		{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo:     &gw.UplinkTXInfo{Frequency: 868100000},
+			RxInfo: &gw.UplinkRXInfo{
+				GatewayId: []byte{3, 3, 3, 3, 3, 3, 3, 3},
+				UplinkId:  []byte{3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3},
+				LoraSnr:   -2,
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		expected dedupEvent
+	}{
+		{
+			name: "best snr",
+			mode: DeduplicationModeBestSNR,
+			expected: dedupEvent{
+				gatewayID: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+				event:     integration.EventUp,
+				uplinkID:  uuid.UUID{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+				v:         &frames[1],
+			},
+		},
+		{
+			name: "combine",
+			mode: DeduplicationModeCombine,
+			expected: dedupEvent{
+				gatewayID: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+				event:     integration.EventUpSet,
+				uplinkID:  uuid.UUID{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2},
+				v: &gw.UplinkFrameSet{
+					PhyPayload: []byte{1, 2, 3},
+					TxInfo:     &gw.UplinkTXInfo{Frequency: 868100000},
+					RxInfo: []*gw.UplinkRXInfo{
+						frames[0].RxInfo,
+						frames[1].RxInfo,
+						frames[2].RxInfo,
+					},
+				},
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			eventChan := make(chan dedupEvent, 10)
+			d, err := newDeduplicator(50*time.Millisecond, tst.mode, func(gatewayID lorawan.EUI64, event string, uplinkID uuid.UUID, v proto.Message) {
+				eventChan <- dedupEvent{gatewayID, event, uplinkID, v}
+			})
+			assert.NoError(err)
+
+			for _, f := range frames {
+				d.add(f)
+			}
+
+			// a different frame is not de-duplicated with the above frames
+			d.add(gw.UplinkFrame{
+				PhyPayload: []byte{3, 2, 1},
+				RxInfo: &gw.UplinkRXInfo{
+					GatewayId: []byte{1, 1, 1, 1, 1, 1, 1, 1},
+				},
+			})
+
+			var events []dedupEvent
+			for i := 0; i < 2; i++ {
+				select {
+				case e := <-eventChan:
+					events = append(events, e)
+				case <-time.After(time.Second):
+					t.Fatal("expected event")
+				}
+			}
+
+			var e dedupEvent
+			for _, ev := range events {
+				if ev.uplinkID != uuid.Nil {
+					e = ev
+				}
+			}
+
+			assert.Equal(tst.expected.gatewayID, e.gatewayID)
+			assert.Equal(tst.expected.event, e.event)
+			assert.Equal(tst.expected.uplinkID, e.uplinkID)
+			assert.True(proto.Equal(tst.expected.v, e.v))
+
+			select {
+			case e := <-eventChan:
+				t.Fatalf("unexpected event: %+v", e)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+
+	t.Run("invalid mode", func(t *testing.T) {
+		assert := require.New(t)
+		_, err := newDeduplicator(time.Second, "foo", nil)
+		assert.Error(err)
+	})
+}
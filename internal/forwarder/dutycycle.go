@@ -0,0 +1,208 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/band"
+)
+
+// txAckStatusDutyCycleOverflow is the status of downlink items that would
+// exceed the duty-cycle or dwell-time limits. The v3 API does not define a
+// duty-cycle status. COLLISION_PACKET (the gateway can not transmit at this
+// moment) signals the network server that the downlink can be retried later,
+// unlike e.g. TX_FREQ which signals that the frequency is not supported. The
+// reason is logged.
+const txAckStatusDutyCycleOverflow = gw.TxAckStatus_COLLISION_PACKET
+
+// Duty-cycle overflow reasons.
+const (
+	overflowReasonDutyCycle = "duty_cycle"
+	overflowReasonDwellTime = "dwell_time"
+)
+
+// maxDwellTime is the max. time on air of a single transmission, when the
+// 400ms dwell-time limit is enabled (e.g. AS923).
+const maxDwellTime = 400 * time.Millisecond
+
+// dwellTimeRegions contains the regions with a 400ms dwell-time limit, which
+// applies depending on the country (AS923) or to the uplink channels
+// (AU915).
+var dwellTimeRegions = map[band.Name]struct{}{
+	band.AS923:   {},
+	band.AS923_2: {},
+	band.AS923_3: {},
+	band.AS923_4: {},
+	band.AU915:   {},
+}
+
+// subBand defines a (regulatory) sub-band with its duty-cycle limit.
+type subBand struct {
+	name         string
+	minFrequency uint32 // inclusive, in Hz
+	maxFrequency uint32 // exclusive, in Hz
+	dutyCycle    float64
+}
+
+// subBands contains the sub-bands with a duty-cycle limit per region. The
+// lorawan/band package does not define the duty-cycle limits, regions that
+// are not in this table only support the dwell-time limit.
+var subBands = map[band.Name][]subBand{
+	band.EU868: {
+		{"g", 863000000, 868000000, 0.01},
+		{"g1", 868000000, 868600000, 0.01},
+		{"g2", 868700000, 869200000, 0.001},
+		{"g3", 869400000, 869650000, 0.1},
+		{"g4", 869700000, 870000000, 0.01},
+	},
+}
+
+// txRecord holds a transmission accounted to a sub-band.
+type txRecord struct {
+	subBand string
+	time    time.Time
+	airtime time.Duration
+}
+
+// dutyCycleAccountant keeps track of the time on air per gateway and
+// sub-band within a sliding window. It is not safe for concurrent use, the
+// txScheduler guards it using its own lock.
+type dutyCycleAccountant struct {
+	window       time.Duration
+	subBands     []subBand
+	maxDwellTime time.Duration
+	records      map[lorawan.EUI64][]*txRecord
+}
+
+// newDutyCycleAccountant creates a new dutyCycleAccountant for the given
+// region.
+func newDutyCycleAccountant(region string, window time.Duration, dwellTime400ms bool) (*dutyCycleAccountant, error) {
+	if _, err := band.GetConfig(band.Name(region), false, lorawan.DwellTimeNoLimit); err != nil {
+		return nil, errors.Wrap(err, "get band config error")
+	}
+
+	if window <= 0 {
+		return nil, errors.New("window must be greater than zero")
+	}
+
+	if _, ok := dwellTimeRegions[band.Name(region)]; dwellTime400ms && !ok {
+		return nil, errors.Errorf("no dwell-time limit defined for region %s", region)
+	}
+
+	sb, ok := subBands[band.Name(region)]
+	if !ok {
+		if !dwellTime400ms {
+			return nil, errors.Errorf("no duty-cycle limits defined for region %s", region)
+		}
+
+		log.WithField("region", region).Warning("forwarder: no duty-cycle limits defined for region, only the dwell-time limit is enforced")
+	}
+
+	d := dutyCycleAccountant{
+		window:   window,
+		subBands: sb,
+		records:  make(map[lorawan.EUI64][]*txRecord),
+	}
+
+	if dwellTime400ms {
+		d.maxDwellTime = maxDwellTime
+	}
+
+	return &d, nil
+}
+
+// check returns the overflow reason when a transmission with the given time
+// on air would exceed the limits. It returns an empty string when the
+// transmission is allowed.
+func (d *dutyCycleAccountant) check(gatewayID lorawan.EUI64, frequency uint32, toa time.Duration) string {
+	if d.maxDwellTime != 0 && toa > d.maxDwellTime {
+		return overflowReasonDwellTime
+	}
+
+	sb, ok := d.subBand(frequency)
+	if !ok {
+		return ""
+	}
+
+	if d.usage(gatewayID, sb.name)+toa > time.Duration(float64(d.window)*sb.dutyCycle) {
+		return overflowReasonDutyCycle
+	}
+
+	return ""
+}
+
+// record accounts the given transmission. It returns nil when the frequency
+// is not within a sub-band with a duty-cycle limit.
+func (d *dutyCycleAccountant) record(gatewayID lorawan.EUI64, frequency uint32, toa time.Duration) *txRecord {
+	sb, ok := d.subBand(frequency)
+	if !ok {
+		return nil
+	}
+
+	r := txRecord{
+		subBand: sb.name,
+		time:    time.Now(),
+		airtime: toa,
+	}
+	d.records[gatewayID] = append(d.records[gatewayID], &r)
+
+	return &r
+}
+
+// remove removes the given record, e.g. when the transmission failed.
+func (d *dutyCycleAccountant) remove(gatewayID lorawan.EUI64, r *txRecord) {
+	records := d.records[gatewayID]
+	for i := range records {
+		if records[i] == r {
+			d.records[gatewayID] = append(records[:i], records[i+1:]...)
+			return
+		}
+	}
+}
+
+// cleanup removes the records that are outside the window.
+func (d *dutyCycleAccountant) cleanup() {
+	since := time.Now().Add(-d.window)
+
+	for gatewayID, records := range d.records {
+		var keep []*txRecord
+		for _, r := range records {
+			if r.time.After(since) {
+				keep = append(keep, r)
+			}
+		}
+
+		if len(keep) == 0 {
+			delete(d.records, gatewayID)
+		} else {
+			d.records[gatewayID] = keep
+		}
+	}
+}
+
+// usage returns the time on air of the gateway within the window for the
+// given sub-band.
+func (d *dutyCycleAccountant) usage(gatewayID lorawan.EUI64, subBand string) time.Duration {
+	since := time.Now().Add(-d.window)
+
+	var usage time.Duration
+	for _, r := range d.records[gatewayID] {
+		if r.subBand == subBand && r.time.After(since) {
+			usage += r.airtime
+		}
+	}
+	return usage
+}
+
+func (d *dutyCycleAccountant) subBand(frequency uint32) (subBand, bool) {
+	for _, sb := range d.subBands {
+		if frequency >= sb.minFrequency && frequency < sb.maxFrequency {
+			return sb, true
+		}
+	}
+	return subBand{}, false
+}
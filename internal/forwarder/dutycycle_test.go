@@ -0,0 +1,175 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+func TestNewDutyCycleAccountant(t *testing.T) {
+	tests := []struct {
+		name      string
+		region    string
+		window    time.Duration
+		dwellTime bool
+		err       bool
+	}{
+		{"EU868", "EU868", time.Hour, false, false},
+		{"AS923 with dwell-time", "AS923", time.Hour, true, false},
+		{"AS923 without dwell-time", "AS923", time.Hour, false, true},
+		{"AU915 with dwell-time", "AU915", time.Hour, true, false},
+		{"EU868 with dwell-time", "EU868", time.Hour, true, true},
+		{"US915 with dwell-time", "US915", time.Hour, true, true},
+		{"US915 without duty-cycle table", "US915", time.Hour, false, true},
+		{"invalid region", "foo", time.Hour, false, true},
+		{"invalid window", "EU868", 0, false, true},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			_, err := newDutyCycleAccountant(tst.region, tst.window, tst.dwellTime)
+			if tst.err {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func TestDutyCycleAccountant(t *testing.T) {
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	t.Run("duty-cycle", func(t *testing.T) {
+		assert := require.New(t)
+
+		// g1 (1%) allows 100ms within the window, g2 (0.1%) allows 10ms
+		d, err := newDutyCycleAccountant("EU868", 10*time.Second, false)
+		assert.NoError(err)
+
+		assert.Equal("", d.check(gatewayID, 868100000, 60*time.Millisecond))
+		r := d.record(gatewayID, 868100000, 60*time.Millisecond)
+		assert.NotNil(r)
+
+		assert.Equal(overflowReasonDutyCycle, d.check(gatewayID, 868300000, 60*time.Millisecond))
+		assert.Equal("", d.check(gatewayID, 868300000, 40*time.Millisecond))
+		assert.Equal(overflowReasonDutyCycle, d.check(gatewayID, 868800000, 20*time.Millisecond))
+		assert.Equal("", d.check(gatewayID, 869525000, 60*time.Millisecond))
+		assert.Equal("", d.check(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, 868100000, 60*time.Millisecond))
+
+		// the gap between g2 and g3 has no duty-cycle limit
+		assert.Nil(d.record(gatewayID, 869300000, time.Second))
+
+		d.remove(gatewayID, r)
+		assert.Equal("", d.check(gatewayID, 868300000, 60*time.Millisecond))
+	})
+
+	t.Run("window", func(t *testing.T) {
+		assert := require.New(t)
+
+		d, err := newDutyCycleAccountant("EU868", 10*time.Second, false)
+		assert.NoError(err)
+
+		r := d.record(gatewayID, 868100000, 100*time.Millisecond)
+		assert.Equal(overflowReasonDutyCycle, d.check(gatewayID, 868100000, time.Millisecond))
+
+		r.time = time.Now().Add(-11 * time.Second)
+		assert.Equal("", d.check(gatewayID, 868100000, time.Millisecond))
+
+		d.cleanup()
+		assert.Len(d.records, 0)
+	})
+
+	t.Run("dwell-time", func(t *testing.T) {
+		assert := require.New(t)
+
+		d, err := newDutyCycleAccountant("AS923", time.Hour, true)
+		assert.NoError(err)
+
+		assert.Equal("", d.check(gatewayID, 923200000, 400*time.Millisecond))
+		assert.Equal(overflowReasonDwellTime, d.check(gatewayID, 923200000, 401*time.Millisecond))
+
+		d, err = newDutyCycleAccountant("EU868", time.Hour, false)
+		assert.NoError(err)
+		assert.Equal("", d.check(gatewayID, 869525000, time.Second))
+	})
+}
+
+func TestTXSchedulerDutyCycle(t *testing.T) {
+	assert := require.New(t)
+	gatewayID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// g1 (1%) allows 100ms within the window
+	d, err := newDutyCycleAccountant("EU868", 10*time.Second, false)
+	assert.NoError(err)
+	s := newTXScheduler(false, d)
+
+	// EU868 has no dwell-time limit, it is set to cover both overflow reasons
+	d.maxDwellTime = maxDwellTime
+
+	rx1 := delayItem([]byte{0, 0, 0, 1}, time.Second, 7)
+	rx1.TxInfo.Frequency = 868100000
+	rx2 := delayItem([]byte{0, 0, 0, 1}, 2*time.Second, 9)
+	rx2.TxInfo.Frequency = 869525000
+	rx2SF12 := delayItem([]byte{0, 0, 0, 1}, 2*time.Second, 12)
+	rx2SF12.TxInfo.Frequency = 869525000
+
+	// 61.7ms of g1 is used
+	out, ack := s.schedule(gw.DownlinkFrame{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{1},
+		Items:      []*gw.DownlinkFrameItem{rx1, rx2},
+	})
+	assert.Nil(ack)
+	assert.Len(out.Items, 2)
+
+	// rx1 would exceed the g1 duty-cycle, rx2 is used instead
+	out, ack = s.schedule(gw.DownlinkFrame{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{2},
+		Items:      []*gw.DownlinkFrameItem{rx1, rx2},
+	})
+	assert.Nil(ack)
+	assert.Equal([]*gw.DownlinkFrameItem{rx2}, out.Items)
+
+	txAck := gw.DownlinkTXAck{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{2},
+		Items:      []*gw.DownlinkTXAckItem{{Status: gw.TxAckStatus_OK}},
+	}
+	s.ack(&txAck)
+	assert.Equal([]*gw.DownlinkTXAckItem{
+		{Status: txAckStatusDutyCycleOverflow},
+		{Status: gw.TxAckStatus_OK},
+	}, txAck.Items)
+
+	// rx1 exceeds the duty-cycle and rx2 (SF12) exceeds the dwell-time
+	_, ack = s.schedule(gw.DownlinkFrame{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{3},
+		Items:      []*gw.DownlinkFrameItem{rx1, rx2SF12},
+	})
+	assert.Equal(&gw.DownlinkTXAck{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{3},
+		Items: []*gw.DownlinkTXAckItem{
+			{Status: txAckStatusDutyCycleOverflow},
+			{Status: txAckStatusDutyCycleOverflow},
+		},
+	}, ack)
+
+	// when sending fails, the duty-cycle usage is released
+	s.cancel(gw.DownlinkFrame{DownlinkId: []byte{1}})
+	out, ack = s.schedule(gw.DownlinkFrame{
+		GatewayId:  gatewayID,
+		DownlinkId: []byte{4},
+		Items:      []*gw.DownlinkFrameItem{rx1},
+	})
+	assert.Nil(ack)
+	assert.Equal([]*gw.DownlinkFrameItem{rx1}, out.Items)
+}
@@ -1,7 +1,10 @@
 package forwarder
 
 import (
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
@@ -9,15 +12,24 @@ import (
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/backend/events"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/hooks"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/metadata"
 	"github.com/brocaar/lorawan"
 )
 
+var (
+	workerPool   *pool
+	drainTimeout time.Duration
+	dedup        *deduplicator
+	scheduler    *txScheduler
+)
+
 // Setup configures the forwarder.
 func Setup(conf config.Config) error {
 	b := backend.GetBackend()
 	i := integration.GetIntegration()
+	var err error
 
 	if b == nil {
 		return errors.New("backend is not set")
@@ -27,6 +39,33 @@ func Setup(conf config.Config) error {
 		return errors.New("integration is not set")
 	}
 
+	workerPool, err = newPool(conf.Forwarder.Workers, conf.Forwarder.QueueSize, conf.Forwarder.DropPolicy)
+	if err != nil {
+		return errors.Wrap(err, "new worker pool error")
+	}
+	drainTimeout = conf.Forwarder.DrainTimeout
+
+	dedup = nil
+	if conf.Forwarder.Deduplication.Enabled {
+		dedup, err = newDeduplicator(conf.Forwarder.Deduplication.Window, conf.Forwarder.Deduplication.Mode, deduplicatedUplinkFunc)
+		if err != nil {
+			return errors.Wrap(err, "new deduplicator error")
+		}
+	}
+
+	var dutyCycle *dutyCycleAccountant
+	if conf.Forwarder.DutyCycle.Enabled {
+		dutyCycle, err = newDutyCycleAccountant(conf.Forwarder.DutyCycle.Region, conf.Forwarder.DutyCycle.Window, conf.Forwarder.DutyCycle.DwellTime400ms)
+		if err != nil {
+			return errors.Wrap(err, "new duty-cycle accountant error")
+		}
+	}
+
+	scheduler = nil
+	if conf.Forwarder.TXSchedule.Enabled || dutyCycle != nil {
+		scheduler = newTXScheduler(conf.Forwarder.TXSchedule.Enabled, dutyCycle)
+	}
+
 	// setup backend callbacks
 	b.SetSubscribeEventFunc(gatewaySubscribeFunc)
 	b.SetUplinkFrameFunc(uplinkFrameFunc)
@@ -42,38 +81,70 @@ func Setup(conf config.Config) error {
 	return nil
 }
 
+// Stop stops the forwarder. It waits until the queued tasks have been
+// processed, or until the drain timeout.
+func Stop() error {
+	if workerPool == nil {
+		return nil
+	}
+
+	if err := workerPool.stop(drainTimeout); err != nil {
+		return errors.Wrap(err, "stop worker pool error")
+	}
+
+	return nil
+}
+
 func gatewaySubscribeFunc(pl events.Subscribe) {
-	go func(pl events.Subscribe) {
+	workerPool.enqueue(pl.GatewayID, "subscribe", func() {
 		if err := integration.GetIntegration().SetGatewaySubscription(pl.Subscribe, pl.GatewayID); err != nil {
 			log.WithError(err).Error("set gateway subscription error")
 		}
-	}(pl)
+	})
 }
 
 func uplinkFrameFunc(pl gw.UplinkFrame) {
-	go func(pl gw.UplinkFrame) {
-		var gatewayID lorawan.EUI64
-		var uplinkID uuid.UUID
-		copy(gatewayID[:], pl.GetRxInfo().GatewayId)
-		copy(uplinkID[:], pl.GetRxInfo().UplinkId)
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GetRxInfo().GatewayId)
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventUp, uplinkID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventUp,
-				"uplink_id":  uplinkID,
-			}).Error("publish event error")
+	workerPool.enqueue(gatewayID, integration.EventUp, func() {
+		for _, pl := range hooks.UplinkFrame(pl) {
+			if dedup != nil {
+				dedup.add(pl)
+				continue
+			}
+
+			var gatewayID lorawan.EUI64
+			var uplinkID uuid.UUID
+			copy(gatewayID[:], pl.GetRxInfo().GatewayId)
+			copy(uplinkID[:], pl.GetRxInfo().UplinkId)
+
+			publishUplink(gatewayID, integration.EventUp, uplinkID, &pl)
 		}
-	}(pl)
+	})
+}
+
+func deduplicatedUplinkFunc(gatewayID lorawan.EUI64, event string, uplinkID uuid.UUID, v proto.Message) {
+	workerPool.enqueue(gatewayID, event, func() {
+		publishUplink(gatewayID, event, uplinkID, v)
+	})
+}
+
+func publishUplink(gatewayID lorawan.EUI64, event string, uplinkID uuid.UUID, v proto.Message) {
+	if err := integration.GetIntegration().PublishEvent(gatewayID, event, uplinkID, v); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"event_type": event,
+			"uplink_id":  uplinkID,
+		}).Error("publish event error")
+	}
 }
 
 func gatewayStatsFunc(pl gw.GatewayStats) {
-	go func(pl gw.GatewayStats) {
-		var gatewayID lorawan.EUI64
-		var statsID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
-		copy(statsID[:], pl.StatsId)
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
 
+	workerPool.enqueue(gatewayID, integration.EventStats, func() {
 		// add meta-data to stats
 		if pl.MetaData == nil {
 			pl.MetaData = make(map[string]string)
@@ -82,48 +153,65 @@ func gatewayStatsFunc(pl gw.GatewayStats) {
 			pl.MetaData[k] = v
 		}
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventStats, statsID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id": gatewayID,
-				"event_type": integration.EventStats,
-				"stats_id":   statsID,
-			}).Error("publish event error")
+		for _, pl := range hooks.GatewayStats(pl) {
+			var gatewayID lorawan.EUI64
+			var statsID uuid.UUID
+			copy(gatewayID[:], pl.GatewayId)
+			copy(statsID[:], pl.StatsId)
+
+			if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventStats, statsID, &pl); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"gateway_id": gatewayID,
+					"event_type": integration.EventStats,
+					"stats_id":   statsID,
+				}).Error("publish event error")
+			}
 		}
-	}(pl)
+	})
 }
 
 func downlinkTxAckFunc(pl gw.DownlinkTXAck) {
-	go func(pl gw.DownlinkTXAck) {
-		var gatewayID lorawan.EUI64
-		var downID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
-		copy(downID[:], pl.DownlinkId)
-
-		// for backwards compatibility
-		for _, err := range pl.Items {
-			if err.Status == gw.TxAckStatus_OK {
-				pl.Error = ""
-				break
-			}
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
 
-			pl.Error = err.String()
+	workerPool.enqueue(gatewayID, integration.EventAck, func() {
+		if scheduler != nil {
+			scheduler.ack(&pl)
 		}
 
-		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventAck, downID, &pl); err != nil {
-			log.WithError(err).WithFields(log.Fields{
-				"gateway_id":  gatewayID,
-				"event_type":  integration.EventAck,
-				"downlink_id": downID,
-			}).Error("publish event error")
+		publishDownlinkTxAck(gatewayID, pl)
+	})
+}
+
+func publishDownlinkTxAck(gatewayID lorawan.EUI64, pl gw.DownlinkTXAck) {
+	var downID uuid.UUID
+	copy(downID[:], pl.DownlinkId)
+
+	// for backwards compatibility
+	for _, err := range pl.Items {
+		if err.Status == gw.TxAckStatus_OK {
+			pl.Error = ""
+			break
 		}
-	}(pl)
+
+		pl.Error = err.String()
+	}
+
+	if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventAck, downID, &pl); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id":  gatewayID,
+			"event_type":  integration.EventAck,
+			"downlink_id": downID,
+		}).Error("publish event error")
+	}
 }
 
 func rawPacketForwarderEventFunc(pl gw.RawPacketForwarderEvent) {
-	go func(pl gw.RawPacketForwarderEvent) {
-		var gatewayID lorawan.EUI64
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	workerPool.enqueue(gatewayID, integration.EventRaw, func() {
 		var rawID uuid.UUID
-		copy(gatewayID[:], pl.GatewayId)
 		copy(rawID[:], pl.RawId)
 
 		if err := integration.GetIntegration().PublishEvent(gatewayID, integration.EventRaw, rawID, &pl); err != nil {
@@ -133,29 +221,53 @@ func rawPacketForwarderEventFunc(pl gw.RawPacketForwarderEvent) {
 				"raw_id":     rawID,
 			}).Error("publish event error")
 		}
-	}(pl)
+	})
 }
 
 func downlinkFrameFunc(pl gw.DownlinkFrame) {
-	go func(pl gw.DownlinkFrame) {
-		if err := backend.GetBackend().SendDownlinkFrame(pl); err != nil {
-			log.WithError(err).Error("send downlink frame error")
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	workerPool.enqueuePriority(gatewayID, "down", func() {
+		for _, pl := range hooks.DownlinkFrame(pl) {
+			if scheduler != nil {
+				var ack *gw.DownlinkTXAck
+				pl, ack = scheduler.schedule(pl)
+				if ack != nil {
+					publishDownlinkTxAck(gatewayID, *ack)
+					continue
+				}
+			}
+
+			if err := backend.GetBackend().SendDownlinkFrame(pl); err != nil {
+				log.WithError(err).Error("send downlink frame error")
+
+				if scheduler != nil {
+					scheduler.cancel(pl)
+				}
+			}
 		}
-	}(pl)
+	})
 }
 
 func gatewayConfigurationFunc(pl gw.GatewayConfiguration) {
-	go func(pl gw.GatewayConfiguration) {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	workerPool.enqueuePriority(gatewayID, "config", func() {
 		if err := backend.GetBackend().ApplyConfiguration(pl); err != nil {
 			log.WithError(err).Error("apply gateway-configuration error")
 		}
-	}(pl)
+	})
 }
 
 func rawPacketForwarderCommandFunc(pl gw.RawPacketForwarderCommand) {
-	go func(pl gw.RawPacketForwarderCommand) {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], pl.GatewayId)
+
+	workerPool.enqueuePriority(gatewayID, "raw_command", func() {
 		if err := backend.GetBackend().RawPacketForwarderCommand(pl); err != nil {
 			log.WithError(err).Error("raw packet-forwarder command error")
 		}
-	}(pl)
+	})
 }
@@ -0,0 +1,62 @@
+package forwarder
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	qdg = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "forwarder_queue_depth",
+		Help: "The number of queued tasks of all gateways (per type).",
+	}, []string{"type"})
+
+	dc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_drop_count",
+		Help: "The number of tasks dropped because the gateway queue was full (per type).",
+	}, []string{"type"})
+
+	plh = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "forwarder_processing_latency_seconds",
+		Help: "The duration between queueing and completing a task (per type).",
+	}, []string{"type"})
+
+	ddc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "forwarder_deduplication_count",
+		Help: "The number of uplink frames suppressed as duplicate.",
+	})
+
+	dcc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "forwarder_downlink_collision_count",
+		Help: "The number of downlink items skipped because of a TX schedule collision.",
+	})
+
+	dcoc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_duty_cycle_overflow_count",
+		Help: "The number of downlink items refused because of the duty-cycle or dwell-time limits (per reason).",
+	}, []string{"reason"})
+)
+
+func queueDepthGauge(t string) prometheus.Gauge {
+	return qdg.With(prometheus.Labels{"type": t})
+}
+
+func dropCounter(t string) prometheus.Counter {
+	return dc.With(prometheus.Labels{"type": t})
+}
+
+func processingLatencyHistogram(t string) prometheus.Observer {
+	return plh.With(prometheus.Labels{"type": t})
+}
+
+func deduplicationCounter() prometheus.Counter {
+	return ddc
+}
+
+func downlinkCollisionCounter() prometheus.Counter {
+	return dcc
+}
+
+func dutyCycleOverflowCounter(reason string) prometheus.Counter {
+	return dcoc.With(prometheus.Labels{"reason": reason})
+}
@@ -0,0 +1,291 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+// Drop policies.
+const (
+	DropPolicyDropOldest = "drop_oldest"
+	DropPolicyDropNewest = "drop_newest"
+	DropPolicyBlock      = "block"
+)
+
+// task holds a queued task.
+type task struct {
+	typ    string
+	queued time.Time
+	f      func()
+}
+
+// gatewayQueue holds the queued tasks of a gateway. Tasks in the priority
+// lane (downlinks and commands) are processed before the other tasks.
+type gatewayQueue struct {
+	tasks    []task
+	priority []task
+
+	// scheduled is set when the gateway is in the ready list or when one of
+	// its tasks is being processed.
+	scheduled bool
+}
+
+// pool implements a bounded worker pool with ordered per-gateway queues.
+// The tasks of a gateway are processed one at a time, in the order they were
+// queued. Tasks of different gateways are processed concurrently. Each
+// gateway has a priority lane, which is processed before the other tasks
+// of the gateway.
+type pool struct {
+	mux        sync.Mutex
+	workCond   *sync.Cond
+	spaceCond  *sync.Cond
+	queues     map[lorawan.EUI64]*gatewayQueue
+	ready      []lorawan.EUI64
+	queueSize  int
+	dropPolicy string
+
+	// stopped is set when the pool no longer accepts new tasks, drained is
+	// closed once all the queued tasks have been processed after stopping.
+	stopped bool
+	drained chan struct{}
+}
+
+// newPool creates a new pool and starts the given number of workers.
+func newPool(workers, queueSize int, dropPolicy string) (*pool, error) {
+	switch dropPolicy {
+	case DropPolicyDropOldest, DropPolicyDropNewest, DropPolicyBlock:
+	default:
+		return nil, errors.Errorf("unknown drop policy: %s", dropPolicy)
+	}
+
+	if workers <= 0 {
+		return nil, errors.New("workers must be greater than zero")
+	}
+
+	if queueSize <= 0 {
+		return nil, errors.New("queue size must be greater than zero")
+	}
+
+	p := pool{
+		queues:     make(map[lorawan.EUI64]*gatewayQueue),
+		queueSize:  queueSize,
+		dropPolicy: dropPolicy,
+		drained:    make(chan struct{}),
+	}
+	p.workCond = sync.NewCond(&p.mux)
+	p.spaceCond = sync.NewCond(&p.mux)
+
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return &p, nil
+}
+
+// enqueue adds the given task to the queue of the given gateway. When the
+// queue is full, the drop policy is applied.
+func (p *pool) enqueue(gatewayID lorawan.EUI64, typ string, f func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.stopped {
+		p.dropStopped(gatewayID, typ)
+		return
+	}
+
+	q := p.getQueue(gatewayID)
+
+	for len(q.tasks) >= p.queueSize {
+		switch p.dropPolicy {
+		case DropPolicyDropNewest:
+			p.drop(gatewayID, typ)
+			return
+		case DropPolicyDropOldest:
+			p.drop(gatewayID, q.tasks[0].typ)
+			queueDepthGauge(q.tasks[0].typ).Dec()
+			q.tasks = q.tasks[1:]
+		case DropPolicyBlock:
+			p.spaceCond.Wait()
+
+			if p.stopped {
+				p.dropStopped(gatewayID, typ)
+				return
+			}
+
+			// the queue might have been removed while waiting
+			q = p.getQueue(gatewayID)
+		}
+	}
+
+	q.tasks = append(q.tasks, task{
+		typ:    typ,
+		queued: time.Now(),
+		f:      f,
+	})
+	queueDepthGauge(typ).Inc()
+
+	p.schedule(gatewayID, q)
+}
+
+// enqueuePriority adds the given task to the priority lane of the given
+// gateway. This never blocks, as it is called from the integration message
+// handlers. When the lane is full, the oldest task is dropped.
+func (p *pool) enqueuePriority(gatewayID lorawan.EUI64, typ string, f func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if p.stopped {
+		p.dropStopped(gatewayID, typ)
+		return
+	}
+
+	q := p.getQueue(gatewayID)
+
+	if len(q.priority) >= p.queueSize {
+		p.drop(gatewayID, q.priority[0].typ)
+		queueDepthGauge(q.priority[0].typ).Dec()
+		q.priority = q.priority[1:]
+	}
+
+	q.priority = append(q.priority, task{
+		typ:    typ,
+		queued: time.Now(),
+		f:      f,
+	})
+	queueDepthGauge(typ).Inc()
+
+	p.schedule(gatewayID, q)
+}
+
+// schedule adds the given gateway to the ready list, when not yet scheduled.
+// The caller must hold the lock.
+func (p *pool) schedule(gatewayID lorawan.EUI64, q *gatewayQueue) {
+	if !q.scheduled {
+		q.scheduled = true
+		p.ready = append(p.ready, gatewayID)
+		p.workCond.Signal()
+	}
+}
+
+// worker processes the queued tasks.
+func (p *pool) worker() {
+	for {
+		p.mux.Lock()
+		for len(p.ready) == 0 {
+			p.workCond.Wait()
+		}
+
+		gatewayID := p.ready[0]
+		p.ready = p.ready[1:]
+		q := p.queues[gatewayID]
+
+		var t task
+		if len(q.priority) != 0 {
+			t = q.priority[0]
+			q.priority = q.priority[1:]
+		} else {
+			t = q.tasks[0]
+			q.tasks = q.tasks[1:]
+			p.spaceCond.Broadcast()
+		}
+		queueDepthGauge(t.typ).Dec()
+		p.mux.Unlock()
+
+		t.f()
+		processingLatencyHistogram(t.typ).Observe(time.Since(t.queued).Seconds())
+
+		p.mux.Lock()
+		if len(q.tasks) != 0 || len(q.priority) != 0 {
+			// re-schedule at the end of the ready list, such that other
+			// gateways are not starved
+			p.ready = append(p.ready, gatewayID)
+			p.workCond.Signal()
+		} else {
+			q.scheduled = false
+			delete(p.queues, gatewayID)
+			p.checkDrained()
+		}
+		p.mux.Unlock()
+	}
+}
+
+// stop stops accepting new tasks and waits until the queued tasks have been
+// processed. It returns an error when the tasks have not been processed
+// within the given timeout.
+func (p *pool) stop(timeout time.Duration) error {
+	p.mux.Lock()
+	if !p.stopped {
+		p.stopped = true
+
+		// unblock the tasks waiting for space in the queue
+		p.spaceCond.Broadcast()
+		p.checkDrained()
+	}
+	p.mux.Unlock()
+
+	select {
+	case <-p.drained:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var remaining int
+	for _, q := range p.queues {
+		remaining += len(q.tasks) + len(q.priority)
+	}
+
+	return errors.Errorf("drain timeout, %d tasks remaining", remaining)
+}
+
+// checkDrained closes the drained channel when the pool has been stopped and
+// all the queued tasks have been processed. The caller must hold the lock.
+func (p *pool) checkDrained() {
+	if !p.stopped || len(p.queues) != 0 {
+		return
+	}
+
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// getQueue returns the queue of the given gateway. The caller must hold the
+// lock.
+func (p *pool) getQueue(gatewayID lorawan.EUI64) *gatewayQueue {
+	q, ok := p.queues[gatewayID]
+	if !ok {
+		q = &gatewayQueue{}
+		p.queues[gatewayID] = q
+	}
+	return q
+}
+
+// dropStopped logs and counts a task that is dropped as the pool has been
+// stopped. The caller must hold the lock.
+func (p *pool) dropStopped(gatewayID lorawan.EUI64, typ string) {
+	dropCounter(typ).Inc()
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"type":       typ,
+	}).Warning("forwarder: worker pool is stopped, dropping task")
+}
+
+// drop logs and counts a dropped task. The caller must hold the lock.
+func (p *pool) drop(gatewayID lorawan.EUI64, typ string) {
+	dropCounter(typ).Inc()
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"type":        typ,
+		"drop_policy": p.dropPolicy,
+	}).Warning("forwarder: queue is full, dropping task")
+}
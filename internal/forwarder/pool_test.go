@@ -0,0 +1,265 @@
+package forwarder
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestNewPool(t *testing.T) {
+	tests := []struct {
+		name       string
+		workers    int
+		queueSize  int
+		dropPolicy string
+		err        bool
+	}{
+		{"drop oldest", 1, 10, DropPolicyDropOldest, false},
+		{"drop newest", 1, 10, DropPolicyDropNewest, false},
+		{"block", 1, 10, DropPolicyBlock, false},
+		{"invalid drop policy", 1, 10, "foo", true},
+		{"no workers", 0, 10, DropPolicyBlock, true},
+		{"unbounded queue", 1, 0, DropPolicyBlock, true},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			_, err := newPool(tst.workers, tst.queueSize, tst.dropPolicy)
+			if tst.err {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+}
+
+func TestPoolOrdering(t *testing.T) {
+	assert := require.New(t)
+
+	p, err := newPool(4, 10, DropPolicyBlock)
+	assert.NoError(err)
+
+	gatewayIDs := []lorawan.EUI64{{1}, {2}, {3}}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[lorawan.EUI64][]int)
+
+	for i := 0; i < 100; i++ {
+		for _, gatewayID := range gatewayIDs {
+			i := i
+			gatewayID := gatewayID
+			wg.Add(1)
+			p.enqueue(gatewayID, "up", func() {
+				defer wg.Done()
+				mux.Lock()
+				results[gatewayID] = append(results[gatewayID], i)
+				mux.Unlock()
+			})
+		}
+	}
+
+	wg.Wait()
+
+	for _, gatewayID := range gatewayIDs {
+		assert.Len(results[gatewayID], 100)
+		for i, v := range results[gatewayID] {
+			assert.Equal(i, v)
+		}
+	}
+}
+
+func TestPoolDropPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		dropPolicy string
+		expected   []int
+	}{
+		{"drop oldest", DropPolicyDropOldest, []int{0, 3, 4}},
+		{"drop newest", DropPolicyDropNewest, []int{0, 1, 2}},
+		{"block", DropPolicyBlock, []int{0, 1, 2, 3, 4}},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			p, err := newPool(1, 2, tst.dropPolicy)
+			assert.NoError(err)
+
+			gatewayID := lorawan.EUI64{1}
+			started := make(chan struct{})
+			release := make(chan struct{})
+			resultChan := make(chan int, 5)
+
+			// the first task blocks the worker, such that the queue fills up
+			p.enqueue(gatewayID, "up", func() {
+				close(started)
+				<-release
+				resultChan <- 0
+			})
+			<-started
+
+			enqueued := make(chan struct{})
+			go func() {
+				for i := 1; i < 5; i++ {
+					i := i
+					p.enqueue(gatewayID, "up", func() {
+						resultChan <- i
+					})
+				}
+				close(enqueued)
+			}()
+
+			if tst.dropPolicy == DropPolicyBlock {
+				select {
+				case <-enqueued:
+					t.Fatal("expected enqueue to block")
+				case <-time.After(100 * time.Millisecond):
+				}
+			} else {
+				<-enqueued
+			}
+
+			close(release)
+			<-enqueued
+
+			var results []int
+			for range tst.expected {
+				select {
+				case i := <-resultChan:
+					results = append(results, i)
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected result")
+				}
+			}
+			assert.Equal(tst.expected, results)
+
+			select {
+			case i := <-resultChan:
+				t.Fatalf("unexpected result: %d", i)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestPoolPriority(t *testing.T) {
+	assert := require.New(t)
+
+	p, err := newPool(1, 2, DropPolicyBlock)
+	assert.NoError(err)
+
+	gatewayID := lorawan.EUI64{1}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	resultChan := make(chan string, 10)
+
+	// the first task blocks the worker, such that the queue fills up
+	p.enqueue(gatewayID, "up", func() {
+		close(started)
+		<-release
+		resultChan <- "up-0"
+	})
+	<-started
+
+	p.enqueue(gatewayID, "up", func() { resultChan <- "up-1" })
+	p.enqueue(gatewayID, "up", func() { resultChan <- "up-2" })
+
+	// the queue is full, enqueueing a priority task must not block and the
+	// oldest priority task is dropped when the lane is full
+	enqueued := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			i := i
+			p.enqueuePriority(gatewayID, "down", func() {
+				resultChan <- fmt.Sprintf("down-%d", i)
+			})
+		}
+		close(enqueued)
+	}()
+
+	select {
+	case <-enqueued:
+	case <-time.After(time.Second):
+		t.Fatal("expected enqueue priority not to block")
+	}
+
+	close(release)
+
+	var results []string
+	for i := 0; i < 5; i++ {
+		select {
+		case s := <-resultChan:
+			results = append(results, s)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected result")
+		}
+	}
+	assert.Equal([]string{"up-0", "down-1", "down-2", "up-1", "up-2"}, results)
+}
+
+func TestPoolStop(t *testing.T) {
+	gatewayID := lorawan.EUI64{1}
+
+	t.Run("drain", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 10, DropPolicyBlock)
+		assert.NoError(err)
+
+		release := make(chan struct{})
+		var mux sync.Mutex
+		var processed []string
+
+		p.enqueue(gatewayID, "up", func() {
+			<-release
+			mux.Lock()
+			processed = append(processed, "up")
+			mux.Unlock()
+		})
+		p.enqueuePriority(gatewayID, "down", func() {
+			mux.Lock()
+			processed = append(processed, "down")
+			mux.Unlock()
+		})
+
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+		}()
+		assert.NoError(p.stop(time.Second))
+		assert.ElementsMatch([]string{"up", "down"}, processed)
+
+		// new tasks are dropped after stopping
+		p.enqueue(gatewayID, "up", func() {
+			t.Error("unexpected task")
+		})
+		p.enqueuePriority(gatewayID, "down", func() {
+			t.Error("unexpected task")
+		})
+		assert.NoError(p.stop(time.Second))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := newPool(1, 10, DropPolicyBlock)
+		assert.NoError(err)
+
+		release := make(chan struct{})
+		defer close(release)
+
+		p.enqueue(gatewayID, "up", func() { <-release })
+		p.enqueue(gatewayID, "up", func() {})
+
+		assert.EqualError(p.stop(10*time.Millisecond), "drain timeout, 1 tasks remaining")
+	})
+}
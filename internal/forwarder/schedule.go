@@ -0,0 +1,413 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/airtime"
+	"github.com/brocaar/lorawan/gps"
+)
+
+// Timing domains. Slots can only be compared within the same domain.
+const (
+	// domainCounter32 is the 32bit concentrator counter (Semtech UDP tmst).
+	domainCounter32 = iota
+	// domainCounter64 is the 64bit concentrator counter (Basic Station xtime).
+	domainCounter64
+	// domainGPSEpoch is the time since GPS epoch.
+	domainGPSEpoch
+)
+
+// pendingTTL defines how long the scheduler waits for the ack of a
+// downlink.
+const pendingTTL = time.Minute
+
+// slotMargin is added to the expiration of a booked slot, to compensate for
+// the unknown delay between the uplink and processing the downlink.
+const slotMargin = time.Second
+
+// txSlot holds a booked TX slot.
+type txSlot struct {
+	board    uint32
+	domain   int
+	start    uint64 // in microseconds
+	duration uint64 // in microseconds
+	expires  time.Time
+}
+
+// overlaps returns true when the given slot overlaps with this slot.
+func (s txSlot) overlaps(o txSlot) bool {
+	if s.board != o.board || s.domain != o.domain {
+		return false
+	}
+
+	d := int64(o.start - s.start)
+	if s.domain == domainCounter32 {
+		d = int64(int32(uint32(o.start - s.start)))
+	}
+
+	if d >= 0 {
+		return uint64(d) < s.duration
+	}
+	return uint64(-d) < o.duration
+}
+
+// pendingDownlink holds a downlink that is waiting for its ack.
+type pendingDownlink struct {
+	gatewayID lorawan.EUI64
+	items     []*gw.DownlinkFrameItem
+	skipped   []gw.TxAckStatus
+	slot      *txSlot
+	record    *txRecord
+	expires   time.Time
+}
+
+// txScheduler keeps the TX schedule of each gateway. Before a downlink is
+// sent, its items are checked against the booked slots and (optionally) the
+// duty-cycle limits. Items that are refused are skipped, such that the
+// backend falls through to the next item.
+type txScheduler struct {
+	mux            sync.Mutex
+	collisionCheck bool
+	dutyCycle      *dutyCycleAccountant
+	slots          map[lorawan.EUI64][]*txSlot
+	pending        map[uuid.UUID]*pendingDownlink
+}
+
+// newTXScheduler creates a new txScheduler. When collisionCheck is false,
+// items are not checked against the booked slots. When dutyCycle is nil,
+// duty-cycle limits are not enforced.
+func newTXScheduler(collisionCheck bool, dutyCycle *dutyCycleAccountant) *txScheduler {
+	return &txScheduler{
+		collisionCheck: collisionCheck,
+		dutyCycle:      dutyCycle,
+		slots:          make(map[lorawan.EUI64][]*txSlot),
+		pending:        make(map[uuid.UUID]*pendingDownlink),
+	}
+}
+
+// schedule books the first item that is not refused. It returns the downlink
+// frame to send, which contains this item and the remaining items. When all
+// items are refused, it returns the ack that must be published instead of
+// sending the downlink frame.
+func (s *txScheduler) schedule(pl gw.DownlinkFrame) (gw.DownlinkFrame, *gw.DownlinkTXAck) {
+	var gatewayID lorawan.EUI64
+	var downID uuid.UUID
+	copy(gatewayID[:], pl.GatewayId)
+	copy(downID[:], pl.DownlinkId)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.cleanup()
+
+	var skipped []gw.TxAckStatus
+
+	for i, item := range pl.Items {
+		if status := s.check(gatewayID, item); status != gw.TxAckStatus_OK {
+			log.WithFields(log.Fields{
+				"gateway_id":  gatewayID,
+				"downlink_id": downID,
+				"item":        i,
+				"status":      status,
+			}).Warning("forwarder: downlink item refused by tx schedule")
+			skipped = append(skipped, status)
+			continue
+		}
+
+		slot, record := s.book(gatewayID, item)
+
+		out := pl
+		out.Items = pl.Items[i:]
+
+		s.pending[downID] = &pendingDownlink{
+			gatewayID: gatewayID,
+			items:     out.Items,
+			skipped:   skipped,
+			slot:      slot,
+			record:    record,
+			expires:   time.Now().Add(pendingTTL),
+		}
+
+		return out, nil
+	}
+
+	ack := gw.DownlinkTXAck{
+		GatewayId:  pl.GatewayId,
+		Token:      pl.Token,
+		DownlinkId: pl.DownlinkId,
+	}
+	for _, status := range skipped {
+		ack.Items = append(ack.Items, &gw.DownlinkTXAckItem{
+			Status: status,
+		})
+	}
+
+	return pl, &ack
+}
+
+// ack updates the schedule using the given ack and maps the ack items back
+// to the items of the original downlink frame.
+func (s *txScheduler) ack(pl *gw.DownlinkTXAck) {
+	var downID uuid.UUID
+	copy(downID[:], pl.DownlinkId)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	p, ok := s.pending[downID]
+	if !ok {
+		return
+	}
+	delete(s.pending, downID)
+
+	// When the booked item was not emitted, release it and book the item
+	// that was emitted instead (if any).
+	if len(pl.Items) == 0 || pl.Items[0].Status != gw.TxAckStatus_OK {
+		s.release(p)
+
+		for i, item := range pl.Items {
+			if item.Status == gw.TxAckStatus_OK && i < len(p.items) {
+				s.book(p.gatewayID, p.items[i])
+			}
+		}
+	}
+
+	if len(p.skipped) != 0 && len(pl.Items) != 0 {
+		items := make([]*gw.DownlinkTXAckItem, 0, len(p.skipped)+len(pl.Items))
+		for _, status := range p.skipped {
+			items = append(items, &gw.DownlinkTXAckItem{
+				Status: status,
+			})
+		}
+		pl.Items = append(items, pl.Items...)
+	}
+}
+
+// cancel releases the given downlink frame, e.g. when sending the downlink
+// frame failed.
+func (s *txScheduler) cancel(pl gw.DownlinkFrame) {
+	s.ack(&gw.DownlinkTXAck{
+		DownlinkId: pl.DownlinkId,
+	})
+}
+
+// check returns the status for the given downlink item. The caller must hold
+// the lock.
+func (s *txScheduler) check(gatewayID lorawan.EUI64, item *gw.DownlinkFrameItem) gw.TxAckStatus {
+	toa, err := timeOnAir(len(item.PhyPayload), item.GetTxInfo())
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Debug("forwarder: calculate time on air error, skipping tx schedule checks")
+		return gw.TxAckStatus_OK
+	}
+
+	if s.collisionCheck {
+		slot, err := itemSlot(item.GetTxInfo(), toa)
+		if err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Debug("forwarder: can not determine tx slot, skipping collision check")
+		}
+
+		if slot != nil && s.collides(gatewayID, *slot) {
+			downlinkCollisionCounter().Inc()
+			return gw.TxAckStatus_COLLISION_PACKET
+		}
+	}
+
+	if s.dutyCycle != nil {
+		if reason := s.dutyCycle.check(gatewayID, item.GetTxInfo().GetFrequency(), toa); reason != "" {
+			dutyCycleOverflowCounter(reason).Inc()
+			log.WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"frequency":  item.GetTxInfo().GetFrequency(),
+				"reason":     reason,
+				"status":     txAckStatusDutyCycleOverflow,
+			}).Warning("forwarder: downlink item refused, duty-cycle or dwell-time limit exceeded")
+			return txAckStatusDutyCycleOverflow
+		}
+	}
+
+	return gw.TxAckStatus_OK
+}
+
+// book books the TX slot and the duty-cycle usage of the given item. The
+// caller must hold the lock.
+func (s *txScheduler) book(gatewayID lorawan.EUI64, item *gw.DownlinkFrameItem) (*txSlot, *txRecord) {
+	toa, err := timeOnAir(len(item.PhyPayload), item.GetTxInfo())
+	if err != nil {
+		return nil, nil
+	}
+
+	var slot *txSlot
+	var record *txRecord
+
+	if s.collisionCheck {
+		if slot, _ = itemSlot(item.GetTxInfo(), toa); slot != nil {
+			s.slots[gatewayID] = append(s.slots[gatewayID], slot)
+		}
+	}
+
+	if s.dutyCycle != nil {
+		record = s.dutyCycle.record(gatewayID, item.GetTxInfo().GetFrequency(), toa)
+	}
+
+	return slot, record
+}
+
+// release releases the TX slot and the duty-cycle usage of the given pending
+// downlink. The caller must hold the lock.
+func (s *txScheduler) release(p *pendingDownlink) {
+	if p.slot != nil {
+		slots := s.slots[p.gatewayID]
+		for i := range slots {
+			if slots[i] == p.slot {
+				s.slots[p.gatewayID] = append(slots[:i], slots[i+1:]...)
+				break
+			}
+		}
+	}
+
+	if p.record != nil {
+		s.dutyCycle.remove(p.gatewayID, p.record)
+	}
+}
+
+// collides returns true when the given slot overlaps with one of the booked
+// slots of the gateway. The caller must hold the lock.
+func (s *txScheduler) collides(gatewayID lorawan.EUI64, slot txSlot) bool {
+	for _, booked := range s.slots[gatewayID] {
+		if booked.overlaps(slot) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup removes the expired slots, duty-cycle records and pending
+// downlinks. The caller must hold the lock.
+func (s *txScheduler) cleanup() {
+	now := time.Now()
+
+	for gatewayID, slots := range s.slots {
+		var keep []*txSlot
+		for _, slot := range slots {
+			if slot.expires.After(now) {
+				keep = append(keep, slot)
+			}
+		}
+
+		if len(keep) == 0 {
+			delete(s.slots, gatewayID)
+		} else {
+			s.slots[gatewayID] = keep
+		}
+	}
+
+	if s.dutyCycle != nil {
+		s.dutyCycle.cleanup()
+	}
+
+	for downID, p := range s.pending {
+		if p.expires.Before(now) {
+			delete(s.pending, downID)
+		}
+	}
+}
+
+// itemSlot returns the TX slot of a downlink item with the given TX info and
+// time on air. It returns nil when the item is sent immediately, as the time
+// of transmission is not known in that case.
+func itemSlot(txInfo *gw.DownlinkTXInfo, toa time.Duration) (*txSlot, error) {
+	slot := txSlot{
+		board:    txInfo.GetBoard(),
+		duration: uint64(toa / time.Microsecond),
+	}
+
+	switch txInfo.GetTiming() {
+	case gw.DownlinkTiming_DELAY:
+		delay, err := ptypes.Duration(txInfo.GetDelayTimingInfo().GetDelay())
+		if err != nil {
+			return nil, errors.Wrap(err, "get delay error")
+		}
+
+		ctx := txInfo.GetContext()
+		switch {
+		case len(ctx) == 4:
+			slot.domain = domainCounter32
+			slot.start = uint64(binary.BigEndian.Uint32(ctx)) + uint64(delay/time.Microsecond)
+		case len(ctx) >= 16:
+			slot.domain = domainCounter64
+			slot.start = binary.BigEndian.Uint64(ctx[8:16]) + uint64(delay/time.Microsecond)
+		default:
+			return nil, errors.Errorf("unexpected context length: %d", len(ctx))
+		}
+
+		slot.expires = time.Now().Add(delay + toa + slotMargin)
+	case gw.DownlinkTiming_GPS_EPOCH:
+		sinceEpoch, err := ptypes.Duration(txInfo.GetGpsEpochTimingInfo().GetTimeSinceGpsEpoch())
+		if err != nil {
+			return nil, errors.Wrap(err, "get time since gps epoch error")
+		}
+
+		slot.domain = domainGPSEpoch
+		slot.start = uint64(sinceEpoch / time.Microsecond)
+		slot.expires = time.Now().Add(sinceEpoch - gps.Time(time.Now()).TimeSinceGPSEpoch() + toa + slotMargin)
+	default:
+		return nil, nil
+	}
+
+	return &slot, nil
+}
+
+// timeOnAir returns the time on air of a frame with the given payload size.
+func timeOnAir(size int, txInfo *gw.DownlinkTXInfo) (time.Duration, error) {
+	if txInfo == nil {
+		return 0, errors.New("tx_info must not be nil")
+	}
+
+	if modInfo := txInfo.GetLoraModulationInfo(); modInfo != nil {
+		var cr airtime.CodingRate
+		switch modInfo.CodeRate {
+		case "4/5":
+			cr = airtime.CodingRate45
+		case "4/6":
+			cr = airtime.CodingRate46
+		case "4/7":
+			cr = airtime.CodingRate47
+		case "4/8":
+			cr = airtime.CodingRate48
+		default:
+			return 0, errors.Errorf("unexpected code-rate: %s", modInfo.CodeRate)
+		}
+
+		if modInfo.Bandwidth == 0 {
+			return 0, errors.New("bandwidth must be greater than zero")
+		}
+
+		// low data-rate optimization is mandated for symbol durations of
+		// 16ms and above
+		ldro := airtime.CalculateLoRaSymbolDuration(int(modInfo.SpreadingFactor), int(modInfo.Bandwidth)) >= 16*time.Millisecond
+
+		return airtime.CalculateLoRaAirtime(size, int(modInfo.SpreadingFactor), int(modInfo.Bandwidth), 8, cr, true, ldro)
+	}
+
+	if modInfo := txInfo.GetFskModulationInfo(); modInfo != nil {
+		if modInfo.Datarate == 0 {
+			return 0, errors.New("datarate must be greater than zero")
+		}
+
+		// preamble (5 bytes), sync-word (3 bytes), length (1 byte) and crc
+		// (2 bytes)
+		bits := (5 + 3 + 1 + size + 2) * 8
+		return time.Duration(bits) * time.Second / time.Duration(modInfo.Datarate), nil
+	}
+
+	return 0, errors.New("unknown modulation info")
+}
@@ -0,0 +1,361 @@
+package forwarder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func delayItem(tmst []byte, delay time.Duration, sf uint32) *gw.DownlinkFrameItem {
+	return &gw.DownlinkFrameItem{
+		PhyPayload: make([]byte, 20),
+		TxInfo: &gw.DownlinkTXInfo{
+			Frequency:  868100000,
+			Modulation: common.Modulation_LORA,
+			ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+				LoraModulationInfo: &gw.LoRaModulationInfo{
+					Bandwidth:       125,
+					SpreadingFactor: sf,
+					CodeRate:        "4/5",
+				},
+			},
+			Timing: gw.DownlinkTiming_DELAY,
+			TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+				DelayTimingInfo: &gw.DelayTimingInfo{
+					Delay: ptypes.DurationProto(delay),
+				},
+			},
+			Context: tmst,
+		},
+	}
+}
+
+func TestTXSlotOverlaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        txSlot
+		b        txSlot
+		expected bool
+	}{
+		{
+			name:     "equal",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 1000, duration: 100},
+			expected: true,
+		},
+		{
+			name:     "b starts during a",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 1099, duration: 100},
+			expected: true,
+		},
+		{
+			name:     "b starts after a",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 1100, duration: 100},
+			expected: false,
+		},
+		{
+			name:     "b ends during a",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 901, duration: 100},
+			expected: true,
+		},
+		{
+			name:     "b ends before a",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 900, duration: 100},
+			expected: false,
+		},
+		{
+			name:     "different board",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 1000, duration: 100, board: 1},
+			expected: false,
+		},
+		{
+			name:     "different domain",
+			a:        txSlot{start: 1000, duration: 100},
+			b:        txSlot{start: 1000, duration: 100, domain: domainGPSEpoch},
+			expected: false,
+		},
+		{
+			name:     "counter wrap",
+			a:        txSlot{start: 1<<32 - 50, duration: 100},
+			b:        txSlot{start: 10, duration: 100},
+			expected: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.expected, tst.a.overlaps(tst.b))
+			assert.Equal(tst.expected, tst.b.overlaps(tst.a))
+		})
+	}
+}
+
+func TestTXScheduler(t *testing.T) {
+	gatewayID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	tmst := []byte{0, 0, 0, 1}
+
+	t.Run("no collision", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		pl := gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, time.Second, 7)},
+		}
+		out, ack := s.schedule(pl)
+		assert.Nil(ack)
+		assert.Equal(pl.Items, out.Items)
+
+		// RX2 of the same uplink does not overlap with RX1
+		pl = gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, 2*time.Second, 12)},
+		}
+		out, ack = s.schedule(pl)
+		assert.Nil(ack)
+		assert.Equal(pl.Items, out.Items)
+	})
+
+	t.Run("fall through to next item", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		_, ack := s.schedule(gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, time.Second, 7)},
+		})
+		assert.Nil(ack)
+
+		pl := gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Items: []*gw.DownlinkFrameItem{
+				delayItem(tmst, time.Second, 7),
+				delayItem(tmst, 2*time.Second, 12),
+			},
+		}
+		out, ack := s.schedule(pl)
+		assert.Nil(ack)
+		assert.Equal(pl.Items[1:], out.Items)
+
+		// the ack of the backend is mapped back to the original items
+		txAck := gw.DownlinkTXAck{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Items: []*gw.DownlinkTXAckItem{
+				{Status: gw.TxAckStatus_OK},
+			},
+		}
+		s.ack(&txAck)
+		assert.Equal([]*gw.DownlinkTXAckItem{
+			{Status: gw.TxAckStatus_COLLISION_PACKET},
+			{Status: gw.TxAckStatus_OK},
+		}, txAck.Items)
+	})
+
+	t.Run("all items collide", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		_, ack := s.schedule(gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, time.Second, 12)},
+		})
+		assert.Nil(ack)
+
+		pl := gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Token:      123,
+			Items: []*gw.DownlinkFrameItem{
+				delayItem(tmst, time.Second+100*time.Millisecond, 7),
+			},
+		}
+		_, ack = s.schedule(pl)
+		assert.Equal(&gw.DownlinkTXAck{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Token:      123,
+			Items: []*gw.DownlinkTXAckItem{
+				{Status: gw.TxAckStatus_COLLISION_PACKET},
+			},
+		}, ack)
+	})
+
+	t.Run("release slot of failed item", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		_, ack := s.schedule(gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items: []*gw.DownlinkFrameItem{
+				delayItem(tmst, time.Second, 7),
+				delayItem(tmst, 2*time.Second, 12),
+			},
+		})
+		assert.Nil(ack)
+
+		// the first item was not emitted, the second was
+		s.ack(&gw.DownlinkTXAck{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items: []*gw.DownlinkTXAckItem{
+				{Status: gw.TxAckStatus_TOO_LATE},
+				{Status: gw.TxAckStatus_OK},
+			},
+		})
+
+		out, ack := s.schedule(gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{2},
+			Items: []*gw.DownlinkFrameItem{
+				delayItem(tmst, 2*time.Second, 12),
+				delayItem(tmst, time.Second, 7),
+			},
+		})
+		assert.Nil(ack)
+		assert.Len(out.Items, 1)
+		assert.Equal(time.Second, out.Items[0].TxInfo.GetDelayTimingInfo().Delay.AsDuration())
+	})
+
+	t.Run("other gateway", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		_, ack := s.schedule(gw.DownlinkFrame{
+			GatewayId:  gatewayID,
+			DownlinkId: []byte{1},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, time.Second, 7)},
+		})
+		assert.Nil(ack)
+
+		_, ack = s.schedule(gw.DownlinkFrame{
+			GatewayId:  []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			DownlinkId: []byte{2},
+			Items:      []*gw.DownlinkFrameItem{delayItem(tmst, time.Second, 7)},
+		})
+		assert.Nil(ack)
+	})
+
+	t.Run("immediately", func(t *testing.T) {
+		assert := require.New(t)
+		s := newTXScheduler(true, nil)
+
+		item := &gw.DownlinkFrameItem{
+			PhyPayload: make([]byte, 20),
+			TxInfo: &gw.DownlinkTXInfo{
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: 7,
+						CodeRate:        "4/5",
+					},
+				},
+				Timing: gw.DownlinkTiming_IMMEDIATELY,
+			},
+		}
+
+		for i := 0; i < 2; i++ {
+			_, ack := s.schedule(gw.DownlinkFrame{
+				GatewayId:  gatewayID,
+				DownlinkId: []byte{byte(i)},
+				Items:      []*gw.DownlinkFrameItem{item},
+			})
+			assert.Nil(ack)
+		}
+	})
+}
+
+func TestTimeOnAir(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		txInfo   gw.DownlinkTXInfo
+		expected time.Duration
+		err      bool
+	}{
+		{
+			name: "lora sf7",
+			size: 13,
+			txInfo: gw.DownlinkTXInfo{
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: 7,
+						CodeRate:        "4/5",
+					},
+				},
+			},
+			expected: 46336 * time.Microsecond,
+		},
+		{
+			name: "lora sf12",
+			size: 13,
+			txInfo: gw.DownlinkTXInfo{
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: 12,
+						CodeRate:        "4/5",
+					},
+				},
+			},
+			expected: 1155072 * time.Microsecond,
+		},
+		{
+			name: "fsk",
+			size: 13,
+			txInfo: gw.DownlinkTXInfo{
+				ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+					FskModulationInfo: &gw.FSKModulationInfo{
+						Datarate: 50000,
+					},
+				},
+			},
+			expected: 3840 * time.Microsecond,
+		},
+		{
+			name: "invalid code-rate",
+			size: 13,
+			txInfo: gw.DownlinkTXInfo{
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: 7,
+						CodeRate:        "4/9",
+					},
+				},
+			},
+			err: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			toa, err := timeOnAir(tst.size, &tst.txInfo)
+			if tst.err {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tst.expected, toa)
+		})
+	}
+}
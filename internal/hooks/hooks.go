@@ -0,0 +1,244 @@
+// Package hooks implements the transformation of uplink frames, gateway
+// stats and downlink frames using user-provided Starlark scripts.
+package hooks
+
+import (
+	"bytes"
+	"encoding/base64"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+// Hook types. These are also the names of the functions that scripts must
+// define to implement the hook.
+const (
+	HookUplink   = "uplink"
+	HookStats    = "stats"
+	HookDownlink = "downlink"
+)
+
+// script holds a loaded script.
+type script struct {
+	name    string
+	globals starlark.StringDict
+}
+
+var (
+	mux     sync.RWMutex
+	scripts []script
+	timeout time.Duration
+)
+
+// predeclared holds the modules that are available to all scripts.
+var predeclared = starlark.StringDict{
+	"json": starlarkjson.Module,
+	"base64": &starlarkstruct.Module{
+		Name: "base64",
+		Members: starlark.StringDict{
+			"encode": starlark.NewBuiltin("base64.encode", base64Encode),
+			"decode": starlark.NewBuiltin("base64.decode", base64Decode),
+		},
+	},
+}
+
+// Setup configures the hooks package and loads the configured scripts.
+func Setup(conf config.Config) error {
+	mux.Lock()
+	defer mux.Unlock()
+
+	scripts = nil
+	timeout = conf.Hooks.Timeout
+
+	if len(conf.Hooks.Scripts) != 0 && timeout <= 0 {
+		return errors.New("timeout must be greater than zero")
+	}
+
+	for _, path := range conf.Hooks.Scripts {
+		thread := newThread(filepath.Base(path))
+		globals, err := starlark.ExecFile(thread, path, nil, predeclared)
+		if err != nil {
+			return errors.Wrapf(err, "load script error, script: %s", path)
+		}
+
+		// the scripts are called concurrently by the forwarder workers,
+		// freezing the globals makes these immutable and safe for
+		// concurrent use
+		globals.Freeze()
+
+		scripts = append(scripts, script{
+			name:    filepath.Base(path),
+			globals: globals,
+		})
+
+		log.WithFields(log.Fields{
+			"script": path,
+		}).Info("hooks: script loaded")
+	}
+
+	return nil
+}
+
+// UplinkFrame applies the uplink hooks to the given uplink frame. It returns
+// the resulting uplink frames.
+func UplinkFrame(pl gw.UplinkFrame) []gw.UplinkFrame {
+	var out []gw.UplinkFrame
+	for _, msg := range run(HookUplink, &pl, func() proto.Message { return &gw.UplinkFrame{} }) {
+		out = append(out, *msg.(*gw.UplinkFrame))
+	}
+	return out
+}
+
+// GatewayStats applies the stats hooks to the given gateway stats. It returns
+// the resulting gateway stats.
+func GatewayStats(pl gw.GatewayStats) []gw.GatewayStats {
+	var out []gw.GatewayStats
+	for _, msg := range run(HookStats, &pl, func() proto.Message { return &gw.GatewayStats{} }) {
+		out = append(out, *msg.(*gw.GatewayStats))
+	}
+	return out
+}
+
+// DownlinkFrame applies the downlink hooks to the given downlink frame. It
+// returns the resulting downlink frames.
+func DownlinkFrame(pl gw.DownlinkFrame) []gw.DownlinkFrame {
+	var out []gw.DownlinkFrame
+	for _, msg := range run(HookDownlink, &pl, func() proto.Message { return &gw.DownlinkFrame{} }) {
+		out = append(out, *msg.(*gw.DownlinkFrame))
+	}
+	return out
+}
+
+// run passes the given message through the scripts implementing the given
+// hook, in the configured order. When a script fails, its input is passed
+// unmodified to the next script.
+func run(hook string, msg proto.Message, newMsg func() proto.Message) []proto.Message {
+	mux.RLock()
+	defer mux.RUnlock()
+
+	msgs := []proto.Message{msg}
+
+	for _, s := range scripts {
+		fn, ok := s.globals[hook].(starlark.Callable)
+		if !ok {
+			continue
+		}
+
+		var next []proto.Message
+		for _, msg := range msgs {
+			out, err := s.call(fn, msg, newMsg)
+			if err != nil {
+				scriptErrorCounter(s.name, hook).Inc()
+				log.WithError(err).WithFields(log.Fields{
+					"script": s.name,
+					"hook":   hook,
+				}).Error("hooks: execute script error, skipping script")
+				next = append(next, msg)
+				continue
+			}
+			next = append(next, out...)
+		}
+		msgs = next
+	}
+
+	return msgs
+}
+
+// call calls the given script function. The function is called with the JSON
+// representation of the message as a dict. It must return the (modified)
+// dict, a list of dicts or None to drop the message.
+func (s script) call(fn starlark.Callable, msg proto.Message, newMsg func() proto.Message) ([]proto.Message, error) {
+	thread := newThread(s.name)
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel("timeout")
+	})
+	defer timer.Stop()
+
+	marshaler := jsonpb.Marshaler{
+		EmitDefaults: true,
+	}
+	str, err := marshaler.MarshalToString(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal message error")
+	}
+
+	in, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(str)}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "decode message error")
+	}
+
+	ret, err := starlark.Call(thread, fn, starlark.Tuple{in}, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "call error")
+	}
+
+	var values []starlark.Value
+	switch v := ret.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.List:
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i))
+		}
+	case starlark.Tuple:
+		values = v
+	default:
+		values = []starlark.Value{v}
+	}
+
+	var out []proto.Message
+	for _, v := range values {
+		b, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{v}, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "encode message error")
+		}
+
+		msg := newMsg()
+		if err := jsonpb.Unmarshal(bytes.NewReader([]byte(b.(starlark.String))), msg); err != nil {
+			return nil, errors.Wrap(err, "unmarshal message error")
+		}
+		out = append(out, msg)
+	}
+
+	return out, nil
+}
+
+func newThread(name string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.WithField("script", name).Info("hooks: " + msg)
+		},
+	}
+}
+
+func base64Encode(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var b starlark.Bytes
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &b); err != nil {
+		return nil, err
+	}
+	return starlark.String(base64.StdEncoding.EncodeToString([]byte(b))), nil
+}
+
+func base64Decode(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.Bytes(b), nil
+}
@@ -0,0 +1,240 @@
+package hooks
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+)
+
+func TestHooks(t *testing.T) {
+	uplink := gw.UplinkFrame{
+		PhyPayload: []byte{0x40, 0x01, 0x02, 0x03, 0x04},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Rssi:      -60,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		scripts  []string
+		expected []gw.UplinkFrame
+		errors   float64
+	}{
+		{
+			name:     "no scripts",
+			expected: []gw.UplinkFrame{uplink},
+		},
+		{
+			name: "script without uplink hook",
+			scripts: []string{`
+def stats(stats):
+  return None
+`},
+			expected: []gw.UplinkFrame{uplink},
+		},
+		{
+			name: "modify",
+			scripts: []string{`
+def uplink(frame):
+  frame["rxInfo"]["board"] = 2
+  return frame
+`},
+			expected: []gw.UplinkFrame{
+				{
+					PhyPayload: uplink.PhyPayload,
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId: uplink.RxInfo.GatewayId,
+						Rssi:      -60,
+						Board:     2,
+					},
+				},
+			},
+		},
+		{
+			name: "drop",
+			scripts: []string{`
+def uplink(frame):
+  phy = base64.decode(frame["phyPayload"])
+  if phy[1:5] == b"\x01\x02\x03\x04":
+    return None
+  return frame
+`},
+		},
+		{
+			name: "duplicate",
+			scripts: []string{`
+def uplink(frame):
+  return [frame, frame]
+`},
+			expected: []gw.UplinkFrame{uplink, uplink},
+		},
+		{
+			name: "chained",
+			scripts: []string{`
+def uplink(frame):
+  return [frame, frame]
+`, `
+def uplink(frame):
+  frame["rxInfo"]["rssi"] += 1
+  return frame
+`},
+			expected: []gw.UplinkFrame{
+				{
+					PhyPayload: uplink.PhyPayload,
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId: uplink.RxInfo.GatewayId,
+						Rssi:      -59,
+					},
+				},
+				{
+					PhyPayload: uplink.PhyPayload,
+					RxInfo: &gw.UplinkRXInfo{
+						GatewayId: uplink.RxInfo.GatewayId,
+						Rssi:      -59,
+					},
+				},
+			},
+		},
+		{
+			name: "error",
+			scripts: []string{`
+def uplink(frame):
+  return frame["foo"]
+`},
+			expected: []gw.UplinkFrame{uplink},
+			errors:   1,
+		},
+		{
+			name: "invalid message",
+			scripts: []string{`
+def uplink(frame):
+  frame["rxInfo"]["rssi"] = "foo"
+  return frame
+`},
+			expected: []gw.UplinkFrame{uplink},
+			errors:   1,
+		},
+		{
+			name: "modify frozen global",
+			scripts: []string{`
+seen = []
+
+def uplink(frame):
+  seen.append(frame)
+  return frame
+`},
+			expected: []gw.UplinkFrame{uplink},
+			errors:   1,
+		},
+		{
+			name: "timeout",
+			scripts: []string{`
+def uplink(frame):
+  for i in range(1000000000):
+    pass
+  return None
+`},
+			expected: []gw.UplinkFrame{uplink},
+			errors:   1,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			dir, err := ioutil.TempDir("", "hooks")
+			assert.NoError(err)
+			defer os.RemoveAll(dir)
+
+			var conf config.Config
+			conf.Hooks.Timeout = 100 * time.Millisecond
+
+			for i, s := range tst.scripts {
+				path := filepath.Join(dir, tst.name+string(rune('a'+i))+".star")
+				assert.NoError(ioutil.WriteFile(path, []byte(s), 0600))
+				conf.Hooks.Scripts = append(conf.Hooks.Scripts, path)
+			}
+
+			assert.NoError(Setup(conf))
+
+			var errCount float64
+			for _, s := range scripts {
+				errCount -= testutil.ToFloat64(scriptErrorCounter(s.name, HookUplink))
+			}
+
+			out := UplinkFrame(uplink)
+			assert.Len(out, len(tst.expected))
+			for i := range tst.expected {
+				assert.True(proto.Equal(&tst.expected[i], &out[i]), "expected: %s, got: %s", tst.expected[i].String(), out[i].String())
+			}
+
+			for _, s := range scripts {
+				errCount += testutil.ToFloat64(scriptErrorCounter(s.name, HookUplink))
+			}
+			assert.Equal(tst.errors, errCount)
+		})
+	}
+
+	t.Run("load error", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.Config
+		conf.Hooks.Timeout = time.Second
+		conf.Hooks.Scripts = []string{"/does/not/exist.star"}
+		assert.Error(Setup(conf))
+	})
+}
+
+func TestStatsAndDownlinkHooks(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "script.star")
+	assert.NoError(ioutil.WriteFile(path, []byte(`
+def stats(stats):
+  stats["metaData"]["env"] = "test"
+  return stats
+
+def downlink(frame):
+  for item in frame["items"]:
+    if item["txInfo"]["power"] > 14:
+      item["txInfo"]["power"] = 14
+  return frame
+`), 0600))
+
+	var conf config.Config
+	conf.Hooks.Timeout = time.Second
+	conf.Hooks.Scripts = []string{path}
+	assert.NoError(Setup(conf))
+
+	stats := GatewayStats(gw.GatewayStats{
+		GatewayId: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		MetaData:  map[string]string{"foo": "bar"},
+	})
+	assert.Len(stats, 1)
+	assert.Equal(map[string]string{"foo": "bar", "env": "test"}, stats[0].MetaData)
+
+	down := DownlinkFrame(gw.DownlinkFrame{
+		Items: []*gw.DownlinkFrameItem{
+			{TxInfo: &gw.DownlinkTXInfo{Power: 27}},
+			{TxInfo: &gw.DownlinkTXInfo{Power: 10}},
+		},
+	})
+	assert.Len(down, 1)
+	assert.EqualValues(14, down[0].Items[0].TxInfo.Power)
+	assert.EqualValues(10, down[0].Items[1].TxInfo.Power)
+}
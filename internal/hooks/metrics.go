@@ -0,0 +1,17 @@
+package hooks
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hooks_script_error_count",
+		Help: "The number of script errors, including timeouts (per script and hook).",
+	}, []string{"script", "hook"})
+)
+
+func scriptErrorCounter(script, hook string) prometheus.Counter {
+	return sec.With(prometheus.Labels{"script": script, "hook": hook})
+}
@@ -0,0 +1,526 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// StreamMethod defines the full method name of the bidirectional stream.
+// Each message of the stream is a google.protobuf.Any wrapping one of the
+// gw messages.
+const StreamMethod = "/chirpstack.gateway_bridge.GatewayBridgeService/Stream"
+
+// StreamDesc describes the bidirectional stream.
+var StreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// Backend implements a gRPC backend. The bridge opens a single bidirectional
+// stream to the server, over which the events and states of all gateways are
+// sent and the commands are received.
+type Backend struct {
+	name string
+
+	conn                    *grpc.ClientConn
+	terminateOnConnectError bool
+	maxReconnectInterval    time.Duration
+
+	streamMux sync.Mutex
+	stream    grpc.ClientStream
+	closed    bool
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]struct{}
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.IntegrationGRPC) (*Backend, error) {
+	b := Backend{
+		name:                    conf.Name,
+		terminateOnConnectError: conf.TerminateOnConnectError,
+		maxReconnectInterval:    conf.MaxReconnectInterval,
+		gateways:                make(map[lorawan.EUI64]struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	if conf.Server == "" {
+		return nil, errors.New("integration/grpc: server must be set")
+	}
+
+	dialOpts := []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conf.KeepAlive,
+			Timeout:             conf.KeepAlive,
+			PermitWithoutStream: true,
+		}),
+	}
+
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/grpc: new tls config error")
+	}
+	if tlsConfig != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	b.conn, err = grpc.Dial(conf.Server, dialOpts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/grpc: dial error")
+	}
+
+	return &b, nil
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	b.wg.Add(1)
+	go b.streamLoop()
+	return nil
+}
+
+// Stop stops the integration.
+func (b *Backend) Stop() error {
+	b.gatewaysMux.Lock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.gateways = make(map[lorawan.EUI64]struct{})
+	b.gatewaysMux.Unlock()
+
+	// Set gateway state to offline for all gateways.
+	for _, gatewayID := range gatewayIDs {
+		pl := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.PublishState(gatewayID, "conn", &pl); err != nil {
+			log.WithError(err).Error("integration/grpc: publish state error")
+		}
+	}
+
+	// Half-close the stream, such that the server can receive the pending
+	// messages before closing the stream.
+	b.streamMux.Lock()
+	b.closed = true
+	if b.stream != nil {
+		b.stream.CloseSend()
+	} else {
+		b.cancel()
+	}
+	b.streamMux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		b.cancel()
+		<-done
+	}
+	b.cancel()
+
+	return b.conn.Close()
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription sets or unsets the gateway. Commands are only
+// handled for subscribed gateways. The connection state of the gateway is
+// sent over the stream.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	log.WithFields(log.Fields{
+		"integration": b.name,
+		"gateway_id":  gatewayID,
+		"subscribe":   subscribe,
+	}).Debug("integration/grpc: set gateway subscription")
+
+	b.gatewaysMux.Lock()
+	_, subscribed := b.gateways[gatewayID]
+	if subscribe == subscribed {
+		b.gatewaysMux.Unlock()
+		return nil
+	}
+
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+	b.gatewaysMux.Unlock()
+
+	state := gw.ConnState_OFFLINE
+	if subscribe {
+		state = gw.ConnState_ONLINE
+	}
+
+	// When not connected, the ONLINE states are sent on connect.
+	if err := b.PublishState(gatewayID, "conn", &gw.ConnState{
+		GatewayId: gatewayID[:],
+		State:     state,
+	}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Warning("integration/grpc: publish conn state error")
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	grpcEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":    "uplink_",
+		"upset": "uplink_",
+		"ack":   "downlink_",
+		"stats": "stats_",
+		"exec":  "exec_",
+		"raw":   "raw_",
+	}
+
+	log.WithFields(log.Fields{
+		"integration":          b.name,
+		"gateway_id":           gatewayID,
+		"event":                event,
+		idPrefix[event] + "id": id,
+	}).Info("integration/grpc: publishing event")
+
+	return b.send(v)
+}
+
+// PublishState publishes the given state.
+func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	grpcStateCounter(state).Inc()
+
+	log.WithFields(log.Fields{
+		"integration": b.name,
+		"gateway_id":  gatewayID,
+		"state":       state,
+	}).Info("integration/grpc: publishing state")
+
+	return b.send(v)
+}
+
+// send wraps the given message in an Any message and sends it over the
+// stream.
+func (b *Backend) send(msg proto.Message) error {
+	a, err := ptypes.MarshalAny(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal any error")
+	}
+
+	b.streamMux.Lock()
+	defer b.streamMux.Unlock()
+
+	if b.stream == nil {
+		return errors.New("not connected")
+	}
+
+	if err := b.stream.SendMsg(a); err != nil {
+		return errors.Wrap(err, "send message error")
+	}
+
+	return nil
+}
+
+// streamLoop (re)opens the stream and receives the commands, until the
+// integration is stopped. Between reconnects, it backs off exponentially up
+// to the max reconnect interval.
+func (b *Backend) streamLoop() {
+	defer b.wg.Done()
+
+	interval := time.Second
+
+	for {
+		stream, err := b.conn.NewStream(b.ctx, &StreamDesc, StreamMethod)
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			if b.terminateOnConnectError {
+				log.Fatal(err)
+			}
+
+			log.WithError(err).WithField("integration", b.name).Error("integration/grpc: open stream error")
+
+			select {
+			case <-time.After(interval):
+			case <-b.ctx.Done():
+				return
+			}
+
+			interval *= 2
+			if b.maxReconnectInterval > 0 && interval > b.maxReconnectInterval {
+				interval = b.maxReconnectInterval
+			}
+			continue
+		}
+
+		interval = time.Second
+		grpcConnectCounter().Inc()
+		log.WithField("integration", b.name).Info("integration/grpc: stream opened")
+
+		b.streamMux.Lock()
+		if b.closed {
+			b.streamMux.Unlock()
+			stream.CloseSend()
+			return
+		}
+		b.stream = stream
+		b.streamMux.Unlock()
+
+		b.publishOnline()
+
+		err = b.receiveLoop(stream)
+
+		b.streamMux.Lock()
+		b.stream = nil
+		closed := b.closed
+		b.streamMux.Unlock()
+
+		if closed || b.ctx.Err() != nil {
+			return
+		}
+
+		grpcDisconnectCounter().Inc()
+		log.WithError(err).WithField("integration", b.name).Error("integration/grpc: stream error")
+	}
+}
+
+// publishOnline publishes the ONLINE state of all subscribed gateways.
+func (b *Backend) publishOnline() {
+	b.gatewaysMux.RLock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.gatewaysMux.RUnlock()
+
+	for _, gatewayID := range gatewayIDs {
+		if err := b.PublishState(gatewayID, "conn", &gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_ONLINE,
+		}); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/grpc: publish conn state error")
+		}
+	}
+}
+
+// receiveLoop receives the commands from the given stream until it returns
+// an error.
+func (b *Backend) receiveLoop(stream grpc.ClientStream) error {
+	for {
+		var a any.Any
+		if err := stream.RecvMsg(&a); err != nil {
+			return err
+		}
+
+		if err := b.handleCommand(&a); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"integration": b.name,
+				"type_url":    a.GetTypeUrl(),
+			}).Error("integration/grpc: handle command error")
+		}
+	}
+}
+
+// handleCommand unwraps the given command and calls its handler func, when
+// it is addressed to one of the subscribed gateways.
+func (b *Backend) handleCommand(a *any.Any) error {
+	var gatewayID lorawan.EUI64
+
+	switch {
+	case ptypes.Is(a, &gw.DownlinkFrame{}):
+		var downlinkFrame gw.DownlinkFrame
+		if err := ptypes.UnmarshalAny(a, &downlinkFrame); err != nil {
+			return errors.Wrap(err, "unmarshal downlink frame error")
+		}
+
+		if len(downlinkFrame.Items) == 0 {
+			return errors.New("downlink must have at least one item")
+		}
+
+		copy(gatewayID[:], downlinkFrame.GetGatewayId())
+		if !b.isSubscribed(gatewayID) {
+			return nil
+		}
+
+		var downID uuid.UUID
+		copy(downID[:], downlinkFrame.GetDownlinkId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"downlink_id": downID,
+		}).Info("integration/grpc: downlink frame received")
+
+		grpcCommandCounter("down").Inc()
+		if b.downlinkFrameFunc != nil {
+			b.downlinkFrameFunc(downlinkFrame)
+		}
+	case ptypes.Is(a, &gw.GatewayConfiguration{}):
+		var gatewayConfig gw.GatewayConfiguration
+		if err := ptypes.UnmarshalAny(a, &gatewayConfig); err != nil {
+			return errors.Wrap(err, "unmarshal gateway configuration error")
+		}
+
+		copy(gatewayID[:], gatewayConfig.GetGatewayId())
+		if !b.isSubscribed(gatewayID) {
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+		}).Info("integration/grpc: gateway configuration received")
+
+		grpcCommandCounter("config").Inc()
+		if b.gatewayConfigurationFunc != nil {
+			b.gatewayConfigurationFunc(gatewayConfig)
+		}
+	case ptypes.Is(a, &gw.GatewayCommandExecRequest{}):
+		var execReq gw.GatewayCommandExecRequest
+		if err := ptypes.UnmarshalAny(a, &execReq); err != nil {
+			return errors.Wrap(err, "unmarshal gateway command execution request error")
+		}
+
+		copy(gatewayID[:], execReq.GetGatewayId())
+		if !b.isSubscribed(gatewayID) {
+			return nil
+		}
+
+		var execID uuid.UUID
+		copy(execID[:], execReq.GetExecId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"exec_id":     execID,
+		}).Info("integration/grpc: gateway command execution request received")
+
+		grpcCommandCounter("exec").Inc()
+		if b.gatewayCommandExecRequestFunc != nil {
+			b.gatewayCommandExecRequestFunc(execReq)
+		}
+	case ptypes.Is(a, &gw.RawPacketForwarderCommand{}):
+		var rawCmd gw.RawPacketForwarderCommand
+		if err := ptypes.UnmarshalAny(a, &rawCmd); err != nil {
+			return errors.Wrap(err, "unmarshal raw packet-forwarder command error")
+		}
+
+		copy(gatewayID[:], rawCmd.GetGatewayId())
+		if !b.isSubscribed(gatewayID) {
+			return nil
+		}
+
+		var rawID uuid.UUID
+		copy(rawID[:], rawCmd.GetRawId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"raw_id":      rawID,
+		}).Info("integration/grpc: raw packet-forwarder command received")
+
+		grpcCommandCounter("raw").Inc()
+		if b.rawPacketForwarderCommandFunc != nil {
+			b.rawPacketForwarderCommandFunc(rawCmd)
+		}
+	default:
+		return errors.New("unexpected command type")
+	}
+
+	return nil
+}
+
+// isSubscribed returns true when the given gateway is subscribed.
+func (b *Backend) isSubscribed(gatewayID lorawan.EUI64) bool {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+
+	_, ok := b.gateways[gatewayID]
+	return ok
+}
+
+func newTLSConfig(conf config.IntegrationGRPC) (*tls.Config, error) {
+	if !conf.TLS && conf.CACert == "" && conf.TLSCert == "" && conf.TLSKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if conf.CACert != "" {
+		cacert, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca-cert error")
+		}
+		certpool := x509.NewCertPool()
+		certpool.AppendCertsFromPEM(cacert)
+
+		tlsConfig.RootCAs = certpool
+	}
+
+	if conf.TLSCert != "" && conf.TLSKey != "" {
+		kp, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	return tlsConfig, nil
+}
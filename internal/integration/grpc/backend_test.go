@@ -0,0 +1,176 @@
+package grpc
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// testServer implements the server side of the stream.
+type testServer struct {
+	received chan proto.Message
+	commands chan proto.Message
+}
+
+func (ts *testServer) handleStream(srv interface{}, stream grpc.ServerStream) error {
+	go func() {
+		for msg := range ts.commands {
+			a, err := ptypes.MarshalAny(msg)
+			if err != nil {
+				panic(err)
+			}
+			if err := stream.SendMsg(a); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var a any.Any
+		if err := stream.RecvMsg(&a); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var da ptypes.DynamicAny
+		if err := ptypes.UnmarshalAny(&a, &da); err != nil {
+			return err
+		}
+		ts.received <- da.Message
+	}
+}
+
+func newTestServer(t *testing.T) (*testServer, string) {
+	ts := &testServer{
+		received: make(chan proto.Message, 10),
+		commands: make(chan proto.Message, 10),
+	}
+
+	method := strings.Split(strings.TrimPrefix(StreamMethod, "/"), "/")
+
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: method[0],
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{
+			{
+				StreamName:    method[1],
+				Handler:       ts.handleStream,
+				ServerStreams: true,
+				ClientStreams: true,
+			},
+		},
+	}, ts)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	return ts, ln.Addr().String()
+}
+
+func TestBackend(t *testing.T) {
+	assert := require.New(t)
+
+	ts, addr := newTestServer(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.IntegrationGRPC
+	conf.Server = addr
+	conf.KeepAlive = 30 * time.Second
+	conf.MaxReconnectInterval = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	downChan := make(chan gw.DownlinkFrame, 1)
+	b.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downChan <- pl
+	})
+
+	// The ONLINE state is sent once the stream has been opened.
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+	assert.NoError(b.Start())
+
+	receive := func() proto.Message {
+		select {
+		case msg := <-ts.received:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected message")
+		}
+		return nil
+	}
+
+	t.Run("conn state", func(t *testing.T) {
+		assert := require.New(t)
+		assert.True(proto.Equal(&gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_ONLINE,
+		}, receive()))
+	})
+
+	t.Run("uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		up := gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}}
+		assert.NoError(b.PublishEvent(gatewayID, "up", uuid.Nil, &up))
+		assert.True(proto.Equal(&up, receive()))
+	})
+
+	t.Run("downlink other gateway", func(t *testing.T) {
+		ts.commands <- &gw.DownlinkFrame{
+			GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			Items:     []*gw.DownlinkFrameItem{{PhyPayload: []byte{1}}},
+		}
+
+		select {
+		case <-downChan:
+			t.Fatal("unexpected downlink")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("downlink", func(t *testing.T) {
+		assert := require.New(t)
+
+		down := gw.DownlinkFrame{
+			GatewayId: gatewayID[:],
+			Items:     []*gw.DownlinkFrameItem{{PhyPayload: []byte{1, 2, 3}}},
+		}
+		ts.commands <- &down
+
+		select {
+		case pl := <-downChan:
+			assert.True(proto.Equal(&down, &pl))
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected downlink")
+		}
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(b.Stop())
+		assert.True(proto.Equal(&gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}, receive()))
+	})
+}
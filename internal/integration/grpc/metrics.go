@@ -0,0 +1,53 @@
+package grpc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_grpc_event_count",
+		Help: "The number of gateway events published by the gRPC integration (per event).",
+	}, []string{"event"})
+
+	sc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_grpc_state_count",
+		Help: "The number of gateway states published by the gRPC integration (per state).",
+	}, []string{"state"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_grpc_command_count",
+		Help: "The number of commands received by the gRPC integration (per command).",
+	}, []string{"command"})
+
+	grpcc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_grpc_connect_count",
+		Help: "The number of times the integration opened the stream to the gRPC server.",
+	})
+
+	grpcd = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_grpc_disconnect_count",
+		Help: "The number of times the stream to the gRPC server was closed unexpectedly.",
+	})
+)
+
+func grpcEventCounter(e string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"event": e})
+}
+
+func grpcStateCounter(s string) prometheus.Counter {
+	return sc.With(prometheus.Labels{"state": s})
+}
+
+func grpcCommandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
+
+func grpcConnectCounter() prometheus.Counter {
+	return grpcc
+}
+
+func grpcDisconnectCounter() prometheus.Counter {
+	return grpcd
+}
@@ -0,0 +1,726 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// Command modes.
+const (
+	CommandModeNone   = ""
+	CommandModeServer = "server"
+	CommandModePoll   = "poll"
+)
+
+// CommandHeader holds the name of the header containing the command type of
+// a long-polling response.
+const CommandHeader = "X-Gateway-Command"
+
+// Backend implements a HTTP backend.
+type Backend struct {
+	name string
+
+	client           *http.Client
+	headers          map[string]string
+	contentType      string
+	maxRetries       int
+	retryInterval    time.Duration
+	maxRetryInterval time.Duration
+
+	eventURLTemplate *template.Template
+	stateURLTemplate *template.Template
+
+	commandMode     string
+	server          *http.Server
+	tlsCert         string
+	tlsKey          string
+	bearerToken     string
+	pollURLTemplate *template.Template
+	pollClient      *http.Client
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]context.CancelFunc
+
+	marshal   func(msg proto.Message) ([]byte, error)
+	unmarshal func(b []byte, msg proto.Message) error
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.IntegrationHTTP) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		name:             conf.Name,
+		client:           &http.Client{Timeout: conf.Timeout},
+		headers:          conf.Headers,
+		maxRetries:       conf.MaxRetries,
+		retryInterval:    conf.RetryInterval,
+		maxRetryInterval: conf.MaxRetryInterval,
+		commandMode:      conf.Command.Mode,
+		tlsCert:          conf.Command.TLSCert,
+		tlsKey:           conf.Command.TLSKey,
+		bearerToken:      conf.Command.BearerToken,
+		gateways:         make(map[lorawan.EUI64]context.CancelFunc),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	m, err := marshaler.Get(conf.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/http: get marshaler error")
+	}
+	b.marshal = m.Marshal
+	b.unmarshal = m.Unmarshal
+	b.contentType = m.ContentType
+
+	if conf.EventURLTemplate == "" {
+		return nil, errors.New("integration/http: event_url_template must be set")
+	}
+
+	b.eventURLTemplate, err = template.New("event").Parse(conf.EventURLTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/http: parse event-url template error")
+	}
+
+	if conf.StateURLTemplate != "" {
+		b.stateURLTemplate, err = template.New("state").Parse(conf.StateURLTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/http: parse state-url template error")
+		}
+	}
+
+	switch conf.Command.Mode {
+	case CommandModeNone:
+	case CommandModeServer:
+		if err := b.setupCommandServer(conf); err != nil {
+			return nil, errors.Wrap(err, "integration/http: setup command server error")
+		}
+	case CommandModePoll:
+		if conf.Command.PollURLTemplate == "" {
+			return nil, errors.New("integration/http: command.poll_url_template must be set")
+		}
+
+		b.pollURLTemplate, err = template.New("poll").Parse(conf.Command.PollURLTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/http: parse poll-url template error")
+		}
+		b.pollClient = &http.Client{Timeout: conf.Command.PollTimeout}
+	default:
+		return nil, fmt.Errorf("integration/http: unknown command mode: %s", conf.Command.Mode)
+	}
+
+	return &b, nil
+}
+
+// setupCommandServer configures the command server. As commands are sent to
+// the gateways, the server must be authenticated unless it only accepts
+// connections from the local host.
+func (b *Backend) setupCommandServer(conf config.IntegrationHTTP) error {
+	if (b.tlsCert == "") != (b.tlsKey == "") {
+		return errors.New("command.tls_cert and command.tls_key must both be set")
+	}
+
+	// without the TLS certificate, the server would fall back to plain HTTP
+	// and the client certificates would never be verified.
+	if conf.Command.CACert != "" && b.tlsCert == "" {
+		return errors.New("command.ca_cert requires command.tls_cert and command.tls_key to be set")
+	}
+
+	if b.bearerToken == "" && conf.Command.CACert == "" && !isLoopbackBind(conf.Command.Bind) {
+		return errors.New("command.bearer_token or command.ca_cert must be set when binding to a non-loopback address")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gateway/", b.handleCommandRequest)
+	b.server = &http.Server{
+		Addr:    conf.Command.Bind,
+		Handler: b.authenticate(mux),
+	}
+
+	// if the CA cert is configured, setup client certificate verification.
+	if conf.Command.CACert != "" {
+		rawCACert, err := ioutil.ReadFile(conf.Command.CACert)
+		if err != nil {
+			return errors.Wrap(err, "read ca cert error")
+		}
+
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(rawCACert)
+
+		b.server.TLSConfig = &tls.Config{
+			ClientCAs:  caCertPool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	return nil
+}
+
+// isLoopbackBind returns true when the given bind address only accepts
+// connections from the local host.
+func isLoopbackBind(bind string) bool {
+	host, _, err := net.SplitHostPort(bind)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authenticate wraps the given handler with bearer-token authentication, when
+// a bearer token has been configured.
+func (b *Backend) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.bearerToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(b.bearerToken)) != 1 {
+				http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	if b.server == nil {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"integration": b.name,
+		"bind":        b.server.Addr,
+	}).Info("integration/http: starting command server")
+
+	go func() {
+		var err error
+		if b.tlsCert != "" && b.tlsKey != "" {
+			err = b.server.ListenAndServeTLS(b.tlsCert, b.tlsKey)
+		} else {
+			err = b.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).WithField("integration", b.name).Fatal("integration/http: command server error")
+		}
+	}()
+
+	return nil
+}
+
+// Stop stops the integration.
+func (b *Backend) Stop() error {
+	b.gatewaysMux.Lock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID, cancel := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+		if cancel != nil {
+			cancel()
+		}
+	}
+	b.gateways = make(map[lorawan.EUI64]context.CancelFunc)
+	b.gatewaysMux.Unlock()
+
+	// Set gateway state to offline for all gateways.
+	for _, gatewayID := range gatewayIDs {
+		pl := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.PublishState(gatewayID, "conn", &pl); err != nil {
+			log.WithError(err).Error("integration/http: publish state error")
+		}
+	}
+
+	b.cancel()
+	b.wg.Wait()
+
+	if b.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return b.server.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription sets or unsets the gateway. Commands are only
+// accepted for subscribed gateways. In poll mode, a long-polling loop is
+// started for each subscribed gateway.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	log.WithFields(log.Fields{
+		"integration": b.name,
+		"gateway_id":  gatewayID,
+		"subscribe":   subscribe,
+	}).Debug("integration/http: set gateway subscription")
+
+	b.gatewaysMux.Lock()
+	cancel, subscribed := b.gateways[gatewayID]
+
+	if subscribe == subscribed {
+		b.gatewaysMux.Unlock()
+		return nil
+	}
+
+	if subscribe {
+		var ctx context.Context
+		if b.pollURLTemplate != nil {
+			ctx, cancel = context.WithCancel(b.ctx)
+		}
+		b.gateways[gatewayID] = cancel
+
+		if ctx != nil {
+			b.wg.Add(1)
+			go b.pollLoop(ctx, gatewayID)
+		}
+	} else {
+		if cancel != nil {
+			cancel()
+		}
+		delete(b.gateways, gatewayID)
+	}
+	b.gatewaysMux.Unlock()
+
+	state := gw.ConnState_OFFLINE
+	if subscribe {
+		state = gw.ConnState_ONLINE
+	}
+
+	// The state is published synchronously, as the subscriptions of a
+	// gateway are set in order. Publishing it in the background could
+	// reverse the ONLINE and OFFLINE states.
+	if err := b.PublishState(gatewayID, "conn", &gw.ConnState{
+		GatewayId: gatewayID[:],
+		State:     state,
+	}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/http: publish conn state error")
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	httpEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":    "uplink_",
+		"upset": "uplink_",
+		"ack":   "downlink_",
+		"stats": "stats_",
+		"exec":  "exec_",
+		"raw":   "raw_",
+	}
+
+	url := bytes.NewBuffer(nil)
+	if err := b.eventURLTemplate.Execute(url, struct {
+		GatewayID lorawan.EUI64
+		EventType string
+	}{gatewayID, event}); err != nil {
+		return errors.Wrap(err, "execute event template error")
+	}
+
+	return b.post(url.String(), log.Fields{
+		idPrefix[event] + "id": id,
+		"event":                event,
+		"gateway_id":           gatewayID,
+	}, v)
+}
+
+// PublishState publishes the given state.
+func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	if b.stateURLTemplate == nil {
+		log.WithFields(log.Fields{
+			"state":      state,
+			"gateway_id": gatewayID,
+		}).Debug("integration/http: ignoring publish state, no state_url_template configured")
+		return nil
+	}
+
+	httpStateCounter(state).Inc()
+
+	url := bytes.NewBuffer(nil)
+	if err := b.stateURLTemplate.Execute(url, struct {
+		GatewayID lorawan.EUI64
+		StateType string
+	}{gatewayID, state}); err != nil {
+		return errors.Wrap(err, "execute state template error")
+	}
+
+	return b.post(url.String(), log.Fields{
+		"state":      state,
+		"gateway_id": gatewayID,
+	}, v)
+}
+
+// post marshals and posts the given message to the given URL. Failed requests
+// (network errors, 429 and 5xx responses) are retried with an exponential
+// backoff, up to the configured number of retries.
+func (b *Backend) post(url string, fields log.Fields, msg proto.Message) error {
+	pl, err := b.marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	fields["integration"] = b.name
+	fields["url"] = url
+
+	log.WithFields(fields).Info("integration/http: posting message")
+
+	interval := b.retryInterval
+	for attempt := 0; ; attempt++ {
+		retry, err := b.doPost(url, pl)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= b.maxRetries {
+			httpErrorCounter().Inc()
+			return errors.Wrap(err, "post message error")
+		}
+
+		log.WithError(err).WithFields(fields).WithField("retry_in", interval).Warning("integration/http: post message error, retrying")
+		httpRetryCounter().Inc()
+
+		select {
+		case <-time.After(interval):
+		case <-b.ctx.Done():
+			return errors.Wrap(err, "post message error")
+		}
+
+		interval *= 2
+		if b.maxRetryInterval > 0 && interval > b.maxRetryInterval {
+			interval = b.maxRetryInterval
+		}
+	}
+}
+
+// doPost performs a single POST request. It returns whether the request can
+// be retried in case of an error.
+func (b *Backend) doPost(url string, pl []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(pl))
+	if err != nil {
+		return false, errors.Wrap(err, "new request error")
+	}
+	req.Header.Set("Content-Type", b.contentType)
+	for k, v := range b.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("expected 2xx response, got: %d", resp.StatusCode)
+	}
+
+	return false, nil
+}
+
+// handleCommandRequest handles the commands posted to
+// /gateway/<gateway_id>/command/<command>.
+func (b *Backend) handleCommandRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "gateway" || parts[2] != "command" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(parts[1])); err != nil {
+		http.Error(w, "invalid gateway id", http.StatusBadRequest)
+		return
+	}
+
+	if !b.isSubscribed(gatewayID) {
+		http.Error(w, "gateway is not connected", http.StatusNotFound)
+		return
+	}
+
+	pl, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := b.handleCommand(gatewayID, parts[3], pl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// pollLoop long-polls the command endpoint of the given gateway until the
+// context is cancelled.
+func (b *Backend) pollLoop(ctx context.Context, gatewayID lorawan.EUI64) {
+	defer b.wg.Done()
+
+	url := bytes.NewBuffer(nil)
+	if err := b.pollURLTemplate.Execute(url, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/http: execute poll template error")
+		return
+	}
+
+	for {
+		if err := b.poll(ctx, gatewayID, url.String()); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.WithError(err).WithFields(log.Fields{
+				"integration": b.name,
+				"gateway_id":  gatewayID,
+				"url":         url.String(),
+			}).Error("integration/http: poll commands error")
+
+			select {
+			case <-time.After(b.retryInterval):
+			case <-ctx.Done():
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// poll performs a single long-polling request. A 200 response must contain
+// the command type in the CommandHeader header, a 204 response indicates
+// that there was no command.
+func (b *Backend) poll(ctx context.Context, gatewayID lorawan.EUI64, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrap(err, "new request error")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", b.contentType)
+	for k, v := range b.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := b.pollClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	pl, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "read body error")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		return b.handleCommand(gatewayID, resp.Header.Get(CommandHeader), pl)
+	default:
+		return fmt.Errorf("expected 200 or 204 response, got: %d", resp.StatusCode)
+	}
+}
+
+// handleCommand unmarshals the given command payload and calls the handler
+// func of the command.
+func (b *Backend) handleCommand(gatewayID lorawan.EUI64, command string, pl []byte) error {
+	switch command {
+	case "down":
+		var downlinkFrame gw.DownlinkFrame
+		if err := b.unmarshal(pl, &downlinkFrame); err != nil {
+			return errors.Wrap(err, "unmarshal downlink frame error")
+		}
+
+		// For backwards compatibility.
+		if len(downlinkFrame.Items) == 0 && (downlinkFrame.TxInfo != nil && len(downlinkFrame.PhyPayload) != 0) {
+			downlinkFrame.Items = append(downlinkFrame.Items, &gw.DownlinkFrameItem{
+				PhyPayload: downlinkFrame.PhyPayload,
+				TxInfo:     downlinkFrame.TxInfo,
+			})
+
+			downlinkFrame.GatewayId = downlinkFrame.Items[0].GetTxInfo().GetGatewayId()
+		}
+
+		if len(downlinkFrame.Items) == 0 {
+			return errors.New("downlink must have at least one item")
+		}
+
+		if err := checkGatewayID(gatewayID, &downlinkFrame.GatewayId); err != nil {
+			return err
+		}
+
+		var downID uuid.UUID
+		copy(downID[:], downlinkFrame.GetDownlinkId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"downlink_id": downID,
+		}).Info("integration/http: downlink frame received")
+
+		httpCommandCounter(command).Inc()
+		if b.downlinkFrameFunc != nil {
+			b.downlinkFrameFunc(downlinkFrame)
+		}
+	case "config":
+		var gatewayConfig gw.GatewayConfiguration
+		if err := b.unmarshal(pl, &gatewayConfig); err != nil {
+			return errors.Wrap(err, "unmarshal gateway configuration error")
+		}
+
+		if err := checkGatewayID(gatewayID, &gatewayConfig.GatewayId); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+		}).Info("integration/http: gateway configuration received")
+
+		httpCommandCounter(command).Inc()
+		if b.gatewayConfigurationFunc != nil {
+			b.gatewayConfigurationFunc(gatewayConfig)
+		}
+	case "exec":
+		var execReq gw.GatewayCommandExecRequest
+		if err := b.unmarshal(pl, &execReq); err != nil {
+			return errors.Wrap(err, "unmarshal gateway command execution request error")
+		}
+
+		if err := checkGatewayID(gatewayID, &execReq.GatewayId); err != nil {
+			return err
+		}
+
+		var execID uuid.UUID
+		copy(execID[:], execReq.GetExecId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"exec_id":     execID,
+		}).Info("integration/http: gateway command execution request received")
+
+		httpCommandCounter(command).Inc()
+		if b.gatewayCommandExecRequestFunc != nil {
+			b.gatewayCommandExecRequestFunc(execReq)
+		}
+	case "raw":
+		var rawCmd gw.RawPacketForwarderCommand
+		if err := b.unmarshal(pl, &rawCmd); err != nil {
+			return errors.Wrap(err, "unmarshal raw packet-forwarder command error")
+		}
+
+		if err := checkGatewayID(gatewayID, &rawCmd.GatewayId); err != nil {
+			return err
+		}
+
+		var rawID uuid.UUID
+		copy(rawID[:], rawCmd.GetRawId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"raw_id":      rawID,
+		}).Info("integration/http: raw packet-forwarder command received")
+
+		httpCommandCounter(command).Inc()
+		if b.rawPacketForwarderCommandFunc != nil {
+			b.rawPacketForwarderCommandFunc(rawCmd)
+		}
+	default:
+		return fmt.Errorf("unexpected command: %s", command)
+	}
+
+	return nil
+}
+
+// checkGatewayID validates that the gateway ID of the command payload matches
+// the gateway ID of the command, as the payload gateway ID is used for
+// routing the command. When the payload does not contain a gateway ID, it is
+// set to the gateway ID of the command.
+func checkGatewayID(gatewayID lorawan.EUI64, payloadGatewayID *[]byte) error {
+	if len(*payloadGatewayID) == 0 {
+		*payloadGatewayID = append([]byte{}, gatewayID[:]...)
+		return nil
+	}
+
+	if !bytes.Equal(*payloadGatewayID, gatewayID[:]) {
+		return errors.New("gateway_id of payload does not match the gateway id of the command")
+	}
+
+	return nil
+}
+
+// isSubscribed returns true when the given gateway is subscribed.
+func (b *Backend) isSubscribed(gatewayID lorawan.EUI64) bool {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+
+	_, ok := b.gateways[gatewayID]
+	return ok
+}
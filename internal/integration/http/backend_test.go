@@ -0,0 +1,387 @@
+package http
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestPublishEvent(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Responses     []int
+		MaxRetries    int
+		ExpectedCalls int
+		ExpectedError bool
+	}{
+		{
+			Name:          "success",
+			Responses:     []int{http.StatusOK},
+			MaxRetries:    3,
+			ExpectedCalls: 1,
+		},
+		{
+			Name:          "retry on 5xx",
+			Responses:     []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent},
+			MaxRetries:    3,
+			ExpectedCalls: 3,
+		},
+		{
+			Name:          "retries exhausted",
+			Responses:     []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			MaxRetries:    2,
+			ExpectedCalls: 3,
+			ExpectedError: true,
+		},
+		{
+			Name:          "no retry on 4xx",
+			Responses:     []int{http.StatusBadRequest},
+			MaxRetries:    3,
+			ExpectedCalls: 1,
+			ExpectedError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var mux sync.Mutex
+			var paths []string
+			var bodies [][]byte
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mux.Lock()
+				defer mux.Unlock()
+
+				b, _ := ioutil.ReadAll(r.Body)
+				assert.Equal("application/json", r.Header.Get("Content-Type"))
+				assert.Equal("secret", r.Header.Get("Authorization"))
+
+				paths = append(paths, r.URL.Path)
+				bodies = append(bodies, b)
+				w.WriteHeader(tst.Responses[len(paths)-1])
+			}))
+			defer server.Close()
+
+			var conf config.IntegrationHTTP
+			conf.Marshaler = "json"
+			conf.EventURLTemplate = server.URL + "/gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+			conf.Headers = map[string]string{"Authorization": "secret"}
+			conf.Timeout = time.Second
+			conf.MaxRetries = tst.MaxRetries
+			conf.RetryInterval = time.Millisecond
+
+			b, err := NewBackend(conf)
+			assert.NoError(err)
+
+			gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+			err = b.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}})
+			if tst.ExpectedError {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+
+			assert.Len(paths, tst.ExpectedCalls)
+			assert.Equal("/gateway/0102030405060708/event/up", paths[0])
+
+			var up gw.UplinkFrame
+			assert.NoError(jsonpb.Unmarshal(bytes.NewReader(bodies[0]), &up))
+			assert.Equal([]byte{1, 2, 3}, up.PhyPayload)
+		})
+	}
+}
+
+func TestConnStateOrdering(t *testing.T) {
+	assert := require.New(t)
+
+	var mux sync.Mutex
+	var states []gw.ConnState_State
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pl gw.ConnState
+		assert.NoError(jsonpb.Unmarshal(r.Body, &pl))
+
+		mux.Lock()
+		states = append(states, pl.State)
+		mux.Unlock()
+	}))
+	defer server.Close()
+
+	var conf config.IntegrationHTTP
+	conf.Marshaler = "json"
+	conf.EventURLTemplate = server.URL + "/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateURLTemplate = server.URL + "/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.Timeout = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+	assert.NoError(b.SetGatewaySubscription(false, gatewayID))
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+	mux.Lock()
+	defer mux.Unlock()
+	assert.Equal([]gw.ConnState_State{gw.ConnState_ONLINE, gw.ConnState_OFFLINE, gw.ConnState_ONLINE}, states)
+}
+
+func TestCommandServer(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.IntegrationHTTP
+	conf.Marshaler = "json"
+	conf.EventURLTemplate = "http://localhost/{{ .GatewayID }}/{{ .EventType }}"
+	conf.Command.Mode = CommandModeServer
+	conf.Command.Bind = "127.0.0.1:3002"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	downChan := make(chan gw.DownlinkFrame, 1)
+	b.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downChan <- pl
+	})
+
+	server := httptest.NewServer(b.server.Handler)
+	defer server.Close()
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	pl := `{"gatewayID": "AQIDBAUGBwg=", "items": [{"phyPayload": "AQID"}]}`
+
+	t.Run("gateway not subscribed", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/down", "application/json", bytes.NewBufferString(pl))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("gateway subscribed", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/down", "application/json", bytes.NewBufferString(pl))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+		down := <-downChan
+		assert.Equal(gatewayID[:], down.GatewayId)
+		assert.Equal([]byte{1, 2, 3}, down.Items[0].PhyPayload)
+	})
+
+	t.Run("gateway id mismatch", func(t *testing.T) {
+		assert := require.New(t)
+
+		otherPL := `{"gatewayID": "CAcGBQQDAgE=", "items": [{"phyPayload": "AQID"}]}`
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/down", "application/json", bytes.NewBufferString(otherPL))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		assert.Len(downChan, 0)
+	})
+
+	t.Run("gateway id from command", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/down", "application/json", bytes.NewBufferString(`{"items": [{"phyPayload": "AQID"}]}`))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+		down := <-downChan
+		assert.Equal(gatewayID[:], down.GatewayId)
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/foo", "application/json", bytes.NewBufferString(pl))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("gateway unsubscribed", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(b.SetGatewaySubscription(false, gatewayID))
+
+		resp, err := http.Post(server.URL+"/gateway/0102030405060708/command/down", "application/json", bytes.NewBufferString(pl))
+		assert.NoError(err)
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestCommandServerSecurity(t *testing.T) {
+	tests := []struct {
+		name          string
+		bind          string
+		bearerToken   string
+		caCert        string
+		tlsCert       string
+		tlsKey        string
+		expectedError string
+	}{
+		{
+			name: "loopback without authentication",
+			bind: "127.0.0.1:3002",
+		},
+		{
+			name: "localhost without authentication",
+			bind: "localhost:3002",
+		},
+		{
+			name:          "non-loopback without authentication",
+			bind:          ":3002",
+			expectedError: "integration/http: setup command server error: command.bearer_token or command.ca_cert must be set when binding to a non-loopback address",
+		},
+		{
+			name:        "non-loopback with bearer token",
+			bind:        ":3002",
+			bearerToken: "secret",
+		},
+		{
+			name:          "ca cert without tls cert",
+			bind:          ":3002",
+			caCert:        "ca.pem",
+			expectedError: "integration/http: setup command server error: command.ca_cert requires command.tls_cert and command.tls_key to be set",
+		},
+		{
+			name:          "tls cert without key",
+			bind:          "127.0.0.1:3002",
+			tlsCert:       "cert.pem",
+			expectedError: "integration/http: setup command server error: command.tls_cert and command.tls_key must both be set",
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var conf config.IntegrationHTTP
+			conf.Marshaler = "json"
+			conf.EventURLTemplate = "http://localhost/{{ .GatewayID }}/{{ .EventType }}"
+			conf.Command.Mode = CommandModeServer
+			conf.Command.Bind = tst.bind
+			conf.Command.BearerToken = tst.bearerToken
+			conf.Command.CACert = tst.caCert
+			conf.Command.TLSCert = tst.tlsCert
+			conf.Command.TLSKey = tst.tlsKey
+
+			_, err := NewBackend(conf)
+			if tst.expectedError != "" {
+				assert.EqualError(err, tst.expectedError)
+			} else {
+				assert.NoError(err)
+			}
+		})
+	}
+
+	t.Run("bearer token", func(t *testing.T) {
+		assert := require.New(t)
+
+		var conf config.IntegrationHTTP
+		conf.Marshaler = "json"
+		conf.EventURLTemplate = "http://localhost/{{ .GatewayID }}/{{ .EventType }}"
+		conf.Command.Mode = CommandModeServer
+		conf.Command.Bind = ":3002"
+		conf.Command.BearerToken = "secret"
+
+		b, err := NewBackend(conf)
+		assert.NoError(err)
+
+		server := httptest.NewServer(b.server.Handler)
+		defer server.Close()
+
+		for token, status := range map[string]int{
+			"":              http.StatusUnauthorized,
+			"Bearer foo":    http.StatusUnauthorized,
+			"Bearer secret": http.StatusNotFound, // gateway is not subscribed
+		} {
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/gateway/0102030405060708/command/down", nil)
+			assert.NoError(err)
+			if token != "" {
+				req.Header.Set("Authorization", token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(err)
+			resp.Body.Close()
+			assert.Equal(status, resp.StatusCode, token)
+		}
+	})
+}
+
+func TestCommandPoll(t *testing.T) {
+	assert := require.New(t)
+
+	var once sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gateway/0102030405060708/command" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		sent := false
+		once.Do(func() {
+			w.Header().Set(CommandHeader, "config")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"gatewayID": "AQIDBAUGBwg=", "version": "1.2.3"}`))
+			sent = true
+		})
+
+		if !sent {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Millisecond):
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	var conf config.IntegrationHTTP
+	conf.Marshaler = "json"
+	conf.EventURLTemplate = server.URL + "/{{ .GatewayID }}/{{ .EventType }}"
+	conf.RetryInterval = time.Millisecond
+	conf.Command.Mode = CommandModePoll
+	conf.Command.PollURLTemplate = server.URL + "/gateway/{{ .GatewayID }}/command"
+	conf.Command.PollTimeout = time.Second
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	configChan := make(chan gw.GatewayConfiguration, 1)
+	b.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		configChan <- pl
+	})
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+	select {
+	case pl := <-configChan:
+		assert.Equal("1.2.3", pl.Version)
+	case <-time.After(time.Second):
+		t.Fatal("expected gateway configuration")
+	}
+
+	assert.NoError(b.Stop())
+}
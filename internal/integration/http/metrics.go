@@ -0,0 +1,53 @@
+package http
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_http_event_count",
+		Help: "The number of gateway events published by the HTTP integration (per event).",
+	}, []string{"event"})
+
+	sc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_http_state_count",
+		Help: "The number of gateway states published by the HTTP integration (per state).",
+	}, []string{"state"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_http_command_count",
+		Help: "The number of commands received by the HTTP integration (per command).",
+	}, []string{"command"})
+
+	rc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_http_retry_count",
+		Help: "The number of times a request of the HTTP integration was retried.",
+	})
+
+	ec = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_http_error_count",
+		Help: "The number of requests of the HTTP integration that failed after all retries.",
+	})
+)
+
+func httpEventCounter(e string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"event": e})
+}
+
+func httpStateCounter(s string) prometheus.Counter {
+	return sc.With(prometheus.Labels{"state": s})
+}
+
+func httpCommandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
+
+func httpRetryCounter() prometheus.Counter {
+	return rc
+}
+
+func httpErrorCounter() prometheus.Counter {
+	return ec
+}
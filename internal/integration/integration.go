@@ -1,12 +1,17 @@
 package integration
 
 import (
+	"fmt"
+
 	"github.com/gofrs/uuid"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/grpc"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/http"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/kafka"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt"
 	"github.com/brocaar/lorawan"
 )
@@ -14,6 +19,7 @@ import (
 // Event types.
 const (
 	EventUp    = "up"
+	EventUpSet = "upset"
 	EventStats = "stats"
 	EventAck   = "ack"
 	EventRaw   = "raw"
@@ -21,12 +27,104 @@ const (
 
 var integration Integration
 
-// Setup configures the integration.
+// Setup configures the integrations. When multiple integrations have been
+// configured, events are published to all of them and commands are accepted
+// from any of them.
 func Setup(conf config.Config) error {
-	var err error
-	integration, err = mqtt.NewBackend(conf)
-	if err != nil {
-		return errors.Wrap(err, "setup mqtt integration error")
+	var integrations []namedIntegration
+
+	for i, mqttConf := range conf.Integration.MQTT {
+		if mqttConf.Name == "" {
+			mqttConf.Name = fmt.Sprintf("mqtt-%d", i)
+		}
+		if mqttConf.Marshaler == "" {
+			mqttConf.Marshaler = conf.Integration.Marshaler
+		}
+
+		b, err := mqtt.NewBackend(mqttConf)
+		if err != nil {
+			return errors.Wrapf(err, "setup mqtt integration %s error", mqttConf.Name)
+		}
+
+		integrations = append(integrations, namedIntegration{
+			name:        mqttConf.Name,
+			Integration: b,
+		})
+	}
+
+	for i, httpConf := range conf.Integration.HTTP {
+		if httpConf.Name == "" {
+			httpConf.Name = fmt.Sprintf("http-%d", i)
+		}
+		if httpConf.Marshaler == "" {
+			httpConf.Marshaler = conf.Integration.Marshaler
+		}
+
+		b, err := http.NewBackend(httpConf)
+		if err != nil {
+			return errors.Wrapf(err, "setup http integration %s error", httpConf.Name)
+		}
+
+		integrations = append(integrations, namedIntegration{
+			name:        httpConf.Name,
+			Integration: b,
+		})
+	}
+
+	for i, kafkaConf := range conf.Integration.Kafka {
+		if kafkaConf.Name == "" {
+			kafkaConf.Name = fmt.Sprintf("kafka-%d", i)
+		}
+		if kafkaConf.Marshaler == "" {
+			kafkaConf.Marshaler = conf.Integration.Marshaler
+		}
+
+		b, err := kafka.NewBackend(kafkaConf)
+		if err != nil {
+			return errors.Wrapf(err, "setup kafka integration %s error", kafkaConf.Name)
+		}
+
+		integrations = append(integrations, namedIntegration{
+			name:        kafkaConf.Name,
+			Integration: b,
+		})
+	}
+
+	for i, grpcConf := range conf.Integration.GRPC {
+		if grpcConf.Name == "" {
+			grpcConf.Name = fmt.Sprintf("grpc-%d", i)
+		}
+
+		b, err := grpc.NewBackend(grpcConf)
+		if err != nil {
+			return errors.Wrapf(err, "setup grpc integration %s error", grpcConf.Name)
+		}
+
+		integrations = append(integrations, namedIntegration{
+			name:        grpcConf.Name,
+			Integration: b,
+		})
+	}
+
+	if conf.Integration.Queue.Path != "" {
+		for i := range integrations {
+			q, err := newQueuedIntegration(integrations[i].name, integrations[i].Integration, conf)
+			if err != nil {
+				return errors.Wrapf(err, "setup queue for integration %s error", integrations[i].name)
+			}
+			integrations[i].Integration = q
+		}
+	}
+
+	switch len(integrations) {
+	case 0:
+		return errors.New("no integration configured")
+	case 1:
+		integration = integrations[0].Integration
+	default:
+		integration = &multiIntegration{
+			integrations: integrations,
+		}
 	}
 
 	return nil
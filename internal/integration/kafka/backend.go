@@ -0,0 +1,591 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
+	"github.com/brocaar/lorawan"
+)
+
+// Header keys.
+const (
+	// EventHeader holds the event type of an event message.
+	EventHeader = "event"
+
+	// StateHeader holds the state type of a state message.
+	StateHeader = "state"
+
+	// CommandHeader holds the command type of a command message.
+	CommandHeader = "command"
+)
+
+// writer defines the interface of the Kafka producer.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// reader defines the interface of the Kafka consumer.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Backend implements a Kafka backend. Events and states are produced with the
+// gateway ID as key, such that the ordering per gateway is retained. Commands
+// are consumed from a single command topic and are filtered on the gateways
+// connected to this instance.
+type Backend struct {
+	name string
+
+	writer writer
+	reader reader
+
+	eventTopicTemplate *template.Template
+	stateTopicTemplate *template.Template
+
+	downlinkFrameFunc             func(gw.DownlinkFrame)
+	gatewayConfigurationFunc      func(gw.GatewayConfiguration)
+	gatewayCommandExecRequestFunc func(gw.GatewayCommandExecRequest)
+	rawPacketForwarderCommandFunc func(gw.RawPacketForwarderCommand)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]struct{}
+
+	marshal   func(msg proto.Message) ([]byte, error)
+	unmarshal func(b []byte, msg proto.Message) error
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(conf config.IntegrationKafka) (*Backend, error) {
+	var err error
+
+	b := Backend{
+		name:     conf.Name,
+		gateways: make(map[lorawan.EUI64]struct{}),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	m, err := marshaler.Get(conf.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: get marshaler error")
+	}
+	b.marshal = m.Marshal
+	b.unmarshal = m.Unmarshal
+
+	if len(conf.Brokers) == 0 {
+		return nil, errors.New("integration/kafka: brokers must be set")
+	}
+
+	b.eventTopicTemplate, err = template.New("event").Parse(conf.EventTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: parse event-topic template error")
+	}
+
+	if conf.StateTopicTemplate != "" {
+		b.stateTopicTemplate, err = template.New("state").Parse(conf.StateTopicTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/kafka: parse state-topic template error")
+		}
+	}
+
+	tlsConfig, err := newTLSConfig(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/kafka: new tls config error")
+	}
+
+	transport := &kafka.Transport{
+		TLS: tlsConfig,
+	}
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+		TLS:       tlsConfig,
+	}
+	if conf.Username != "" {
+		mechanism := plain.Mechanism{
+			Username: conf.Username,
+			Password: conf.Password,
+		}
+		transport.SASL = mechanism
+		dialer.SASLMechanism = mechanism
+	}
+
+	// The writer is asynchronous, such that producing a message does not
+	// block the caller until the batch has been written. Write errors are
+	// logged by the completion handler.
+	b.writer = &kafka.Writer{
+		Addr:         kafka.TCP(conf.Brokers...),
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: conf.BatchTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		RequiredAcks: kafka.RequireOne,
+		Transport:    transport,
+		Async:        true,
+		Completion:   b.writeCompletion,
+	}
+
+	if conf.CommandTopic != "" {
+		groupID := conf.GroupID
+		if groupID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				return nil, errors.Wrap(err, "integration/kafka: get hostname error")
+			}
+			groupID = "chirpstack-gateway-bridge-" + hostname
+		}
+
+		b.reader = kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     conf.Brokers,
+			GroupID:     groupID,
+			Topic:       conf.CommandTopic,
+			StartOffset: kafka.LastOffset,
+			Dialer:      dialer,
+		})
+	}
+
+	return &b, nil
+}
+
+// Start starts the integration.
+func (b *Backend) Start() error {
+	if b.reader != nil {
+		b.wg.Add(1)
+		go b.commandLoop()
+	}
+	return nil
+}
+
+// Stop stops the integration.
+func (b *Backend) Stop() error {
+	b.gatewaysMux.Lock()
+	var gatewayIDs []lorawan.EUI64
+	for gatewayID := range b.gateways {
+		gatewayIDs = append(gatewayIDs, gatewayID)
+	}
+	b.gateways = make(map[lorawan.EUI64]struct{})
+	b.gatewaysMux.Unlock()
+
+	// Set gateway state to offline for all gateways.
+	for _, gatewayID := range gatewayIDs {
+		pl := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.PublishState(gatewayID, "conn", &pl); err != nil {
+			log.WithError(err).Error("integration/kafka: publish state error")
+		}
+	}
+
+	b.cancel()
+	b.wg.Wait()
+
+	if b.reader != nil {
+		if err := b.reader.Close(); err != nil {
+			log.WithError(err).Error("integration/kafka: close reader error")
+		}
+	}
+
+	return b.writer.Close()
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func.
+func (b *Backend) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	b.downlinkFrameFunc = f
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func.
+func (b *Backend) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	b.gatewayConfigurationFunc = f
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler func.
+func (b *Backend) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	b.gatewayCommandExecRequestFunc = f
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler func.
+func (b *Backend) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	b.rawPacketForwarderCommandFunc = f
+}
+
+// SetGatewaySubscription sets or unsets the gateway. Commands are only
+// handled for subscribed gateways.
+func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	log.WithFields(log.Fields{
+		"integration": b.name,
+		"gateway_id":  gatewayID,
+		"subscribe":   subscribe,
+	}).Debug("integration/kafka: set gateway subscription")
+
+	b.gatewaysMux.Lock()
+	_, subscribed := b.gateways[gatewayID]
+	if subscribe == subscribed {
+		b.gatewaysMux.Unlock()
+		return nil
+	}
+
+	if subscribe {
+		b.gateways[gatewayID] = struct{}{}
+	} else {
+		delete(b.gateways, gatewayID)
+	}
+	b.gatewaysMux.Unlock()
+
+	state := gw.ConnState_OFFLINE
+	if subscribe {
+		state = gw.ConnState_ONLINE
+	}
+
+	// The state is published synchronously, as the subscriptions of a
+	// gateway are set in order. Publishing it in the background could
+	// reverse the ONLINE and OFFLINE states.
+	if err := b.PublishState(gatewayID, "conn", &gw.ConnState{
+		GatewayId: gatewayID[:],
+		State:     state,
+	}); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/kafka: publish conn state error")
+	}
+
+	return nil
+}
+
+// PublishEvent publishes the given event.
+func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	kafkaEventCounter(event).Inc()
+	idPrefix := map[string]string{
+		"up":    "uplink_",
+		"upset": "uplink_",
+		"ack":   "downlink_",
+		"stats": "stats_",
+		"exec":  "exec_",
+		"raw":   "raw_",
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.eventTopicTemplate.Execute(topic, struct {
+		GatewayID lorawan.EUI64
+		EventType string
+	}{gatewayID, event}); err != nil {
+		return errors.Wrap(err, "execute event template error")
+	}
+
+	return b.produce(topic.String(), gatewayID, EventHeader, event, log.Fields{
+		idPrefix[event] + "id": id,
+		"event":                event,
+	}, v)
+}
+
+// PublishState publishes the given state. As Kafka does not support retained
+// messages, the state topic should be configured with log compaction.
+func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	if b.stateTopicTemplate == nil {
+		log.WithFields(log.Fields{
+			"state":      state,
+			"gateway_id": gatewayID,
+		}).Debug("integration/kafka: ignoring publish state, no state_topic_template configured")
+		return nil
+	}
+
+	kafkaStateCounter(state).Inc()
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.stateTopicTemplate.Execute(topic, struct {
+		GatewayID lorawan.EUI64
+		StateType string
+	}{gatewayID, state}); err != nil {
+		return errors.Wrap(err, "execute state template error")
+	}
+
+	return b.produce(topic.String(), gatewayID, StateHeader, state, log.Fields{
+		"state": state,
+	}, v)
+}
+
+// produce marshals and produces the given message, using the gateway ID as
+// key.
+func (b *Backend) produce(topic string, gatewayID lorawan.EUI64, header, typ string, fields log.Fields, msg proto.Message) error {
+	pl, err := b.marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal message error")
+	}
+
+	fields["integration"] = b.name
+	fields["topic"] = topic
+	fields["gateway_id"] = gatewayID
+
+	log.WithFields(fields).Info("integration/kafka: producing message")
+
+	if err := b.writer.WriteMessages(context.Background(), kafka.Message{
+		Topic: topic,
+		Key:   []byte(gatewayID.String()),
+		Value: pl,
+		Headers: []kafka.Header{
+			{Key: header, Value: []byte(typ)},
+		},
+	}); err != nil {
+		return errors.Wrap(err, "write message error")
+	}
+
+	return nil
+}
+
+// writeCompletion is called by the asynchronous writer after writing a batch
+// of messages.
+func (b *Backend) writeCompletion(msgs []kafka.Message, err error) {
+	if err == nil {
+		return
+	}
+
+	kafkaWriteErrorCounter().Add(float64(len(msgs)))
+	for _, msg := range msgs {
+		log.WithError(err).WithFields(log.Fields{
+			"integration": b.name,
+			"topic":       msg.Topic,
+			"gateway_id":  string(msg.Key),
+		}).Error("integration/kafka: write message error")
+	}
+}
+
+// commandLoop consumes the command topic until the integration is stopped.
+func (b *Backend) commandLoop() {
+	defer b.wg.Done()
+
+	for {
+		msg, err := b.reader.FetchMessage(b.ctx)
+		if err != nil {
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			log.WithError(err).WithField("integration", b.name).Error("integration/kafka: fetch command error")
+
+			select {
+			case <-time.After(time.Second):
+			case <-b.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		b.handleMessage(msg)
+
+		if err := b.reader.CommitMessages(b.ctx, msg); err != nil && b.ctx.Err() == nil {
+			log.WithError(err).WithField("integration", b.name).Error("integration/kafka: commit command error")
+		}
+	}
+}
+
+// handleMessage handles the given command message when it is addressed to
+// one of the subscribed gateways.
+func (b *Backend) handleMessage(msg kafka.Message) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText(msg.Key); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"integration": b.name,
+			"key":         string(msg.Key),
+		}).Error("integration/kafka: invalid command key")
+		return
+	}
+
+	if !b.isSubscribed(gatewayID) {
+		kafkaCommandSkipCounter().Inc()
+		return
+	}
+
+	var command string
+	for _, h := range msg.Headers {
+		if h.Key == CommandHeader {
+			command = string(h.Value)
+		}
+	}
+
+	if err := b.handleCommand(gatewayID, command, msg.Value); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"command":     command,
+		}).Error("integration/kafka: handle command error")
+	}
+}
+
+// handleCommand unmarshals the given command payload and calls the handler
+// func of the command.
+func (b *Backend) handleCommand(gatewayID lorawan.EUI64, command string, pl []byte) error {
+	switch command {
+	case "down":
+		var downlinkFrame gw.DownlinkFrame
+		if err := b.unmarshal(pl, &downlinkFrame); err != nil {
+			return errors.Wrap(err, "unmarshal downlink frame error")
+		}
+
+		if len(downlinkFrame.Items) == 0 {
+			return errors.New("downlink must have at least one item")
+		}
+
+		if err := checkGatewayID(gatewayID, &downlinkFrame.GatewayId); err != nil {
+			return err
+		}
+
+		var downID uuid.UUID
+		copy(downID[:], downlinkFrame.GetDownlinkId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"downlink_id": downID,
+		}).Info("integration/kafka: downlink frame received")
+
+		kafkaCommandCounter(command).Inc()
+		if b.downlinkFrameFunc != nil {
+			b.downlinkFrameFunc(downlinkFrame)
+		}
+	case "config":
+		var gatewayConfig gw.GatewayConfiguration
+		if err := b.unmarshal(pl, &gatewayConfig); err != nil {
+			return errors.Wrap(err, "unmarshal gateway configuration error")
+		}
+
+		if err := checkGatewayID(gatewayID, &gatewayConfig.GatewayId); err != nil {
+			return err
+		}
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+		}).Info("integration/kafka: gateway configuration received")
+
+		kafkaCommandCounter(command).Inc()
+		if b.gatewayConfigurationFunc != nil {
+			b.gatewayConfigurationFunc(gatewayConfig)
+		}
+	case "exec":
+		var execReq gw.GatewayCommandExecRequest
+		if err := b.unmarshal(pl, &execReq); err != nil {
+			return errors.Wrap(err, "unmarshal gateway command execution request error")
+		}
+
+		if err := checkGatewayID(gatewayID, &execReq.GatewayId); err != nil {
+			return err
+		}
+
+		var execID uuid.UUID
+		copy(execID[:], execReq.GetExecId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"exec_id":     execID,
+		}).Info("integration/kafka: gateway command execution request received")
+
+		kafkaCommandCounter(command).Inc()
+		if b.gatewayCommandExecRequestFunc != nil {
+			b.gatewayCommandExecRequestFunc(execReq)
+		}
+	case "raw":
+		var rawCmd gw.RawPacketForwarderCommand
+		if err := b.unmarshal(pl, &rawCmd); err != nil {
+			return errors.Wrap(err, "unmarshal raw packet-forwarder command error")
+		}
+
+		if err := checkGatewayID(gatewayID, &rawCmd.GatewayId); err != nil {
+			return err
+		}
+
+		var rawID uuid.UUID
+		copy(rawID[:], rawCmd.GetRawId())
+
+		log.WithFields(log.Fields{
+			"integration": b.name,
+			"gateway_id":  gatewayID,
+			"raw_id":      rawID,
+		}).Info("integration/kafka: raw packet-forwarder command received")
+
+		kafkaCommandCounter(command).Inc()
+		if b.rawPacketForwarderCommandFunc != nil {
+			b.rawPacketForwarderCommandFunc(rawCmd)
+		}
+	default:
+		return fmt.Errorf("unexpected command: %s", command)
+	}
+
+	return nil
+}
+
+// checkGatewayID validates that the gateway ID of the command payload matches
+// the gateway ID of the message key, as the subscription filter is applied on
+// the key and the payload gateway ID is used for routing the command. When
+// the payload does not contain a gateway ID, it is set to the key gateway ID.
+func checkGatewayID(gatewayID lorawan.EUI64, payloadGatewayID *[]byte) error {
+	if len(*payloadGatewayID) == 0 {
+		*payloadGatewayID = append([]byte{}, gatewayID[:]...)
+		return nil
+	}
+
+	if !bytes.Equal(*payloadGatewayID, gatewayID[:]) {
+		return errors.New("gateway_id of payload does not match the gateway id of the message key")
+	}
+
+	return nil
+}
+
+// isSubscribed returns true when the given gateway is subscribed.
+func (b *Backend) isSubscribed(gatewayID lorawan.EUI64) bool {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+
+	_, ok := b.gateways[gatewayID]
+	return ok
+}
+
+func newTLSConfig(conf config.IntegrationKafka) (*tls.Config, error) {
+	if !conf.TLS && conf.CACert == "" && conf.TLSCert == "" && conf.TLSKey == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if conf.CACert != "" {
+		cacert, err := ioutil.ReadFile(conf.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca-cert error")
+		}
+		certpool := x509.NewCertPool()
+		certpool.AppendCertsFromPEM(cacert)
+
+		tlsConfig.RootCAs = certpool
+	}
+
+	if conf.TLSCert != "" && conf.TLSKey != "" {
+		kp, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	return tlsConfig, nil
+}
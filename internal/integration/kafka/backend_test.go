@@ -0,0 +1,243 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// testBroker is a local stand-in for a Kafka broker, implementing both the
+// writer and reader interfaces.
+type testBroker struct {
+	mux       sync.Mutex
+	produced  []kafka.Message
+	commands  chan kafka.Message
+	committed chan kafka.Message
+}
+
+func newTestBroker() *testBroker {
+	return &testBroker{
+		commands:  make(chan kafka.Message, 10),
+		committed: make(chan kafka.Message, 10),
+	}
+}
+
+func (b *testBroker) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.produced = append(b.produced, msgs...)
+	return nil
+}
+
+func (b *testBroker) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-b.commands:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (b *testBroker) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		b.committed <- msg
+	}
+	return nil
+}
+
+func (b *testBroker) Close() error {
+	return nil
+}
+
+func (b *testBroker) getProduced() []kafka.Message {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]kafka.Message{}, b.produced...)
+}
+
+func newTestBackend(t *testing.T) (*Backend, *testBroker) {
+	var conf config.IntegrationKafka
+	conf.Marshaler = "protobuf"
+	conf.Brokers = []string{"localhost:9092"}
+	conf.EventTopicTemplate = "gateway.event.{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway.state.{{ .StateType }}"
+	conf.CommandTopic = "gateway.command"
+	conf.GroupID = "test"
+
+	b, err := NewBackend(conf)
+	require.NoError(t, err)
+
+	broker := newTestBroker()
+	b.writer = broker
+	b.reader = broker
+
+	return b, broker
+}
+
+func TestPublishEvent(t *testing.T) {
+	assert := require.New(t)
+
+	b, broker := newTestBackend(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	up := gw.UplinkFrame{PhyPayload: []byte{1, 2, 3}}
+	assert.NoError(b.PublishEvent(gatewayID, "up", uuid.Nil, &up))
+
+	produced := broker.getProduced()
+	assert.Len(produced, 1)
+	assert.Equal("gateway.event.up", produced[0].Topic)
+	assert.Equal([]byte("0102030405060708"), produced[0].Key)
+	assert.Equal([]kafka.Header{{Key: EventHeader, Value: []byte("up")}}, produced[0].Headers)
+
+	var pl gw.UplinkFrame
+	assert.NoError(proto.Unmarshal(produced[0].Value, &pl))
+	assert.True(proto.Equal(&up, &pl))
+}
+
+func TestAsyncWriter(t *testing.T) {
+	assert := require.New(t)
+
+	var conf config.IntegrationKafka
+	conf.Marshaler = "protobuf"
+	conf.Brokers = []string{"localhost:9092"}
+	conf.EventTopicTemplate = "gateway.event.{{ .EventType }}"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	w, ok := b.writer.(*kafka.Writer)
+	assert.True(ok)
+	assert.True(w.Async)
+
+	errCount := testutil.ToFloat64(kafkaWriteErrorCounter())
+	w.Completion([]kafka.Message{{Topic: "gateway.event.up"}, {Topic: "gateway.event.up"}}, errors.New("boom"))
+	w.Completion([]kafka.Message{{Topic: "gateway.event.up"}}, nil)
+	assert.Equal(errCount+2, testutil.ToFloat64(kafkaWriteErrorCounter()))
+}
+
+func TestConnStateOrdering(t *testing.T) {
+	assert := require.New(t)
+
+	b, broker := newTestBackend(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+	assert.NoError(b.SetGatewaySubscription(false, gatewayID))
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+	var states []gw.ConnState_State
+	for _, msg := range broker.getProduced() {
+		var pl gw.ConnState
+		assert.NoError(proto.Unmarshal(msg.Value, &pl))
+		states = append(states, pl.State)
+	}
+	assert.Equal([]gw.ConnState_State{gw.ConnState_ONLINE, gw.ConnState_OFFLINE, gw.ConnState_ONLINE}, states)
+}
+
+func TestCommands(t *testing.T) {
+	assert := require.New(t)
+
+	b, broker := newTestBackend(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	downChan := make(chan gw.DownlinkFrame, 1)
+	b.SetDownlinkFrameFunc(func(pl gw.DownlinkFrame) {
+		downChan <- pl
+	})
+
+	assert.NoError(b.Start())
+	assert.NoError(b.SetGatewaySubscription(true, gatewayID))
+
+	down := gw.DownlinkFrame{
+		GatewayId: gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{PhyPayload: []byte{1, 2, 3}},
+		},
+	}
+	downB, err := proto.Marshal(&down)
+	assert.NoError(err)
+
+	t.Run("other gateway", func(t *testing.T) {
+		broker.commands <- kafka.Message{
+			Key:     []byte("0807060504030201"),
+			Value:   downB,
+			Headers: []kafka.Header{{Key: CommandHeader, Value: []byte("down")}},
+		}
+		<-broker.committed
+
+		select {
+		case <-downChan:
+			t.Fatal("unexpected downlink")
+		default:
+		}
+	})
+
+	t.Run("local gateway", func(t *testing.T) {
+		assert := require.New(t)
+
+		broker.commands <- kafka.Message{
+			Key:     []byte("0102030405060708"),
+			Value:   downB,
+			Headers: []kafka.Header{{Key: CommandHeader, Value: []byte("down")}},
+		}
+		<-broker.committed
+
+		select {
+		case pl := <-downChan:
+			assert.True(proto.Equal(&down, &pl))
+		case <-time.After(time.Second):
+			t.Fatal("expected downlink")
+		}
+	})
+
+	t.Run("local gateway key with other gateway payload", func(t *testing.T) {
+		otherDown := gw.DownlinkFrame{
+			GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1},
+			Items: []*gw.DownlinkFrameItem{
+				{PhyPayload: []byte{1, 2, 3}},
+			},
+		}
+		otherDownB, err := proto.Marshal(&otherDown)
+		require.NoError(t, err)
+
+		broker.commands <- kafka.Message{
+			Key:     []byte("0102030405060708"),
+			Value:   otherDownB,
+			Headers: []kafka.Header{{Key: CommandHeader, Value: []byte("down")}},
+		}
+		<-broker.committed
+
+		select {
+		case <-downChan:
+			t.Fatal("unexpected downlink")
+		default:
+		}
+	})
+
+	// The ONLINE state is published on subscribe.
+	assert.Len(broker.getProduced(), 1)
+
+	// The OFFLINE state is published on stop.
+	assert.NoError(b.Stop())
+
+	var states []gw.ConnState_State
+	for _, msg := range broker.getProduced() {
+		assert.Equal("gateway.state.conn", msg.Topic)
+		var pl gw.ConnState
+		assert.NoError(proto.Unmarshal(msg.Value, &pl))
+		states = append(states, pl.State)
+	}
+	assert.Equal([]gw.ConnState_State{gw.ConnState_ONLINE, gw.ConnState_OFFLINE}, states)
+}
@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	pc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_kafka_event_count",
+		Help: "The number of gateway events produced by the Kafka integration (per event).",
+	}, []string{"event"})
+
+	sc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_kafka_state_count",
+		Help: "The number of gateway states produced by the Kafka integration (per state).",
+	}, []string{"state"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_kafka_command_count",
+		Help: "The number of commands handled by the Kafka integration (per command).",
+	}, []string{"command"})
+
+	csc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_kafka_command_skip_count",
+		Help: "The number of commands skipped by the Kafka integration as the gateway is not connected to this instance.",
+	})
+
+	wec = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_kafka_write_error_count",
+		Help: "The number of messages that the Kafka integration failed to write.",
+	})
+)
+
+func kafkaEventCounter(e string) prometheus.Counter {
+	return pc.With(prometheus.Labels{"event": e})
+}
+
+func kafkaStateCounter(s string) prometheus.Counter {
+	return sc.With(prometheus.Labels{"state": s})
+}
+
+func kafkaCommandCounter(c string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"command": c})
+}
+
+func kafkaCommandSkipCounter() prometheus.Counter {
+	return csc
+}
+
+func kafkaWriteErrorCounter() prometheus.Counter {
+	return wec
+}
@@ -0,0 +1,335 @@
+package marshaler
+
+import (
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var (
+	cborEncMode cbor.EncMode
+	cborDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+
+	// Timestamps are encoded as RFC3339 string (tag 0), as the epoch based
+	// encoding (tag 1) uses a float, which loses the ns precision.
+	cborEncMode, err = cbor.EncOptions{
+		Time:    cbor.TimeRFC3339Nano,
+		TimeTag: cbor.EncTagRequired,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+
+	cborDecMode, err = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// MarshalCBOR marshals the given message into CBOR. Messages are encoded as
+// map, using the JSON field names as keys. Only the populated fields are
+// included. Bytes are encoded as byte string, enums as integer, timestamps as
+// RFC3339 string (tag 0) and durations as integer (nanoseconds).
+func MarshalCBOR(msg proto.Message) ([]byte, error) {
+	return cborEncMode.Marshal(cborMessage(proto.MessageReflect(msg)))
+}
+
+// UnmarshalCBOR unmarshals the given CBOR into the given message. Unknown
+// fields are ignored.
+func UnmarshalCBOR(b []byte, msg proto.Message) error {
+	var obj interface{}
+	if err := cborDecMode.Unmarshal(b, &obj); err != nil {
+		return errors.Wrap(err, "unmarshal cbor error")
+	}
+
+	return setCBORMessage(proto.MessageReflect(msg), obj)
+}
+
+func cborMessage(m protoreflect.Message) interface{} {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Timestamp":
+		seconds, nanos := wktFields(m)
+		return time.Unix(seconds, nanos).UTC()
+	case "google.protobuf.Duration":
+		seconds, nanos := wktFields(m)
+		return int64(time.Duration(seconds)*time.Second + time.Duration(nanos))
+	}
+
+	out := make(map[string]interface{})
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			l := v.List()
+			items := make([]interface{}, l.Len())
+			for i := range items {
+				items[i] = cborValue(fd, l.Get(i))
+			}
+			out[fd.JSONName()] = items
+		case fd.IsMap():
+			// map keys are always encoded as string
+			items := make(map[string]interface{})
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				items[k.String()] = cborValue(fd.MapValue(), v)
+				return true
+			})
+			out[fd.JSONName()] = items
+		default:
+			out[fd.JSONName()] = cborValue(fd, v)
+		}
+		return true
+	})
+
+	return out
+}
+
+func cborValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return cborMessage(v.Message())
+	case protoreflect.EnumKind:
+		return int32(v.Enum())
+	default:
+		return v.Interface()
+	}
+}
+
+func setCBORMessage(m protoreflect.Message, v interface{}) error {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Timestamp":
+		t, err := toTime(v)
+		if err != nil {
+			return err
+		}
+		setWKTFields(m, t.Unix(), int32(t.Nanosecond()))
+		return nil
+	case "google.protobuf.Duration":
+		i, err := toInt64(v)
+		if err != nil {
+			return err
+		}
+		d := time.Duration(i)
+		setWKTFields(m, int64(d/time.Second), int32(d%time.Second))
+		return nil
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("expected map for %s, got %T", m.Descriptor().FullName(), v)
+	}
+
+	for key, v := range obj {
+		fd := fieldByKey(m.Descriptor(), key)
+		if fd == nil {
+			continue
+		}
+
+		if err := setCBORField(m, fd, v); err != nil {
+			return errors.Wrapf(err, "decode %s error", fd.FullName())
+		}
+	}
+
+	return nil
+}
+
+func setCBORField(m protoreflect.Message, fd protoreflect.FieldDescriptor, v interface{}) error {
+	switch {
+	case fd.IsList():
+		items, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("expected array, got %T", v)
+		}
+
+		l := m.Mutable(fd).List()
+		for _, item := range items {
+			pv, err := cborProtoValue(fd, l.NewElement, item)
+			if err != nil {
+				return err
+			}
+			l.Append(pv)
+		}
+	case fd.IsMap():
+		items, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("expected map, got %T", v)
+		}
+
+		mp := m.Mutable(fd).Map()
+		for k, item := range items {
+			mk, err := cborMapKey(fd.MapKey(), k)
+			if err != nil {
+				return err
+			}
+
+			pv, err := cborProtoValue(fd.MapValue(), mp.NewValue, item)
+			if err != nil {
+				return err
+			}
+			mp.Set(mk, pv)
+		}
+	case fd.Message() != nil:
+		return setCBORMessage(m.Mutable(fd).Message(), v)
+	default:
+		pv, err := cborProtoValue(fd, nil, v)
+		if err != nil {
+			return err
+		}
+		m.Set(fd, pv)
+	}
+
+	return nil
+}
+
+func cborProtoValue(fd protoreflect.FieldDescriptor, newValue func() protoreflect.Value, v interface{}) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		pv := newValue()
+		return pv, setCBORMessage(pv.Message(), v)
+	case protoreflect.BoolKind:
+		b, ok := v.(bool)
+		if !ok {
+			return protoreflect.Value{}, errors.Errorf("expected bool, got %T", v)
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		i, err := toInt64(v)
+		return protoreflect.ValueOfInt32(int32(i)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		i, err := toInt64(v)
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		i, err := toInt64(v)
+		return protoreflect.ValueOfUint32(uint32(i)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if u, ok := v.(uint64); ok {
+			return protoreflect.ValueOfUint64(u), nil
+		}
+		i, err := toInt64(v)
+		return protoreflect.ValueOfUint64(uint64(i)), err
+	case protoreflect.FloatKind:
+		f, err := toFloat64(v)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := toFloat64(v)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.StringKind:
+		s, ok := v.(string)
+		if !ok {
+			return protoreflect.Value{}, errors.Errorf("expected string, got %T", v)
+		}
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BytesKind:
+		b, ok := v.([]byte)
+		if !ok {
+			return protoreflect.Value{}, errors.Errorf("expected byte string, got %T", v)
+		}
+		return protoreflect.ValueOfBytes(b), nil
+	case protoreflect.EnumKind:
+		i, err := toInt64(v)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), err
+	default:
+		return protoreflect.Value{}, errors.Errorf("unsupported kind: %s", fd.Kind())
+	}
+}
+
+func cborMapKey(fd protoreflect.FieldDescriptor, s string) (protoreflect.MapKey, error) {
+	var v protoreflect.Value
+
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(s)
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return protoreflect.MapKey{}, errors.Wrap(err, "parse map key error")
+		}
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		i, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return protoreflect.MapKey{}, errors.Wrap(err, "parse map key error")
+		}
+		v = protoreflect.ValueOfInt32(int32(i))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return protoreflect.MapKey{}, errors.Wrap(err, "parse map key error")
+		}
+		v = protoreflect.ValueOfInt64(i)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		i, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return protoreflect.MapKey{}, errors.Wrap(err, "parse map key error")
+		}
+		v = protoreflect.ValueOfUint32(uint32(i))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return protoreflect.MapKey{}, errors.Wrap(err, "parse map key error")
+		}
+		v = protoreflect.ValueOfUint64(i)
+	default:
+		return protoreflect.MapKey{}, errors.Errorf("unsupported map key kind: %s", fd.Kind())
+	}
+
+	return v.MapKey(), nil
+}
+
+func wktFields(m protoreflect.Message) (int64, int64) {
+	fields := m.Descriptor().Fields()
+	return m.Get(fields.ByName("seconds")).Int(), m.Get(fields.ByName("nanos")).Int()
+}
+
+func setWKTFields(m protoreflect.Message, seconds int64, nanos int32) {
+	fields := m.Descriptor().Fields()
+	m.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(seconds))
+	m.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(nanos))
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, errors.Wrap(err, "parse time error")
+	default:
+		return time.Time{}, errors.Errorf("expected time, got %T", v)
+	}
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case uint64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	default:
+		return 0, errors.Errorf("expected integer, got %T", v)
+	}
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case float32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	default:
+		return 0, errors.Errorf("expected float, got %T", v)
+	}
+}
@@ -0,0 +1,221 @@
+package marshaler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/brocaar/lorawan"
+)
+
+// decodedSuffix is appended to the key of the PHYPayload field, for the key
+// holding the decoded PHYPayload.
+const decodedSuffix = "Decoded"
+
+// MarshalJSONV4 marshals the given message into JSON, using the v4 style
+// encoding. Compared to the json marshaler, IDs and EUIs are encoded as HEX
+// string and the PHYPayload is encoded as both base64 and as decoded LoRaWAN
+// structure. Timestamps are encoded as RFC3339 string.
+func MarshalJSONV4(msg proto.Message) ([]byte, error) {
+	marshaler := jsonpb.Marshaler{
+		EnumsAsInts:  false,
+		EmitDefaults: true,
+	}
+	str, err := marshaler.MarshalToString(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal json error")
+	}
+
+	obj, err := decodeJSONObject([]byte(str))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := walkJSON(proto.MessageReflect(msg).Descriptor(), obj, marshalJSONV4Field); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSONV4 unmarshals the given v4 style JSON into the given message.
+// IDs and EUIs may be encoded as HEX or as base64 string. The decoded
+// PHYPayload is ignored.
+func UnmarshalJSONV4(b []byte, msg proto.Message) error {
+	obj, err := decodeJSONObject(b)
+	if err != nil {
+		return err
+	}
+
+	if err := walkJSON(proto.MessageReflect(msg).Descriptor(), obj, unmarshalJSONV4Field); err != nil {
+		return err
+	}
+
+	b, err = json.Marshal(obj)
+	if err != nil {
+		return errors.Wrap(err, "marshal json error")
+	}
+
+	unmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: true, // we don't want to fail on unknown fields
+	}
+	return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
+}
+
+func marshalJSONV4Field(fd protoreflect.FieldDescriptor, obj map[string]interface{}, key string) error {
+	switch {
+	case isIDField(fd):
+		v, err := mapStrings(obj[key], func(s string) (string, error) {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return "", errors.Wrap(err, "decode base64 error")
+			}
+			return hex.EncodeToString(b), nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "encode %s error", fd.Name())
+		}
+		obj[key] = v
+	case isPHYPayloadField(fd):
+		s, ok := obj[key].(string)
+		if !ok || s == "" {
+			return nil
+		}
+
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return errors.Wrapf(err, "decode %s error", fd.Name())
+		}
+
+		// The PHYPayload is not always a valid LoRaWAN frame (e.g. proprietary
+		// frames), in which case only the base64 encoding is included.
+		var phy lorawan.PHYPayload
+		if err := phy.UnmarshalBinary(b); err == nil {
+			obj[key+decodedSuffix] = phy
+		}
+	}
+
+	return nil
+}
+
+func unmarshalJSONV4Field(fd protoreflect.FieldDescriptor, obj map[string]interface{}, key string) error {
+	if !isIDField(fd) {
+		return nil
+	}
+
+	v, err := mapStrings(obj[key], func(s string) (string, error) {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			// not HEX encoded, assume base64
+			return s, nil
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "decode %s error", fd.Name())
+	}
+	obj[key] = v
+
+	return nil
+}
+
+// walkJSON calls fn for each (non-message) field of the given JSON object
+// and of the nested objects, using the given message descriptor.
+func walkJSON(md protoreflect.MessageDescriptor, obj map[string]interface{}, fn func(protoreflect.FieldDescriptor, map[string]interface{}, string) error) error {
+	// fn may add keys to obj
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+
+	for _, key := range keys {
+		fd := fieldByKey(md, key)
+		if fd == nil {
+			continue
+		}
+
+		if fd.IsMap() {
+			if fd.MapValue().Message() == nil {
+				continue
+			}
+
+			m, _ := obj[key].(map[string]interface{})
+			for _, v := range m {
+				if o, ok := v.(map[string]interface{}); ok {
+					if err := walkJSON(fd.MapValue().Message(), o, fn); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if fd.Message() != nil {
+			var items []interface{}
+			if fd.IsList() {
+				items, _ = obj[key].([]interface{})
+			} else {
+				items = []interface{}{obj[key]}
+			}
+
+			// Well-known types like Timestamp and Duration are encoded as
+			// string and are skipped.
+			for _, v := range items {
+				if o, ok := v.(map[string]interface{}); ok {
+					if err := walkJSON(fd.Message(), o, fn); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+
+		if err := fn(fd, obj, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mapStrings applies f to the given string or list of strings.
+func mapStrings(v interface{}, f func(string) (string, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return f(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			s, ok := v[i].(string)
+			if !ok {
+				out[i] = v[i]
+				continue
+			}
+
+			var err error
+			out[i], err = f(s)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
+
+func decodeJSONObject(b []byte) (map[string]interface{}, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // preserve the precision of 64 bit integers
+	if err := dec.Decode(&obj); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json error")
+	}
+	return obj, nil
+}
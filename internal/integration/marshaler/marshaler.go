@@ -0,0 +1,98 @@
+// Package marshaler implements the payload marshalers of the integrations
+// and of the roaming forwarder.
+package marshaler
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Marshaler implements the marshal and unmarshal functions for a given
+// encoding.
+type Marshaler struct {
+	Marshal     func(msg proto.Message) ([]byte, error)
+	Unmarshal   func(b []byte, msg proto.Message) error
+	ContentType string
+}
+
+// Get returns the marshaler for the given encoding name. Valid names are
+// json, protobuf, json_v4 and cbor.
+func Get(name string) (Marshaler, error) {
+	switch name {
+	case "json":
+		return Marshaler{
+			Marshal:     MarshalJSON,
+			Unmarshal:   UnmarshalJSON,
+			ContentType: "application/json",
+		}, nil
+	case "protobuf":
+		return Marshaler{
+			Marshal:     proto.Marshal,
+			Unmarshal:   proto.Unmarshal,
+			ContentType: "application/octet-stream",
+		}, nil
+	case "json_v4":
+		return Marshaler{
+			Marshal:     MarshalJSONV4,
+			Unmarshal:   UnmarshalJSONV4,
+			ContentType: "application/json",
+		}, nil
+	case "cbor":
+		return Marshaler{
+			Marshal:     MarshalCBOR,
+			Unmarshal:   UnmarshalCBOR,
+			ContentType: "application/cbor",
+		}, nil
+	default:
+		return Marshaler{}, fmt.Errorf("unknown marshaler: %s", name)
+	}
+}
+
+// MarshalJSON marshals the given message into JSON (jsonpb).
+func MarshalJSON(msg proto.Message) ([]byte, error) {
+	marshaler := &jsonpb.Marshaler{
+		EnumsAsInts:  false,
+		EmitDefaults: true,
+	}
+	str, err := marshaler.MarshalToString(msg)
+	return []byte(str), err
+}
+
+// UnmarshalJSON unmarshals the given JSON (jsonpb) into the given message.
+func UnmarshalJSON(b []byte, msg proto.Message) error {
+	unmarshaler := &jsonpb.Unmarshaler{
+		AllowUnknownFields: true, // we don't want to fail on unknown fields
+	}
+	return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
+}
+
+// fieldByKey returns the field descriptor matching the given (JSON or
+// original) field name.
+func fieldByKey(md protoreflect.MessageDescriptor, key string) protoreflect.FieldDescriptor {
+	fields := md.Fields()
+	if fd := fields.ByJSONName(key); fd != nil {
+		return fd
+	}
+	return fields.ByName(protoreflect.Name(key))
+}
+
+// isIDField returns true when the given field holds an ID or EUI.
+func isIDField(fd protoreflect.FieldDescriptor) bool {
+	if fd.Kind() != protoreflect.BytesKind {
+		return false
+	}
+
+	name := string(fd.Name())
+	return name == "id" || strings.HasSuffix(name, "_id") || strings.HasSuffix(name, "_eui")
+}
+
+// isPHYPayloadField returns true when the given field holds a LoRaWAN
+// PHYPayload.
+func isPHYPayloadField(fd protoreflect.FieldDescriptor) bool {
+	return fd.Kind() == protoreflect.BytesKind && fd.Name() == "phy_payload"
+}
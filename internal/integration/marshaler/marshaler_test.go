@@ -0,0 +1,153 @@
+package marshaler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/common"
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+)
+
+func testMessages() []proto.Message {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	nowPB, _ := ptypes.TimestampProto(now)
+
+	return []proto.Message{
+		&gw.UplinkFrame{
+			// unconfirmed data up, DevAddr 01020304, FCnt 10, FPort 1
+			PhyPayload: []byte{0x40, 0x04, 0x03, 0x02, 0x01, 0x00, 0x0a, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+			TxInfo: &gw.UplinkTXInfo{
+				Frequency:  868100000,
+				Modulation: common.Modulation_LORA,
+				ModulationInfo: &gw.UplinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						Bandwidth:       125,
+						SpreadingFactor: 7,
+						CodeRate:        "4/5",
+					},
+				},
+			},
+			RxInfo: &gw.UplinkRXInfo{
+				GatewayId:         []byte{1, 2, 3, 4, 5, 6, 7, 8},
+				UplinkId:          []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+				Time:              nowPB,
+				TimeSinceGpsEpoch: ptypes.DurationProto(1500 * time.Millisecond),
+				Rssi:              -60,
+				LoraSnr:           -5.5,
+				CrcStatus:         gw.CRCStatus_CRC_OK,
+				Context:           []byte{1, 2, 3, 4},
+			},
+		},
+		&gw.DownlinkFrame{
+			GatewayId:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			DownlinkId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			Token:      1234,
+			Items: []*gw.DownlinkFrameItem{
+				{
+					PhyPayload: []byte{0x60, 0x04, 0x03, 0x02, 0x01, 0x00, 0x0a, 0x00, 0x01, 0x02, 0x03, 0x04},
+					TxInfo: &gw.DownlinkTXInfo{
+						Frequency: 868100000,
+						Power:     14,
+						Timing:    gw.DownlinkTiming_DELAY,
+						TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+							DelayTimingInfo: &gw.DelayTimingInfo{
+								Delay: ptypes.DurationProto(time.Second),
+							},
+						},
+						Context: []byte{1, 2, 3, 4},
+					},
+				},
+			},
+		},
+		&gw.GatewayStats{
+			GatewayId:             []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Time:                  nowPB,
+			RxPacketsReceived:     10,
+			MetaData:              map[string]string{"foo": "bar"},
+			TxPacketsPerFrequency: map[uint32]uint32{868100000: 3},
+			Location: &common.Location{
+				Latitude:  1.123,
+				Longitude: 2.123,
+				Source:    common.LocationSource_GPS,
+			},
+		},
+	}
+}
+
+func TestCBOR(t *testing.T) {
+	for _, msg := range testMessages() {
+		t.Run(proto.MessageName(msg), func(t *testing.T) {
+			assert := require.New(t)
+
+			b, err := MarshalCBOR(msg)
+			assert.NoError(err)
+
+			out := proto.Clone(msg)
+			out.Reset()
+			assert.NoError(UnmarshalCBOR(b, out))
+			assert.True(proto.Equal(msg, out), "expected: %s, got: %s", msg, out)
+
+			// CBOR is more compact than JSON
+			j, err := MarshalJSONV4(msg)
+			assert.NoError(err)
+			assert.Less(len(b), len(j))
+		})
+	}
+
+	t.Run("unknown fields", func(t *testing.T) {
+		assert := require.New(t)
+
+		b, err := cborEncMode.Marshal(map[string]interface{}{
+			"gatewayID": []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			"foo":       "bar",
+		})
+		assert.NoError(err)
+
+		var pl gw.GatewayConfiguration
+		assert.NoError(UnmarshalCBOR(b, &pl))
+		assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, pl.GatewayId)
+	})
+}
+
+func TestJSONV4(t *testing.T) {
+	for _, msg := range testMessages() {
+		t.Run(proto.MessageName(msg), func(t *testing.T) {
+			assert := require.New(t)
+
+			b, err := MarshalJSONV4(msg)
+			assert.NoError(err)
+
+			out := proto.Clone(msg)
+			out.Reset()
+			assert.NoError(UnmarshalJSONV4(b, out))
+			assert.True(proto.Equal(msg, out), "expected: %s, got: %s", msg, out)
+		})
+	}
+
+	t.Run("encoding", func(t *testing.T) {
+		assert := require.New(t)
+
+		b, err := MarshalJSONV4(testMessages()[0])
+		assert.NoError(err)
+
+		s := string(b)
+		assert.Contains(s, `"gatewayID":"0102030405060708"`)
+		assert.Contains(s, `"uplinkID":"0102030405060708090a0b0c0d0e0f10"`)
+		assert.Contains(s, `"time":"2022-01-02T03:04:05.123456789Z"`)
+		assert.Contains(s, `"phyPayload":"QAQDAgEACgABAQIDBAUGBw=="`)
+		assert.Contains(s, `"phyPayloadDecoded":{"mhdr":{"mType":"UnconfirmedDataUp","major":"LoRaWANR1"}`)
+		assert.Contains(s, `"devAddr":"01020304"`)
+	})
+
+	t.Run("base64 ids", func(t *testing.T) {
+		assert := require.New(t)
+
+		var pl gw.GatewayConfiguration
+		assert.NoError(UnmarshalJSONV4([]byte(`{"gatewayID": "AQIDBAUGBwg=", "version": "1"}`), &pl))
+		assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, pl.GatewayId)
+	})
+}
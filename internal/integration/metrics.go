@@ -0,0 +1,44 @@
+package integration
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	qdg = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "integration_queue_depth",
+		Help: "The number of events in the store-and-forward queue (per integration).",
+	}, []string{"integration"})
+
+	qec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_queue_enqueue_count",
+		Help: "The number of events added to the store-and-forward queue (per integration).",
+	}, []string{"integration"})
+
+	qrc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_queue_replay_count",
+		Help: "The number of queued events published by the store-and-forward queue (per integration).",
+	}, []string{"integration"})
+
+	qdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_queue_drop_count",
+		Help: "The number of events dropped from the store-and-forward queue (per integration and reason).",
+	}, []string{"integration", "reason"})
+)
+
+func queueDepthGauge(i string) prometheus.Gauge {
+	return qdg.With(prometheus.Labels{"integration": i})
+}
+
+func queueEnqueueCounter(i string) prometheus.Counter {
+	return qec.With(prometheus.Labels{"integration": i})
+}
+
+func queueReplayCounter(i string) prometheus.Counter {
+	return qrc.With(prometheus.Labels{"integration": i})
+}
+
+func queueDropCounter(i, reason string) prometheus.Counter {
+	return qdc.With(prometheus.Labels{"integration": i, "reason": reason})
+}
@@ -127,11 +127,11 @@ type AzureIoTHubAuthentication struct {
 }
 
 // NewAzureIoTHubAuthentication creates an AzureIoTHubAuthentication.
-func NewAzureIoTHubAuthentication(c config.Config) (Authentication, error) {
+func NewAzureIoTHubAuthentication(c config.IntegrationMQTT) (Authentication, error) {
 	var auth AzureIoTHubAuthentication
 
 	at := authTypeSymmetric
-	conf := c.Integration.MQTT.Auth.AzureIoTHub
+	conf := c.Auth.AzureIoTHub
 
 	certpool := x509.NewCertPool()
 	rootCAs := fmt.Sprintf("%s%s%s", digiCertBaltimoreRootCA, microsoftRSARootCA2017, digiCertGlobalRootG2)
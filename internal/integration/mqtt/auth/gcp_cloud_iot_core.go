@@ -25,8 +25,8 @@ type GCPCloudIoTCoreAuthentication struct {
 }
 
 // NewGCPCloudIoTCoreAuthentication create a GCPCloudIoTCoreAuthentication.
-func NewGCPCloudIoTCoreAuthentication(conf config.Config) (Authentication, error) {
-	keyFileRaw, err := ioutil.ReadFile(conf.Integration.MQTT.Auth.GCPCloudIoTCore.JWTKeyFile)
+func NewGCPCloudIoTCoreAuthentication(conf config.IntegrationMQTT) (Authentication, error) {
+	keyFileRaw, err := ioutil.ReadFile(conf.Auth.GCPCloudIoTCore.JWTKeyFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "read jwt key-file error")
 	}
@@ -37,19 +37,19 @@ func NewGCPCloudIoTCoreAuthentication(conf config.Config) (Authentication, error
 	}
 
 	clientID := fmt.Sprintf("projects/%s/locations/%s/registries/%s/devices/%s",
-		conf.Integration.MQTT.Auth.GCPCloudIoTCore.ProjectID,
-		conf.Integration.MQTT.Auth.GCPCloudIoTCore.CloudRegion,
-		conf.Integration.MQTT.Auth.GCPCloudIoTCore.RegistryID,
-		conf.Integration.MQTT.Auth.GCPCloudIoTCore.DeviceID,
+		conf.Auth.GCPCloudIoTCore.ProjectID,
+		conf.Auth.GCPCloudIoTCore.CloudRegion,
+		conf.Auth.GCPCloudIoTCore.RegistryID,
+		conf.Auth.GCPCloudIoTCore.DeviceID,
 	)
 
 	return &GCPCloudIoTCoreAuthentication{
 		siginingMethod: jwt.SigningMethodRS256,
 		privateKey:     privateKey,
 		clientID:       clientID,
-		server:         conf.Integration.MQTT.Auth.GCPCloudIoTCore.Server,
-		projectID:      conf.Integration.MQTT.Auth.GCPCloudIoTCore.ProjectID,
-		jwtExpiration:  conf.Integration.MQTT.Auth.GCPCloudIoTCore.JWTExpiration,
+		server:         conf.Auth.GCPCloudIoTCore.Server,
+		projectID:      conf.Auth.GCPCloudIoTCore.ProjectID,
+		jwtExpiration:  conf.Auth.GCPCloudIoTCore.JWTExpiration,
 	}, nil
 }
 
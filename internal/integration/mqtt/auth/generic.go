@@ -24,11 +24,11 @@ type GenericAuthentication struct {
 }
 
 // NewGenericAuthentication creates a GenericAuthentication.
-func NewGenericAuthentication(conf config.Config) (Authentication, error) {
+func NewGenericAuthentication(conf config.IntegrationMQTT) (Authentication, error) {
 	tlsConfig, err := newTLSConfig(
-		conf.Integration.MQTT.Auth.Generic.CACert,
-		conf.Integration.MQTT.Auth.Generic.TLSCert,
-		conf.Integration.MQTT.Auth.Generic.TLSKey,
+		conf.Auth.Generic.CACert,
+		conf.Auth.Generic.TLSCert,
+		conf.Auth.Generic.TLSKey,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "mqtt/auth: new tls config error")
@@ -36,11 +36,11 @@ func NewGenericAuthentication(conf config.Config) (Authentication, error) {
 
 	return &GenericAuthentication{
 		tlsConfig:    tlsConfig,
-		servers:      conf.Integration.MQTT.Auth.Generic.Servers,
-		username:     conf.Integration.MQTT.Auth.Generic.Username,
-		password:     conf.Integration.MQTT.Auth.Generic.Password,
-		cleanSession: conf.Integration.MQTT.Auth.Generic.CleanSession,
-		clientID:     conf.Integration.MQTT.Auth.Generic.ClientID,
+		servers:      conf.Auth.Generic.Servers,
+		username:     conf.Auth.Generic.Username,
+		password:     conf.Auth.Generic.Password,
+		cleanSession: conf.Auth.Generic.CleanSession,
+		clientID:     conf.Auth.Generic.ClientID,
 	}, nil
 }
 
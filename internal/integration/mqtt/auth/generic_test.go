@@ -11,17 +11,17 @@ import (
 func TestGenericAuthentication(t *testing.T) {
 	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
 
-	var conf config.Config
-	conf.Integration.Marshaler = "json"
-	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
-	conf.Integration.MQTT.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
-	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
-	conf.Integration.MQTT.Auth.Type = "generic"
-	conf.Integration.MQTT.Auth.Generic.Servers = []string{"tcp://localhost:1883"}
-	conf.Integration.MQTT.Auth.Generic.Username = "foo"
-	conf.Integration.MQTT.Auth.Generic.Password = "bar"
-	conf.Integration.MQTT.Auth.Generic.CleanSession = true
-	conf.Integration.MQTT.Auth.Generic.ClientID = gatewayID.String()
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Auth.Type = "generic"
+	conf.Auth.Generic.Servers = []string{"tcp://localhost:1883"}
+	conf.Auth.Generic.Username = "foo"
+	conf.Auth.Generic.Password = "bar"
+	conf.Auth.Generic.CleanSession = true
+	conf.Auth.Generic.ClientID = gatewayID.String()
 
 	t.Run("New", func(t *testing.T) {
 		assert := require.New(t)
@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"text/template"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// GatewayCredentials holds the MQTT credentials of a single gateway.
+type GatewayCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientID string `json:"client_id"`
+	TLSCert  string `json:"tls_cert"`
+	TLSKey   string `json:"tls_key"`
+}
+
+// PerGatewayAuthentication resolves the MQTT credentials of each gateway
+// when using a MQTT connection per gateway. The credentials are looked up
+// in the credentials file and fall back to the configured templates.
+type PerGatewayAuthentication struct {
+	servers      []string
+	cleanSession bool
+	rootCAs      *x509.CertPool
+
+	usernameTemplate *template.Template
+	passwordTemplate *template.Template
+	clientIDTemplate *template.Template
+	tlsCertTemplate  *template.Template
+	tlsKeyTemplate   *template.Template
+
+	credentials map[lorawan.EUI64]GatewayCredentials
+}
+
+// NewPerGatewayAuthentication creates a PerGatewayAuthentication.
+func NewPerGatewayAuthentication(conf config.IntegrationMQTT) (*PerGatewayAuthentication, error) {
+	a := PerGatewayAuthentication{
+		servers:      conf.Auth.Generic.Servers,
+		cleanSession: conf.Auth.Generic.CleanSession,
+		credentials:  make(map[lorawan.EUI64]GatewayCredentials),
+	}
+
+	if conf.Auth.Generic.CACert != "" {
+		cacert, err := ioutil.ReadFile(conf.Auth.Generic.CACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "load ca-cert error")
+		}
+		a.rootCAs = x509.NewCertPool()
+		a.rootCAs.AppendCertsFromPEM(cacert)
+	}
+
+	for _, t := range []struct {
+		name string
+		text string
+		tmpl **template.Template
+	}{
+		{"username", conf.PerGateway.UsernameTemplate, &a.usernameTemplate},
+		{"password", conf.PerGateway.PasswordTemplate, &a.passwordTemplate},
+		{"client_id", conf.PerGateway.ClientIDTemplate, &a.clientIDTemplate},
+		{"tls_cert", conf.PerGateway.TLSCertTemplate, &a.tlsCertTemplate},
+		{"tls_key", conf.PerGateway.TLSKeyTemplate, &a.tlsKeyTemplate},
+	} {
+		tmpl, err := template.New(t.name).Parse(t.text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s template error", t.name)
+		}
+		*t.tmpl = tmpl
+	}
+
+	if conf.PerGateway.CredentialsFile != "" {
+		b, err := ioutil.ReadFile(conf.PerGateway.CredentialsFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read credentials file error")
+		}
+
+		if err := json.Unmarshal(b, &a.credentials); err != nil {
+			return nil, errors.Wrap(err, "unmarshal credentials file error")
+		}
+	}
+
+	return &a, nil
+}
+
+// GetCredentials returns the credentials for the given gateway.
+func (a *PerGatewayAuthentication) GetCredentials(gatewayID lorawan.EUI64) (GatewayCredentials, error) {
+	if c, ok := a.credentials[gatewayID]; ok {
+		return c, nil
+	}
+
+	var c GatewayCredentials
+	for _, t := range []struct {
+		tmpl *template.Template
+		out  *string
+	}{
+		{a.usernameTemplate, &c.Username},
+		{a.passwordTemplate, &c.Password},
+		{a.clientIDTemplate, &c.ClientID},
+		{a.tlsCertTemplate, &c.TLSCert},
+		{a.tlsKeyTemplate, &c.TLSKey},
+	} {
+		buf := bytes.NewBuffer(nil)
+		if err := t.tmpl.Execute(buf, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
+			return c, errors.Wrapf(err, "execute %s template error", t.tmpl.Name())
+		}
+		*t.out = buf.String()
+	}
+
+	return c, nil
+}
+
+// Init applies the configuration of the given gateway.
+func (a *PerGatewayAuthentication) Init(opts *mqtt.ClientOptions, gatewayID lorawan.EUI64) error {
+	c, err := a.GetCredentials(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get credentials error")
+	}
+
+	for _, server := range a.servers {
+		opts.AddBroker(server)
+	}
+	opts.SetUsername(c.Username)
+	opts.SetPassword(c.Password)
+	opts.SetCleanSession(a.cleanSession)
+	opts.SetClientID(c.ClientID)
+
+	if a.rootCAs == nil && c.TLSCert == "" && c.TLSKey == "" {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs: a.rootCAs,
+	}
+
+	if c.TLSCert != "" && c.TLSKey != "" {
+		kp, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	opts.SetTLSConfig(tlsConfig)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestPerGatewayAuthentication(t *testing.T) {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "credentials")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`{
+		"0102030405060708": {
+			"username": "gw1",
+			"password": "secret",
+			"client_id": "client-1"
+		}
+	}`)
+	assert.NoError(err)
+	assert.NoError(f.Close())
+
+	var conf config.IntegrationMQTT
+	conf.Auth.Type = "generic"
+	conf.Auth.Generic.Servers = []string{"tcp://localhost:1883"}
+	conf.PerGateway.Enabled = true
+	conf.PerGateway.UsernameTemplate = "gw-{{ .GatewayID }}"
+	conf.PerGateway.PasswordTemplate = "password"
+	conf.PerGateway.ClientIDTemplate = "{{ .GatewayID }}"
+	conf.PerGateway.TLSCertTemplate = "/certs/{{ .GatewayID }}.crt"
+	conf.PerGateway.TLSKeyTemplate = "/certs/{{ .GatewayID }}.key"
+	conf.PerGateway.CredentialsFile = f.Name()
+
+	auth, err := NewPerGatewayAuthentication(conf)
+	assert.NoError(err)
+
+	tests := []struct {
+		name      string
+		gatewayID lorawan.EUI64
+		expected  GatewayCredentials
+	}{
+		{
+			name:      "credentials file",
+			gatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			expected: GatewayCredentials{
+				Username: "gw1",
+				Password: "secret",
+				ClientID: "client-1",
+			},
+		},
+		{
+			name:      "templates",
+			gatewayID: lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+			expected: GatewayCredentials{
+				Username: "gw-0807060504030201",
+				Password: "password",
+				ClientID: "0807060504030201",
+				TLSCert:  "/certs/0807060504030201.crt",
+				TLSKey:   "/certs/0807060504030201.key",
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			c, err := auth.GetCredentials(tst.gatewayID)
+			assert.NoError(err)
+			assert.Equal(tst.expected, c)
+		})
+	}
+}
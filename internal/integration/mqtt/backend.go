@@ -3,6 +3,7 @@ package mqtt
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
 	"text/template"
@@ -11,13 +12,13 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gofrs/uuid"
-	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/chirpstack-api/go/v3/gw"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/marshaler"
 	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/auth"
 	"github.com/brocaar/lorawan"
 )
@@ -45,29 +46,56 @@ type Backend struct {
 	maxTokenWait            time.Duration
 
 	qos                  uint8
+	events               map[string]config.IntegrationMQTTPublish
+	states               map[string]config.IntegrationMQTTPublish
+	subscriptions        map[string]config.IntegrationMQTTSubscribe
 	eventTopicTemplate   *template.Template
 	stateTopicTemplate   *template.Template
 	commandTopicTemplate *template.Template
 
 	marshal   func(msg proto.Message) ([]byte, error)
 	unmarshal func(b []byte, msg proto.Message) error
+
+	instanceID string
+
+	haEnabled               bool
+	sharedSubscriptionGroup string
+	instanceTopicTemplate   *template.Template
+	ownersMux               sync.RWMutex
+	owners                  map[lorawan.EUI64]string
+
+	perGatewayAuth       *auth.PerGatewayAuthentication
+	gatewayConnsMux      sync.RWMutex
+	gatewayConns         map[lorawan.EUI64]paho.Client
+	keepAlive            time.Duration
+	maxReconnectInterval time.Duration
+
+	bridgeStateTopicTemplate *template.Template
+	heartbeatInterval        time.Duration
+	gracePeriod              time.Duration
+	previousGatewaysMux      sync.Mutex
+	previousGateways         map[lorawan.EUI64]struct{}
+	previousGatewaysDone     bool
 }
 
 // NewBackend creates a new Backend.
-func NewBackend(conf config.Config) (*Backend, error) {
+func NewBackend(conf config.IntegrationMQTT) (*Backend, error) {
 	var err error
 
 	b := Backend{
-		qos:                     conf.Integration.MQTT.Auth.Generic.QOS,
-		terminateOnConnectError: conf.Integration.MQTT.TerminateOnConnectError,
+		qos:                     conf.Auth.Generic.QOS,
+		terminateOnConnectError: conf.TerminateOnConnectError,
 		clientOpts:              paho.NewClientOptions(),
 		gateways:                make(map[lorawan.EUI64]struct{}),
 		gatewaysSubscribed:      make(map[lorawan.EUI64]struct{}),
-		stateRetained:           conf.Integration.MQTT.StateRetained,
-		maxTokenWait:            conf.Integration.MQTT.MaxTokenWait,
+		stateRetained:           conf.StateRetained,
+		maxTokenWait:            conf.MaxTokenWait,
+		events:                  conf.Events,
+		states:                  conf.States,
+		subscriptions:           conf.Subscriptions,
 	}
 
-	switch conf.Integration.MQTT.Auth.Type {
+	switch conf.Auth.Type {
 	case "generic":
 		b.auth, err = auth.NewGenericAuthentication(conf)
 		if err != nil {
@@ -79,74 +107,68 @@ func NewBackend(conf config.Config) (*Backend, error) {
 			return nil, errors.Wrap(err, "integration/mqtt: new GCP Cloud IoT Core authentication error")
 		}
 
-		conf.Integration.MQTT.EventTopicTemplate = "/devices/gw-{{ .GatewayID }}/events/{{ .EventType }}"
-		conf.Integration.MQTT.CommandTopicTemplate = "/devices/gw-{{ .GatewayID }}/commands/#"
-		conf.Integration.MQTT.StateTopicTemplate = ""
+		conf.EventTopicTemplate = "/devices/gw-{{ .GatewayID }}/events/{{ .EventType }}"
+		conf.CommandTopicTemplate = "/devices/gw-{{ .GatewayID }}/commands/#"
+		conf.StateTopicTemplate = ""
 	case "azure_iot_hub":
 		b.auth, err = auth.NewAzureIoTHubAuthentication(conf)
 		if err != nil {
 			return nil, errors.Wrap(err, "integration/mqtt: new azure iot hub authentication error")
 		}
 
-		conf.Integration.MQTT.EventTopicTemplate = "devices/{{ .GatewayID }}/messages/events/{{ .EventType }}"
-		conf.Integration.MQTT.CommandTopicTemplate = "devices/{{ .GatewayID }}/messages/devicebound/#"
-		conf.Integration.MQTT.StateTopicTemplate = ""
+		conf.EventTopicTemplate = "devices/{{ .GatewayID }}/messages/events/{{ .EventType }}"
+		conf.CommandTopicTemplate = "devices/{{ .GatewayID }}/messages/devicebound/#"
+		conf.StateTopicTemplate = ""
 	default:
-		return nil, fmt.Errorf("integration/mqtt: unknown auth type: %s", conf.Integration.MQTT.Auth.Type)
+		return nil, fmt.Errorf("integration/mqtt: unknown auth type: %s", conf.Auth.Type)
 	}
 
-	switch conf.Integration.Marshaler {
-	case "json":
-		b.marshal = func(msg proto.Message) ([]byte, error) {
-			marshaler := &jsonpb.Marshaler{
-				EnumsAsInts:  false,
-				EmitDefaults: true,
-			}
-			str, err := marshaler.MarshalToString(msg)
-			return []byte(str), err
-		}
-
-		b.unmarshal = func(b []byte, msg proto.Message) error {
-			unmarshaler := &jsonpb.Unmarshaler{
-				AllowUnknownFields: true, // we don't want to fail on unknown fields
-			}
-			return unmarshaler.Unmarshal(bytes.NewReader(b), msg)
-		}
-	case "protobuf":
-		b.marshal = func(msg proto.Message) ([]byte, error) {
-			return proto.Marshal(msg)
-		}
-
-		b.unmarshal = func(b []byte, msg proto.Message) error {
-			return proto.Unmarshal(b, msg)
-		}
-	default:
-		return nil, fmt.Errorf("integration/mqtt: unknown marshaler: %s", conf.Integration.Marshaler)
+	m, err := marshaler.Get(conf.Marshaler)
+	if err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: get marshaler error")
 	}
+	b.marshal = m.Marshal
+	b.unmarshal = m.Unmarshal
 
-	b.eventTopicTemplate, err = template.New("event").Parse(conf.Integration.MQTT.EventTopicTemplate)
+	b.eventTopicTemplate, err = template.New("event").Parse(conf.EventTopicTemplate)
 	if err != nil {
 		return nil, errors.Wrap(err, "integration/mqtt: parse event-topic template error")
 	}
 
-	if conf.Integration.MQTT.StateTopicTemplate != "" {
-		b.stateTopicTemplate, err = template.New("state").Parse(conf.Integration.MQTT.StateTopicTemplate)
+	if conf.StateTopicTemplate != "" {
+		b.stateTopicTemplate, err = template.New("state").Parse(conf.StateTopicTemplate)
 		if err != nil {
 			return nil, errors.Wrap(err, "integration/mqtt: parse state-topic template error")
 		}
 	}
 
-	b.commandTopicTemplate, err = template.New("event").Parse(conf.Integration.MQTT.CommandTopicTemplate)
+	b.commandTopicTemplate, err = template.New("event").Parse(conf.CommandTopicTemplate)
 	if err != nil {
 		return nil, errors.Wrap(err, "integration/mqtt: parse event-topic template error")
 	}
 
+	b.instanceID = conf.InstanceID
+	if b.instanceID == "" {
+		b.instanceID, err = os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "integration/mqtt: get hostname error")
+		}
+	}
+
+	if err := b.setupHA(conf); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: setup ha error")
+	}
+
+	if err := b.setupPerGateway(conf); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: setup per-gateway connections error")
+	}
+
 	b.clientOpts.SetProtocolVersion(4)
 	b.clientOpts.SetAutoReconnect(true) // this is required for buffering messages in case offline!
 	b.clientOpts.SetOnConnectHandler(b.onConnected)
 	b.clientOpts.SetConnectionLostHandler(b.onConnectionLost)
-	b.clientOpts.SetKeepAlive(conf.Integration.MQTT.KeepAlive)
-	b.clientOpts.SetMaxReconnectInterval(conf.Integration.MQTT.MaxReconnectInterval)
+	b.clientOpts.SetKeepAlive(conf.KeepAlive)
+	b.clientOpts.SetMaxReconnectInterval(conf.MaxReconnectInterval)
 
 	if err = b.auth.Init(b.clientOpts); err != nil {
 		return nil, errors.Wrap(err, "mqtt: init authentication error")
@@ -163,40 +185,66 @@ func NewBackend(conf config.Config) (*Backend, error) {
 		// As we know the Gateway ID and a state topic has been configured, we set
 		// the last will and testament.
 		if b.stateTopicTemplate != nil {
-			pl := gw.ConnState{
-				GatewayId: gatewayID[:],
-				State:     gw.ConnState_OFFLINE,
-			}
-			bb, err := b.marshal(&pl)
+			topic, bb, err := b.getConnStateWill(*gatewayID)
 			if err != nil {
-				return nil, errors.Wrap(err, "marshal error")
-			}
-
-			topic := bytes.NewBuffer(nil)
-			if err := b.stateTopicTemplate.Execute(topic, struct {
-				GatewayID lorawan.EUI64
-				StateType string
-			}{*gatewayID, "conn"}); err != nil {
-				return nil, errors.Wrap(err, "execute state template error")
+				return nil, err
 			}
 
 			log.WithFields(log.Fields{
 				"gateway_id": gatewayID,
-				"topic":      topic.String(),
+				"topic":      topic,
 			}).Info("integration/mqtt: setting last will and testament")
 
-			b.clientOpts.SetBinaryWill(topic.String(), bb, b.qos, true)
+			qos, _ := b.getStateOptions("conn")
+			b.clientOpts.SetBinaryWill(topic, bb, qos, true)
 		}
 	}
 
+	if err := b.setupBridgeState(conf); err != nil {
+		return nil, errors.Wrap(err, "integration/mqtt: setup bridge state error")
+	}
+
 	return &b, nil
 }
 
+// getConnStateWill returns the topic and payload of the OFFLINE conn state
+// last will and testament for the given gateway.
+func (b *Backend) getConnStateWill(gatewayID lorawan.EUI64) (string, []byte, error) {
+	pl := gw.ConnState{
+		GatewayId: gatewayID[:],
+		State:     gw.ConnState_OFFLINE,
+	}
+	bb, err := b.marshal(&pl)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "marshal error")
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.stateTopicTemplate.Execute(topic, struct {
+		GatewayID lorawan.EUI64
+		StateType string
+	}{gatewayID, "conn"}); err != nil {
+		return "", nil, errors.Wrap(err, "execute state template error")
+	}
+
+	return topic.String(), bb, nil
+}
+
 // Start starts the integration.
 func (b *Backend) Start() error {
+	if b.gatewayConns != nil {
+		go b.gatewayConnLoop()
+		return nil
+	}
+
 	b.connectLoop()
 	go b.reconnectLoop()
 	go b.subscribeLoop()
+
+	if b.bridgeStateTopicTemplate != nil {
+		go b.bridgeStateLoop()
+	}
+
 	return nil
 }
 
@@ -205,11 +253,35 @@ func (b *Backend) Stop() error {
 	b.connMux.Lock()
 	defer b.connMux.Unlock()
 
+	if b.gatewayConns != nil {
+		b.gatewayConnsMux.Lock()
+		closeConns := b.gatewayConns
+		b.gatewayConns = make(map[lorawan.EUI64]paho.Client)
+		b.gatewayConnsMux.Unlock()
+
+		for gatewayID, c := range closeConns {
+			b.closeGatewayConn(gatewayID, c)
+		}
+		b.connClosed = true
+		return nil
+	}
+
 	b.gatewaysMux.Lock()
 	defer b.gatewaysMux.Unlock()
 
-	// Set gateway state to offline for all gateways.
+	// Set gateway state to offline for all gateways. In HA mode, this is
+	// only done for the gateways owned by this instance.
 	for gatewayID := range b.gateways {
+		if !b.isOwner(gatewayID) {
+			continue
+		}
+
+		if b.haEnabled {
+			if err := b.releaseOwnership(gatewayID); err != nil {
+				log.WithError(err).Error("integration/mqtt: release ownership error")
+			}
+		}
+
 		pl := gw.ConnState{
 			GatewayId: gatewayID[:],
 			State:     gw.ConnState_OFFLINE,
@@ -219,6 +291,21 @@ func (b *Backend) Stop() error {
 		}
 	}
 
+	// All gateways are set to offline, so there is nothing to cleanup on the
+	// next startup. The list of the previous run is kept when this instance
+	// is stopped before its cleanup was performed.
+	if b.bridgeStateTopicTemplate != nil {
+		if b.isPreviousGatewaysDone() {
+			if err := b.publishBridgeGateways([]lorawan.EUI64{}); err != nil {
+				log.WithError(err).Error("integration/mqtt: publish bridge gateways state error")
+			}
+		}
+
+		if err := b.publishBridgeConnState(b.conn, gw.ConnState_OFFLINE); err != nil {
+			log.WithError(err).Error("integration/mqtt: publish bridge state error")
+		}
+	}
+
 	b.conn.Disconnect(250)
 	b.connClosed = true
 	return nil
@@ -282,52 +369,74 @@ func (b *Backend) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64
 }
 
 func (b *Backend) subscribeGateway(gatewayID lorawan.EUI64) error {
-	topic := bytes.NewBuffer(nil)
-	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+	topic, err := b.getCommandTopic(gatewayID)
+	if err != nil {
+		return err
 	}
+	qos := b.getSubscriptionQOS("command")
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
-		"qos":   b.qos,
+		"topic": topic,
+		"qos":   qos,
 	}).Info("integration/mqtt: subscribing to topic")
 
-	if err := tokenWrapper(b.conn.Subscribe(topic.String(), b.qos, b.handleCommand), b.maxTokenWait); err != nil {
+	handler := b.handleCommand
+	if b.haEnabled {
+		handler = b.handleGatewayCommand(gatewayID)
+	}
+
+	if err := tokenWrapper(b.conn.Subscribe(topic, qos, handler), b.maxTokenWait); err != nil {
 		return errors.Wrap(err, "subscribe topic error")
 	}
 
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
-		"qos":   b.qos,
+		"topic": topic,
+		"qos":   qos,
 	}).Debug("integration/mqtt: subscribed to topic")
 
 	return nil
 }
 
 func (b *Backend) unsubscribeGateway(gatewayID lorawan.EUI64) error {
-	topic := bytes.NewBuffer(nil)
-	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
-		return errors.Wrap(err, "execute command topic template error")
+	topic, err := b.getCommandTopic(gatewayID)
+	if err != nil {
+		return err
 	}
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 	}).Info("integration/mqtt: unsubscribing from topic")
 
-	if err := tokenWrapper(b.conn.Unsubscribe(topic.String()), b.maxTokenWait); err != nil {
+	if err := tokenWrapper(b.conn.Unsubscribe(topic), b.maxTokenWait); err != nil {
 		return errors.Wrap(err, "unsubscribe topic error")
 	}
 
 	log.WithFields(log.Fields{
-		"topic": topic.String(),
+		"topic": topic,
 	}).Debug("integration/mqtt: unsubscribed from topic")
 
 	return nil
 }
 
+// getCommandTopic returns the command topic to (un)subscribe to for the
+// given gateway. In HA mode, this is a shared subscription.
+func (b *Backend) getCommandTopic(gatewayID lorawan.EUI64) (string, error) {
+	topic := bytes.NewBuffer(nil)
+	if err := b.commandTopicTemplate.Execute(topic, struct{ GatewayID lorawan.EUI64 }{gatewayID}); err != nil {
+		return "", errors.Wrap(err, "execute command topic template error")
+	}
+
+	if b.haEnabled && b.sharedSubscriptionGroup != "" {
+		return "$share/" + b.sharedSubscriptionGroup + "/" + topic.String(), nil
+	}
+
+	return topic.String(), nil
+}
+
 // PublishEvent publishes the given event.
 func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
 	mqttEventCounter(event).Inc()
 	idPrefix := map[string]string{
 		"up":    "uplink_",
+		"upset": "uplink_",
 		"ack":   "downlink_",
 		"stats": "stats_",
 		"exec":  "exec_",
@@ -340,6 +449,15 @@ func (b *Backend) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UU
 
 // PublishState publishes the given state as retained message.
 func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	conn, err := b.getConn(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get connection error")
+	}
+
+	return b.publishState(conn, gatewayID, state, v)
+}
+
+func (b *Backend) publishState(conn paho.Client, gatewayID lorawan.EUI64, state string, v proto.Message) error {
 	if b.stateTopicTemplate == nil {
 		log.WithFields(log.Fields{
 			"state":      state,
@@ -363,13 +481,14 @@ func (b *Backend) PublishState(gatewayID lorawan.EUI64, state string, v proto.Me
 		return errors.Wrap(err, "marshal message error")
 	}
 
+	qos, retained := b.getStateOptions(state)
 	log.WithFields(log.Fields{
 		"topic":      topic.String(),
-		"qos":        b.qos,
+		"qos":        qos,
 		"state":      state,
 		"gateway_id": gatewayID,
 	}).Info("integration/mqtt: publishing state")
-	if err := tokenWrapper(b.conn.Publish(topic.String(), b.qos, b.stateRetained, bytes), b.maxTokenWait); err != nil {
+	if err := tokenWrapper(conn.Publish(topic.String(), qos, retained, bytes), b.maxTokenWait); err != nil {
 		return err
 	}
 	return nil
@@ -450,6 +569,14 @@ func (b *Backend) onConnected(c paho.Client) {
 	// onConnectionLost function, the function could block until the connection
 	// is restored because the (un)subscribe operations will block until then.
 	b.gatewaysSubscribed = make(map[lorawan.EUI64]struct{})
+
+	if b.haEnabled {
+		b.subscribeHA(c)
+	}
+
+	if b.bridgeStateTopicTemplate != nil {
+		b.subscribeBridgeState(c)
+	}
 }
 
 func (b *Backend) subscribeLoop() {
@@ -497,6 +624,12 @@ func (b *Backend) subscribeLoop() {
 			if err := b.subscribeGateway(gatewayID); err != nil {
 				log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: subscribe gateway error")
 			} else {
+				if b.haEnabled {
+					if err := b.claimOwnership(gatewayID); err != nil {
+						log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: claim ownership error")
+					}
+				}
+
 				if err := b.PublishState(gatewayID, "conn", &statePL); err != nil {
 					log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish conn state error")
 				} else {
@@ -513,7 +646,16 @@ func (b *Backend) subscribeLoop() {
 
 			if err := b.unsubscribeGateway(gatewayID); err != nil {
 				log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: unsubscribe gateway error")
+			} else if !b.isOwner(gatewayID) {
+				// the gateway is connected to an other instance
+				delete(b.gatewaysSubscribed, gatewayID)
 			} else {
+				if b.haEnabled {
+					if err := b.releaseOwnership(gatewayID); err != nil {
+						log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: release ownership error")
+					}
+				}
+
 				if err := b.PublishState(gatewayID, "conn", &statePL); err != nil {
 					log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish conn state error")
 				} else {
@@ -659,6 +801,19 @@ func (b *Backend) handleCommand(c paho.Client, msg paho.Message) {
 }
 
 func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, fields log.Fields, msg proto.Message) error {
+	conn, err := b.getConn(gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get connection error")
+	}
+
+	// While reconnecting, paho drops QoS 0 messages without returning an
+	// error. Returning an error makes it possible to queue the event. QoS 1
+	// and 2 messages are held by paho and published once reconnected.
+	qos, retained := b.getEventOptions(event)
+	if qos == 0 && !conn.IsConnectionOpen() {
+		return errors.New("mqtt connection is not open")
+	}
+
 	topic := bytes.NewBuffer(nil)
 	if err := b.eventTopicTemplate.Execute(topic, struct {
 		GatewayID lorawan.EUI64
@@ -673,11 +828,11 @@ func (b *Backend) publishEvent(gatewayID lorawan.EUI64, event string, fields log
 	}
 
 	fields["topic"] = topic.String()
-	fields["qos"] = b.qos
+	fields["qos"] = qos
 	fields["event"] = event
 
 	log.WithFields(fields).Info("integration/mqtt: publishing event")
-	if err := tokenWrapper(b.conn.Publish(topic.String(), b.qos, false, bytes), b.maxTokenWait); err != nil {
+	if err := tokenWrapper(conn.Publish(topic.String(), qos, retained, bytes), b.maxTokenWait); err != nil {
 		return err
 	}
 	return nil
@@ -52,19 +52,19 @@ func (ts *MQTTBackendTestSuite) SetupSuite() {
 
 	ts.gatewayID = lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
 
-	var conf config.Config
-	conf.Integration.Marshaler = "json"
-	conf.Integration.MQTT.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
-	conf.Integration.MQTT.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
-	conf.Integration.MQTT.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
-	conf.Integration.MQTT.StateRetained = true
-	conf.Integration.MQTT.Auth.Type = "generic"
-	conf.Integration.MQTT.Auth.Generic.Servers = []string{server}
-	conf.Integration.MQTT.Auth.Generic.Username = username
-	conf.Integration.MQTT.Auth.Generic.Password = password
-	conf.Integration.MQTT.Auth.Generic.CleanSession = true
-	conf.Integration.MQTT.Auth.Generic.ClientID = ts.gatewayID.String()
-	conf.Integration.MQTT.MaxTokenWait = time.Second
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.StateRetained = true
+	conf.Auth.Type = "generic"
+	conf.Auth.Generic.Servers = []string{server}
+	conf.Auth.Generic.Username = username
+	conf.Auth.Generic.Password = password
+	conf.Auth.Generic.CleanSession = true
+	conf.Auth.Generic.ClientID = ts.gatewayID.String()
+	conf.MaxTokenWait = time.Second
 
 	var err error
 	ts.backend, err = NewBackend(conf)
@@ -0,0 +1,296 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"text/template"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// Bridge state types.
+const (
+	bridgeStateConn     = "conn"
+	bridgeStateGateways = "gateways"
+)
+
+// bridgeConnState holds the payload of the bridge conn state message.
+type bridgeConnState struct {
+	InstanceID string     `json:"instanceID"`
+	State      string     `json:"state"`
+	Time       *time.Time `json:"time,omitempty"`
+}
+
+// bridgeGatewaysState holds the payload of the bridge gateways state message.
+type bridgeGatewaysState struct {
+	InstanceID string          `json:"instanceID"`
+	GatewayIDs []lorawan.EUI64 `json:"gatewayIDs"`
+}
+
+// setupBridgeState configures the bridge state. When enabled, the bridge
+// publishes its own (retained) conn state with an OFFLINE last will and
+// testament, a periodic heartbeat and the list of connected gateways. On
+// startup, the gateways of the list published by the previous run that did
+// not reconnect within the grace period are set to OFFLINE.
+func (b *Backend) setupBridgeState(conf config.IntegrationMQTT) error {
+	if !conf.BridgeState.Enabled {
+		return nil
+	}
+
+	if b.gatewayConns != nil {
+		return errors.New("bridge state can not be combined with per-gateway connections")
+	}
+
+	if b.auth.GetGatewayID() != nil {
+		return errors.New("bridge state can not be combined with a gateway id provided by the authentication")
+	}
+
+	if b.stateTopicTemplate == nil {
+		return errors.New("bridge state requires a state_topic_template")
+	}
+
+	if conf.BridgeState.HeartbeatInterval <= 0 {
+		return errors.New("heartbeat_interval must be greater than zero")
+	}
+
+	var err error
+	b.bridgeStateTopicTemplate, err = template.New("bridge_state").Parse(conf.BridgeState.StateTopicTemplate)
+	if err != nil {
+		return errors.Wrap(err, "parse bridge state-topic template error")
+	}
+
+	b.heartbeatInterval = conf.BridgeState.HeartbeatInterval
+	b.gracePeriod = conf.BridgeState.GracePeriod
+	b.previousGateways = make(map[lorawan.EUI64]struct{})
+
+	topic, err := b.getBridgeStateTopic(bridgeStateConn)
+	if err != nil {
+		return err
+	}
+
+	pl, err := json.Marshal(bridgeConnState{
+		InstanceID: b.instanceID,
+		State:      gw.ConnState_OFFLINE.String(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal bridge state error")
+	}
+
+	log.WithFields(log.Fields{
+		"instance_id": b.instanceID,
+		"topic":       topic,
+	}).Info("integration/mqtt: setting bridge last will and testament")
+
+	b.clientOpts.SetBinaryWill(topic, pl, b.qos, true)
+
+	return nil
+}
+
+// subscribeBridgeState subscribes to the gateways state of this instance, to
+// retrieve the gateways of the previous run, and publishes the ONLINE state.
+func (b *Backend) subscribeBridgeState(c paho.Client) {
+	topic, err := b.getBridgeStateTopic(bridgeStateGateways)
+	if err != nil {
+		log.WithError(err).Error("integration/mqtt: get bridge state topic error")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"topic": topic,
+		"qos":   b.qos,
+	}).Info("integration/mqtt: subscribing to topic")
+
+	if err := tokenWrapper(c.Subscribe(topic, b.qos, b.handlePreviousGateways), b.maxTokenWait); err != nil {
+		log.WithError(err).WithField("topic", topic).Error("integration/mqtt: subscribe topic error")
+	}
+
+	if err := b.publishBridgeConnState(c, gw.ConnState_ONLINE); err != nil {
+		log.WithError(err).Error("integration/mqtt: publish bridge state error")
+	}
+}
+
+// handlePreviousGateways handles the (retained) gateways state, published
+// by the previous run of this instance. Messages received after the grace
+// period are ignored.
+func (b *Backend) handlePreviousGateways(c paho.Client, msg paho.Message) {
+	b.previousGatewaysMux.Lock()
+	defer b.previousGatewaysMux.Unlock()
+
+	if b.previousGatewaysDone || len(msg.Payload()) == 0 {
+		return
+	}
+
+	var state bridgeGatewaysState
+	if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("integration/mqtt: unmarshal bridge gateways state error")
+		return
+	}
+
+	for _, gatewayID := range state.GatewayIDs {
+		b.previousGateways[gatewayID] = struct{}{}
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_count": len(state.GatewayIDs),
+	}).Info("integration/mqtt: gateways of previous run received")
+}
+
+// bridgeStateLoop publishes the heartbeat and performs the cleanup of the
+// gateways of the previous run after the grace period.
+func (b *Backend) bridgeStateLoop() {
+	ticker := time.NewTicker(b.heartbeatInterval)
+	defer ticker.Stop()
+
+	graceTimer := time.NewTimer(b.gracePeriod)
+	defer graceTimer.Stop()
+
+	var graceExpired bool
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-graceTimer.C:
+			graceExpired = true
+		}
+
+		if b.isClosed() {
+			break
+		}
+
+		if !b.conn.IsConnected() {
+			continue
+		}
+
+		if graceExpired && !b.isPreviousGatewaysDone() {
+			b.cleanupPreviousGateways()
+		}
+
+		if err := b.publishBridgeConnState(b.conn, gw.ConnState_ONLINE); err != nil {
+			log.WithError(err).Error("integration/mqtt: publish bridge state error")
+		}
+
+		if b.isPreviousGatewaysDone() {
+			if err := b.publishBridgeGateways(b.getGatewayIDs()); err != nil {
+				log.WithError(err).Error("integration/mqtt: publish bridge gateways state error")
+			}
+		}
+	}
+}
+
+// cleanupPreviousGateways sets the gateways of the previous run which did not
+// reconnect to OFFLINE. In HA mode, gateways owned by other instances are
+// skipped.
+func (b *Backend) cleanupPreviousGateways() {
+	b.previousGatewaysMux.Lock()
+	b.previousGatewaysDone = true
+	previous := b.previousGateways
+	b.previousGateways = make(map[lorawan.EUI64]struct{})
+	b.previousGatewaysMux.Unlock()
+
+	b.gatewaysMux.RLock()
+	var offline []lorawan.EUI64
+	for gatewayID := range previous {
+		if _, ok := b.gateways[gatewayID]; !ok && b.isOwner(gatewayID) {
+			offline = append(offline, gatewayID)
+		}
+	}
+	b.gatewaysMux.RUnlock()
+
+	for _, gatewayID := range offline {
+		log.WithField("gateway_id", gatewayID).Info("integration/mqtt: gateway did not reconnect within grace period, setting state to offline")
+
+		statePL := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.PublishState(gatewayID, "conn", &statePL); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish conn state error")
+			continue
+		}
+
+		mqttGatewayCleanupCounter().Inc()
+	}
+}
+
+func (b *Backend) isPreviousGatewaysDone() bool {
+	b.previousGatewaysMux.Lock()
+	defer b.previousGatewaysMux.Unlock()
+	return b.previousGatewaysDone
+}
+
+// getGatewayIDs returns the sorted IDs of the connected gateways.
+func (b *Backend) getGatewayIDs() []lorawan.EUI64 {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+
+	out := make([]lorawan.EUI64, 0, len(b.gateways))
+	for gatewayID := range b.gateways {
+		out = append(out, gatewayID)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i][:], out[j][:]) < 0
+	})
+
+	return out
+}
+
+func (b *Backend) publishBridgeConnState(c paho.Client, state gw.ConnState_State) error {
+	s := bridgeConnState{
+		InstanceID: b.instanceID,
+		State:      state.String(),
+	}
+
+	if state == gw.ConnState_ONLINE {
+		now := time.Now().UTC()
+		s.Time = &now
+	}
+
+	return b.publishBridgeState(c, bridgeStateConn, s)
+}
+
+func (b *Backend) publishBridgeGateways(gatewayIDs []lorawan.EUI64) error {
+	return b.publishBridgeState(b.conn, bridgeStateGateways, bridgeGatewaysState{
+		InstanceID: b.instanceID,
+		GatewayIDs: gatewayIDs,
+	})
+}
+
+func (b *Backend) publishBridgeState(c paho.Client, stateType string, v interface{}) error {
+	topic, err := b.getBridgeStateTopic(stateType)
+	if err != nil {
+		return err
+	}
+
+	pl, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal bridge state error")
+	}
+
+	log.WithFields(log.Fields{
+		"topic": topic,
+		"qos":   b.qos,
+		"state": stateType,
+	}).Debug("integration/mqtt: publishing bridge state")
+
+	return tokenWrapper(c.Publish(topic, b.qos, true, pl), b.maxTokenWait)
+}
+
+func (b *Backend) getBridgeStateTopic(stateType string) (string, error) {
+	topic := bytes.NewBuffer(nil)
+	if err := b.bridgeStateTopicTemplate.Execute(topic, struct {
+		InstanceID string
+		StateType  string
+	}{b.instanceID, stateType}); err != nil {
+		return "", errors.Wrap(err, "execute bridge state template error")
+	}
+	return topic.String(), nil
+}
@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func bridgeStateTestConfig() config.IntegrationMQTT {
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Auth.Type = "generic"
+	conf.InstanceID = "bridge-a"
+	conf.BridgeState.Enabled = true
+	conf.BridgeState.StateTopicTemplate = "bridge/{{ .InstanceID }}/state/{{ .StateType }}"
+	conf.BridgeState.HeartbeatInterval = 30 * time.Second
+	conf.BridgeState.GracePeriod = time.Minute
+	return conf
+}
+
+func TestNewBackendBridgeState(t *testing.T) {
+	t.Run("last will", func(t *testing.T) {
+		assert := require.New(t)
+
+		b, err := NewBackend(bridgeStateTestConfig())
+		assert.NoError(err)
+
+		opts := b.clientOpts
+		assert.True(opts.WillEnabled)
+		assert.True(opts.WillRetained)
+		assert.Equal("bridge/bridge-a/state/conn", opts.WillTopic)
+		assert.JSONEq(`{"instanceID": "bridge-a", "state": "OFFLINE"}`, string(opts.WillPayload))
+	})
+
+	t.Run("state topic required", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := bridgeStateTestConfig()
+		conf.StateTopicTemplate = ""
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+
+	t.Run("per-gateway connections", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := bridgeStateTestConfig()
+		conf.PerGateway.Enabled = true
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+
+	t.Run("gateway id provided by authentication", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := bridgeStateTestConfig()
+		conf.Auth.Generic.ClientID = "0102030405060708"
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+}
+
+func TestCleanupPreviousGateways(t *testing.T) {
+	assert := require.New(t)
+
+	b, err := NewBackend(bridgeStateTestConfig())
+	assert.NoError(err)
+
+	c := testClient{}
+	b.conn = &c
+
+	reconnected := lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1}
+	lost := lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2}
+	assert.NoError(b.SetGatewaySubscription(true, reconnected))
+
+	pl, err := json.Marshal(bridgeGatewaysState{
+		InstanceID: "bridge-a",
+		GatewayIDs: []lorawan.EUI64{reconnected, lost},
+	})
+	assert.NoError(err)
+	b.handlePreviousGateways(&c, testMessage{topic: "bridge/bridge-a/state/gateways", payload: pl})
+	assert.False(b.isPreviousGatewaysDone())
+
+	b.cleanupPreviousGateways()
+	assert.True(b.isPreviousGatewaysDone())
+
+	offlinePL, err := b.marshal(&gw.ConnState{
+		GatewayId: lost[:],
+		State:     gw.ConnState_OFFLINE,
+	})
+	assert.NoError(err)
+	assert.Equal([]testMessage{
+		{topic: "gateway/0202020202020202/state/conn", payload: offlinePL},
+	}, c.published)
+
+	// messages received after the grace period are ignored
+	b.handlePreviousGateways(&c, testMessage{topic: "bridge/bridge-a/state/gateways", payload: pl})
+	assert.Len(b.previousGateways, 0)
+
+	assert.NoError(b.publishBridgeGateways(b.getGatewayIDs()))
+	assert.Equal("bridge/bridge-a/state/gateways", c.published[1].topic)
+	assert.JSONEq(`{"instanceID": "bridge-a", "gatewayIDs": ["0101010101010101"]}`, string(c.published[1].payload))
+}
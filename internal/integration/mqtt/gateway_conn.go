@@ -0,0 +1,227 @@
+package mqtt
+
+import (
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/mqtt/auth"
+	"github.com/brocaar/lorawan"
+)
+
+// setupPerGateway configures the per-gateway connections mode. In this mode,
+// a MQTT connection is opened for each subscribed gateway, using the
+// credentials of that gateway. Each connection has its own last will and
+// testament.
+func (b *Backend) setupPerGateway(conf config.IntegrationMQTT) error {
+	if !conf.PerGateway.Enabled {
+		return nil
+	}
+
+	if conf.Auth.Type != "generic" {
+		return errors.New("per-gateway connections require the generic authentication type")
+	}
+
+	if conf.HA.Enabled {
+		return errors.New("per-gateway connections can not be combined with the ha mode")
+	}
+
+	var err error
+	b.perGatewayAuth, err = auth.NewPerGatewayAuthentication(conf)
+	if err != nil {
+		return errors.Wrap(err, "new per-gateway authentication error")
+	}
+
+	b.gatewayConns = make(map[lorawan.EUI64]paho.Client)
+	b.keepAlive = conf.KeepAlive
+	b.maxReconnectInterval = conf.MaxReconnectInterval
+
+	log.Info("integration/mqtt: per-gateway connections enabled")
+
+	return nil
+}
+
+// newGatewayClient returns a new MQTT client for the given gateway.
+func (b *Backend) newGatewayClient(gatewayID lorawan.EUI64) (paho.Client, error) {
+	opts := paho.NewClientOptions()
+	opts.SetProtocolVersion(4)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(b.onGatewayConnected(gatewayID))
+	opts.SetConnectionLostHandler(b.onGatewayConnectionLost(gatewayID))
+	opts.SetKeepAlive(b.keepAlive)
+	opts.SetMaxReconnectInterval(b.maxReconnectInterval)
+
+	if err := b.perGatewayAuth.Init(opts, gatewayID); err != nil {
+		return nil, errors.Wrap(err, "init authentication error")
+	}
+
+	if b.stateTopicTemplate != nil {
+		topic, pl, err := b.getConnStateWill(gatewayID)
+		if err != nil {
+			return nil, err
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"topic":      topic,
+		}).Info("integration/mqtt: setting last will and testament")
+
+		qos, _ := b.getStateOptions("conn")
+		opts.SetBinaryWill(topic, pl, qos, true)
+	}
+
+	return paho.NewClient(opts), nil
+}
+
+// onGatewayConnected returns the on connect handler for the given gateway.
+// As the client has been setup with auto-reconnect and clean-session, this
+// (re-)subscribes to the command topic on every connect.
+func (b *Backend) onGatewayConnected(gatewayID lorawan.EUI64) paho.OnConnectHandler {
+	return func(c paho.Client) {
+		mqttConnectCounter().Inc()
+		log.WithField("gateway_id", gatewayID).Info("integration/mqtt: gateway connected to mqtt broker")
+
+		topic, err := b.getCommandTopic(gatewayID)
+		if err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: get command topic error")
+			return
+		}
+
+		qos := b.getSubscriptionQOS("command")
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"topic":      topic,
+			"qos":        qos,
+		}).Info("integration/mqtt: subscribing to topic")
+
+		if err := tokenWrapper(c.Subscribe(topic, qos, b.handleCommand), b.maxTokenWait); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: subscribe gateway error")
+			return
+		}
+
+		statePL := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_ONLINE,
+		}
+		if err := b.publishState(c, gatewayID, "conn", &statePL); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish conn state error")
+		}
+	}
+}
+
+// onGatewayConnectionLost returns the connection lost handler for the given
+// gateway. Unlike the shared connection, losing the connection of a single
+// gateway is never fatal (not even with terminate_on_connect_error), the
+// client reconnects automatically.
+func (b *Backend) onGatewayConnectionLost(gatewayID lorawan.EUI64) paho.ConnectionLostHandler {
+	return func(c paho.Client, err error) {
+		mqttDisconnectCounter().Inc()
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: gateway connection error, reconnecting")
+	}
+}
+
+// gatewayConnLoop opens and closes the gateway connections, based on the
+// gateway subscriptions.
+func (b *Backend) gatewayConnLoop() {
+	for {
+		time.Sleep(time.Millisecond * 100)
+
+		if b.isClosed() {
+			break
+		}
+
+		var connect []lorawan.EUI64
+		var disconnect []lorawan.EUI64
+
+		b.gatewaysMux.RLock()
+		b.gatewayConnsMux.Lock()
+
+		for gatewayID := range b.gateways {
+			if _, ok := b.gatewayConns[gatewayID]; !ok {
+				connect = append(connect, gatewayID)
+			}
+		}
+
+		for gatewayID := range b.gatewayConns {
+			if _, ok := b.gateways[gatewayID]; !ok {
+				disconnect = append(disconnect, gatewayID)
+			}
+		}
+
+		b.gatewaysMux.RUnlock()
+
+		for _, gatewayID := range connect {
+			c, err := b.newGatewayClient(gatewayID)
+			if err != nil {
+				log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: new gateway client error")
+				continue
+			}
+
+			log.WithField("gateway_id", gatewayID).Info("integration/mqtt: connecting gateway to mqtt broker")
+
+			// As connect-retry is enabled, the token will only complete once
+			// connected or when the connection has been closed.
+			token := c.Connect()
+			go func(gatewayID lorawan.EUI64) {
+				if token.Wait() && token.Error() != nil {
+					log.WithError(token.Error()).WithField("gateway_id", gatewayID).Error("integration/mqtt: gateway connection error")
+				}
+			}(gatewayID)
+
+			b.gatewayConns[gatewayID] = c
+		}
+
+		// the connections are removed under the lock, but closed after
+		// unlocking, as closing waits for the OFFLINE state to be published
+		closeConns := make(map[lorawan.EUI64]paho.Client, len(disconnect))
+		for _, gatewayID := range disconnect {
+			closeConns[gatewayID] = b.gatewayConns[gatewayID]
+			delete(b.gatewayConns, gatewayID)
+		}
+
+		b.gatewayConnsMux.Unlock()
+
+		for gatewayID, c := range closeConns {
+			b.closeGatewayConn(gatewayID, c)
+		}
+	}
+}
+
+// closeGatewayConn publishes the OFFLINE state and closes the given gateway
+// connection.
+func (b *Backend) closeGatewayConn(gatewayID lorawan.EUI64, c paho.Client) {
+	if c.IsConnectionOpen() {
+		statePL := gw.ConnState{
+			GatewayId: gatewayID[:],
+			State:     gw.ConnState_OFFLINE,
+		}
+		if err := b.publishState(c, gatewayID, "conn", &statePL); err != nil {
+			log.WithError(err).WithField("gateway_id", gatewayID).Error("integration/mqtt: publish conn state error")
+		}
+	}
+
+	log.WithField("gateway_id", gatewayID).Info("integration/mqtt: disconnecting gateway from mqtt broker")
+	mqttDisconnectCounter().Inc()
+	c.Disconnect(250)
+}
+
+// getConn returns the MQTT client to use for the given gateway.
+func (b *Backend) getConn(gatewayID lorawan.EUI64) (paho.Client, error) {
+	if b.gatewayConns == nil {
+		return b.conn, nil
+	}
+
+	b.gatewayConnsMux.RLock()
+	defer b.gatewayConnsMux.RUnlock()
+
+	c, ok := b.gatewayConns[gatewayID]
+	if !ok {
+		return nil, errors.New("no mqtt connection for gateway")
+	}
+	return c, nil
+}
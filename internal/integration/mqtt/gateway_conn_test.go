@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func perGatewayTestConfig() config.IntegrationMQTT {
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Auth.Type = "generic"
+	conf.Auth.Generic.Servers = []string{"tcp://127.0.0.1:1883"}
+	conf.PerGateway.Enabled = true
+	conf.PerGateway.UsernameTemplate = "gw-{{ .GatewayID }}"
+	conf.PerGateway.ClientIDTemplate = "{{ .GatewayID }}"
+	return conf
+}
+
+func TestNewBackendPerGateway(t *testing.T) {
+	t.Run("ha mode", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := perGatewayTestConfig()
+		conf.HA.Enabled = true
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+
+	t.Run("auth type", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := perGatewayTestConfig()
+		conf.Auth.Type = "azure_iot_hub"
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+}
+
+func TestGatewayClient(t *testing.T) {
+	assert := require.New(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	b, err := NewBackend(perGatewayTestConfig())
+	assert.NoError(err)
+
+	t.Run("no connection", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := b.getConn(gatewayID)
+		assert.Error(err)
+		assert.Error(b.PublishState(gatewayID, "conn", &gw.ConnState{}))
+	})
+
+	t.Run("new gateway client", func(t *testing.T) {
+		assert := require.New(t)
+
+		c, err := b.newGatewayClient(gatewayID)
+		assert.NoError(err)
+
+		opts := c.OptionsReader()
+		assert.Equal("0102030405060708", opts.ClientID())
+		assert.Equal("gw-0102030405060708", opts.Username())
+		assert.True(opts.WillEnabled())
+		assert.True(opts.WillRetained())
+		assert.Equal("gateway/0102030405060708/state/conn", opts.WillTopic())
+
+		_, willPL, err := b.getConnStateWill(gatewayID)
+		assert.NoError(err)
+		assert.Equal(willPL, opts.WillPayload())
+	})
+
+	t.Run("connection lost is not fatal", func(t *testing.T) {
+		assert := require.New(t)
+
+		b.terminateOnConnectError = true
+		defer func() { b.terminateOnConnectError = false }()
+
+		disconnects := testutil.ToFloat64(mqttDisconnectCounter())
+		b.onGatewayConnectionLost(gatewayID)(nil, errors.New("connection reset"))
+		assert.Equal(disconnects+1, testutil.ToFloat64(mqttDisconnectCounter()))
+	})
+}
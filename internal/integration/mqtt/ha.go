@@ -0,0 +1,256 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+// ownerStateType is the state type of the retained owner state message.
+const ownerStateType = "owner"
+
+// ownerState holds the payload of the owner state message. An empty
+// instance ID means that the gateway is not owned by any instance.
+type ownerState struct {
+	GatewayID  lorawan.EUI64 `json:"gatewayID"`
+	InstanceID string        `json:"instanceID"`
+}
+
+// setupHA configures the HA mode. In HA mode, multiple bridge instances
+// share the command topics using a shared subscription. Each instance
+// advertises the gateways it holds a connection to using a retained owner
+// state message. Commands received by an instance which is not the owner of
+// the gateway are re-published to the instance topic of the owner.
+func (b *Backend) setupHA(conf config.IntegrationMQTT) error {
+	if !conf.HA.Enabled {
+		return nil
+	}
+
+	if b.stateTopicTemplate == nil {
+		return errors.New("ha mode requires a state_topic_template")
+	}
+
+	b.haEnabled = true
+	b.sharedSubscriptionGroup = conf.HA.SharedSubscriptionGroup
+	b.owners = make(map[lorawan.EUI64]string)
+
+	var err error
+	b.instanceTopicTemplate, err = template.New("instance").Parse(conf.HA.InstanceTopicTemplate)
+	if err != nil {
+		return errors.Wrap(err, "parse instance-topic template error")
+	}
+
+	log.WithFields(log.Fields{
+		"instance_id": b.instanceID,
+	}).Info("integration/mqtt: ha mode enabled")
+
+	return nil
+}
+
+// subscribeHA subscribes to the owner state messages of all gateways and to
+// the instance topic of this instance.
+func (b *Backend) subscribeHA(c paho.Client) {
+	ownerTopic := bytes.NewBuffer(nil)
+	if err := b.stateTopicTemplate.Execute(ownerTopic, struct {
+		GatewayID string
+		StateType string
+	}{"+", ownerStateType}); err != nil {
+		log.WithError(err).Error("integration/mqtt: execute state template error")
+		return
+	}
+
+	instanceTopic := bytes.NewBuffer(nil)
+	if err := b.instanceTopicTemplate.Execute(instanceTopic, struct {
+		InstanceID  string
+		GatewayID   string
+		CommandType string
+	}{b.instanceID, "+", "+"}); err != nil {
+		log.WithError(err).Error("integration/mqtt: execute instance template error")
+		return
+	}
+
+	ownerQOS, _ := b.getStateOptions(ownerStateType)
+
+	for _, s := range []struct {
+		topic   string
+		qos     uint8
+		handler paho.MessageHandler
+	}{
+		{ownerTopic.String(), ownerQOS, b.handleOwnerState},
+		{instanceTopic.String(), b.getSubscriptionQOS("command"), b.handleCommand}, // commands re-published by other instances
+	} {
+		log.WithFields(log.Fields{
+			"topic": s.topic,
+			"qos":   s.qos,
+		}).Info("integration/mqtt: subscribing to topic")
+
+		if err := tokenWrapper(c.Subscribe(s.topic, s.qos, s.handler), b.maxTokenWait); err != nil {
+			log.WithError(err).WithField("topic", s.topic).Error("integration/mqtt: subscribe topic error")
+		}
+	}
+}
+
+// handleOwnerState handles the owner state messages.
+func (b *Backend) handleOwnerState(c paho.Client, msg paho.Message) {
+	if len(msg.Payload()) == 0 {
+		return
+	}
+
+	var state ownerState
+	if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+		log.WithError(err).WithField("topic", msg.Topic()).Error("integration/mqtt: unmarshal owner state error")
+		return
+	}
+
+	b.ownersMux.Lock()
+	defer b.ownersMux.Unlock()
+
+	if state.InstanceID == "" {
+		delete(b.owners, state.GatewayID)
+	} else {
+		b.owners[state.GatewayID] = state.InstanceID
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  state.GatewayID,
+		"instance_id": state.InstanceID,
+	}).Debug("integration/mqtt: gateway owner updated")
+}
+
+// handleGatewayCommand returns the handler for the commands of the given
+// gateway. In HA mode, commands for gateways owned by other instances are
+// re-published to the owner.
+func (b *Backend) handleGatewayCommand(gatewayID lorawan.EUI64) paho.MessageHandler {
+	return func(c paho.Client, msg paho.Message) {
+		if owner, ok := b.getOwner(gatewayID); ok && owner != b.instanceID {
+			if err := b.forwardCommand(c, owner, gatewayID, msg); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"gateway_id":  gatewayID,
+					"instance_id": owner,
+				}).Error("integration/mqtt: forward command error")
+			}
+			return
+		}
+
+		b.handleCommand(c, msg)
+	}
+}
+
+// forwardCommand re-publishes the given command to the instance topic of
+// the given owner.
+func (b *Backend) forwardCommand(c paho.Client, owner string, gatewayID lorawan.EUI64, msg paho.Message) error {
+	command := commandType(msg.Topic())
+	if command == "" {
+		return errors.Errorf("unexpected command topic: %s", msg.Topic())
+	}
+
+	topic := bytes.NewBuffer(nil)
+	if err := b.instanceTopicTemplate.Execute(topic, struct {
+		InstanceID  string
+		GatewayID   lorawan.EUI64
+		CommandType string
+	}{owner, gatewayID, command}); err != nil {
+		return errors.Wrap(err, "execute instance template error")
+	}
+
+	mqttCommandForwardCounter(command).Inc()
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"instance_id": owner,
+		"topic":       topic.String(),
+		"command":     command,
+	}).Info("integration/mqtt: forwarding command to gateway owner")
+
+	return tokenWrapper(c.Publish(topic.String(), b.getSubscriptionQOS("command"), false, msg.Payload()), b.maxTokenWait)
+}
+
+// claimOwnership advertises this instance as owner of the given gateway.
+func (b *Backend) claimOwnership(gatewayID lorawan.EUI64) error {
+	b.ownersMux.Lock()
+	b.owners[gatewayID] = b.instanceID
+	b.ownersMux.Unlock()
+
+	return b.publishOwnerState(gatewayID, b.instanceID)
+}
+
+// releaseOwnership clears the owner of the given gateway, when this instance
+// is the owner.
+func (b *Backend) releaseOwnership(gatewayID lorawan.EUI64) error {
+	b.ownersMux.Lock()
+	owner, ok := b.owners[gatewayID]
+	if !ok || owner != b.instanceID {
+		b.ownersMux.Unlock()
+		return nil
+	}
+	delete(b.owners, gatewayID)
+	b.ownersMux.Unlock()
+
+	return b.publishOwnerState(gatewayID, "")
+}
+
+// isOwner returns true when the given gateway is owned by this instance or
+// when the owner is unknown. It always returns true when HA mode is
+// disabled.
+func (b *Backend) isOwner(gatewayID lorawan.EUI64) bool {
+	owner, ok := b.getOwner(gatewayID)
+	return !ok || owner == b.instanceID
+}
+
+func (b *Backend) getOwner(gatewayID lorawan.EUI64) (string, bool) {
+	if !b.haEnabled {
+		return "", false
+	}
+
+	b.ownersMux.RLock()
+	defer b.ownersMux.RUnlock()
+
+	owner, ok := b.owners[gatewayID]
+	return owner, ok
+}
+
+func (b *Backend) publishOwnerState(gatewayID lorawan.EUI64, instanceID string) error {
+	topic := bytes.NewBuffer(nil)
+	if err := b.stateTopicTemplate.Execute(topic, struct {
+		GatewayID lorawan.EUI64
+		StateType string
+	}{gatewayID, ownerStateType}); err != nil {
+		return errors.Wrap(err, "execute state template error")
+	}
+
+	pl, err := json.Marshal(ownerState{
+		GatewayID:  gatewayID,
+		InstanceID: instanceID,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal owner state error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"instance_id": instanceID,
+		"topic":       topic.String(),
+	}).Info("integration/mqtt: publishing owner state")
+
+	// the owner state must always be retained
+	qos, _ := b.getStateOptions(ownerStateType)
+	return tokenWrapper(b.conn.Publish(topic.String(), qos, true, pl), b.maxTokenWait)
+}
+
+// commandType returns the command type of the given command topic.
+func commandType(topic string) string {
+	for _, t := range []string{"down", "config", "exec", "raw"} {
+		if strings.HasSuffix(topic, t) || strings.Contains(topic, "command="+t) {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,187 @@
+package mqtt
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+type testToken struct{}
+
+func (t testToken) Wait() bool                     { return true }
+func (t testToken) WaitTimeout(time.Duration) bool { return true }
+func (t testToken) Done() <-chan struct{}          { return nil }
+func (t testToken) Error() error                   { return nil }
+
+type testMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+func (m testMessage) Duplicate() bool   { return false }
+func (m testMessage) Qos() byte         { return m.qos }
+func (m testMessage) Retained() bool    { return m.retained }
+func (m testMessage) Topic() string     { return m.topic }
+func (m testMessage) MessageID() uint16 { return 0 }
+func (m testMessage) Payload() []byte   { return m.payload }
+func (m testMessage) Ack()              {}
+
+// testClient records the published messages, all other methods of the
+// paho.Client interface are not implemented.
+type testClient struct {
+	paho.Client
+
+	published []testMessage
+	notOpen   bool
+}
+
+func (c *testClient) IsConnected() bool {
+	return true
+}
+
+func (c *testClient) IsConnectionOpen() bool {
+	return !c.notOpen
+}
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.published = append(c.published, testMessage{topic: topic, qos: qos, retained: retained, payload: payload.([]byte)})
+	return testToken{}
+}
+
+func haTestConfig() config.IntegrationMQTT {
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Auth.Type = "generic"
+	conf.HA.Enabled = true
+	conf.InstanceID = "bridge-a"
+	conf.HA.SharedSubscriptionGroup = "bridge"
+	conf.HA.InstanceTopicTemplate = "bridge/{{ .InstanceID }}/gateway/{{ .GatewayID }}/command/{{ .CommandType }}"
+	return conf
+}
+
+func TestNewBackendHA(t *testing.T) {
+	t.Run("command topic", func(t *testing.T) {
+		assert := require.New(t)
+
+		b, err := NewBackend(haTestConfig())
+		assert.NoError(err)
+
+		topic, err := b.getCommandTopic(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.NoError(err)
+		assert.Equal("$share/bridge/gateway/0102030405060708/command/#", topic)
+	})
+
+	t.Run("default instance id", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := haTestConfig()
+		conf.InstanceID = ""
+		b, err := NewBackend(conf)
+		assert.NoError(err)
+
+		hostname, err := os.Hostname()
+		assert.NoError(err)
+		assert.Equal(hostname, b.instanceID)
+	})
+
+	t.Run("state topic required", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := haTestConfig()
+		conf.StateTopicTemplate = ""
+		_, err := NewBackend(conf)
+		assert.Error(err)
+	})
+}
+
+func TestHAOwnership(t *testing.T) {
+	assert := require.New(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	b, err := NewBackend(haTestConfig())
+	assert.NoError(err)
+
+	var configs []gw.GatewayConfiguration
+	b.SetGatewayConfigurationFunc(func(pl gw.GatewayConfiguration) {
+		configs = append(configs, pl)
+	})
+
+	c := testClient{}
+	handler := b.handleGatewayCommand(gatewayID)
+	cmd := testMessage{
+		topic:   "gateway/0102030405060708/command/config",
+		payload: []byte(`{"gatewayID": "AQIDBAUGBwg=", "version": "1"}`),
+	}
+
+	t.Run("unknown owner", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.True(b.isOwner(gatewayID))
+		handler(&c, cmd)
+		assert.Len(configs, 1)
+		assert.Len(c.published, 0)
+	})
+
+	t.Run("other owner", func(t *testing.T) {
+		assert := require.New(t)
+
+		b.handleOwnerState(&c, testMessage{
+			topic:   "gateway/0102030405060708/state/owner",
+			payload: []byte(`{"gatewayID": "0102030405060708", "instanceID": "bridge-b"}`),
+		})
+		assert.False(b.isOwner(gatewayID))
+
+		handler(&c, cmd)
+		assert.Len(configs, 1)
+		assert.Equal([]testMessage{
+			{topic: "bridge/bridge-b/gateway/0102030405060708/command/config", payload: cmd.payload},
+		}, c.published)
+	})
+
+	t.Run("ownership released", func(t *testing.T) {
+		assert := require.New(t)
+
+		b.handleOwnerState(&c, testMessage{
+			topic:   "gateway/0102030405060708/state/owner",
+			payload: []byte(`{"gatewayID": "0102030405060708", "instanceID": ""}`),
+		})
+		assert.True(b.isOwner(gatewayID))
+
+		handler(&c, cmd)
+		assert.Len(configs, 2)
+		assert.Len(c.published, 1)
+	})
+}
+
+func TestCommandType(t *testing.T) {
+	tests := []struct {
+		topic    string
+		expected string
+	}{
+		{"gateway/0102030405060708/command/down", "down"},
+		{"gateway/0102030405060708/command/config", "config"},
+		{"gateway/0102030405060708/command/exec", "exec"},
+		{"gateway/0102030405060708/command/raw", "raw"},
+		{"devices/0102030405060708/messages/devicebound/command=down", "down"},
+		{"gateway/0102030405060708/command/foo", ""},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.topic, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.expected, commandType(tst.topic))
+		})
+	}
+}
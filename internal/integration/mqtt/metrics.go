@@ -21,6 +21,16 @@ var (
 		Help: "The number of commands received by the MQTT integration (per command).",
 	}, []string{"command"})
 
+	cfc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "integration_mqtt_command_forward_count",
+		Help: "The number of commands re-published to the owning instance in HA mode (per command).",
+	}, []string{"command"})
+
+	gcc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "integration_mqtt_gateway_cleanup_count",
+		Help: "The number of gateways of the previous run set to OFFLINE after the grace period.",
+	})
+
 	mqttc = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "integration_mqtt_connect_count",
 		Help: "The number of times the integration connected to the MQTT broker.",
@@ -49,6 +59,14 @@ func mqttCommandCounter(c string) prometheus.Counter {
 	return cc.With(prometheus.Labels{"command": c})
 }
 
+func mqttCommandForwardCounter(c string) prometheus.Counter {
+	return cfc.With(prometheus.Labels{"command": c})
+}
+
+func mqttGatewayCleanupCounter() prometheus.Counter {
+	return gcc
+}
+
 func mqttConnectCounter() prometheus.Counter {
 	return mqttc
 }
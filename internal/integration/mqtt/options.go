@@ -0,0 +1,25 @@
+package mqtt
+
+// getEventOptions returns the QoS and retain flag for the given event type.
+func (b *Backend) getEventOptions(event string) (uint8, bool) {
+	if opts, ok := b.events[event]; ok {
+		return opts.QOS, opts.Retained
+	}
+	return b.qos, false
+}
+
+// getStateOptions returns the QoS and retain flag for the given state type.
+func (b *Backend) getStateOptions(state string) (uint8, bool) {
+	if opts, ok := b.states[state]; ok {
+		return opts.QOS, opts.Retained
+	}
+	return b.qos, b.stateRetained
+}
+
+// getSubscriptionQOS returns the QoS for the given subscription type.
+func (b *Backend) getSubscriptionQOS(subscription string) uint8 {
+	if opts, ok := b.subscriptions[subscription]; ok {
+		return opts.QOS
+	}
+	return b.qos
+}
@@ -0,0 +1,133 @@
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestPublishOptions(t *testing.T) {
+	assert := require.New(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.StateTopicTemplate = "gateway/{{ .GatewayID }}/state/{{ .StateType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.StateRetained = true
+	conf.Auth.Type = "generic"
+	conf.Auth.Generic.QOS = 2
+	conf.Events = map[string]config.IntegrationMQTTPublish{
+		"up":    {QOS: 1},
+		"stats": {QOS: 0, Retained: true},
+	}
+	conf.States = map[string]config.IntegrationMQTTPublish{
+		"conn": {QOS: 1, Retained: false},
+	}
+	conf.Subscriptions = map[string]config.IntegrationMQTTSubscribe{
+		"command": {QOS: 0},
+	}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	c := testClient{}
+	b.conn = &c
+
+	tests := []struct {
+		name     string
+		publish  func() error
+		qos      byte
+		retained bool
+	}{
+		{
+			name: "up event",
+			publish: func() error {
+				return b.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{})
+			},
+			qos: 1,
+		},
+		{
+			name: "stats event",
+			publish: func() error {
+				return b.PublishEvent(gatewayID, "stats", uuid.Nil, &gw.GatewayStats{})
+			},
+			qos:      0,
+			retained: true,
+		},
+		{
+			name: "ack event uses defaults",
+			publish: func() error {
+				return b.PublishEvent(gatewayID, "ack", uuid.Nil, &gw.DownlinkTXAck{})
+			},
+			qos: 2,
+		},
+		{
+			name: "conn state",
+			publish: func() error {
+				return b.PublishState(gatewayID, "conn", &gw.ConnState{})
+			},
+			qos: 1,
+		},
+		{
+			name: "other state uses defaults",
+			publish: func() error {
+				return b.PublishState(gatewayID, "foo", &gw.ConnState{})
+			},
+			qos:      2,
+			retained: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			c.published = nil
+
+			assert.NoError(tst.publish())
+			assert.Len(c.published, 1)
+			assert.Equal(tst.qos, c.published[0].Qos())
+			assert.Equal(tst.retained, c.published[0].Retained())
+		})
+	}
+
+	assert.Equal(uint8(0), b.getSubscriptionQOS("command"))
+	assert.Equal(uint8(2), b.getSubscriptionQOS("foo"))
+}
+
+func TestPublishEventConnectionNotOpen(t *testing.T) {
+	assert := require.New(t)
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	var conf config.IntegrationMQTT
+	conf.Marshaler = "json"
+	conf.EventTopicTemplate = "gateway/{{ .GatewayID }}/event/{{ .EventType }}"
+	conf.CommandTopicTemplate = "gateway/{{ .GatewayID }}/command/#"
+	conf.Auth.Type = "generic"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+
+	// connected, but reconnecting, QoS 0 messages would be dropped
+	c := testClient{notOpen: true}
+	b.conn = &c
+
+	assert.EqualError(b.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{}), "mqtt connection is not open")
+	assert.Len(c.published, 0)
+
+	c.notOpen = false
+	assert.NoError(b.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{}))
+	assert.Len(c.published, 1)
+
+	// QoS 1 messages are held by paho while reconnecting
+	b.qos = 1
+	c.notOpen = true
+	assert.NoError(b.PublishEvent(gatewayID, "up", uuid.Nil, &gw.UplinkFrame{}))
+	assert.Len(c.published, 2)
+}
@@ -0,0 +1,128 @@
+package integration
+
+import (
+	"sync"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+// namedIntegration holds an integration with its name.
+type namedIntegration struct {
+	Integration
+	name string
+}
+
+// multiIntegration implements the Integration interface by fanning out to
+// multiple integrations. A failing integration does not affect the others:
+// errors are logged per integration and only returned when all integrations
+// failed.
+type multiIntegration struct {
+	integrations []namedIntegration
+}
+
+// SetGatewaySubscription sets the gateway subscription for all integrations.
+func (m *multiIntegration) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	return m.forEach("set gateway subscription", func(i Integration) error {
+		return i.SetGatewaySubscription(subscribe, gatewayID)
+	})
+}
+
+// PublishEvent publishes the given event to all integrations.
+func (m *multiIntegration) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	return m.forEach("publish event", func(i Integration) error {
+		return i.PublishEvent(gatewayID, event, id, v)
+	})
+}
+
+// PublishState publishes the given state to all integrations.
+func (m *multiIntegration) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	return m.forEach("publish state", func(i Integration) error {
+		return i.PublishState(gatewayID, state, v)
+	})
+}
+
+// SetDownlinkFrameFunc sets the DownlinkFrame handler func for all
+// integrations.
+func (m *multiIntegration) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	for _, i := range m.integrations {
+		i.SetDownlinkFrameFunc(f)
+	}
+}
+
+// SetRawPacketForwarderCommandFunc sets the RawPacketForwarderCommand handler
+// func for all integrations.
+func (m *multiIntegration) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {
+	for _, i := range m.integrations {
+		i.SetRawPacketForwarderCommandFunc(f)
+	}
+}
+
+// SetGatewayConfigurationFunc sets the GatewayConfiguration handler func for
+// all integrations.
+func (m *multiIntegration) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {
+	for _, i := range m.integrations {
+		i.SetGatewayConfigurationFunc(f)
+	}
+}
+
+// SetGatewayCommandExecRequestFunc sets the GatewayCommandExecRequest handler
+// func for all integrations.
+func (m *multiIntegration) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {
+	for _, i := range m.integrations {
+		i.SetGatewayCommandExecRequestFunc(f)
+	}
+}
+
+// Start starts all integrations.
+func (m *multiIntegration) Start() error {
+	return m.forEach("start", func(i Integration) error {
+		return i.Start()
+	})
+}
+
+// Stop stops all integrations.
+func (m *multiIntegration) Stop() error {
+	return m.forEach("stop", func(i Integration) error {
+		return i.Stop()
+	})
+}
+
+// forEach calls the given function for every integration, concurrently such
+// that a slow integration does not block the others. Errors are logged and an
+// error is only returned when the function failed for all integrations.
+func (m *multiIntegration) forEach(action string, f func(Integration) error) error {
+	errs := make([]error, len(m.integrations))
+
+	var wg sync.WaitGroup
+	for j := range m.integrations {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			errs[j] = f(m.integrations[j].Integration)
+		}(j)
+	}
+	wg.Wait()
+
+	var lastErr error
+	failed := 0
+
+	for j, err := range errs {
+		if err != nil {
+			log.WithError(err).WithField("integration", m.integrations[j].name).Errorf("integration: %s error", action)
+			lastErr = err
+			failed++
+		}
+	}
+
+	if failed != 0 && failed == len(m.integrations) {
+		return errors.Wrapf(lastErr, "%s failed for all integrations", action)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package integration
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/lorawan"
+)
+
+type testIntegration struct {
+	err       error
+	events    []string
+	downlinkF func(gw.DownlinkFrame)
+
+	// block, when set, blocks PublishEvent until it is closed
+	block chan struct{}
+
+	// published, when set, is signaled after each published event
+	published chan struct{}
+}
+
+func (t *testIntegration) SetGatewaySubscription(subscribe bool, gatewayID lorawan.EUI64) error {
+	return t.err
+}
+
+func (t *testIntegration) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	if t.block != nil {
+		<-t.block
+	}
+	if t.err != nil {
+		return t.err
+	}
+	t.events = append(t.events, event)
+	if t.published != nil {
+		t.published <- struct{}{}
+	}
+	return nil
+}
+
+func (t *testIntegration) PublishState(gatewayID lorawan.EUI64, state string, v proto.Message) error {
+	return t.err
+}
+
+func (t *testIntegration) SetDownlinkFrameFunc(f func(gw.DownlinkFrame)) {
+	t.downlinkF = f
+}
+
+func (t *testIntegration) SetRawPacketForwarderCommandFunc(f func(gw.RawPacketForwarderCommand)) {}
+
+func (t *testIntegration) SetGatewayConfigurationFunc(f func(gw.GatewayConfiguration)) {}
+
+func (t *testIntegration) SetGatewayCommandExecRequestFunc(f func(gw.GatewayCommandExecRequest)) {}
+
+func (t *testIntegration) Start() error {
+	return t.err
+}
+
+func (t *testIntegration) Stop() error {
+	return t.err
+}
+
+func TestMultiIntegration(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Errors        []error
+		ExpectedError bool
+	}{
+		{
+			Name:   "all succeed",
+			Errors: []error{nil, nil},
+		},
+		{
+			Name:   "one fails",
+			Errors: []error{errors.New("boom"), nil},
+		},
+		{
+			Name:          "all fail",
+			Errors:        []error{errors.New("boom"), errors.New("boom")},
+			ExpectedError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var m multiIntegration
+			var ints []*testIntegration
+			for _, err := range tst.Errors {
+				i := &testIntegration{err: err}
+				ints = append(ints, i)
+				m.integrations = append(m.integrations, namedIntegration{name: "test", Integration: i})
+			}
+
+			err := m.PublishEvent(lorawan.EUI64{1}, EventUp, uuid.Nil, &gw.UplinkFrame{})
+			if tst.ExpectedError {
+				assert.Error(err)
+			} else {
+				assert.NoError(err)
+			}
+
+			for i, ti := range ints {
+				if tst.Errors[i] == nil {
+					assert.Equal([]string{EventUp}, ti.events)
+				} else {
+					assert.Len(ti.events, 0)
+				}
+			}
+		})
+	}
+
+	t.Run("slow integration does not block the others", func(t *testing.T) {
+		assert := require.New(t)
+
+		slow := &testIntegration{block: make(chan struct{})}
+		fast := &testIntegration{published: make(chan struct{}, 1)}
+		m := multiIntegration{integrations: []namedIntegration{
+			{name: "slow", Integration: slow},
+			{name: "fast", Integration: fast},
+		}}
+
+		done := make(chan error)
+		go func() {
+			done <- m.PublishEvent(lorawan.EUI64{1}, EventUp, uuid.Nil, &gw.UplinkFrame{})
+		}()
+
+		// the fast integration publishes while the slow one is blocked
+		select {
+		case <-fast.published:
+		case <-time.After(time.Second):
+			t.Fatal("fast integration was blocked by the slow integration")
+		}
+
+		select {
+		case <-done:
+			t.Fatal("publish returned before the slow integration completed")
+		default:
+		}
+
+		close(slow.block)
+		assert.NoError(<-done)
+		assert.Equal([]string{EventUp}, fast.events)
+		assert.Equal([]string{EventUp}, slow.events)
+	})
+
+	t.Run("commands from any integration", func(t *testing.T) {
+		assert := require.New(t)
+
+		a := &testIntegration{}
+		b := &testIntegration{}
+		m := multiIntegration{integrations: []namedIntegration{
+			{name: "a", Integration: a},
+			{name: "b", Integration: b},
+		}}
+
+		var received int
+		m.SetDownlinkFrameFunc(func(gw.DownlinkFrame) { received++ })
+
+		a.downlinkF(gw.DownlinkFrame{})
+		b.downlinkF(gw.DownlinkFrame{})
+		assert.Equal(2, received)
+	})
+}
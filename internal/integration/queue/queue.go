@@ -0,0 +1,195 @@
+// Package queue implements a crash-safe on-disk FIFO queue for gateway
+// events.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+)
+
+const fileSuffix = ".event"
+
+// Item holds a queued event.
+type Item struct {
+	Event     string        `json:"event"`
+	GatewayID lorawan.EUI64 `json:"gateway_id"`
+	ID        uuid.UUID     `json:"id"`
+	Time      time.Time     `json:"time"`
+
+	// Payload holds the Protobuf encoded google.protobuf.Any message of the
+	// event.
+	Payload []byte `json:"payload"`
+}
+
+// Queue implements an on-disk FIFO queue. Each item is stored as a separate
+// file, named by its sequence number. Files are written to a temporary file
+// first and then renamed, such that a crash never results in a partially
+// written item.
+type Queue struct {
+	mux     sync.Mutex
+	dir     string
+	maxSize int
+	seqs    []uint64
+	next    uint64
+}
+
+// Open opens (or creates) the queue in the given directory. Items that were
+// queued before a restart are retained. When maxSize is greater than zero,
+// the queue holds at most maxSize items.
+func Open(dir string, maxSize int) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "create queue directory error")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read queue directory error")
+	}
+
+	q := Queue{
+		dir:     dir,
+		maxSize: maxSize,
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileSuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), fileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.seqs = append(q.seqs, seq)
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+
+	sort.Slice(q.seqs, func(i, j int) bool { return q.seqs[i] < q.seqs[j] })
+
+	return &q, nil
+}
+
+// Len returns the number of queued items.
+func (q *Queue) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return len(q.seqs)
+}
+
+// Push appends the given item to the queue. When the queue is full, the
+// oldest items are removed. It returns the number of removed items.
+func (q *Queue) Push(item Item) (int, error) {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal item error")
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	seq := q.next
+	tmp := filepath.Join(q.dir, fmt.Sprintf("%020d.tmp", seq))
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "create file error")
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "write file error")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "sync file error")
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "close file error")
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		os.Remove(tmp)
+		return 0, errors.Wrap(err, "rename file error")
+	}
+
+	q.next++
+	q.seqs = append(q.seqs, seq)
+
+	var dropped int
+	for q.maxSize > 0 && len(q.seqs) > q.maxSize {
+		if err := q.remove(); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// Peek returns the oldest item of the queue, without removing it. It returns
+// false when the queue is empty. Items that can not be read are removed.
+func (q *Queue) Peek() (Item, bool, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for len(q.seqs) != 0 {
+		var item Item
+
+		b, err := ioutil.ReadFile(q.path(q.seqs[0]))
+		if err == nil {
+			err = json.Unmarshal(b, &item)
+		}
+		if err == nil {
+			return item, true, nil
+		}
+
+		log.WithError(err).WithField("file", q.path(q.seqs[0])).Error("integration/queue: read item error, removing item")
+		if err := q.remove(); err != nil {
+			return item, false, err
+		}
+	}
+
+	return Item{}, false, nil
+}
+
+// Pop removes the oldest item of the queue.
+func (q *Queue) Pop() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.seqs) == 0 {
+		return nil
+	}
+	return q.remove()
+}
+
+// remove removes the oldest item. The caller must hold the lock.
+func (q *Queue) remove() error {
+	if err := os.Remove(q.path(q.seqs[0])); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove file error")
+	}
+	q.seqs = q.seqs[1:]
+	return nil
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, fileSuffix))
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func TestQueue(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	q, err := Open(dir, 3)
+	assert.NoError(err)
+	assert.Equal(0, q.Len())
+
+	_, ok, err := q.Peek()
+	assert.NoError(err)
+	assert.False(ok)
+
+	for i := 0; i < 4; i++ {
+		dropped, err := q.Push(Item{
+			Event:     "up",
+			GatewayID: lorawan.EUI64{byte(i)},
+			Payload:   []byte{byte(i)},
+		})
+		assert.NoError(err)
+
+		if i < 3 {
+			assert.Equal(0, dropped)
+		} else {
+			assert.Equal(1, dropped)
+		}
+	}
+	assert.Equal(3, q.Len())
+
+	t.Run("oldest item dropped", func(t *testing.T) {
+		assert := require.New(t)
+
+		item, ok, err := q.Peek()
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(lorawan.EUI64{1}, item.GatewayID)
+		assert.Equal([]byte{1}, item.Payload)
+	})
+
+	t.Run("items retained on re-open", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.Pop())
+
+		q, err := Open(dir, 3)
+		assert.NoError(err)
+		assert.Equal(2, q.Len())
+
+		// new items are appended after the existing items
+		_, err = q.Push(Item{Event: "up", GatewayID: lorawan.EUI64{4}})
+		assert.NoError(err)
+
+		for _, exp := range []lorawan.EUI64{{2}, {3}, {4}} {
+			item, ok, err := q.Peek()
+			assert.NoError(err)
+			assert.True(ok)
+			assert.Equal(exp, item.GatewayID)
+			assert.NoError(q.Pop())
+		}
+		assert.Equal(0, q.Len())
+	})
+
+	t.Run("corrupt item is removed", func(t *testing.T) {
+		assert := require.New(t)
+
+		q, err := Open(dir, 0)
+		assert.NoError(err)
+
+		_, err = q.Push(Item{Event: "up", GatewayID: lorawan.EUI64{5}})
+		assert.NoError(err)
+		_, err = q.Push(Item{Event: "up", GatewayID: lorawan.EUI64{6}})
+		assert.NoError(err)
+
+		assert.NoError(ioutil.WriteFile(q.path(q.seqs[0]), []byte("foo"), 0600))
+
+		item, ok, err := q.Peek()
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(lorawan.EUI64{6}, item.GatewayID)
+		assert.Equal(1, q.Len())
+	})
+}
@@ -0,0 +1,230 @@
+package integration
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/integration/queue"
+	"github.com/brocaar/lorawan"
+)
+
+// Queue drop reasons.
+const (
+	dropReasonMaxSize = "max_size"
+	dropReasonMaxAge  = "max_age"
+)
+
+// queuedIntegration wraps an integration with an on-disk store-and-forward
+// queue. Events that can not be published are queued and are re-published
+// in order once the integration is able to publish again. While the queue
+// is not empty, new events are appended to the queue to retain the ordering.
+type queuedIntegration struct {
+	Integration
+
+	name          string
+	queue         *queue.Queue
+	maxAge        time.Duration
+	retryInterval time.Duration
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newQueuedIntegration wraps the given integration with a queue stored in a
+// sub-directory (named after the integration) of the configured path.
+func newQueuedIntegration(name string, i Integration, conf config.Config) (*queuedIntegration, error) {
+	if conf.Integration.Queue.RetryInterval <= 0 {
+		return nil, errors.New("retry_interval must be greater than zero")
+	}
+
+	q, err := queue.Open(filepath.Join(conf.Integration.Queue.Path, name), conf.Integration.Queue.MaxSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "open queue error")
+	}
+
+	queueDepthGauge(name).Set(float64(q.Len()))
+
+	return &queuedIntegration{
+		Integration:   i,
+		name:          name,
+		queue:         q,
+		maxAge:        conf.Integration.Queue.MaxAge,
+		retryInterval: conf.Integration.Queue.RetryInterval,
+		notify:        make(chan struct{}, 1),
+	}, nil
+}
+
+// Start starts the integration and the replay of the queued events.
+func (q *queuedIntegration) Start() error {
+	if err := q.Integration.Start(); err != nil {
+		return err
+	}
+
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+	go q.replayLoop()
+
+	return nil
+}
+
+// Stop stops the replay of the queued events and the integration. Events
+// remaining in the queue are replayed after a restart.
+func (q *queuedIntegration) Stop() error {
+	if q.stop != nil {
+		close(q.stop)
+		<-q.done
+	}
+
+	return q.Integration.Stop()
+}
+
+// PublishEvent publishes the given event, or queues it when the queue is not
+// empty or publishing fails.
+func (q *queuedIntegration) PublishEvent(gatewayID lorawan.EUI64, event string, id uuid.UUID, v proto.Message) error {
+	if q.queue.Len() == 0 {
+		err := q.Integration.PublishEvent(gatewayID, event, id, v)
+		if err == nil {
+			return nil
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"integration": q.name,
+			"gateway_id":  gatewayID,
+			"event_type":  event,
+		}).Warning("integration/queue: publish event error, queueing event")
+	}
+
+	a, err := ptypes.MarshalAny(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal any error")
+	}
+
+	b, err := proto.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "marshal event error")
+	}
+
+	dropped, err := q.queue.Push(queue.Item{
+		Event:     event,
+		GatewayID: gatewayID,
+		ID:        id,
+		Time:      time.Now(),
+		Payload:   b,
+	})
+	if dropped != 0 {
+		queueDropCounter(q.name, dropReasonMaxSize).Add(float64(dropped))
+	}
+	queueDepthGauge(q.name).Set(float64(q.queue.Len()))
+	if err != nil {
+		return errors.Wrap(err, "queue event error")
+	}
+
+	queueEnqueueCounter(q.name).Inc()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// replayLoop re-publishes the queued events until the integration is
+// stopped.
+func (q *queuedIntegration) replayLoop() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(q.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+
+		q.replay()
+	}
+}
+
+// replay re-publishes the queued events in order, until the queue is empty
+// or publishing fails.
+func (q *queuedIntegration) replay() {
+	defer func() {
+		queueDepthGauge(q.name).Set(float64(q.queue.Len()))
+	}()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		item, ok, err := q.queue.Peek()
+		if err != nil {
+			log.WithError(err).WithField("integration", q.name).Error("integration/queue: peek queue error")
+			return
+		}
+		if !ok {
+			return
+		}
+
+		if q.maxAge > 0 && time.Since(item.Time) > q.maxAge {
+			queueDropCounter(q.name, dropReasonMaxAge).Inc()
+			if err := q.queue.Pop(); err != nil {
+				log.WithError(err).WithField("integration", q.name).Error("integration/queue: pop queue error")
+				return
+			}
+			continue
+		}
+
+		v, err := unmarshalItem(item)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"integration": q.name,
+				"gateway_id":  item.GatewayID,
+				"event_type":  item.Event,
+			}).Error("integration/queue: unmarshal queued event error, dropping event")
+		} else if err := q.Integration.PublishEvent(item.GatewayID, item.Event, item.ID, v); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"integration": q.name,
+				"queue_depth": q.queue.Len(),
+			}).Warning("integration/queue: replay event error")
+			return
+		} else {
+			queueReplayCounter(q.name).Inc()
+		}
+
+		if err := q.queue.Pop(); err != nil {
+			log.WithError(err).WithField("integration", q.name).Error("integration/queue: pop queue error")
+			return
+		}
+	}
+}
+
+// unmarshalItem returns the event message of the given queued item.
+func unmarshalItem(item queue.Item) (proto.Message, error) {
+	var a any.Any
+	if err := proto.Unmarshal(item.Payload, &a); err != nil {
+		return nil, err
+	}
+
+	var v ptypes.DynamicAny
+	if err := ptypes.UnmarshalAny(&a, &v); err != nil {
+		return nil, err
+	}
+
+	return v.Message, nil
+}
@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/chirpstack-api/go/v3/gw"
+	"github.com/brocaar/chirpstack-gateway-bridge/internal/config"
+	"github.com/brocaar/lorawan"
+)
+
+func TestQueuedIntegration(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "queue")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var conf config.Config
+	conf.Integration.Queue.Path = dir
+	conf.Integration.Queue.MaxSize = 10
+	conf.Integration.Queue.RetryInterval = time.Second
+
+	ti := &testIntegration{}
+	q, err := newQueuedIntegration("test", ti, conf)
+	assert.NoError(err)
+
+	gatewayID := lorawan.EUI64{1}
+
+	t.Run("published when online", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(q.PublishEvent(gatewayID, EventUp, uuid.Nil, &gw.UplinkFrame{}))
+		assert.Equal([]string{EventUp}, ti.events)
+		assert.Equal(0, q.queue.Len())
+	})
+
+	t.Run("queued when offline", func(t *testing.T) {
+		assert := require.New(t)
+
+		ti.err = errors.New("offline")
+		ti.events = nil
+
+		assert.NoError(q.PublishEvent(gatewayID, EventUp, uuid.Nil, &gw.UplinkFrame{PhyPayload: []byte{1}}))
+		assert.NoError(q.PublishEvent(gatewayID, EventStats, uuid.Nil, &gw.GatewayStats{}))
+		assert.Equal(2, q.queue.Len())
+
+		// replay fails while offline
+		q.replay()
+		assert.Equal(2, q.queue.Len())
+	})
+
+	t.Run("queued while queue not empty", func(t *testing.T) {
+		assert := require.New(t)
+
+		ti.err = nil
+		assert.NoError(q.PublishEvent(gatewayID, EventAck, uuid.Nil, &gw.DownlinkTXAck{}))
+		assert.Len(ti.events, 0)
+		assert.Equal(3, q.queue.Len())
+	})
+
+	t.Run("replayed in order", func(t *testing.T) {
+		assert := require.New(t)
+
+		q.replay()
+		assert.Equal([]string{EventUp, EventStats, EventAck}, ti.events)
+		assert.Equal(0, q.queue.Len())
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		assert := require.New(t)
+
+		ti.err = errors.New("offline")
+		ti.events = nil
+		assert.NoError(q.PublishEvent(gatewayID, EventUp, uuid.Nil, &gw.UplinkFrame{}))
+
+		ti.err = nil
+		q.maxAge = time.Nanosecond
+		time.Sleep(time.Millisecond)
+
+		q.replay()
+		assert.Len(ti.events, 0)
+		assert.Equal(0, q.queue.Len())
+	})
+}